@@ -1,6 +1,10 @@
 package cli
 
 import (
+	"fmt"
+
+	"github.com/Xelvra/peerchat/internal/message"
+	"github.com/Xelvra/peerchat/internal/p2p"
 	"github.com/spf13/cobra"
 )
 
@@ -17,7 +21,7 @@ QUICK START:
   3. peerchat-cli start    # Start interactive chat
 
 STANDALONE COMMANDS (no running node required):
-  init, doctor, version, manual, help
+  init, doctor, version, manual, decrypt, network, contacts, help
 
 INTERACTIVE COMMANDS (available in chat mode):
   /help, /peers, /discover, /connect, /status, /quit
@@ -44,6 +48,10 @@ Performance targets:
 	rootCmd.AddCommand(createIdCommand())
 	rootCmd.AddCommand(createProfileCommand())
 	rootCmd.AddCommand(createSendFileCommand())
+	rootCmd.AddCommand(createTransfersCommand())
+	rootCmd.AddCommand(createDecryptCommand())
+	rootCmd.AddCommand(createNetworkCommand())
+	rootCmd.AddCommand(createContactsCommand())
 	rootCmd.AddCommand(createStopCommand())
 	rootCmd.AddCommand(createSetupCommand())
 	rootCmd.AddCommand(createDoctorCommand())
@@ -69,6 +77,38 @@ func createStartCommand() *cobra.Command {
 		Run:   RunStart,
 	}
 	cmd.Flags().Bool("daemon", false, "Run as background daemon")
+	cmd.Flags().StringSlice("mailbox", nil, "Multiaddr of an always-on peer that holds messages for you while offline")
+	cmd.Flags().StringSlice("serve-mailbox", nil, "DID of a user to hold messages for while they are offline")
+	cmd.Flags().Bool("share-files", false, "Serve transferred files to other peers downloading them and announce them in the DHT")
+	cmd.Flags().Bool("encrypt-downloads", false, "Keep received files encrypted on disk; open them with 'peerchat-cli decrypt'")
+	cmd.Flags().Bool("accept-files", false, "Receive files that pass the acceptance policy without asking")
+	cmd.Flags().Bool("files-from-contacts", false, "Reject files from senders that are not in your contacts")
+	cmd.Flags().Int64("max-file-size", message.DefaultMaxFileSize>>20, fmt.Sprintf("Largest file to receive in MiB, at most %d (0 for no lower limit)", message.MaxFileSize>>20))
+	cmd.Flags().StringSlice("allow-file-types", nil, "MIME types of files to receive, type/* for a family (default all)")
+	cmd.Flags().StringSlice("block-file-types", nil, "MIME types of files to refuse, type/* for a family")
+	cmd.Flags().Int("max-incoming-files", message.DefaultMaxConcurrentFile, "Files received at once (0 for no limit)")
+	cmd.Flags().Int64("peer-file-quota", message.DefaultPeerFileQuota>>20, "MiB of files received from one peer per day (0 for no limit)")
+	cmd.Flags().Int64("upload-limit", 0, "Total file upload rate in KiB/s (0 for no limit)")
+	cmd.Flags().Int64("download-limit", 0, "Total file download rate in KiB/s (0 for no limit)")
+	cmd.Flags().Int64("peer-upload-limit", 0, "File upload rate to each peer in KiB/s (0 for no limit)")
+	cmd.Flags().Int64("peer-download-limit", 0, "File download rate from each peer in KiB/s (0 for no limit)")
+	cmd.Flags().StringSlice("bootstrap", nil, "Multiaddr (with /p2p/) of a bootstrap peer, in addition to ~/.xelvra/bootstrap.txt")
+	cmd.Flags().Bool("no-dht", false, "Run without the DHT and find peers through bootstrap peers and the local network only")
+	cmd.Flags().StringSlice("stun", nil, "STUN server (host:port) for NAT detection instead of the defaults; RFC 5780 support is needed to tell the NAT type")
+
+	relayLimits := p2p.DefaultRelayServiceConfig()
+	cmd.Flags().Bool("relay-service", false, "Relay connections for contacts, or private network members, while this node is publicly reachable")
+	cmd.Flags().Int("relay-reservations", relayLimits.MaxReservations, "Peers the relay service holds reservations for at once")
+	cmd.Flags().Duration("relay-duration", relayLimits.Duration, "Longest a relayed connection stays open")
+	cmd.Flags().Int64("relay-data", relayLimits.Data>>10, "KiB relayed per connection in each direction")
+	cmd.Flags().String("relay-policy", p2p.PolicyLowestLatency.String(), "How relays are picked while NATed: latency, reliability, random or round-robin")
+	cmd.Flags().Int("relays", 2, "Relays to hold reservations with while NATed")
+	cmd.Flags().Bool("websocket", false, "Also listen and dial over WebSocket, for networks letting only HTTP(S) through")
+	cmd.Flags().StringSlice("ws-listen", nil, "WebSocket listen multiaddr instead of /tcp/0/ws, e.g. /ip4/0.0.0.0/tcp/443/tls/ws")
+	cmd.Flags().String("ws-cert", "", "PEM certificate for secure WebSocket (/tls/ws) listeners")
+	cmd.Flags().String("ws-key", "", "PEM private key of --ws-cert")
+	cmd.Flags().Bool("webtransport", false, "Also listen and dial over WebTransport (not in private networks)")
+	cmd.Flags().StringSlice("webtransport-listen", nil, "WebTransport listen multiaddr instead of /udp/0/quic-v1/webtransport")
 	return cmd
 }
 
@@ -159,6 +199,107 @@ func createSendFileCommand() *cobra.Command {
 	}
 }
 
+// createTransfersCommand creates the transfers command
+func createTransfersCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "transfers",
+		Short: "List incoming files waiting to be accepted",
+		Run:   RunTransfers,
+	}
+	accept := &cobra.Command{
+		Use:   "accept [transfer_id] [path...]",
+		Short: "Accept an incoming file, or only the given paths of a multi-file offer",
+		Args:  cobra.MinimumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			from, _ := cmd.Flags().GetString("peer")
+			RunDecideTransfer(from, args[0], true, args[1:]...)
+		},
+	}
+	reject := &cobra.Command{
+		Use:   "reject [transfer_id]",
+		Short: "Reject an incoming file on the running node",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			from, _ := cmd.Flags().GetString("peer")
+			RunDecideTransfer(from, args[0], false)
+		},
+	}
+	for _, sub := range []*cobra.Command{accept, reject} {
+		sub.Flags().String("peer", "", "Peer ID of the sender, when several peers offer a file with the same ID")
+		cmd.AddCommand(sub)
+	}
+	return cmd
+}
+
+// createDecryptCommand creates the decrypt command
+func createDecryptCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "decrypt [file] [output]",
+		Short: "Decrypt a file received with --encrypt-downloads",
+		Args:  cobra.RangeArgs(1, 2),
+		Run:   RunDecrypt,
+	}
+}
+
+// createNetworkCommand creates the network command
+func createNetworkCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "network",
+		Short: "Show whether this node is on the public network or a private one",
+		Run:   RunNetworkShow,
+	}
+	create := &cobra.Command{
+		Use:   "create",
+		Short: "Create a private network and print its key to share with members",
+		Args:  cobra.NoArgs,
+		Run:   RunNetworkCreate,
+	}
+	create.Flags().Bool("force", false, "Replace the key of the private network this node is in")
+	join := &cobra.Command{
+		Use:   "join [key] [bootstrap_addr...]",
+		Short: "Join a private network with its shared key and bootstrap peers",
+		Args:  cobra.MinimumNArgs(1),
+		Run:   RunNetworkJoin,
+	}
+	join.Flags().Bool("force", false, "Replace the key of the private network this node is in")
+	cmd.AddCommand(create, join, &cobra.Command{
+		Use:   "leave",
+		Short: "Leave the private network and return to the public network",
+		Args:  cobra.NoArgs,
+		Run:   RunNetworkLeave,
+	})
+	return cmd
+}
+
+// createContactsCommand creates the contacts command
+func createContactsCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "contacts",
+		Short: "List your contacts",
+		Args:  cobra.NoArgs,
+		Run:   RunContacts,
+	}
+	add := &cobra.Command{
+		Use:   "add [peer_id] [name]",
+		Short: "Add a peer to your contacts, or unblock it",
+		Args:  cobra.RangeArgs(1, 2),
+		Run: func(cmd *cobra.Command, args []string) {
+			RunSaveContact(cmd, args, false)
+		},
+	}
+	add.Flags().String("did", "", "The contact's DID, as shown by 'peerchat-cli id'")
+	block := &cobra.Command{
+		Use:   "block [peer_id]",
+		Short: "Block a peer's messages, files and routing",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			RunSaveContact(cmd, args, true)
+		},
+	}
+	cmd.AddCommand(add, block)
+	return cmd
+}
+
 // createStopCommand creates the stop command
 func createStopCommand() *cobra.Command {
 	return &cobra.Command{
@@ -4,12 +4,20 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 
+	"github.com/Xelvra/peerchat/internal/message"
 	"github.com/Xelvra/peerchat/internal/p2p"
 	"github.com/chzyer/readline"
 )
 
+const (
+	// historyDisplayLimit is the number of messages shown by /history
+	historyDisplayLimit = 30
+)
+
 // InteractiveCompleter provides tab completion for interactive mode
 type InteractiveCompleter struct {
 	commands []string
@@ -91,7 +99,7 @@ func CreateReadlineInstance() (*readline.Instance, *InteractiveCompleter, error)
 	// Define available commands
 	commands := []string{
 		"/help", "/peers", "/discover", "/connect", "/disconnect",
-		"/status", "/clear", "/quit", "/exit",
+		"/reply", "/history", "/files", "/accept", "/reject", "/status", "/clear", "/quit", "/exit",
 	}
 
 	completer := &InteractiveCompleter{
@@ -137,6 +145,11 @@ func HandleChatCommand(input string, wrapper *p2p.P2PWrapper, nodeInfo *p2p.Node
 		fmt.Println("  /peers         - List connected peers")
 		fmt.Println("  /discover      - Discover peers in network")
 		fmt.Println("  /connect <id>  - Connect to a peer (supports tab completion)")
+		fmt.Println("  /reply <n> <message> - Reply to message [n] in its thread")
+		fmt.Println("  /history       - Show recent messages as threads")
+		fmt.Println("  /files         - List incoming files waiting for a decision")
+		fmt.Println("  /accept <id> [path...] - Accept an incoming file, or some files of a folder")
+		fmt.Println("  /reject <id>   - Reject an incoming file")
 		fmt.Println("  /status        - Show node status")
 		fmt.Println("  /clear         - Clear screen")
 		fmt.Println("  /quit, /exit   - Exit chat")
@@ -193,6 +206,60 @@ func HandleChatCommand(input string, wrapper *p2p.P2PWrapper, nodeInfo *p2p.Node
 			fmt.Println("💡 Make sure the peer ID is correct and the peer is online")
 		}
 
+	case "/reply":
+		if len(parts) < 3 {
+			fmt.Println("❌ Usage: /reply <n> <message>")
+			return
+		}
+		number, err := strconv.Atoi(strings.TrimPrefix(strings.TrimSuffix(parts[1], "]"), "["))
+		if err != nil || number <= 0 {
+			fmt.Printf("❌ Invalid message number: %s\n", parts[1])
+			return
+		}
+		text := strings.Join(parts[2:], " ")
+
+		if err := wrapper.ReplyToMessage(number, text); err != nil {
+			fmt.Printf("❌ Failed to send reply: %v\n", err)
+			fmt.Println("💡 Use '/history' to see message numbers")
+			return
+		}
+		fmt.Printf("✅ Reply to [%d] sent: '%s'\n", number, text)
+
+	case "/history":
+		PrintThreadedHistory(wrapper.GetRecentMessages(historyDisplayLimit))
+
+	case "/files":
+		offers := wrapper.PendingFileOffers()
+		if len(offers) == 0 {
+			fmt.Println("📭 No incoming files waiting")
+			return
+		}
+		fmt.Println("📥 Incoming files waiting for a decision:")
+		for _, offer := range offers {
+			PrintFileOffer(offer)
+		}
+
+	case "/accept", "/reject":
+		if len(parts) < 2 {
+			fmt.Printf("❌ Usage: %s <id>\n", command)
+			return
+		}
+		accept := command == "/accept"
+		var paths []string
+		if accept {
+			paths = parts[2:]
+		}
+		if err := wrapper.DecideFileOffer(parts[1], accept, paths...); err != nil {
+			fmt.Printf("❌ %v\n", err)
+			fmt.Println("💡 Use '/files' to see incoming files")
+			return
+		}
+		if accept {
+			fmt.Printf("✅ Accepted %s\n", parts[1])
+		} else {
+			fmt.Printf("🚫 Rejected %s\n", parts[1])
+		}
+
 	case "/status":
 		fmt.Println("📊 Node Status:")
 		fmt.Printf("  Peer ID: %s\n", nodeInfo.PeerID)
@@ -216,6 +283,72 @@ func HandleChatCommand(input string, wrapper *p2p.P2PWrapper, nodeInfo *p2p.Node
 	}
 }
 
+// PrintThreadedHistory renders recent messages grouped into reply threads
+func PrintThreadedHistory(entries []*message.HistoryEntry) {
+	if len(entries) == 0 {
+		fmt.Println("📭 No messages yet")
+		return
+	}
+
+	// Group entries by thread, keeping threads in order of first appearance
+	var roots []string
+	threads := make(map[string][]*message.HistoryEntry)
+	for _, entry := range entries {
+		root := entry.Message.RootID()
+		if _, exists := threads[root]; !exists {
+			roots = append(roots, root)
+		}
+		threads[root] = append(threads[root], entry)
+	}
+
+	fmt.Println("🧵 Recent messages:")
+	for _, root := range roots {
+		thread := threads[root]
+		sort.SliceStable(thread, func(i, j int) bool {
+			return thread[i].Message.Lamport < thread[j].Message.Lamport
+		})
+		for _, entry := range thread {
+			indent := strings.Repeat("    ", entry.Depth)
+			marker := "•"
+			if entry.Message.IsReply() {
+				marker = "↪"
+			}
+			fmt.Printf("  %s%s [%d] %s: %s\n", indent, marker, entry.Number,
+				shortSender(entry.Message.From), string(entry.Message.Content))
+		}
+	}
+}
+
+// AnnounceFileOffers prints incoming files that have not been shown yet and
+// forgets offers that are no longer pending
+func AnnounceFileOffers(wrapper *p2p.P2PWrapper, announced map[string]bool) {
+	pending := make(map[string]bool)
+	for _, offer := range wrapper.PendingFileOffers() {
+		pending[offer.ID] = true
+		if announced[offer.ID] {
+			continue
+		}
+		announced[offer.ID] = true
+		fmt.Println("\n📥 Incoming file:")
+		PrintFileOffer(offer)
+		fmt.Printf("💡 Type '/accept %s' or '/reject %s'\n", offer.ID, offer.ID)
+	}
+
+	for id := range announced {
+		if !pending[id] {
+			delete(announced, id)
+		}
+	}
+}
+
+// shortSender abbreviates a sender DID for compact display
+func shortSender(did string) string {
+	if len(did) > 24 {
+		return did[:24] + "..."
+	}
+	return did
+}
+
 // HandleChatMessage sends a message to connected peers
 func HandleChatMessage(message string, wrapper *p2p.P2PWrapper) {
 	fmt.Printf("📤 Sending: %s\n", message)
@@ -2,12 +2,16 @@ package cli
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
+	"unicode"
 
+	"github.com/Xelvra/peerchat/internal/message"
 	"github.com/Xelvra/peerchat/internal/p2p"
 	"github.com/spf13/cobra"
 )
@@ -103,15 +107,32 @@ func RunStatus(cmd *cobra.Command, args []string) {
 	// Display discovery status
 	if status.Discovery != nil {
 		fmt.Println("🔍 Discovery Status:")
+		fmt.Printf("  IPv6 Link-Local: %s\n", getStatusIcon(status.Discovery.IPv6LinkLocal))
 		fmt.Printf("  mDNS: %s\n", getStatusIcon(status.Discovery.MDNSActive))
 		fmt.Printf("  DHT: %s\n", getStatusIcon(status.Discovery.DHTActive))
 		fmt.Printf("  UDP Broadcast: %s\n", getStatusIcon(status.Discovery.UDPBroadcast))
+		fmt.Printf("  Relay service: %s\n", getStatusIcon(status.Discovery.RelayService))
 		fmt.Printf("  Known peers: %d\n", status.Discovery.KnownPeers)
 		if !status.Discovery.LastDiscovery.IsZero() {
 			fmt.Printf("  Last discovery: %s\n", status.Discovery.LastDiscovery.Format("15:04:05"))
 		}
 	}
 
+	// Display relay health
+	if len(status.Relays) > 0 {
+		fmt.Println()
+		fmt.Println("🛰️  Relays:")
+		for _, relay := range status.Relays {
+			state := "standby"
+			if relay.Active {
+				state = "reserved"
+			}
+			fmt.Printf("  %s %s (%s): rtt %s, %.0f%% of %d probes answered, %d reservations (%d lost), %.1f KiB/s\n",
+				getStatusIcon(relay.Reachable), relay.PeerID, state, relay.Latency.Round(time.Millisecond),
+				relay.Reliability*100, relay.Probes, relay.Reservations, relay.Lost, relay.Throughput/1024)
+		}
+	}
+
 	// Display energy optimization status (if available)
 	fmt.Println()
 	fmt.Println("⚡ Energy Optimization:")
@@ -348,6 +369,225 @@ func RunSendFile(cmd *cobra.Command, args []string) {
 	fmt.Println("This feature requires P2P file transfer protocol.")
 }
 
+// RunTransfers lists incoming files the running node is waiting on
+func RunTransfers(cmd *cobra.Command, args []string) {
+	status, err := p2p.ReadNodeStatus()
+	if err != nil || status == nil || !status.IsRunning {
+		fmt.Println("❌ No running node found")
+		fmt.Println("💡 Start the node first with: peerchat-cli start --daemon")
+		return
+	}
+
+	offers, err := p2p.ReadPendingFileOffers()
+	if err != nil {
+		fmt.Printf("❌ Failed to read file offers: %v\n", err)
+		return
+	}
+	if len(offers) == 0 {
+		fmt.Println("📭 No incoming files waiting")
+		return
+	}
+
+	fmt.Println("📥 Incoming files waiting for a decision:")
+	for _, offer := range offers {
+		PrintFileOffer(offer)
+	}
+	fmt.Println("💡 Use 'peerchat-cli transfers accept <id>' or 'peerchat-cli transfers reject <id>'")
+}
+
+// RunDecideTransfer accepts or rejects an incoming file on the running node
+func RunDecideTransfer(from, id string, accept bool, paths ...string) {
+	if err := p2p.DecideFileOffer(from, id, accept, paths...); err != nil {
+		if errors.Is(err, message.ErrUnknownOffer) {
+			fmt.Printf("❌ No incoming file %s is waiting (it may have timed out)\n", id)
+			return
+		}
+		if errors.Is(err, message.ErrAmbiguousOffer) {
+			fmt.Printf("❌ Several peers offer a file with ID %s\n", id)
+			fmt.Println("💡 Pick the sender with --peer <peer_id>")
+			return
+		}
+		fmt.Printf("❌ Failed to send decision: %v\n", err)
+		return
+	}
+
+	if accept && len(paths) > 0 {
+		fmt.Printf("✅ Accepted %d files of %s\n", len(paths), id)
+	} else if accept {
+		fmt.Printf("✅ Accepted %s\n", id)
+	} else {
+		fmt.Printf("🚫 Rejected %s\n", id)
+	}
+}
+
+// RunContacts lists the user's contacts
+func RunContacts(cmd *cobra.Command, args []string) {
+	contacts, err := p2p.Contacts()
+	if err != nil {
+		fmt.Printf("❌ Failed to read contacts: %v\n", err)
+		fmt.Println("💡 Create your identity first with: peerchat-cli init")
+		return
+	}
+	if len(contacts) == 0 {
+		fmt.Println("📭 No contacts yet")
+		fmt.Println("💡 Add one with: peerchat-cli contacts add <peer_id> [name]")
+		return
+	}
+
+	fmt.Println("👥 Contacts:")
+	for _, contact := range contacts {
+		status := ""
+		if contact.IsBlocked {
+			status = " (blocked)"
+		}
+		fmt.Printf("  %s  %s%s\n", contact.MessengerID.PeerID, contact.DisplayName, status)
+	}
+}
+
+// RunSaveContact adds a peer to the contacts, or blocks it
+func RunSaveContact(cmd *cobra.Command, args []string, blocked bool) {
+	did, _ := cmd.Flags().GetString("did")
+	var name string
+	if len(args) > 1 {
+		name = args[1]
+	}
+
+	if err := p2p.SaveContact(args[0], did, name, blocked); err != nil {
+		fmt.Printf("❌ Failed to save contact: %v\n", err)
+		return
+	}
+	if blocked {
+		fmt.Printf("🚫 Blocked %s\n", args[0])
+	} else {
+		fmt.Printf("✅ Added %s to your contacts\n", args[0])
+	}
+}
+
+// RunDecrypt decrypts a file kept encrypted at rest next to it, or to the given output
+func RunDecrypt(cmd *cobra.Command, args []string) {
+	path := args[0]
+	output := strings.TrimSuffix(path, message.EncryptedFileExt)
+	if len(args) > 1 {
+		output = args[1]
+	} else if output == path {
+		fmt.Printf("❌ %s does not end in %s, name the output file\n", path, message.EncryptedFileExt)
+		return
+	}
+
+	if err := p2p.DecryptDownload(path, output); err != nil {
+		fmt.Printf("❌ Failed to decrypt %s: %v\n", path, err)
+		return
+	}
+	fmt.Printf("🔓 Decrypted to %s\n", output)
+}
+
+// RunNetworkShow handles the network command
+func RunNetworkShow(cmd *cobra.Command, args []string) {
+	psk, bootstrap, err := p2p.PrivateNetwork()
+	if err != nil {
+		fmt.Printf("❌ Failed to read network configuration: %v\n", err)
+		return
+	}
+
+	if psk == nil {
+		fmt.Println("🌐 Public network")
+	} else {
+		fmt.Printf("🔒 Private network %s\n", p2p.NetworkKeyFingerprint(psk))
+	}
+	if len(bootstrap) == 0 {
+		fmt.Println("📭 No bootstrap peers configured")
+		return
+	}
+	fmt.Println("📡 Bootstrap peers:")
+	for _, info := range bootstrap {
+		fmt.Printf("  %s %v\n", info.ID, info.Addrs)
+	}
+}
+
+// RunNetworkCreate handles the network create command
+func RunNetworkCreate(cmd *cobra.Command, args []string) {
+	force, _ := cmd.Flags().GetBool("force")
+	psk, err := p2p.CreatePrivateNetwork(force)
+	if err != nil {
+		fmt.Printf("❌ Failed to create private network: %v\n", err)
+		if errors.Is(err, p2p.ErrNetworkKeyExists) {
+			fmt.Println("💡 Use --force to replace it, or 'peerchat-cli network leave' first")
+		}
+		return
+	}
+
+	key := p2p.EncodeNetworkKey(psk)
+	fmt.Printf("🔒 Created private network %s\n", p2p.NetworkKeyFingerprint(psk))
+	fmt.Println()
+	fmt.Println("Share this key only with members, over a channel you trust:")
+	fmt.Printf("  %s\n", key)
+	fmt.Println()
+	fmt.Println("Members join with the key and the address of a node already in the network:")
+	fmt.Printf("  peerchat-cli network join %s /ip4/<ip>/tcp/<port>/p2p/<peer_id>\n", key)
+	fmt.Println("💡 Restart the node to switch networks; QUIC is disabled in private networks")
+}
+
+// RunNetworkJoin handles the network join command
+func RunNetworkJoin(cmd *cobra.Command, args []string) {
+	force, _ := cmd.Flags().GetBool("force")
+	psk, err := p2p.JoinPrivateNetwork(args[0], args[1:], force)
+	if err != nil {
+		fmt.Printf("❌ Failed to join private network: %v\n", err)
+		if errors.Is(err, p2p.ErrNetworkKeyExists) {
+			fmt.Println("💡 Use --force to leave the current private network")
+		}
+		return
+	}
+
+	fmt.Printf("🔒 Joined private network %s\n", p2p.NetworkKeyFingerprint(psk))
+	if len(args) > 1 {
+		fmt.Printf("📡 Added %d bootstrap address(es)\n", len(args)-1)
+	}
+	fmt.Println("💡 Restart the node to connect to the private network")
+}
+
+// RunNetworkLeave handles the network leave command
+func RunNetworkLeave(cmd *cobra.Command, args []string) {
+	if err := p2p.LeavePrivateNetwork(); err != nil {
+		fmt.Printf("❌ Failed to leave private network: %v\n", err)
+		return
+	}
+	fmt.Println("🌐 Left the private network; the node joins the public network on its next start")
+	fmt.Printf("💡 Bootstrap peers in ~/.xelvra/%s are kept; remove them to use the public bootstrap nodes\n", p2p.BootstrapFile)
+}
+
+// PrintFileOffer shows one incoming file waiting for a decision, with the
+// files of a multi-file offer. Names are sanitized so they cannot carry
+// terminal control sequences.
+func PrintFileOffer(offer message.FileOffer) {
+	fmt.Printf("  %s  %s (%s, %d bytes) from %s, expires in %s\n",
+		offer.ID, message.SanitizeFileName(offer.Metadata.Name), offer.Metadata.MimeType, offer.Metadata.Size,
+		offer.PeerID.String(), time.Until(offer.Expires).Round(time.Second))
+	if preview := offer.Metadata.Preview; preview != nil {
+		fmt.Printf("      %s\n", preview)
+		if thumbnail, err := preview.DecodeThumbnail(); err == nil {
+			for _, line := range RenderThumbnail(thumbnail, thumbnailColumns) {
+				fmt.Printf("      %s\n", line)
+			}
+		}
+	}
+	for _, file := range offer.Files {
+		fmt.Printf("      %s (%d bytes", strings.ToValidUTF8(strings.Map(printableRune, file.Path), "?"), file.Size)
+		if file.Preview != nil {
+			fmt.Printf(", %s", file.Preview)
+		}
+		fmt.Println(")")
+	}
+}
+
+// printableRune drops control characters from text shown in the terminal
+func printableRune(r rune) rune {
+	if unicode.IsControl(r) || unicode.Is(unicode.Cf, r) {
+		return -1
+	}
+	return r
+}
+
 // RunStop handles the stop command
 func RunStop(cmd *cobra.Command, args []string) {
 	fmt.Println("🛑 Stopping P2P node...")
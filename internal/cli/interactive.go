@@ -10,6 +10,7 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/Xelvra/peerchat/internal/message"
 	"github.com/Xelvra/peerchat/internal/p2p"
 	"github.com/chzyer/readline"
 	"github.com/spf13/cobra"
@@ -32,6 +33,7 @@ func RunInteractiveChat(cmd *cobra.Command, args []string) {
 	// Create P2P wrapper (try real P2P first, fallback to simulation)
 	ctx := context.Background()
 	wrapper := p2p.NewP2PWrapper(ctx, false)
+	applyStartFlags(cmd, wrapper)
 
 	fmt.Println("🔧 Initializing P2P node...")
 	if err := wrapper.Start(); err != nil {
@@ -123,6 +125,9 @@ func RunInteractiveChat(cmd *cobra.Command, args []string) {
 		}
 	}()
 
+	// Incoming file offers already shown to the user
+	announcedOffers := make(map[string]bool)
+
 	// Main event loop
 	for {
 		select {
@@ -156,6 +161,7 @@ func RunInteractiveChat(cmd *cobra.Command, args []string) {
 
 		default:
 			// Check for incoming messages (placeholder)
+			AnnounceFileOffers(wrapper, announcedOffers)
 			time.Sleep(100 * time.Millisecond)
 		}
 	}
@@ -177,6 +183,7 @@ func RunDaemonMode(cmd *cobra.Command, args []string) {
 	// Create P2P wrapper
 	ctx := context.Background()
 	wrapper := p2p.NewP2PWrapper(ctx, false)
+	applyStartFlags(cmd, wrapper)
 
 	fmt.Println("🔧 Initializing P2P node...")
 	if err := wrapper.Start(); err != nil {
@@ -208,3 +215,93 @@ func RunDaemonMode(cmd *cobra.Command, args []string) {
 	fmt.Println("\n👋 Shutdown signal received, stopping daemon...")
 	fmt.Println("✅ Daemon stopped successfully")
 }
+
+// applyStartFlags passes start command flags through to the node configuration
+func applyStartFlags(cmd *cobra.Command, wrapper *p2p.P2PWrapper) {
+	mailboxes, _ := cmd.Flags().GetStringSlice("mailbox")
+	mailboxOwners, _ := cmd.Flags().GetStringSlice("serve-mailbox")
+	shareFiles, _ := cmd.Flags().GetBool("share-files")
+	encryptDownloads, _ := cmd.Flags().GetBool("encrypt-downloads")
+
+	policy := message.DefaultFileAcceptPolicy()
+	policy.AutoAccept, _ = cmd.Flags().GetBool("accept-files")
+	policy.ContactsOnly, _ = cmd.Flags().GetBool("files-from-contacts")
+	if maxFileSize, err := cmd.Flags().GetInt64("max-file-size"); err == nil {
+		policy.MaxFileSize = maxFileSize << 20
+	}
+	policy.AllowedMimeTypes, _ = cmd.Flags().GetStringSlice("allow-file-types")
+	policy.BlockedMimeTypes, _ = cmd.Flags().GetStringSlice("block-file-types")
+	if maxIncoming, err := cmd.Flags().GetInt("max-incoming-files"); err == nil {
+		policy.MaxConcurrent = maxIncoming
+	}
+	if peerQuota, err := cmd.Flags().GetInt64("peer-file-quota"); err == nil {
+		policy.PeerQuota = peerQuota << 20
+	}
+
+	var bandwidth message.BandwidthLimits
+	for flag, limit := range map[string]*int64{
+		"upload-limit":        &bandwidth.Upload,
+		"download-limit":      &bandwidth.Download,
+		"peer-upload-limit":   &bandwidth.PeerUpload,
+		"peer-download-limit": &bandwidth.PeerDownload,
+	} {
+		if kib, err := cmd.Flags().GetInt64(flag); err == nil {
+			*limit = kib << 10
+		}
+	}
+
+	bootstrapAddrs, _ := cmd.Flags().GetStringSlice("bootstrap")
+	bootstrapPeers, err := p2p.ParseBootstrapPeers(bootstrapAddrs)
+	if err != nil {
+		fmt.Printf("⚠️  Ignoring --bootstrap: %v\n", err)
+	}
+	disableDHT, _ := cmd.Flags().GetBool("no-dht")
+	stunServers, _ := cmd.Flags().GetStringSlice("stun")
+
+	relayService, _ := cmd.Flags().GetBool("relay-service")
+	relayLimits := p2p.DefaultRelayServiceConfig()
+	if reservations, err := cmd.Flags().GetInt("relay-reservations"); err == nil {
+		relayLimits.MaxReservations = reservations
+	}
+	if duration, err := cmd.Flags().GetDuration("relay-duration"); err == nil {
+		relayLimits.Duration = duration
+	}
+	if kib, err := cmd.Flags().GetInt64("relay-data"); err == nil {
+		relayLimits.Data = kib << 10
+	}
+	policyName, _ := cmd.Flags().GetString("relay-policy")
+	relayPolicy, err := p2p.ParseRelaySelectionPolicy(policyName)
+	if err != nil {
+		fmt.Printf("⚠️  Ignoring --relay-policy: %v\n", err)
+	}
+	activeRelays, _ := cmd.Flags().GetInt("relays")
+
+	enableWebSocket, _ := cmd.Flags().GetBool("websocket")
+	webSocketListen, _ := cmd.Flags().GetStringSlice("ws-listen")
+	webSocketCert, _ := cmd.Flags().GetString("ws-cert")
+	webSocketKey, _ := cmd.Flags().GetString("ws-key")
+	enableWebTransport, _ := cmd.Flags().GetBool("webtransport")
+	webTransportListen, _ := cmd.Flags().GetStringSlice("webtransport-listen")
+
+	wrapper.ConfigureNode(func(config *p2p.NodeConfig) {
+		config.Mailboxes = mailboxes
+		config.MailboxOwners = mailboxOwners
+		config.ShareFiles = shareFiles
+		config.EncryptDownloads = encryptDownloads
+		config.FileAcceptPolicy = policy
+		config.Bandwidth = bandwidth
+		config.BootstrapPeers = bootstrapPeers
+		config.DisableDHT = disableDHT
+		config.STUNServers = stunServers
+		config.RelayService = relayService
+		config.RelayLimits = relayLimits
+		config.RelayPolicy = relayPolicy
+		config.ActiveRelays = activeRelays
+		config.EnableWebSocket = enableWebSocket || len(webSocketListen) > 0
+		config.WebSocketListenAddrs = webSocketListen
+		config.WebSocketCertFile = webSocketCert
+		config.WebSocketKeyFile = webSocketKey
+		config.EnableWebTransport = enableWebTransport || len(webTransportListen) > 0
+		config.WebTransportListenAddrs = webTransportListen
+	})
+}
@@ -6,7 +6,7 @@ import (
 
 // RunManual handles the manual command
 func RunManual(version string) {
-	fmt.Printf(`
+	fmt.Print(`
 XELVRA P2P MESSENGER CLI MANUAL
 ===============================
 
@@ -44,10 +44,60 @@ COMMANDS
     start             Start interactive P2P chat mode with full features
                       Supports tab completion, command history, and real-time messaging
                       Use --daemon flag to run as background service
+                      Use --mailbox <multiaddr> to have an always-on peer hold your
+                      messages while offline, and --serve-mailbox <did> to hold
+                      messages for someone else
+                      Use --share-files to let other peers download files you
+                      sent or received from you in parallel with other holders
+                      Use --encrypt-downloads to keep received files encrypted
+                      on disk; they are saved as <name>.xenc
+                      Incoming files are only received after you accept them;
+                      --accept-files accepts them automatically, while
+                      --files-from-contacts and --max-file-size <MiB> limit them
+                      --allow-file-types and --block-file-types take MIME types
+                      such as image/* or application/pdf, --max-incoming-files
+                      caps files received at once and --peer-file-quota <MiB>
+                      what one peer may send per day
+                      --upload-limit and --download-limit <KiB/s> cap file
+                      transfer rates in total, --peer-upload-limit and
+                      --peer-download-limit per peer; chat messages always go
+                      first and large transfers pause while the battery is low
+                      --bootstrap <multiaddr> adds a bootstrap peer to those in
+                      ~/.xelvra/bootstrap.txt and --no-dht turns the DHT off
+                      --stun <host:port> sets the STUN servers used to detect
+                      the NAT type; they need RFC 5780 support
+                      --relay-service relays connections for NATed contacts,
+                      or any member of a private network, while the node is
+                      publicly reachable and advertises it in the DHT;
+                      --relay-reservations, --relay-duration and --relay-data
+                      (KiB per connection) cap its use
+                      --relay-policy picks the relays reserved while NATed by
+                      latency, reliability, random or round-robin, and
+                      --relays sets how many reservations are kept
+                      --websocket and --webtransport add transports that pass
+                      networks letting only HTTPS out; --ws-listen and
+                      --webtransport-listen set their addresses, --ws-cert
+                      and --ws-key a certificate for /tls/ws listeners. When
+                      TCP and QUIC dials keep failing, they are dialed first
 
                       Examples:
                         peerchat-cli start
                         peerchat-cli start --daemon
+                        peerchat-cli start --daemon --serve-mailbox did:xelvra:...
+                        peerchat-cli start --no-dht --bootstrap /ip4/10.0.0.5/tcp/4001/p2p/12D3KooW...
+
+  PRIVATE NETWORKS
+    network           Show whether the node is on the public or a private network
+    network create    Generate a pre-shared key for a new private network and
+                      print it for sharing; only nodes with the key can connect
+    network join      Store a shared key and the addresses of member nodes
+    network leave     Remove the key and return to the public network
+                      Private networks do not use the public bootstrap nodes and
+                      run over TCP only; restart the node after changing networks
+
+                      Examples:
+                        peerchat-cli network create
+                        peerchat-cli network join 3f9c... /ip4/10.0.0.5/tcp/4001/p2p/12D3KooW...
 
   NODE MANAGEMENT
     status            Show detailed node status and network information
@@ -93,6 +143,26 @@ COMMANDS
                       Example:
                         peerchat-cli send-file 12D3KooW... /path/to/file.txt
 
+    transfers         List incoming files the running node is waiting on
+                      Files not accepted within 45 seconds are rejected
+                      Folders and file sets arrive as one offer listing every
+                      file; name paths after the ID to accept only those files
+                      --peer <id> picks the sender when two peers use the same ID
+
+                      Examples:
+                        peerchat-cli transfers
+                        peerchat-cli transfers accept file_1718...
+                        peerchat-cli transfers accept manifest_1718... photos/a.jpg
+                        peerchat-cli transfers reject file_1718...
+
+    decrypt           Decrypt a file received with --encrypt-downloads
+                      Writes <name> next to <name>.xenc unless an output is given;
+                      existing files are never replaced
+
+                      Examples:
+                        peerchat-cli decrypt ~/.xelvra/downloads/report.pdf.xenc
+                        peerchat-cli decrypt report.pdf.xenc /tmp/report.pdf
+
   IDENTITY & PROFILES
     id                Show your identity information
                       Displays DID, Peer ID, and network addresses
@@ -106,6 +176,17 @@ COMMANDS
                       Example:
                         peerchat-cli profile 12D3KooW...
 
+    contacts          List your contacts; add and block manage them
+                      Files (with --files-from-contacts), relaying and
+                      multi-hop routing are limited to contacts, and
+                      blocked peers are refused everywhere
+                      --did records the contact's DID from 'peerchat-cli id'
+
+                      Examples:
+                        peerchat-cli contacts
+                        peerchat-cli contacts add 12D3KooW... alice
+                        peerchat-cli contacts block 12D3KooW...
+
   HELP & INFORMATION
     manual            Show this comprehensive manual
     version           Show version and build information
@@ -137,6 +218,12 @@ INTERACTIVE CHAT COMMANDS
     /discover         Discover new peers on the network
     /connect <id>     Connect to a specific peer (with tab completion)
     /disconnect <id>  Disconnect from a peer
+    /reply <n> <msg>  Reply to message [n]; replies are shown as threads
+    /history          Show recent messages grouped into reply threads
+    /files            List incoming files waiting for a decision
+    /accept <id>      Accept an incoming file; add paths to accept only
+                      those files of a folder
+    /reject <id>      Reject an incoming file
     /status           Show current node status
     /clear            Clear the screen
     /quit, /exit      Exit interactive chat mode
@@ -158,8 +245,11 @@ FILES AND DIRECTORIES
     ~/.xelvra/identity.key        Private key file (Ed25519)
     ~/.xelvra/peerchat.log        Application log file (rotated)
     ~/.xelvra/chat_history        Interactive chat command history
-    ~/.xelvra/offline_messages/   Stored offline messages
+    ~/.xelvra/userdata.db         Local database (message history, outbox)
     ~/.xelvra/downloads/          Received files directory
+    ~/.xelvra/file_offers.json    Incoming files waiting to be accepted
+    ~/.xelvra/swarm.key           Private network pre-shared key
+    ~/.xelvra/bootstrap.txt       Bootstrap peer multiaddrs, one per line
 
 CONFIGURATION
     The configuration file (~/.xelvra/config.yaml) contains:
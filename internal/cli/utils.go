@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"encoding/json"
 	"fmt"
+	"image"
 	"os"
 	"path/filepath"
 	"strings"
@@ -149,3 +150,49 @@ func RunInlinePeerDiscovery(wrapper *p2p.P2PWrapper) {
 		fmt.Println("💡 Use '/connect <peer_id>' to connect to a peer")
 	}
 }
+
+// thumbnailColumns is the width offered file thumbnails are drawn at
+const thumbnailColumns = 32
+
+// RenderThumbnail draws an image as terminal lines of upper half blocks with
+// 24-bit colors, two pixel rows per line, scaled down to at most columns wide
+func RenderThumbnail(img image.Image, columns int) []string {
+	bounds := img.Bounds()
+	if bounds.Empty() || columns <= 0 {
+		return nil
+	}
+
+	width := bounds.Dx()
+	if width > columns {
+		width = columns
+	}
+	height := bounds.Dy() * width / bounds.Dx()
+	if height < 1 {
+		height = 1
+	}
+
+	// pixel samples the source pixel under a cell of the scaled image
+	pixel := func(x, y int) (uint32, uint32, uint32) {
+		r, g, b, _ := img.At(bounds.Min.X+x*bounds.Dx()/width, bounds.Min.Y+y*bounds.Dy()/height).RGBA()
+		return r >> 8, g >> 8, b >> 8
+	}
+
+	var lines []string
+	for y := 0; y < height; y += 2 {
+		var line strings.Builder
+		for x := 0; x < width; x++ {
+			r, g, b := pixel(x, y)
+			fmt.Fprintf(&line, "\x1b[38;2;%d;%d;%dm", r, g, b)
+			if y+1 < height {
+				r, g, b = pixel(x, y+1)
+				fmt.Fprintf(&line, "\x1b[48;2;%d;%d;%dm", r, g, b)
+			} else {
+				line.WriteString("\x1b[49m")
+			}
+			line.WriteString("▀")
+		}
+		line.WriteString("\x1b[0m")
+		lines = append(lines, line.String())
+	}
+	return lines
+}
@@ -0,0 +1,74 @@
+package crypto
+
+import (
+	"crypto/ed25519"
+	"crypto/sha512"
+	"fmt"
+	"math/big"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+// curve25519Prime is the field prime 2^255 - 19 shared by both curve forms
+var curve25519Prime = new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 255), big.NewInt(19))
+
+// PublicKeyFromEd25519 converts an Ed25519 identity key to the Curve25519
+// public key of the same key pair, so data can be sealed to a peer's identity.
+// It maps the Edwards y coordinate to the Montgomery u = (1+y)/(1-y).
+func PublicKeyFromEd25519(publicKey ed25519.PublicKey) ([]byte, error) {
+	if len(publicKey) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid Ed25519 public key size: %d", len(publicKey))
+	}
+
+	// The key is y in little-endian with the sign of x in the top bit
+	encoded := make([]byte, ed25519.PublicKeySize)
+	for i, b := range publicKey {
+		encoded[ed25519.PublicKeySize-1-i] = b
+	}
+	encoded[0] &= 0x7f
+	y := new(big.Int).SetBytes(encoded)
+	if y.Cmp(curve25519Prime) >= 0 {
+		return nil, fmt.Errorf("invalid Ed25519 public key")
+	}
+
+	denominator := new(big.Int).Sub(big.NewInt(1), y)
+	denominator.Mod(denominator, curve25519Prime)
+	if denominator.Sign() == 0 {
+		return nil, fmt.Errorf("invalid Ed25519 public key")
+	}
+	u := new(big.Int).Add(big.NewInt(1), y)
+	u.Mul(u, denominator.ModInverse(denominator, curve25519Prime))
+	u.Mod(u, curve25519Prime)
+
+	result := make([]byte, PublicKeySize)
+	u.FillBytes(result)
+	for i, j := 0, len(result)-1; i < j; i, j = i+1, j-1 {
+		result[i], result[j] = result[j], result[i]
+	}
+	return result, nil
+}
+
+// KeyPairFromEd25519 derives the Curve25519 key pair of an Ed25519 identity
+// key. The private key is the clamped scalar Ed25519 signs with, so its public
+// key matches PublicKeyFromEd25519.
+func KeyPairFromEd25519(privateKey ed25519.PrivateKey) (*KeyPair, error) {
+	if len(privateKey) != ed25519.PrivateKeySize {
+		return nil, fmt.Errorf("invalid Ed25519 private key size: %d", len(privateKey))
+	}
+
+	digest := sha512.Sum512(privateKey.Seed())
+	scalar := make([]byte, PrivateKeySize)
+	copy(scalar, digest[:PrivateKeySize])
+	scalar[0] &= 248
+	scalar[31] &= 127
+	scalar[31] |= 64
+	for i := range digest {
+		digest[i] = 0
+	}
+
+	publicKey, err := curve25519.X25519(scalar, curve25519.Basepoint)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive public key: %w", err)
+	}
+	return NewSecureKeyPair(scalar, publicKey), nil
+}
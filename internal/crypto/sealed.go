@@ -0,0 +1,91 @@
+package crypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// SealedOverhead is the number of bytes SealAnonymous adds to the plaintext
+const SealedOverhead = PublicKeySize + NonceSize + TagSize
+
+// SealAnonymous encrypts plaintext to a Curve25519 public key using a fresh
+// ephemeral key, so the ciphertext reveals nothing about the sender.
+// The result is ephemeralPublicKey || nonce || ciphertext.
+func SealAnonymous(recipientPublicKey, plaintext, info []byte) ([]byte, error) {
+	ephemeral, err := GenerateKeyPair()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate ephemeral key: %w", err)
+	}
+	defer ephemeral.Destroy()
+
+	gcm, err := sealedCipher(ephemeral.PrivateKey, recipientPublicKey, ephemeral.PublicKey, recipientPublicKey, info)
+	if err != nil {
+		return nil, err
+	}
+
+	sealed := make([]byte, PublicKeySize+NonceSize, SealedOverhead+len(plaintext))
+	copy(sealed, ephemeral.PublicKey)
+	if _, err := io.ReadFull(rand.Reader, sealed[PublicKeySize:]); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+
+	return gcm.Seal(sealed, sealed[PublicKeySize:], plaintext, nil), nil
+}
+
+// OpenAnonymous decrypts data produced by SealAnonymous with the recipient's key pair
+func OpenAnonymous(recipient *KeyPair, sealed, info []byte) ([]byte, error) {
+	if len(sealed) < SealedOverhead {
+		return nil, fmt.Errorf("sealed data too short")
+	}
+
+	ephemeralPublicKey := sealed[:PublicKeySize]
+	nonce := sealed[PublicKeySize : PublicKeySize+NonceSize]
+
+	gcm, err := sealedCipher(recipient.PrivateKey, ephemeralPublicKey, ephemeralPublicKey, recipient.PublicKey, info)
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext, err := gcm.Open(nil, nonce, sealed[PublicKeySize+NonceSize:], nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open sealed data: %w", err)
+	}
+
+	return plaintext, nil
+}
+
+// sealedCipher derives the AES-GCM cipher shared by both ends of a sealed box.
+// Both public keys are bound into the key derivation.
+func sealedCipher(privateKey, peerPublicKey, ephemeralPublicKey, recipientPublicKey, info []byte) (cipher.AEAD, error) {
+	shared, err := performDH(privateKey, peerPublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compute shared secret: %w", err)
+	}
+
+	salt := make([]byte, 0, 2*PublicKeySize)
+	salt = append(salt, ephemeralPublicKey...)
+	salt = append(salt, recipientPublicKey...)
+
+	key := make([]byte, AESKeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, shared, salt, info), key); err != nil {
+		return nil, fmt.Errorf("failed to derive key: %w", err)
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create AES cipher: %w", err)
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create GCM: %w", err)
+	}
+
+	return gcm, nil
+}
@@ -0,0 +1,121 @@
+package db
+
+import (
+	"crypto/ed25519"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/Xelvra/peerchat/internal/user"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// SaveContact stores a user profile and adds it to owner's contacts. The
+// profile's IsBlocked flag blocks the contact.
+func (db *SQLiteDB) SaveContact(ownerDID string, contact *user.UserProfile) error {
+	if err := db.SaveUser(contact); err != nil {
+		return err
+	}
+
+	query := `
+		INSERT INTO contacts (owner_did, contact_did, display_name, is_blocked)
+		VALUES (?, ?, ?, ?)
+		ON CONFLICT(owner_did, contact_did) DO UPDATE SET
+			display_name = excluded.display_name,
+			is_blocked = excluded.is_blocked
+	`
+
+	_, err := db.db.Exec(query,
+		ownerDID,
+		contact.MessengerID.GetDID(),
+		contact.DisplayName,
+		contact.IsBlocked,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to save contact: %w", err)
+	}
+
+	db.incrementTransactionCount()
+	return nil
+}
+
+// ContactStatus reports whether a peer's public key belongs to one of owner's
+// contacts and whether that contact or user is blocked
+func (db *SQLiteDB) ContactStatus(ownerDID string, peerID peer.ID) (bool, bool, error) {
+	pubKey, err := peerID.ExtractPublicKey()
+	if err != nil {
+		return false, false, fmt.Errorf("failed to extract public key: %w", err)
+	}
+	raw, err := pubKey.Raw()
+	if err != nil {
+		return false, false, fmt.Errorf("failed to read public key: %w", err)
+	}
+
+	query := `
+		SELECT c.is_blocked OR u.is_blocked
+		FROM contacts c
+		JOIN users u ON u.did = c.contact_did
+		WHERE c.owner_did = ? AND u.public_key = ?
+	`
+
+	var blocked bool
+	err = db.db.QueryRow(query, ownerDID, hex.EncodeToString(raw)).Scan(&blocked)
+	if err == sql.ErrNoRows {
+		return false, false, nil
+	}
+	if err != nil {
+		return false, false, fmt.Errorf("failed to look up contact: %w", err)
+	}
+	return true, blocked, nil
+}
+
+// LoadContacts returns owner's contacts in the order they were added, with
+// IsBlocked set for blocked contacts
+func (db *SQLiteDB) LoadContacts(ownerDID string) ([]*user.UserProfile, error) {
+	query := `
+		SELECT u.did, u.public_key, c.display_name, c.is_blocked OR u.is_blocked, c.added_at
+		FROM contacts c
+		JOIN users u ON u.did = c.contact_did
+		WHERE c.owner_did = ?
+		ORDER BY c.added_at, u.did
+	`
+
+	rows, err := db.db.Query(query, ownerDID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load contacts: %w", err)
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			db.logger.WithError(err).Error("Failed to close rows")
+		}
+	}()
+
+	var contacts []*user.UserProfile
+	for rows.Next() {
+		var did, publicKeyHex string
+		var displayName sql.NullString
+		profile := &user.UserProfile{}
+		if err := rows.Scan(&did, &publicKeyHex, &displayName, &profile.IsBlocked, &profile.ContactsSince); err != nil {
+			return nil, fmt.Errorf("failed to read contact: %w", err)
+		}
+
+		publicKey, err := hex.DecodeString(publicKeyHex)
+		if err != nil || len(publicKey) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid public key for contact %s", did)
+		}
+		pubKey, err := crypto.UnmarshalEd25519PublicKey(publicKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid public key for contact %s: %w", did, err)
+		}
+		peerID, err := peer.IDFromPublicKey(pubKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid public key for contact %s: %w", did, err)
+		}
+
+		profile.MessengerID = &user.MessengerID{DID: did, PublicKey: publicKey, PeerID: peerID}
+		profile.DisplayName = displayName.String
+		contacts = append(contacts, profile)
+	}
+	return contacts, rows.Err()
+}
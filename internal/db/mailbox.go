@@ -0,0 +1,231 @@
+package db
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Xelvra/peerchat/internal/message"
+)
+
+// StoreEnvelope saves an envelope held for another user, encrypting its payload at rest.
+// An envelope already stored for the owner under the same ID is never replaced.
+func (db *SQLiteDB) StoreEnvelope(env *message.Envelope) error {
+	payload, err := db.encrypt(env.Payload)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt envelope: %w", err)
+	}
+
+	query := `
+		INSERT INTO mailbox_envelopes
+		(id, owner_did, sender_did, sender_peer, payload, size, created_at, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (owner_did, id) DO NOTHING
+	`
+
+	result, err := db.db.Exec(query,
+		env.ID,
+		env.Owner,
+		env.Sender,
+		env.SenderPeer,
+		payload,
+		len(env.Payload),
+		env.CreatedAt,
+		env.ExpiresAt,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to store envelope: %w", err)
+	}
+
+	stored, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to check stored envelope: %w", err)
+	}
+	if stored == 0 {
+		return message.ErrEnvelopeExists
+	}
+
+	db.incrementTransactionCount()
+	return nil
+}
+
+// LoadEnvelopes loads up to limit unexpired envelopes for an owner, oldest first
+func (db *SQLiteDB) LoadEnvelopes(owner string, limit int) ([]*message.Envelope, error) {
+	if limit <= 0 {
+		limit = -1 // No limit
+	}
+
+	query := `
+		SELECT id, owner_did, sender_did, sender_peer, payload, created_at, expires_at
+		FROM mailbox_envelopes
+		WHERE owner_did = ? AND expires_at > ?
+		ORDER BY created_at ASC
+		LIMIT ?
+	`
+
+	rows, err := db.db.Query(query, owner, time.Now(), limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query envelopes: %w", err)
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			db.logger.WithError(err).Error("Failed to close rows")
+		}
+	}()
+
+	var envelopes []*message.Envelope
+
+	for rows.Next() {
+		var env message.Envelope
+		var senderDID, senderPeer sql.NullString
+		var payload []byte
+
+		err := rows.Scan(
+			&env.ID,
+			&env.Owner,
+			&senderDID,
+			&senderPeer,
+			&payload,
+			&env.CreatedAt,
+			&env.ExpiresAt,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan envelope: %w", err)
+		}
+
+		env.Payload, err = db.decrypt(payload)
+		if err != nil {
+			db.logger.WithError(err).WithField("envelope_id", env.ID).Warn("Failed to decrypt envelope, skipping")
+			continue
+		}
+
+		env.Sender = senderDID.String
+		env.SenderPeer = senderPeer.String
+		envelopes = append(envelopes, &env)
+	}
+
+	return envelopes, rows.Err()
+}
+
+// DeleteEnvelopes removes envelopes of an owner by ID
+func (db *SQLiteDB) DeleteEnvelopes(owner string, ids []string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(ids)), ",")
+	query := fmt.Sprintf(`DELETE FROM mailbox_envelopes WHERE owner_did = ? AND id IN (%s)`, placeholders)
+
+	args := make([]interface{}, 0, len(ids)+1)
+	args = append(args, owner)
+	for _, id := range ids {
+		args = append(args, id)
+	}
+
+	if _, err := db.db.Exec(query, args...); err != nil {
+		return fmt.Errorf("failed to delete envelopes: %w", err)
+	}
+
+	db.incrementTransactionCount()
+	return nil
+}
+
+// MailboxUsage returns the number of envelopes and payload bytes stored for an owner
+func (db *SQLiteDB) MailboxUsage(owner string) (int, int64, error) {
+	var count int
+	var size int64
+
+	err := db.db.QueryRow(`SELECT COUNT(*), COALESCE(SUM(size), 0) FROM mailbox_envelopes WHERE owner_did = ?`,
+		owner).Scan(&count, &size)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to query mailbox usage: %w", err)
+	}
+
+	return count, size, nil
+}
+
+// PurgeExpiredEnvelopes removes expired envelopes
+func (db *SQLiteDB) PurgeExpiredEnvelopes(now time.Time) (int, error) {
+	result, err := db.db.Exec(`DELETE FROM mailbox_envelopes WHERE expires_at <= ?`, now)
+	if err != nil {
+		return 0, fmt.Errorf("failed to purge envelopes: %w", err)
+	}
+
+	removed, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("failed to count purged envelopes: %w", err)
+	}
+
+	if removed > 0 {
+		db.incrementTransactionCount()
+	}
+	return int(removed), nil
+}
+
+// SaveMailboxAnnouncement saves or replaces the mailboxes a peer announced, encrypted at rest
+func (db *SQLiteDB) SaveMailboxAnnouncement(peerID string, announcement *message.MailboxAnnouncement) error {
+	data, err := json.Marshal(announcement)
+	if err != nil {
+		return fmt.Errorf("failed to serialize mailbox announcement: %w", err)
+	}
+
+	encrypted, err := db.encrypt(data)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt mailbox announcement: %w", err)
+	}
+
+	query := `
+		INSERT INTO mailbox_directory (peer_id, announcement, updated_at)
+		VALUES (?, ?, ?)
+		ON CONFLICT(peer_id) DO UPDATE SET
+			announcement = excluded.announcement,
+			updated_at = excluded.updated_at
+	`
+
+	if _, err := db.db.Exec(query, peerID, encrypted, time.Now()); err != nil {
+		return fmt.Errorf("failed to save mailbox announcement: %w", err)
+	}
+
+	db.incrementTransactionCount()
+	return nil
+}
+
+// LoadMailboxAnnouncements loads the saved announcements by peer ID
+func (db *SQLiteDB) LoadMailboxAnnouncements() (map[string]*message.MailboxAnnouncement, error) {
+	rows, err := db.db.Query(`SELECT peer_id, announcement FROM mailbox_directory`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query mailbox announcements: %w", err)
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			db.logger.WithError(err).Error("Failed to close rows")
+		}
+	}()
+
+	announcements := make(map[string]*message.MailboxAnnouncement)
+
+	for rows.Next() {
+		var peerID string
+		var encrypted []byte
+		if err := rows.Scan(&peerID, &encrypted); err != nil {
+			return nil, fmt.Errorf("failed to scan mailbox announcement: %w", err)
+		}
+
+		data, err := db.decrypt(encrypted)
+		if err != nil {
+			db.logger.WithError(err).WithField("peer_id", peerID).Warn("Failed to decrypt mailbox announcement, skipping")
+			continue
+		}
+
+		var announcement message.MailboxAnnouncement
+		if err := json.Unmarshal(data, &announcement); err != nil {
+			db.logger.WithError(err).WithField("peer_id", peerID).Warn("Failed to parse mailbox announcement, skipping")
+			continue
+		}
+		announcements[peerID] = &announcement
+	}
+
+	return announcements, rows.Err()
+}
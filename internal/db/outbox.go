@@ -0,0 +1,157 @@
+package db
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/Xelvra/peerchat/internal/message"
+)
+
+// SaveOutboxEntry inserts or updates an outbox entry with an encrypted payload
+func (db *SQLiteDB) SaveOutboxEntry(entry *message.OutboxEntry) error {
+	msgData, err := json.Marshal(entry.Message)
+	if err != nil {
+		return fmt.Errorf("failed to serialize outbox message: %w", err)
+	}
+
+	payload, err := db.encrypt(msgData)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt outbox message: %w", err)
+	}
+
+	query := `
+		INSERT INTO outbox
+		(message_id, peer_id, payload, state, attempts, next_attempt, last_error, created_at, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(message_id) DO UPDATE SET
+			state = excluded.state,
+			attempts = excluded.attempts,
+			next_attempt = excluded.next_attempt,
+			last_error = excluded.last_error
+	`
+
+	_, err = db.db.Exec(query,
+		entry.Message.ID,
+		entry.PeerID,
+		payload,
+		int(entry.State),
+		entry.Attempts,
+		entry.NextAttempt,
+		entry.LastError,
+		entry.CreatedAt,
+		entry.ExpiresAt,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to save outbox entry: %w", err)
+	}
+
+	db.incrementTransactionCount()
+	return nil
+}
+
+// LoadOutbox loads undelivered outbox entries for a peer, or for all peers if peerID is empty
+func (db *SQLiteDB) LoadOutbox(peerID string) ([]*message.OutboxEntry, error) {
+	query := `
+		SELECT message_id, peer_id, payload, state, attempts, next_attempt,
+		       last_error, created_at, expires_at
+		FROM outbox
+		WHERE state IN (?, ?) AND (? = '' OR peer_id = ?)
+		ORDER BY created_at ASC
+	`
+
+	rows, err := db.db.Query(query,
+		int(message.OutboxPending), int(message.OutboxSending), peerID, peerID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query outbox: %w", err)
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			db.logger.WithError(err).Error("Failed to close rows")
+		}
+	}()
+
+	var entries []*message.OutboxEntry
+
+	for rows.Next() {
+		var entry message.OutboxEntry
+		var messageID string
+		var payload []byte
+		var state int
+		var lastError sql.NullString
+
+		err := rows.Scan(
+			&messageID,
+			&entry.PeerID,
+			&payload,
+			&state,
+			&entry.Attempts,
+			&entry.NextAttempt,
+			&lastError,
+			&entry.CreatedAt,
+			&entry.ExpiresAt,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan outbox entry: %w", err)
+		}
+
+		msgData, err := db.decrypt(payload)
+		if err != nil {
+			db.logger.WithError(err).WithField("message_id", messageID).Warn("Failed to decrypt outbox message, skipping")
+			continue
+		}
+
+		var msg message.Message
+		if err := json.Unmarshal(msgData, &msg); err != nil {
+			db.logger.WithError(err).WithField("message_id", messageID).Warn("Failed to parse outbox message, skipping")
+			continue
+		}
+
+		entry.Message = &msg
+		entry.State = message.OutboxState(state)
+		entry.LastError = lastError.String
+		entries = append(entries, &entry)
+	}
+
+	return entries, rows.Err()
+}
+
+// DeleteOutboxEntry removes an outbox entry
+func (db *SQLiteDB) DeleteOutboxEntry(messageID string) error {
+	if _, err := db.db.Exec(`DELETE FROM outbox WHERE message_id = ?`, messageID); err != nil {
+		return fmt.Errorf("failed to delete outbox entry: %w", err)
+	}
+
+	db.incrementTransactionCount()
+	return nil
+}
+
+// PurgeOutbox removes delivered and expired outbox entries
+func (db *SQLiteDB) PurgeOutbox(now time.Time) (int, error) {
+	result, err := db.db.Exec(`DELETE FROM outbox WHERE state IN (?, ?) OR expires_at < ?`,
+		int(message.OutboxDelivered), int(message.OutboxExpired), now)
+	if err != nil {
+		return 0, fmt.Errorf("failed to purge outbox: %w", err)
+	}
+
+	removed, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("failed to count purged outbox entries: %w", err)
+	}
+
+	if removed > 0 {
+		db.incrementTransactionCount()
+	}
+	return int(removed), nil
+}
+
+// ResetSendingOutbox returns entries interrupted mid-delivery to the pending state
+func (db *SQLiteDB) ResetSendingOutbox() error {
+	_, err := db.db.Exec(`UPDATE outbox SET state = ? WHERE state = ?`,
+		int(message.OutboxPending), int(message.OutboxSending))
+	if err != nil {
+		return fmt.Errorf("failed to reset outbox entries: %w", err)
+	}
+	return nil
+}
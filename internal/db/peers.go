@@ -0,0 +1,173 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	multiaddr "github.com/multiformats/go-multiaddr"
+)
+
+// KnownPeer is an address book entry for a peer this node has been connected to
+type KnownPeer struct {
+	ID        peer.ID
+	Addrs     []KnownAddr
+	LastSeen  time.Time     // Last time the peer was connected
+	Transport string        // Transport of the last successful connection: tcp, quic, relay, ...
+	Latency   time.Duration // Round-trip time, zero if unknown
+}
+
+// KnownAddr is an address of a known peer and when it last worked or was announced
+type KnownAddr struct {
+	Addr      multiaddr.Multiaddr
+	LastSeen  time.Time
+	Announced bool // Not connected through; a stored address keeps its time
+}
+
+// SaveKnownPeer inserts or updates an address book entry. Addresses are added
+// to those already stored; an address keeps the latest time it was seen, and
+// announced addresses only set it when they are new. Times are stored in UTC
+// so they compare in order.
+func (db *SQLiteDB) SaveKnownPeer(known *KnownPeer) error {
+	tx, err := db.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	_, err = tx.Exec(`
+		INSERT INTO known_peers (peer_id, last_seen, transport, latency_ms)
+		VALUES (?, ?, ?, ?)
+		ON CONFLICT(peer_id) DO UPDATE SET
+			last_seen = MAX(last_seen, excluded.last_seen),
+			transport = COALESCE(NULLIF(excluded.transport, ''), transport),
+			latency_ms = CASE WHEN excluded.latency_ms > 0 THEN excluded.latency_ms ELSE latency_ms END
+	`, known.ID.String(), known.LastSeen.UTC(), known.Transport, known.Latency.Milliseconds())
+	if err != nil {
+		return fmt.Errorf("failed to save known peer: %w", err)
+	}
+
+	for _, addr := range known.Addrs {
+		query := `
+			INSERT INTO known_peer_addrs (peer_id, addr, last_seen)
+			VALUES (?, ?, ?)
+			ON CONFLICT(peer_id, addr) DO UPDATE SET
+				last_seen = MAX(last_seen, excluded.last_seen)
+		`
+		if addr.Announced {
+			query = `
+				INSERT INTO known_peer_addrs (peer_id, addr, last_seen)
+				VALUES (?, ?, ?)
+				ON CONFLICT(peer_id, addr) DO NOTHING
+			`
+		}
+		_, err := tx.Exec(query, known.ID.String(), addr.Addr.String(), addr.LastSeen.UTC())
+		if err != nil {
+			return fmt.Errorf("failed to save known peer address: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit known peer: %w", err)
+	}
+
+	db.incrementTransactionCount()
+	return nil
+}
+
+// LoadKnownPeers loads the address book, most recently seen peers first
+func (db *SQLiteDB) LoadKnownPeers() ([]*KnownPeer, error) {
+	query := `
+		SELECT p.peer_id, p.last_seen, p.transport, p.latency_ms, a.addr, a.last_seen
+		FROM known_peers p
+		LEFT JOIN known_peer_addrs a ON a.peer_id = p.peer_id
+		ORDER BY p.last_seen DESC, p.peer_id, a.last_seen DESC
+	`
+
+	rows, err := db.db.Query(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query known peers: %w", err)
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			db.logger.WithError(err).Error("Failed to close rows")
+		}
+	}()
+
+	var peers []*KnownPeer
+	var current *KnownPeer
+	for rows.Next() {
+		var peerIDStr string
+		var lastSeen time.Time
+		var transport, addrStr sql.NullString
+		var latencyMs int64
+		var addrSeen *time.Time
+
+		if err := rows.Scan(&peerIDStr, &lastSeen, &transport, &latencyMs, &addrStr, &addrSeen); err != nil {
+			return nil, fmt.Errorf("failed to scan known peer: %w", err)
+		}
+
+		if current == nil || current.ID.String() != peerIDStr {
+			peerID, err := peer.Decode(peerIDStr)
+			if err != nil {
+				db.logger.WithError(err).WithField("peer_id", peerIDStr).Warn("Invalid peer ID in address book, skipping")
+				current = nil
+				continue
+			}
+			current = &KnownPeer{
+				ID:        peerID,
+				LastSeen:  lastSeen,
+				Transport: transport.String,
+				Latency:   time.Duration(latencyMs) * time.Millisecond,
+			}
+			peers = append(peers, current)
+		}
+
+		if !addrStr.Valid || addrSeen == nil {
+			continue
+		}
+		addr, err := multiaddr.NewMultiaddr(addrStr.String)
+		if err != nil {
+			continue
+		}
+		current.Addrs = append(current.Addrs, KnownAddr{Addr: addr, LastSeen: *addrSeen})
+	}
+
+	return peers, rows.Err()
+}
+
+// PruneKnownPeers deletes addresses not seen since addrsBefore and peers not
+// seen since peersBefore, returning how many peers were removed
+func (db *SQLiteDB) PruneKnownPeers(addrsBefore, peersBefore time.Time) (int, error) {
+	tx, err := db.db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	if _, err := tx.Exec(`DELETE FROM known_peer_addrs WHERE last_seen < ?`, addrsBefore.UTC()); err != nil {
+		return 0, fmt.Errorf("failed to prune known peer addresses: %w", err)
+	}
+	if _, err := tx.Exec(`
+		DELETE FROM known_peer_addrs
+		WHERE peer_id IN (SELECT peer_id FROM known_peers WHERE last_seen < ?)
+	`, peersBefore.UTC()); err != nil {
+		return 0, fmt.Errorf("failed to prune known peer addresses: %w", err)
+	}
+	result, err := tx.Exec(`DELETE FROM known_peers WHERE last_seen < ?`, peersBefore.UTC())
+	if err != nil {
+		return 0, fmt.Errorf("failed to prune known peers: %w", err)
+	}
+	removed, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("failed to count pruned peers: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit pruning: %w", err)
+	}
+
+	db.incrementTransactionCount()
+	return int(removed), nil
+}
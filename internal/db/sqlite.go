@@ -6,6 +6,7 @@ import (
 	"crypto/rand"
 	"crypto/sha256"
 	"database/sql"
+	"encoding/json"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -14,6 +15,7 @@ import (
 
 	"github.com/Xelvra/peerchat/internal/message"
 	"github.com/Xelvra/peerchat/internal/user"
+	"github.com/libp2p/go-libp2p/core/peer"
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/sirupsen/logrus"
 	"golang.org/x/crypto/pbkdf2"
@@ -243,6 +245,10 @@ func (db *SQLiteDB) initSchema() error {
 		content BLOB,
 		metadata TEXT, -- JSON
 		timestamp DATETIME NOT NULL,
+		reply_to TEXT, -- ID of the message being replied to
+		thread_id TEXT, -- ID of the thread root message
+		lamport INTEGER DEFAULT 0, -- Per-conversation logical clock
+		conversation TEXT, -- Key of the conversation the clock belongs to
 		signature BLOB,
 		is_encrypted BOOLEAN DEFAULT FALSE,
 		is_read BOOLEAN DEFAULT FALSE,
@@ -323,6 +329,55 @@ func (db *SQLiteDB) initSchema() error {
 		completed_at DATETIME
 	);
 	
+	-- Outbox table for durable offline message delivery
+	CREATE TABLE IF NOT EXISTS outbox (
+		message_id TEXT PRIMARY KEY,
+		peer_id TEXT NOT NULL,
+		payload BLOB NOT NULL, -- Encrypted message JSON
+		state INTEGER NOT NULL DEFAULT 0, -- OutboxState
+		attempts INTEGER NOT NULL DEFAULT 0,
+		next_attempt DATETIME NOT NULL,
+		last_error TEXT,
+		created_at DATETIME NOT NULL,
+		expires_at DATETIME NOT NULL
+	);
+
+	-- Envelopes held for other users when acting as their mailbox
+	CREATE TABLE IF NOT EXISTS mailbox_envelopes (
+		id TEXT NOT NULL, -- Chosen by the sender, unique per owner only
+		owner_did TEXT NOT NULL,
+		sender_did TEXT,
+		sender_peer TEXT,
+		payload BLOB NOT NULL, -- Encrypted at rest
+		size INTEGER NOT NULL,
+		created_at DATETIME NOT NULL,
+		expires_at DATETIME NOT NULL,
+		PRIMARY KEY (owner_did, id)
+	);
+
+	-- Mailboxes other peers announced for leaving them messages while they are offline
+	CREATE TABLE IF NOT EXISTS mailbox_directory (
+		peer_id TEXT PRIMARY KEY,
+		announcement BLOB NOT NULL, -- Encrypted announcement JSON
+		updated_at DATETIME NOT NULL
+	);
+
+	-- Address book of peers this node has been connected to
+	CREATE TABLE IF NOT EXISTS known_peers (
+		peer_id TEXT PRIMARY KEY,
+		last_seen DATETIME NOT NULL,
+		transport TEXT, -- tcp, quic, relay, ...
+		latency_ms INTEGER DEFAULT 0
+	);
+
+	CREATE TABLE IF NOT EXISTS known_peer_addrs (
+		peer_id TEXT NOT NULL,
+		addr TEXT NOT NULL,
+		last_seen DATETIME NOT NULL,
+		PRIMARY KEY (peer_id, addr),
+		FOREIGN KEY (peer_id) REFERENCES known_peers(peer_id)
+	);
+
 	-- Create indexes for better performance
 	CREATE INDEX IF NOT EXISTS idx_messages_from_did ON messages(from_did);
 	CREATE INDEX IF NOT EXISTS idx_messages_to_did ON messages(to_did);
@@ -333,6 +388,11 @@ func (db *SQLiteDB) initSchema() error {
 	CREATE INDEX IF NOT EXISTS idx_files_message_id ON files(message_id);
 	CREATE INDEX IF NOT EXISTS idx_file_transfers_peer_id ON file_transfers(peer_id);
 	CREATE INDEX IF NOT EXISTS idx_file_transfers_status ON file_transfers(status);
+	CREATE INDEX IF NOT EXISTS idx_outbox_peer_id ON outbox(peer_id, created_at);
+	CREATE INDEX IF NOT EXISTS idx_mailbox_envelopes_owner ON mailbox_envelopes(owner_did, created_at);
+	CREATE INDEX IF NOT EXISTS idx_mailbox_envelopes_expires_at ON mailbox_envelopes(expires_at);
+	CREATE INDEX IF NOT EXISTS idx_outbox_next_attempt ON outbox(next_attempt);
+	CREATE INDEX IF NOT EXISTS idx_known_peer_addrs_last_seen ON known_peer_addrs(last_seen);
 	
 	-- Create triggers for updating timestamps
 	CREATE TRIGGER IF NOT EXISTS update_users_timestamp 
@@ -353,10 +413,94 @@ func (db *SQLiteDB) initSchema() error {
 		return fmt.Errorf("failed to create schema: %w", err)
 	}
 
+	if err := db.migrateSchema(); err != nil {
+		return fmt.Errorf("failed to migrate schema: %w", err)
+	}
+
 	db.logger.Info("Database schema initialized successfully")
 	return nil
 }
 
+// migrateSchema adds columns introduced after the initial schema to existing databases
+func (db *SQLiteDB) migrateSchema() error {
+	migrations := []struct {
+		table  string
+		column string
+		ddl    string
+	}{
+		{"messages", "reply_to", "ALTER TABLE messages ADD COLUMN reply_to TEXT"},
+		{"messages", "thread_id", "ALTER TABLE messages ADD COLUMN thread_id TEXT"},
+		{"messages", "lamport", "ALTER TABLE messages ADD COLUMN lamport INTEGER DEFAULT 0"},
+		{"messages", "conversation", "ALTER TABLE messages ADD COLUMN conversation TEXT"},
+		{"file_transfers", "metadata", "ALTER TABLE file_transfers ADD COLUMN metadata TEXT"},
+		{"file_transfers", "local_path", "ALTER TABLE file_transfers ADD COLUMN local_path TEXT"},
+		{"file_transfers", "chunk_bitmap", "ALTER TABLE file_transfers ADD COLUMN chunk_bitmap BLOB"},
+		{"file_transfers", "chunk_hashes", "ALTER TABLE file_transfers ADD COLUMN chunk_hashes BLOB"},
+		{"file_transfers", "updated_at", "ALTER TABLE file_transfers ADD COLUMN updated_at DATETIME"},
+		{"files", "media_type", "ALTER TABLE files ADD COLUMN media_type INTEGER"},
+		{"files", "width", "ALTER TABLE files ADD COLUMN width INTEGER"},
+		{"files", "height", "ALTER TABLE files ADD COLUMN height INTEGER"},
+		{"files", "duration_ms", "ALTER TABLE files ADD COLUMN duration_ms INTEGER"},
+		{"files", "thumbnail", "ALTER TABLE files ADD COLUMN thumbnail BLOB"},
+	}
+
+	for _, m := range migrations {
+		exists, err := db.columnExists(m.table, m.column)
+		if err != nil {
+			return err
+		}
+		if exists {
+			continue
+		}
+		if _, err := db.db.Exec(m.ddl); err != nil {
+			return fmt.Errorf("failed to add column %s.%s: %w", m.table, m.column, err)
+		}
+		db.logger.WithFields(logrus.Fields{
+			"table":  m.table,
+			"column": m.column,
+		}).Info("Database schema migrated")
+	}
+
+	// Indexes on migrated columns must be created after the columns exist
+	indexes := `
+	CREATE INDEX IF NOT EXISTS idx_messages_thread_id ON messages(thread_id);
+	CREATE INDEX IF NOT EXISTS idx_messages_lamport ON messages(lamport);
+	CREATE INDEX IF NOT EXISTS idx_messages_conversation ON messages(conversation, lamport);
+	`
+	if _, err := db.db.Exec(indexes); err != nil {
+		return fmt.Errorf("failed to create indexes: %w", err)
+	}
+
+	return nil
+}
+
+// columnExists checks whether a table already has the given column
+func (db *SQLiteDB) columnExists(table, column string) (bool, error) {
+	rows, err := db.db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return false, fmt.Errorf("failed to read table info for %s: %w", table, err)
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			db.logger.WithError(err).Error("Failed to close rows")
+		}
+	}()
+
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, colType string
+		var defaultValue sql.NullString
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &defaultValue, &pk); err != nil {
+			return false, fmt.Errorf("failed to scan table info: %w", err)
+		}
+		if name == column {
+			return true, nil
+		}
+	}
+
+	return false, rows.Err()
+}
+
 // SaveUser saves or updates a user profile
 func (db *SQLiteDB) SaveUser(profile *user.UserProfile) error {
 	query := `
@@ -424,12 +568,14 @@ func (db *SQLiteDB) LoadUser(did string) (*user.UserProfile, error) {
 	return &profile, nil
 }
 
-// SaveMessage saves a message to the database with encryption
+// SaveMessage saves a message to the database with encryption. A message
+// already stored, such as one delivered twice, is left unchanged.
 func (db *SQLiteDB) SaveMessage(msg *message.Message) error {
 	query := `
-		INSERT INTO messages
-		(id, type, from_did, to_did, group_id, content, metadata, timestamp, signature, is_encrypted)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		INSERT OR IGNORE INTO messages
+		(id, type, from_did, to_did, group_id, content, metadata, timestamp,
+		 reply_to, thread_id, lamport, conversation, signature, is_encrypted)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
 	`
 
 	// Encrypt sensitive content
@@ -457,6 +603,10 @@ func (db *SQLiteDB) SaveMessage(msg *message.Message) error {
 		encryptedContent,
 		metadataJSON,
 		msg.Timestamp,
+		msg.ReplyTo,
+		msg.ThreadID,
+		int64(msg.Lamport),
+		msg.Conversation(),
 		msg.Signature,
 		msg.IsEncrypted,
 	)
@@ -473,14 +623,43 @@ func (db *SQLiteDB) SaveMessage(msg *message.Message) error {
 func (db *SQLiteDB) LoadMessages(fromDID, toDID string, limit int) ([]*message.Message, error) {
 	query := `
 		SELECT id, type, from_did, to_did, group_id, content, metadata,
-		       timestamp, signature, is_encrypted
+		       timestamp, reply_to, thread_id, lamport, signature, is_encrypted
 		FROM messages
 		WHERE (from_did = ? AND to_did = ?) OR (from_did = ? AND to_did = ?)
-		ORDER BY timestamp DESC
+		ORDER BY lamport DESC, timestamp DESC, id DESC
 		LIMIT ?
 	`
 
-	rows, err := db.db.Query(query, fromDID, toDID, toDID, fromDID, limit)
+	return db.queryMessages(query, fromDID, toDID, toDID, fromDID, limit)
+}
+
+// MaxLamport returns the highest Lamport timestamp stored for a conversation,
+// or zero if it has no messages
+func (db *SQLiteDB) MaxLamport(conversation string) (uint64, error) {
+	var lamport int64
+	err := db.db.QueryRow(`SELECT COALESCE(MAX(lamport), 0) FROM messages WHERE conversation = ?`, conversation).Scan(&lamport)
+	if err != nil {
+		return 0, fmt.Errorf("failed to load conversation clock: %w", err)
+	}
+	return uint64(lamport), nil
+}
+
+// LoadThread loads all messages of a reply thread in causal order
+func (db *SQLiteDB) LoadThread(threadID string) ([]*message.Message, error) {
+	query := `
+		SELECT id, type, from_did, to_did, group_id, content, metadata,
+		       timestamp, reply_to, thread_id, lamport, signature, is_encrypted
+		FROM messages
+		WHERE id = ? OR thread_id = ?
+		ORDER BY lamport ASC, timestamp ASC, id ASC
+	`
+
+	return db.queryMessages(query, threadID, threadID)
+}
+
+// queryMessages runs a message query and decrypts the resulting rows
+func (db *SQLiteDB) queryMessages(query string, args ...interface{}) ([]*message.Message, error) {
+	rows, err := db.db.Query(query, args...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to query messages: %w", err)
 	}
@@ -497,6 +676,8 @@ func (db *SQLiteDB) LoadMessages(fromDID, toDID string, limit int) ([]*message.M
 		var msgType int
 		var metadataJSON string
 		var encryptedContent []byte
+		var replyTo, threadID sql.NullString
+		var lamport sql.NullInt64
 
 		err := rows.Scan(
 			&msg.ID,
@@ -507,6 +688,9 @@ func (db *SQLiteDB) LoadMessages(fromDID, toDID string, limit int) ([]*message.M
 			&encryptedContent,
 			&metadataJSON,
 			&msg.Timestamp,
+			&replyTo,
+			&threadID,
+			&lamport,
 			&msg.Signature,
 			&msg.IsEncrypted,
 		)
@@ -528,12 +712,15 @@ func (db *SQLiteDB) LoadMessages(fromDID, toDID string, limit int) ([]*message.M
 		}
 
 		msg.Type = message.MessageType(msgType)
+		msg.ReplyTo = replyTo.String
+		msg.ThreadID = threadID.String
+		msg.Lamport = uint64(lamport.Int64)
 		// TODO: Deserialize metadata from JSON
 
 		messages = append(messages, &msg)
 	}
 
-	return messages, nil
+	return messages, rows.Err()
 }
 
 // SaveSetting saves an encrypted setting to the database
@@ -574,12 +761,22 @@ func (db *SQLiteDB) LoadSetting(key string) ([]byte, error) {
 	return value, nil
 }
 
-// SaveFileTransfer saves file transfer information
+// SaveFileTransfer saves file transfer information, including the state needed to resume it
 func (db *SQLiteDB) SaveFileTransfer(transfer *message.FileTransfer) error {
 	query := `
-		INSERT OR REPLACE INTO file_transfers
-		(transfer_id, peer_id, file_name, file_size, file_hash, status, direction, progress, completed_at)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+		INSERT INTO file_transfers
+		(transfer_id, peer_id, file_name, file_size, file_hash, status, direction, progress, completed_at,
+		 metadata, local_path, chunk_bitmap, chunk_hashes, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(transfer_id) DO UPDATE SET
+			status = excluded.status,
+			progress = excluded.progress,
+			completed_at = excluded.completed_at,
+			metadata = excluded.metadata,
+			local_path = excluded.local_path,
+			chunk_bitmap = excluded.chunk_bitmap,
+			chunk_hashes = excluded.chunk_hashes,
+			updated_at = excluded.updated_at
 	`
 
 	var completedAt *time.Time
@@ -592,7 +789,17 @@ func (db *SQLiteDB) SaveFileTransfer(transfer *message.FileTransfer) error {
 		direction = 1 // incoming
 	}
 
-	_, err := db.db.Exec(query,
+	metadata, err := json.Marshal(transfer.Metadata)
+	if err != nil {
+		return fmt.Errorf("failed to marshal file metadata: %w", err)
+	}
+
+	var bitmap []byte
+	if transfer.Chunks != nil {
+		bitmap = transfer.Chunks.Bytes()
+	}
+
+	_, err = db.db.Exec(query,
 		transfer.ID,
 		transfer.PeerID.String(),
 		transfer.Metadata.Name,
@@ -602,16 +809,194 @@ func (db *SQLiteDB) SaveFileTransfer(transfer *message.FileTransfer) error {
 		direction,
 		transfer.Progress,
 		completedAt,
+		string(metadata),
+		transfer.LocalPath,
+		bitmap,
+		transfer.ChunkHashes,
+		time.Now(),
 	)
 
 	if err != nil {
 		return fmt.Errorf("failed to save file transfer: %w", err)
 	}
 
+	if err := db.saveFile(transfer); err != nil {
+		return err
+	}
+
 	db.incrementTransactionCount()
 	return nil
 }
 
+// saveFile records the transferred file and its media preview in the files table
+func (db *SQLiteDB) saveFile(transfer *message.FileTransfer) error {
+	if transfer.Metadata.ID == "" {
+		return nil
+	}
+
+	query := `
+		INSERT INTO files
+		(id, filename, file_size, file_hash, mime_type, local_path, upload_progress, download_progress,
+		 status, media_type, width, height, duration_ms, thumbnail)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(id) DO UPDATE SET
+			local_path = excluded.local_path,
+			upload_progress = MAX(upload_progress, excluded.upload_progress),
+			download_progress = MAX(download_progress, excluded.download_progress),
+			status = excluded.status,
+			media_type = COALESCE(excluded.media_type, media_type),
+			width = COALESCE(excluded.width, width),
+			height = COALESCE(excluded.height, height),
+			duration_ms = COALESCE(excluded.duration_ms, duration_ms),
+			thumbnail = COALESCE(excluded.thumbnail, thumbnail)
+	`
+
+	var uploadProgress, downloadProgress float64
+	if transfer.IsOutgoing() {
+		uploadProgress = transfer.Progress
+	} else {
+		downloadProgress = transfer.Progress
+	}
+
+	var status string
+	switch transfer.Status {
+	case message.FileTransferPending:
+		status = "pending"
+	case message.FileTransferActive:
+		status = "transferring"
+	case message.FileTransferCompleted:
+		status = "completed"
+	default:
+		status = "failed"
+	}
+
+	var mediaType, width, height, durationMs interface{}
+	var thumbnail []byte
+	if preview := transfer.Metadata.Preview; preview != nil {
+		mediaType = int(preview.Kind)
+		width = preview.Width
+		height = preview.Height
+		durationMs = preview.Duration.Milliseconds()
+		thumbnail = preview.Thumbnail
+	}
+
+	_, err := db.db.Exec(query,
+		transfer.Metadata.ID,
+		transfer.Metadata.Name,
+		transfer.Metadata.Size,
+		transfer.Metadata.Hash,
+		transfer.Metadata.MimeType,
+		transfer.LocalPath,
+		uploadProgress,
+		downloadProgress,
+		status,
+		mediaType,
+		width,
+		height,
+		durationMs,
+		thumbnail,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to save file: %w", err)
+	}
+	return nil
+}
+
+// LoadFilePreview loads the media preview stored for a file, or nil if it has none
+func (db *SQLiteDB) LoadFilePreview(fileID string) (*message.FilePreview, error) {
+	query := `
+		SELECT media_type, width, height, duration_ms, thumbnail
+		FROM files
+		WHERE id = ?
+	`
+
+	var mediaType, width, height, durationMs sql.NullInt64
+	var thumbnail []byte
+	err := db.db.QueryRow(query, fileID).Scan(&mediaType, &width, &height, &durationMs, &thumbnail)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("file not found: %s", fileID)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load file preview: %w", err)
+	}
+	if !mediaType.Valid {
+		return nil, nil
+	}
+
+	return &message.FilePreview{
+		Kind:      message.MessageType(mediaType.Int64),
+		Width:     int(width.Int64),
+		Height:    int(height.Int64),
+		Duration:  time.Duration(durationMs.Int64) * time.Millisecond,
+		Thumbnail: thumbnail,
+	}, nil
+}
+
+// LoadResumableTransfers loads pending and active transfers with their chunk bitmaps
+func (db *SQLiteDB) LoadResumableTransfers() ([]*message.FileTransfer, error) {
+	query := `
+		SELECT transfer_id, peer_id, status, direction, metadata, local_path, chunk_bitmap, chunk_hashes, created_at
+		FROM file_transfers
+		WHERE status IN (?, ?) AND metadata IS NOT NULL
+		ORDER BY created_at ASC
+	`
+
+	rows, err := db.db.Query(query, int(message.FileTransferPending), int(message.FileTransferActive))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query file transfers: %w", err)
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			db.logger.WithError(err).Error("Failed to close rows")
+		}
+	}()
+
+	var transfers []*message.FileTransfer
+
+	for rows.Next() {
+		var transferID, peerIDStr, metadataJSON string
+		var status, direction int
+		var localPath sql.NullString
+		var bitmap, chunkHashes []byte
+		var createdAt time.Time
+
+		if err := rows.Scan(&transferID, &peerIDStr, &status, &direction, &metadataJSON, &localPath, &bitmap, &chunkHashes, &createdAt); err != nil {
+			return nil, fmt.Errorf("failed to scan file transfer: %w", err)
+		}
+
+		logger := db.logger.WithField("transfer_id", transferID)
+
+		peerID, err := peer.Decode(peerIDStr)
+		if err != nil {
+			logger.WithError(err).Warn("Invalid peer ID in file transfer, skipping")
+			continue
+		}
+
+		var metadata message.FileMetadata
+		if err := json.Unmarshal([]byte(metadataJSON), &metadata); err != nil {
+			logger.WithError(err).Warn("Invalid file transfer metadata, skipping")
+			continue
+		}
+
+		chunks, err := message.ChunkBitmapFromBytes(metadata.ChunkCount, bitmap)
+		if err != nil {
+			logger.WithError(err).Warn("Invalid chunk bitmap, skipping")
+			continue
+		}
+
+		transfer := message.NewFileTransfer(transferID, peerID, metadata, direction == 0, db.logger)
+		transfer.Status = message.FileTransferStatus(status)
+		transfer.StartTime = createdAt
+		transfer.LocalPath = localPath.String
+		transfer.ChunkHashes = chunkHashes
+		transfer.RestoreChunks(chunks)
+
+		transfers = append(transfers, transfer)
+	}
+
+	return transfers, rows.Err()
+}
+
 // LoadFileTransfers loads file transfer history for a peer
 func (db *SQLiteDB) LoadFileTransfers(peerID string, limit int) ([]map[string]interface{}, error) {
 	query := `
@@ -671,6 +1056,9 @@ func (db *SQLiteDB) LoadFileTransfers(peerID string, limit int) ([]map[string]in
 
 // incrementTransactionCount increments the transaction counter and performs checkpoint if needed
 func (db *SQLiteDB) incrementTransactionCount() {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
 	db.transactionCount++
 
 	if db.transactionCount%CheckpointInterval == 0 {
@@ -0,0 +1,224 @@
+package message
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"golang.org/x/time/rate"
+)
+
+// UrgentFileSize is the largest file still sent while transfers are paused to
+// save energy, so small attachments do not wait for the charger
+const UrgentFileSize = 256 * 1024
+
+// ErrTransfersPaused is returned when a file transfer stops because the device
+// is saving energy. The transfer resumes with ResumeAll.
+var ErrTransfersPaused = errors.New("file transfers paused to save energy")
+
+// BandwidthLimits caps file transfer throughput in bytes per second. Zero
+// means unlimited. Chat messages are never throttled.
+type BandwidthLimits struct {
+	Upload       int64 // All outgoing file data
+	Download     int64 // All incoming file data
+	PeerUpload   int64 // Outgoing file data to each peer
+	PeerDownload int64 // Incoming file data from each peer
+}
+
+// transferScheduler throttles file chunks with token buckets, holds them back
+// while messages to the same peer are being sent, and pauses them in deep sleep
+type transferScheduler struct {
+	limits       BandwidthLimits
+	upload       *rate.Limiter
+	download     *rate.Limiter
+	peerUpload   map[peer.ID]*rate.Limiter
+	peerDownload map[peer.ID]*rate.Limiter
+
+	// Messages in flight per peer; idle is closed and replaced whenever a
+	// peer's count drops to zero
+	urgent map[peer.ID]int
+	idle   chan struct{}
+
+	paused func() bool // nil never pauses
+
+	mu sync.Mutex
+}
+
+// newTransferScheduler creates a scheduler without limits
+func newTransferScheduler() *transferScheduler {
+	s := &transferScheduler{
+		urgent: make(map[peer.ID]int),
+		idle:   make(chan struct{}),
+	}
+	s.setLimits(BandwidthLimits{})
+	return s
+}
+
+// newLimiter returns a token bucket for a rate in bytes per second, or nil
+// for no limit. The burst holds a whole frame so WaitN never rejects a chunk,
+// which grows beyond FileChunkSize when encrypted or sent uncompressed.
+func newLimiter(bytesPerSecond int64) *rate.Limiter {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+	burst := int(bytesPerSecond)
+	if burst < FileMaxFrameSize || int64(burst) != bytesPerSecond {
+		burst = FileMaxFrameSize
+	}
+	return rate.NewLimiter(rate.Limit(bytesPerSecond), burst)
+}
+
+// setLimits replaces the limits; per-peer buckets are recreated on demand
+func (s *transferScheduler) setLimits(limits BandwidthLimits) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.limits = limits
+	s.upload = newLimiter(limits.Upload)
+	s.download = newLimiter(limits.Download)
+	s.peerUpload = make(map[peer.ID]*rate.Limiter)
+	s.peerDownload = make(map[peer.ID]*rate.Limiter)
+}
+
+// isPaused reports whether non-urgent transfers should stop
+func (s *transferScheduler) isPaused() bool {
+	s.mu.Lock()
+	paused := s.paused
+	s.mu.Unlock()
+	return paused != nil && paused()
+}
+
+// beginUrgent marks a message to the peer as in flight. File chunks to the
+// peer wait until the returned function has been called.
+func (s *transferScheduler) beginUrgent(peerID peer.ID) func() {
+	s.mu.Lock()
+	s.urgent[peerID]++
+	s.mu.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+
+			if s.urgent[peerID]--; s.urgent[peerID] <= 0 {
+				delete(s.urgent, peerID)
+				close(s.idle)
+				s.idle = make(chan struct{})
+			}
+		})
+	}
+}
+
+// waitUpload blocks until n bytes of file data may be sent to the peer
+func (s *transferScheduler) waitUpload(ctx context.Context, peerID peer.ID, n int, urgent bool) error {
+	if !urgent && s.isPaused() {
+		return ErrTransfersPaused
+	}
+	if err := s.waitForMessages(ctx, peerID); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	global, perPeer := s.upload, s.peerLimiter(s.peerUpload, peerID, s.limits.PeerUpload)
+	s.mu.Unlock()
+	return waitLimiters(ctx, n, global, perPeer)
+}
+
+// waitDownload blocks until n more bytes of file data may be read from the peer
+func (s *transferScheduler) waitDownload(ctx context.Context, peerID peer.ID, n int) error {
+	s.mu.Lock()
+	global, perPeer := s.download, s.peerLimiter(s.peerDownload, peerID, s.limits.PeerDownload)
+	s.mu.Unlock()
+	return waitLimiters(ctx, n, global, perPeer)
+}
+
+// waitForMessages blocks while messages to the peer are being sent
+func (s *transferScheduler) waitForMessages(ctx context.Context, peerID peer.ID) error {
+	for {
+		s.mu.Lock()
+		busy, idle := s.urgent[peerID] > 0, s.idle
+		s.mu.Unlock()
+
+		if !busy {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-idle:
+		}
+	}
+}
+
+// peerLimiter returns the peer's bucket in limiters, creating it if needed.
+// The caller holds s.mu.
+func (s *transferScheduler) peerLimiter(limiters map[peer.ID]*rate.Limiter, peerID peer.ID, bytesPerSecond int64) *rate.Limiter {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+	limiter, exists := limiters[peerID]
+	if !exists {
+		limiter = newLimiter(bytesPerSecond)
+		limiters[peerID] = limiter
+	}
+	return limiter
+}
+
+// forgetPeer drops the peer's buckets once it disconnects
+func (s *transferScheduler) forgetPeer(peerID peer.ID) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.peerUpload, peerID)
+	delete(s.peerDownload, peerID)
+}
+
+// waitLimiters takes n tokens from every bucket that is set
+func waitLimiters(ctx context.Context, n int, limiters ...*rate.Limiter) error {
+	for _, limiter := range limiters {
+		if limiter == nil {
+			continue
+		}
+		if err := limiter.WaitN(ctx, n); err != nil {
+			return fmt.Errorf("failed to wait for bandwidth: %w", err)
+		}
+	}
+	return nil
+}
+
+// SetBandwidthLimits sets the upload and download rate limits for file transfers
+func (ftm *FileTransferManager) SetBandwidthLimits(limits BandwidthLimits) {
+	ftm.scheduler.setLimits(limits)
+}
+
+// SetPauseCheck sets the function deciding whether non-urgent transfers pause,
+// such as the energy manager's deep sleep mode. Call ResumeAll when it turns false.
+func (ftm *FileTransferManager) SetPauseCheck(paused func() bool) {
+	ftm.scheduler.mu.Lock()
+	defer ftm.scheduler.mu.Unlock()
+	ftm.scheduler.paused = paused
+}
+
+// PreemptTransfers holds back file chunks to the peer until the returned
+// function is called, so a message is not queued behind them
+func (ftm *FileTransferManager) PreemptTransfers(peerID peer.ID) func() {
+	return ftm.scheduler.beginUrgent(peerID)
+}
+
+// ResumeAll resumes paused or interrupted outgoing transfers to every connected peer
+func (ftm *FileTransferManager) ResumeAll() {
+	if ftm.host == nil {
+		return
+	}
+	for _, peerID := range ftm.host.Network().Peers() {
+		ftm.ResumePeer(peerID)
+	}
+}
+
+// urgentTransfer reports whether a transfer keeps going while transfers are paused
+func urgentTransfer(transfer *FileTransfer) bool {
+	return transfer.Metadata.Size <= UrgentFileSize
+}
@@ -0,0 +1,85 @@
+package message
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	// CompressionZstd is the only codec offered for file transfers and messages
+	CompressionZstd = "zstd"
+
+	// MessageCompressionThreshold is the smallest message worth compressing
+	MessageCompressionThreshold = 1024
+
+	// maxDecompressedSize bounds any decompressed chunk or message
+	maxDecompressedSize = MaxMessageSize
+)
+
+// Codecs are created on first use and shared; EncodeAll and DecodeAll are safe
+// for concurrent use
+var (
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+	zstdErr     error
+)
+
+// zstdCodecs returns the shared zstd encoder and decoder
+func zstdCodecs() (*zstd.Encoder, *zstd.Decoder, error) {
+	zstdOnce.Do(func() {
+		if zstdEncoder, zstdErr = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedFastest)); zstdErr != nil {
+			return
+		}
+		zstdDecoder, zstdErr = zstd.NewReader(nil, zstd.WithDecoderMaxMemory(maxDecompressedSize))
+	})
+	return zstdEncoder, zstdDecoder, zstdErr
+}
+
+// compressData compresses data with zstd. It returns false if compression
+// would not make the data smaller.
+func compressData(data []byte) ([]byte, bool) {
+	encoder, _, err := zstdCodecs()
+	if err != nil {
+		return nil, false
+	}
+	compressed := encoder.EncodeAll(data, nil)
+	if len(compressed) >= len(data) {
+		return nil, false
+	}
+	return compressed, true
+}
+
+// decompressData decompresses zstd data that may expand to at most limit bytes
+func decompressData(data []byte, limit int) ([]byte, error) {
+	_, decoder, err := zstdCodecs()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create zstd decoder: %w", err)
+	}
+	decompressed, err := decoder.DecodeAll(data, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress data: %w", err)
+	}
+	if len(decompressed) > limit {
+		return nil, fmt.Errorf("decompressed data exceeds %d bytes", limit)
+	}
+	return decompressed, nil
+}
+
+// compressibleMimeType reports whether files of a MIME type are worth
+// compressing; media and archives are already compressed
+func compressibleMimeType(mimeType string) bool {
+	for _, prefix := range []string{"image/", "video/", "audio/"} {
+		if strings.HasPrefix(mimeType, prefix) {
+			return false
+		}
+	}
+	switch mimeType {
+	case "application/zip", "application/gzip", "application/zstd", "application/x-7z-compressed", "application/pdf":
+		return false
+	}
+	return true
+}
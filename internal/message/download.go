@@ -0,0 +1,170 @@
+package message
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Download naming limits
+const (
+	MaxFileNameLength   = 255        // Bytes, the common file system limit
+	maxOfferedNameBytes = 4096       // Longer offered names are rejected outright
+	defaultFileName     = "download" // Used when nothing of the offered name survives
+	maxNameCollisions   = 1000       // "name (n).ext" suffixes tried before giving up
+	stagingDirName      = ".partial" // Private directory for files still being received
+)
+
+// windowsReservedNames cannot be used as file names on Windows, with or without an extension
+var windowsReservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true,
+	"COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true,
+	"LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// SanitizeFileName turns a sender-supplied file name into a single, harmless
+// path element: directories are dropped, control and formatting characters
+// are removed, characters that are invalid on common file systems are
+// replaced, and reserved or empty names are made safe.
+func SanitizeFileName(name string) string {
+	name = strings.ToValidUTF8(name, "_")
+
+	// Keep only the last path element, whichever separator the sender used
+	if i := strings.LastIndexAny(name, `/\`); i >= 0 {
+		name = name[i+1:]
+	}
+
+	var b strings.Builder
+	for _, r := range name {
+		switch {
+		case unicode.IsControl(r) || unicode.Is(unicode.Cf, r):
+			// Drop control characters and invisible formatting such as
+			// right-to-left overrides that disguise extensions
+		case strings.ContainsRune(`<>:"|?*`, r):
+			b.WriteRune('_')
+		case unicode.IsSpace(r):
+			b.WriteRune(' ')
+		default:
+			b.WriteRune(r)
+		}
+	}
+	name = b.String()
+
+	// Leading dots hide files and ".." escapes; trailing dots and spaces are
+	// stripped by some file systems
+	name = strings.TrimLeft(name, ". ")
+	name = strings.TrimRight(name, ". ")
+
+	if name == "" {
+		return defaultFileName
+	}
+
+	stem, ext := splitExt(name)
+	if windowsReservedNames[strings.ToUpper(strings.TrimRight(stem, " "))] {
+		stem = "_" + stem
+	}
+
+	return truncateFileName(stem, ext)
+}
+
+// splitExt splits a name into stem and extension, keeping the dot with the
+// extension. Only short extensions count, so long dotted names stay intact.
+func splitExt(name string) (string, string) {
+	ext := filepath.Ext(name)
+	if ext == name || len(ext) > 16 {
+		return name, ""
+	}
+	return strings.TrimSuffix(name, ext), ext
+}
+
+// truncateFileName shortens the stem so stem+ext fits MaxFileNameLength bytes
+// without splitting a character
+func truncateFileName(stem, ext string) string {
+	limit := MaxFileNameLength - len(ext)
+	if len(stem) > limit {
+		cut := limit
+		for cut > 0 && !utf8.RuneStart(stem[cut]) {
+			cut--
+		}
+		stem = strings.TrimRight(stem[:cut], ". ")
+		if stem == "" {
+			stem = defaultFileName
+		}
+	}
+	return stem + ext
+}
+
+// collisionName returns the name used for the nth duplicate, "name (n).ext"
+func collisionName(name string, n int) string {
+	stem, ext := splitExt(name)
+	return truncateFileName(stem, fmt.Sprintf(" (%d)%s", n, ext))
+}
+
+// ensurePrivateDir creates dir with owner-only permissions, or tightens an
+// existing one. A symlink is refused so staged files cannot be redirected.
+func ensurePrivateDir(dir string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+
+	info, err := os.Lstat(dir)
+	if err != nil {
+		return fmt.Errorf("failed to inspect directory: %w", err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+	if info.Mode().Perm() != 0700 {
+		if err := os.Chmod(dir, 0700); err != nil {
+			return fmt.Errorf("failed to restrict directory permissions: %w", err)
+		}
+	}
+	return nil
+}
+
+// publishFile moves a verified staged file into dir under a sanitized name,
+// adding " (n)" when the name is taken. Existing files are never replaced.
+func publishFile(stagedPath, dir, name string) (string, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create download directory: %w", err)
+	}
+
+	name = SanitizeFileName(name)
+	for n := 0; n <= maxNameCollisions; n++ {
+		candidate := name
+		if n > 0 {
+			candidate = collisionName(name, n)
+		}
+		destPath := filepath.Join(dir, candidate)
+
+		// A hard link fails instead of replacing an existing file, which makes
+		// the move atomic without a window for another writer
+		err := os.Link(stagedPath, destPath)
+		if errors.Is(err, os.ErrExist) {
+			continue
+		}
+		if err != nil {
+			// Some file systems do not support hard links
+			if _, statErr := os.Lstat(destPath); statErr == nil {
+				continue
+			}
+			if err := os.Rename(stagedPath, destPath); err != nil {
+				return "", fmt.Errorf("failed to move received file: %w", err)
+			}
+			return destPath, nil
+		}
+
+		if err := os.Remove(stagedPath); err != nil {
+			return "", fmt.Errorf("failed to remove staged file: %w", err)
+		}
+		return destPath, nil
+	}
+
+	return "", fmt.Errorf("too many files named %s", name)
+}
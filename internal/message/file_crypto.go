@@ -0,0 +1,301 @@
+package message
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	xcrypto "github.com/Xelvra/peerchat/internal/crypto"
+	"github.com/libp2p/go-libp2p/core/crypto"
+)
+
+const (
+	// EncryptionAESGCM is the only cipher offered for file transfers
+	EncryptionAESGCM = "aes-256-gcm"
+
+	// EncryptedFileExt is appended to received files kept encrypted at rest
+	EncryptedFileExt = ".xenc"
+
+	fileKeySize = 32
+
+	// fileKeyInfo domain-separates content keys sealed to the receiver
+	fileKeyInfo = "xelvra-file-key-v1"
+	// fileAtRestInfo domain-separates keys of files encrypted at rest
+	fileAtRestInfo = "xelvra-file-at-rest-v1"
+
+	// Files encrypted at rest start with
+	//
+	//	magic (8) | chunk size (4) | sealed key length (2) | sealed key
+	//
+	// followed by every chunk sealed with the file key
+	fileAtRestMagic       = "XELVENC1"
+	maxAtRestChunkSize    = 1024 * 1024
+	maxAtRestSealedKeyLen = 1024
+)
+
+// newFileKey returns a random content key for one file
+func newFileKey() ([]byte, error) {
+	key := make([]byte, fileKeySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, fmt.Errorf("failed to generate file key: %w", err)
+	}
+	return key, nil
+}
+
+// fileCipher returns the AEAD for a content key
+func fileCipher(key []byte) (cipher.AEAD, error) {
+	if len(key) != fileKeySize {
+		return nil, fmt.Errorf("invalid file key size: %d", len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create AES cipher: %w", err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create GCM: %w", err)
+	}
+	return gcm, nil
+}
+
+// chunkNonce binds a chunk index into the nonce. Every transfer session has its
+// own key, so an index is never used twice with a key.
+func chunkNonce(aead cipher.AEAD, chunkID int) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], uint64(chunkID))
+	return nonce
+}
+
+// encryptChunk seals chunk data, binding the transfer ID as additional data
+func encryptChunk(aead cipher.AEAD, transferID string, chunkID int, data []byte) []byte {
+	return aead.Seal(nil, chunkNonce(aead, chunkID), data, []byte(transferID))
+}
+
+// decryptChunk opens chunk data sealed by encryptChunk
+func decryptChunk(aead cipher.AEAD, transferID string, chunkID int, data []byte) ([]byte, error) {
+	plaintext, err := aead.Open(nil, chunkNonce(aead, chunkID), data, []byte(transferID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt chunk %d: %w", chunkID, err)
+	}
+	return plaintext, nil
+}
+
+// identityCurveKey returns the Curve25519 public key of an Ed25519 peer key
+func identityCurveKey(key crypto.PubKey) ([]byte, error) {
+	if key == nil || key.Type() != crypto.Ed25519 {
+		return nil, fmt.Errorf("peer key is not an Ed25519 key")
+	}
+	raw, err := key.Raw()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read peer key: %w", err)
+	}
+	return xcrypto.PublicKeyFromEd25519(raw)
+}
+
+// identityKeyPair returns the Curve25519 key pair of an Ed25519 host key
+func identityKeyPair(key crypto.PrivKey) (*xcrypto.KeyPair, error) {
+	if key == nil || key.Type() != crypto.Ed25519 {
+		return nil, fmt.Errorf("host key is not an Ed25519 key")
+	}
+	raw, err := key.Raw()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read host key: %w", err)
+	}
+	return xcrypto.KeyPairFromEd25519(raw)
+}
+
+// sealFileKey encrypts a content key to the receiver's identity key, bound to the transfer
+func sealFileKey(receiver crypto.PubKey, transferID string, key []byte) ([]byte, error) {
+	publicKey, err := identityCurveKey(receiver)
+	if err != nil {
+		return nil, err
+	}
+	return xcrypto.SealAnonymous(publicKey, key, []byte(fileKeyInfo+transferID))
+}
+
+// openFileKey decrypts a content key sealed to our identity key
+func openFileKey(hostKey crypto.PrivKey, transferID string, sealed []byte) ([]byte, error) {
+	keyPair, err := identityKeyPair(hostKey)
+	if err != nil {
+		return nil, err
+	}
+	defer keyPair.Destroy()
+
+	key, err := xcrypto.OpenAnonymous(keyPair, sealed, []byte(fileKeyInfo+transferID))
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != fileKeySize {
+		return nil, fmt.Errorf("invalid file key size: %d", len(key))
+	}
+	return key, nil
+}
+
+// atRestChunkData is the additional data of a chunk encrypted at rest: the file
+// header and whether it is the last chunk, so chunks cannot be cut off unnoticed
+func atRestChunkData(header []byte, final bool) []byte {
+	data := append([]byte(nil), header...)
+	if final {
+		return append(data, 1)
+	}
+	return append(data, 0)
+}
+
+// encryptFileAtRest writes srcPath to a new file destPath encrypted with a
+// fresh key, which is sealed to ownerKey (a Curve25519 public key) in the header
+func encryptFileAtRest(srcPath, destPath string, ownerKey []byte) (err error) {
+	in, err := os.Open(srcPath)
+	if err != nil {
+		return fmt.Errorf("failed to open file: %w", err)
+	}
+	defer func() { _ = in.Close() }()
+
+	info, err := in.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat file: %w", err)
+	}
+
+	key, err := newFileKey()
+	if err != nil {
+		return err
+	}
+	aead, err := fileCipher(key)
+	if err != nil {
+		return err
+	}
+	sealedKey, err := xcrypto.SealAnonymous(ownerKey, key, []byte(fileAtRestInfo))
+	if err != nil {
+		return fmt.Errorf("failed to seal file key: %w", err)
+	}
+
+	header := []byte(fileAtRestMagic)
+	header = binary.BigEndian.AppendUint32(header, FileChunkSize)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(sealedKey)))
+	header = append(header, sealedKey...)
+
+	out, err := os.OpenFile(destPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to create encrypted file: %w", err)
+	}
+	defer func() {
+		if closeErr := out.Close(); err == nil && closeErr != nil {
+			err = fmt.Errorf("failed to close encrypted file: %w", closeErr)
+		}
+		if err != nil {
+			_ = os.Remove(destPath)
+		}
+	}()
+
+	if _, err := out.Write(header); err != nil {
+		return fmt.Errorf("failed to write encrypted file: %w", err)
+	}
+
+	// An empty file still gets one final chunk
+	chunkCount := int((info.Size() + FileChunkSize - 1) / FileChunkSize)
+	if chunkCount == 0 {
+		chunkCount = 1
+	}
+	buffer := make([]byte, FileChunkSize)
+	for chunkID := 0; chunkID < chunkCount; chunkID++ {
+		n, err := io.ReadFull(in, buffer)
+		if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+			return fmt.Errorf("failed to read file: %w", err)
+		}
+		sealed := aead.Seal(nil, chunkNonce(aead, chunkID), buffer[:n], atRestChunkData(header, chunkID == chunkCount-1))
+		if _, err := out.Write(sealed); err != nil {
+			return fmt.Errorf("failed to write encrypted file: %w", err)
+		}
+	}
+
+	return out.Sync()
+}
+
+// DecryptFile decrypts a received file kept encrypted at rest into a new file
+// destPath, using the identity key the file was received with
+func DecryptFile(srcPath, destPath string, identityKey ed25519.PrivateKey) (err error) {
+	in, err := os.Open(srcPath)
+	if err != nil {
+		return fmt.Errorf("failed to open encrypted file: %w", err)
+	}
+	defer func() { _ = in.Close() }()
+
+	header := make([]byte, len(fileAtRestMagic)+6)
+	if _, err := io.ReadFull(in, header); err != nil {
+		return fmt.Errorf("failed to read file header: %w", err)
+	}
+	if !bytes.Equal(header[:len(fileAtRestMagic)], []byte(fileAtRestMagic)) {
+		return fmt.Errorf("%s is not an encrypted download", srcPath)
+	}
+	chunkSize := int(binary.BigEndian.Uint32(header[len(fileAtRestMagic):]))
+	keyLen := int(binary.BigEndian.Uint16(header[len(fileAtRestMagic)+4:]))
+	if chunkSize <= 0 || chunkSize > maxAtRestChunkSize || keyLen > maxAtRestSealedKeyLen {
+		return fmt.Errorf("invalid file header")
+	}
+	sealedKey := make([]byte, keyLen)
+	if _, err := io.ReadFull(in, sealedKey); err != nil {
+		return fmt.Errorf("failed to read file header: %w", err)
+	}
+	header = append(header, sealedKey...)
+
+	keyPair, err := xcrypto.KeyPairFromEd25519(identityKey)
+	if err != nil {
+		return err
+	}
+	defer keyPair.Destroy()
+	key, err := xcrypto.OpenAnonymous(keyPair, sealedKey, []byte(fileAtRestInfo))
+	if err != nil {
+		return fmt.Errorf("file was not encrypted for this identity: %w", err)
+	}
+	aead, err := fileCipher(key)
+	if err != nil {
+		return err
+	}
+
+	info, err := in.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat encrypted file: %w", err)
+	}
+	sealedChunkSize := int64(chunkSize + aead.Overhead())
+	body := info.Size() - int64(len(header))
+	chunkCount := int((body + sealedChunkSize - 1) / sealedChunkSize)
+	if chunkCount == 0 {
+		return fmt.Errorf("encrypted file is truncated")
+	}
+
+	out, err := os.OpenFile(destPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to create decrypted file: %w", err)
+	}
+	defer func() {
+		if closeErr := out.Close(); err == nil && closeErr != nil {
+			err = fmt.Errorf("failed to close decrypted file: %w", closeErr)
+		}
+		if err != nil {
+			_ = os.Remove(destPath)
+		}
+	}()
+
+	buffer := make([]byte, sealedChunkSize)
+	for chunkID := 0; chunkID < chunkCount; chunkID++ {
+		n, err := io.ReadFull(in, buffer)
+		if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+			return fmt.Errorf("failed to read encrypted file: %w", err)
+		}
+		plaintext, err := aead.Open(nil, chunkNonce(aead, chunkID), buffer[:n], atRestChunkData(header, chunkID == chunkCount-1))
+		if err != nil {
+			return fmt.Errorf("encrypted file is corrupted at chunk %d", chunkID)
+		}
+		if _, err := out.Write(plaintext); err != nil {
+			return fmt.Errorf("failed to write decrypted file: %w", err)
+		}
+	}
+
+	return nil
+}
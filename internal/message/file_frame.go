@@ -0,0 +1,208 @@
+package message
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+const (
+	// FileStreamProtocolID carries chunks as binary frames with flow control.
+	// FileProtocolID (JSON frames, no flow control) is still accepted from older peers.
+	FileStreamProtocolID = protocol.ID("/xelvra/file/2.0.0")
+
+	// EncryptedFileStreamProtocolID is FileStreamProtocolID with end-to-end
+	// encryption required; unencrypted offers are only accepted on older protocols
+	EncryptedFileStreamProtocolID = protocol.ID("/xelvra/file/2.1.0")
+
+	// Flow control on FileStreamProtocolID
+	FileWindowChunks = 64                   // Chunks the sender may have in flight
+	fileCreditBatch  = FileWindowChunks / 4 // Receiver returns credits in batches of this size
+
+	// Frame kinds on FileStreamProtocolID
+	fileFrameControl byte = 1 // JSON FileTransferRequest
+	fileFrameChunk   byte = 2 // Binary chunk, see encodeChunkFrame
+	fileFrameCredit  byte = 3 // uint32 number of chunks the sender may send
+	fileFrameZstd    byte = 4 // Chunk frame whose data is zstd compressed
+)
+
+// isBinaryFileStream reports whether a stream uses the binary file framing
+func isBinaryFileStream(stream network.Stream) bool {
+	return stream.Protocol() == FileStreamProtocolID || stream.Protocol() == EncryptedFileStreamProtocolID
+}
+
+// requiresFileEncryption reports whether both peers must encrypt file chunks
+func requiresFileEncryption(stream network.Stream) bool {
+	return stream.Protocol() == EncryptedFileStreamProtocolID
+}
+
+// encodeChunkFrame lays out a chunk as
+//
+//	kind | id length (1) | transfer ID | chunk index (4) | SHA-256 (32) |
+//	proof length (1) | proof hashes (32 each) | data
+//
+// after the 4-byte frame length. The kind is fileFrameZstd if the data is compressed.
+func encodeChunkFrame(request FileTransferRequest) ([]byte, error) {
+	if len(request.TransferID) > 255 {
+		return nil, fmt.Errorf("transfer ID too long")
+	}
+	if len(request.ChunkHash) != sha256.Size {
+		return nil, fmt.Errorf("chunk %d has no hash", request.ChunkID)
+	}
+	if len(request.Proof) > 255 {
+		return nil, fmt.Errorf("proof too long")
+	}
+
+	size := 1 + 1 + len(request.TransferID) + 4 + sha256.Size + 1 + len(request.Proof)*sha256.Size + len(request.Data)
+	frame := make([]byte, 4, 4+size)
+	binary.BigEndian.PutUint32(frame, uint32(size))
+
+	kind := fileFrameChunk
+	if request.Compressed {
+		kind = fileFrameZstd
+	}
+	frame = append(frame, kind, byte(len(request.TransferID)))
+	frame = append(frame, request.TransferID...)
+	frame = binary.BigEndian.AppendUint32(frame, uint32(request.ChunkID))
+	frame = append(frame, request.ChunkHash...)
+	frame = append(frame, byte(len(request.Proof)))
+	for _, hash := range request.Proof {
+		if len(hash) != sha256.Size {
+			return nil, fmt.Errorf("invalid Merkle proof for chunk %d", request.ChunkID)
+		}
+		frame = append(frame, hash...)
+	}
+	frame = append(frame, request.Data...)
+
+	return frame, nil
+}
+
+// decodeChunkFrame parses the payload of a chunk frame after its kind byte
+func decodeChunkFrame(payload []byte) (*FileTransferRequest, error) {
+	if len(payload) < 1 {
+		return nil, fmt.Errorf("truncated chunk frame")
+	}
+	idLen := int(payload[0])
+	payload = payload[1:]
+	if len(payload) < idLen+4+sha256.Size+1 {
+		return nil, fmt.Errorf("truncated chunk frame")
+	}
+
+	request := &FileTransferRequest{
+		Magic:      FileTransferMagic,
+		Type:       "chunk",
+		TransferID: string(payload[:idLen]),
+	}
+	payload = payload[idLen:]
+
+	request.ChunkID = int(binary.BigEndian.Uint32(payload))
+	request.ChunkHash = payload[4 : 4+sha256.Size]
+	proofLen := int(payload[4+sha256.Size])
+	payload = payload[4+sha256.Size+1:]
+
+	if len(payload) < proofLen*sha256.Size {
+		return nil, fmt.Errorf("truncated Merkle proof")
+	}
+	for i := 0; i < proofLen; i++ {
+		request.Proof = append(request.Proof, payload[:sha256.Size])
+		payload = payload[sha256.Size:]
+	}
+	request.Data = payload
+
+	return request, nil
+}
+
+// writeBinaryFileFrame writes a frame on FileStreamProtocolID. Chunks and
+// credits use their binary layouts; everything else is a JSON control frame.
+func writeBinaryFileFrame(w io.Writer, request FileTransferRequest) error {
+	var frame []byte
+
+	switch request.Type {
+	case "chunk":
+		var err error
+		if frame, err = encodeChunkFrame(request); err != nil {
+			return err
+		}
+
+	case "credit":
+		frame = make([]byte, 4, 9)
+		binary.BigEndian.PutUint32(frame, 5)
+		frame = append(frame, fileFrameCredit)
+		frame = binary.BigEndian.AppendUint32(frame, uint32(request.Credits))
+
+	default:
+		request.Magic = FileTransferMagic
+		data, err := json.Marshal(request)
+		if err != nil {
+			return fmt.Errorf("failed to marshal request: %w", err)
+		}
+		frame = make([]byte, 4, 5+len(data))
+		binary.BigEndian.PutUint32(frame, uint32(1+len(data)))
+		frame = append(frame, fileFrameControl)
+		frame = append(frame, data...)
+	}
+
+	if _, err := w.Write(frame); err != nil {
+		return fmt.Errorf("failed to write data: %w", err)
+	}
+	return nil
+}
+
+// readBinaryFileFrame reads a frame written by writeBinaryFileFrame
+func readBinaryFileFrame(r io.Reader) (*FileTransferRequest, error) {
+	var lenBytes [4]byte
+	if _, err := io.ReadFull(r, lenBytes[:]); err != nil {
+		return nil, fmt.Errorf("failed to read length: %w", err)
+	}
+
+	length := binary.BigEndian.Uint32(lenBytes[:])
+	if length == 0 || length > FileMaxFrameSize {
+		return nil, fmt.Errorf("invalid frame size: %d bytes", length)
+	}
+
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, fmt.Errorf("failed to read frame data: %w", err)
+	}
+
+	switch data[0] {
+	case fileFrameChunk, fileFrameZstd:
+		request, err := decodeChunkFrame(data[1:])
+		if err != nil {
+			return nil, err
+		}
+		request.Compressed = data[0] == fileFrameZstd
+		return request, nil
+
+	case fileFrameCredit:
+		if len(data) != 5 {
+			return nil, fmt.Errorf("invalid credit frame")
+		}
+		return &FileTransferRequest{
+			Magic:   FileTransferMagic,
+			Type:    "credit",
+			Credits: int(binary.BigEndian.Uint32(data[1:])),
+		}, nil
+
+	case fileFrameControl:
+		var request FileTransferRequest
+		if err := json.Unmarshal(data[1:], &request); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal frame: %w", err)
+		}
+		if request.Magic != FileTransferMagic {
+			return nil, fmt.Errorf("invalid magic number: %x", request.Magic)
+		}
+		if request.Type == "chunk" || request.Type == "credit" {
+			return nil, fmt.Errorf("%s sent as a control frame", request.Type)
+		}
+		return &request, nil
+
+	default:
+		return nil, fmt.Errorf("unknown frame kind: %d", data[0])
+	}
+}
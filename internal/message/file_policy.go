@@ -0,0 +1,365 @@
+package message
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/sirupsen/logrus"
+)
+
+// Default file acceptance limits
+const (
+	DefaultMaxFileSize       = MaxFileSize // Largest file any transfer carries
+	DefaultMaxConcurrentFile = 4
+	DefaultPeerFileQuota     = 10 * MaxFileSize // Per peer per quota window
+	DefaultFileQuotaWindow   = 24 * time.Hour
+	DefaultFileOfferTimeout  = 45 * time.Second // Below FileIdleTimeout so the sender still gets the reject
+)
+
+// ErrOfferTimeout is returned when nobody accepted an incoming file in time
+var ErrOfferTimeout = errors.New("file offer was not accepted in time")
+
+// ErrUnknownOffer is returned when deciding on an offer that is not pending
+var ErrUnknownOffer = errors.New("no pending file offer with this ID")
+
+// ErrAmbiguousOffer is returned when several peers offer files with the same ID
+// and the decision does not name the peer
+var ErrAmbiguousOffer = errors.New("several peers offer a file with this ID")
+
+// FileAcceptPolicy decides which incoming files are received
+type FileAcceptPolicy struct {
+	ContactsOnly     bool          // Reject senders that are not in the contacts table
+	MaxFileSize      int64         // Largest accepted file in bytes, 0 for no limit below MaxFileSize
+	AllowedMimeTypes []string      // Accepted MIME types, "type/*" matches a family; empty allows all
+	BlockedMimeTypes []string      // Rejected MIME types, checked before AllowedMimeTypes
+	MaxConcurrent    int           // Incoming transfers received at once, 0 for no limit
+	PeerQuota        int64         // Bytes accepted from one peer per QuotaWindow, 0 for no limit
+	QuotaWindow      time.Duration // Window the per-peer quota applies to
+	AutoAccept       bool          // Accept files that pass the policy without asking
+	OfferTimeout     time.Duration // How long an offer waits for a decision before it is rejected
+}
+
+// DefaultFileAcceptPolicy returns a policy that asks before receiving any file
+func DefaultFileAcceptPolicy() *FileAcceptPolicy {
+	return &FileAcceptPolicy{
+		MaxFileSize:   DefaultMaxFileSize,
+		MaxConcurrent: DefaultMaxConcurrentFile,
+		PeerQuota:     DefaultPeerFileQuota,
+		QuotaWindow:   DefaultFileQuotaWindow,
+		OfferTimeout:  DefaultFileOfferTimeout,
+	}
+}
+
+// ContactStore looks up the user's contacts for the file acceptance policy
+type ContactStore interface {
+	// ContactStatus reports whether the peer's key belongs to a contact of
+	// owner and whether that contact is blocked
+	ContactStatus(ownerDID string, peerID peer.ID) (isContact, blocked bool, err error)
+}
+
+// FileOffer is an incoming file waiting for the user to accept or reject it
+type FileOffer struct {
+	ID       string         `json:"id"`
+	PeerID   peer.ID        `json:"peer_id"`
+	Metadata FileMetadata   `json:"metadata"`
+	Files    []FileMetadata `json:"files,omitempty"` // Files of a multi-file transfer the user may pick from
+	Expires  time.Time      `json:"expires"`
+
+	decision chan offerDecision
+}
+
+// offerKey identifies a pending offer. Transfer IDs are chosen by the sender,
+// so offers from different peers may share one.
+type offerKey struct {
+	peer peer.ID
+	id   string
+}
+
+// offerDecision is the user's answer to an offer. Empty paths accept every file.
+type offerDecision struct {
+	accept bool
+	paths  []string
+}
+
+// peerQuota tracks the bytes accepted from a peer in the current window
+type peerQuota struct {
+	windowStart time.Time
+	bytes       int64
+}
+
+// mimeMatches reports whether a MIME type matches any of the patterns
+func mimeMatches(mimeType string, patterns []string) bool {
+	mimeType = strings.ToLower(mimeType)
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(pattern)
+		if pattern == "*" || pattern == "*/*" || pattern == mimeType {
+			return true
+		}
+		if family, ok := strings.CutSuffix(pattern, "/*"); ok && strings.HasPrefix(mimeType, family+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// checkSender rejects blocked senders, and senders that are not contacts if the
+// policy requires it. It also applies to resumed transfers.
+func (ftm *FileTransferManager) checkSender(remotePeer peer.ID) error {
+	if ftm.contacts == nil {
+		if ftm.policy.ContactsOnly {
+			return fmt.Errorf("sender is not a contact")
+		}
+		return nil
+	}
+
+	isContact, blocked, err := ftm.contacts.ContactStatus(ftm.ownerDID, remotePeer)
+	if err != nil {
+		ftm.logger.WithError(err).Warn("Failed to look up contact")
+		return fmt.Errorf("sender could not be verified")
+	}
+	if blocked {
+		return fmt.Errorf("sender is blocked")
+	}
+	if ftm.policy.ContactsOnly && !isContact {
+		return fmt.Errorf("sender is not a contact")
+	}
+	return nil
+}
+
+// checkOffer applies the size, MIME type and quota limits to a new offer
+func (ftm *FileTransferManager) checkOffer(remotePeer peer.ID, metadata FileMetadata) error {
+	policy := ftm.policy
+
+	if policy.MaxFileSize > 0 && metadata.Size > policy.MaxFileSize {
+		return fmt.Errorf("file is larger than the %d byte limit", policy.MaxFileSize)
+	}
+	if mimeMatches(metadata.MimeType, policy.BlockedMimeTypes) {
+		return fmt.Errorf("file type %s is not accepted", metadata.MimeType)
+	}
+	if len(policy.AllowedMimeTypes) > 0 && !mimeMatches(metadata.MimeType, policy.AllowedMimeTypes) {
+		return fmt.Errorf("file type %s is not accepted", metadata.MimeType)
+	}
+
+	// Files over the quota are refused before asking; reserveQuota charges it
+	if policy.PeerQuota > 0 {
+		ftm.mu.Lock()
+		used := ftm.currentQuota(remotePeer).bytes
+		ftm.mu.Unlock()
+		if used+metadata.Size > policy.PeerQuota {
+			return fmt.Errorf("sender exceeded the file quota")
+		}
+	}
+	return nil
+}
+
+// currentQuota returns the sender's quota for the current window, starting a
+// new window when the last one has passed. The caller must hold ftm.mu.
+func (ftm *FileTransferManager) currentQuota(remotePeer peer.ID) *peerQuota {
+	quota, exists := ftm.quotas[remotePeer]
+	if !exists || time.Since(quota.windowStart) >= ftm.policy.QuotaWindow {
+		quota = &peerQuota{windowStart: time.Now()}
+		ftm.quotas[remotePeer] = quota
+	}
+	return quota
+}
+
+// reserveQuota counts accepted files against the sender's quota if they fit,
+// checking and charging it in one step so concurrent offers cannot overrun it.
+// The returned function refunds the reservation when the files are not received.
+func (ftm *FileTransferManager) reserveQuota(remotePeer peer.ID, size int64) (refund func(), err error) {
+	ftm.mu.Lock()
+	defer ftm.mu.Unlock()
+
+	quota := ftm.currentQuota(remotePeer)
+	if ftm.policy.PeerQuota > 0 && quota.bytes+size > ftm.policy.PeerQuota {
+		return nil, fmt.Errorf("sender exceeded the file quota")
+	}
+	quota.bytes += size
+
+	return func() {
+		ftm.mu.Lock()
+		quota.bytes -= size
+		ftm.mu.Unlock()
+	}, nil
+}
+
+// admit reserves one of the concurrent receive slots
+func (ftm *FileTransferManager) admit() (release func(), err error) {
+	ftm.mu.Lock()
+	defer ftm.mu.Unlock()
+
+	if ftm.policy.MaxConcurrent > 0 && ftm.receiving >= ftm.policy.MaxConcurrent {
+		return nil, fmt.Errorf("too many concurrent transfers, try again later")
+	}
+	ftm.receiving++
+
+	return func() {
+		ftm.mu.Lock()
+		ftm.receiving--
+		ftm.mu.Unlock()
+	}, nil
+}
+
+// awaitDecision asks the user about an offer unless the policy accepts it
+// automatically, and rejects it when nobody decides before the timeout. For a
+// multi-file offer it returns the paths of the files the user picked, or nil
+// for all of them.
+func (ftm *FileTransferManager) awaitDecision(remotePeer peer.ID, metadata FileMetadata, files []FileMetadata) ([]string, error) {
+	if ftm.policy.AutoAccept {
+		return nil, nil
+	}
+
+	offer := &FileOffer{
+		ID:       metadata.ID,
+		PeerID:   remotePeer,
+		Metadata: metadata,
+		Files:    files,
+		Expires:  time.Now().Add(ftm.policy.OfferTimeout),
+		decision: make(chan offerDecision, 1),
+	}
+
+	key := offerKey{peer: remotePeer, id: offer.ID}
+	ftm.mu.Lock()
+	if _, exists := ftm.offers[key]; exists {
+		ftm.mu.Unlock()
+		return nil, fmt.Errorf("transfer ID %s is already offered", offer.ID)
+	}
+	ftm.offers[key] = offer
+	onOffer := ftm.onOffer
+	ftm.mu.Unlock()
+
+	defer func() {
+		ftm.mu.Lock()
+		delete(ftm.offers, key)
+		ftm.mu.Unlock()
+		ftm.notifyOffers()
+	}()
+
+	ftm.logger.WithFields(logrus.Fields{
+		"transfer_id": offer.ID,
+		"peer":        remotePeer.String(),
+		"file_name":   metadata.Name,
+	}).Info("Waiting for the user to accept a file")
+
+	if onOffer != nil {
+		onOffer(*offer)
+	}
+
+	timer := time.NewTimer(ftm.policy.OfferTimeout)
+	defer timer.Stop()
+
+	select {
+	case decision := <-offer.decision:
+		if !decision.accept {
+			return nil, fmt.Errorf("file was declined")
+		}
+		return decision.paths, nil
+	case <-timer.C:
+		return nil, ErrOfferTimeout
+	case <-ftm.ctx.Done():
+		return nil, fmt.Errorf("receiver is shutting down")
+	}
+}
+
+// notifyOffers reports a change of the pending offers to the offer handler
+func (ftm *FileTransferManager) notifyOffers() {
+	ftm.mu.Lock()
+	onChange := ftm.onOffersChanged
+	ftm.mu.Unlock()
+
+	if onChange != nil {
+		onChange()
+	}
+}
+
+// SetOfferHandlers registers functions called when a new file offer waits for
+// a decision and whenever the set of pending offers changes
+func (ftm *FileTransferManager) SetOfferHandlers(onOffer func(FileOffer), onChange func()) {
+	ftm.mu.Lock()
+	defer ftm.mu.Unlock()
+	ftm.onOffer = onOffer
+	ftm.onOffersChanged = onChange
+}
+
+// PendingOffers returns the incoming files waiting for a decision
+func (ftm *FileTransferManager) PendingOffers() []FileOffer {
+	ftm.mu.Lock()
+	defer ftm.mu.Unlock()
+
+	offers := make([]FileOffer, 0, len(ftm.offers))
+	for _, offer := range ftm.offers {
+		offers = append(offers, *offer)
+	}
+	return offers
+}
+
+// AcceptOffer lets a pending incoming file from a peer be received. An empty
+// peer picks the only offer with the ID. For a multi-file offer, paths picks
+// the files to receive; without paths all are received.
+func (ftm *FileTransferManager) AcceptOffer(from peer.ID, id string, paths ...string) error {
+	return ftm.decideOffer(from, id, offerDecision{accept: true, paths: paths})
+}
+
+// RejectOffer declines a pending incoming file from a peer, or the only offer
+// with the ID if the peer is empty
+func (ftm *FileTransferManager) RejectOffer(from peer.ID, id string) error {
+	return ftm.decideOffer(from, id, offerDecision{})
+}
+
+// findOffer returns the pending offer with the ID from a peer, or from any
+// peer if it is empty. The caller must hold ftm.mu.
+func (ftm *FileTransferManager) findOffer(from peer.ID, id string) (*FileOffer, error) {
+	if from != "" {
+		offer, exists := ftm.offers[offerKey{peer: from, id: id}]
+		if !exists {
+			return nil, ErrUnknownOffer
+		}
+		return offer, nil
+	}
+
+	var found *FileOffer
+	for key, offer := range ftm.offers {
+		if key.id != id {
+			continue
+		}
+		if found != nil {
+			return nil, ErrAmbiguousOffer
+		}
+		found = offer
+	}
+	if found == nil {
+		return nil, ErrUnknownOffer
+	}
+	return found, nil
+}
+
+// decideOffer delivers the user's decision to the waiting transfer
+func (ftm *FileTransferManager) decideOffer(from peer.ID, id string, decision offerDecision) error {
+	ftm.mu.Lock()
+	offer, err := ftm.findOffer(from, id)
+	ftm.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if len(decision.paths) > 0 {
+		offered := make(map[string]bool, len(offer.Files))
+		for _, file := range offer.Files {
+			offered[file.Path] = true
+		}
+		for _, path := range decision.paths {
+			if !offered[path] {
+				return fmt.Errorf("%s is not part of offer %s", path, id)
+			}
+		}
+	}
+
+	select {
+	case offer.decision <- decision:
+	default: // Already decided
+	}
+	return nil
+}
@@ -0,0 +1,196 @@
+package message
+
+import (
+	"fmt"
+	"math/bits"
+	"sync"
+)
+
+// ChunkRange is a half-open range [Start, End) of chunk indexes
+type ChunkRange struct {
+	Start int `json:"start"`
+	End   int `json:"end"`
+}
+
+// ChunkBitmap records which chunks of a file are present
+type ChunkBitmap struct {
+	bits  []byte
+	total int
+	count int
+}
+
+// NewChunkBitmap creates an empty bitmap for total chunks
+func NewChunkBitmap(total int) *ChunkBitmap {
+	if total < 0 {
+		total = 0
+	}
+	return &ChunkBitmap{
+		bits:  make([]byte, (total+7)/8),
+		total: total,
+	}
+}
+
+// ChunkBitmapFromBytes restores a bitmap saved with Bytes
+func ChunkBitmapFromBytes(total int, data []byte) (*ChunkBitmap, error) {
+	cb := NewChunkBitmap(total)
+	if len(data) == 0 {
+		return cb, nil
+	}
+	if len(data) != len(cb.bits) {
+		return nil, fmt.Errorf("chunk bitmap has %d bytes, expected %d", len(data), len(cb.bits))
+	}
+
+	copy(cb.bits, data)
+	// Clear padding bits so Count stays exact
+	if rem := total % 8; rem != 0 {
+		cb.bits[len(cb.bits)-1] &= byte(1<<rem) - 1
+	}
+	for _, b := range cb.bits {
+		cb.count += bits.OnesCount8(b)
+	}
+	return cb, nil
+}
+
+// Set marks a chunk as present and reports whether it was missing before
+func (cb *ChunkBitmap) Set(index int) bool {
+	if index < 0 || index >= cb.total || cb.Has(index) {
+		return false
+	}
+	cb.bits[index/8] |= 1 << (index % 8)
+	cb.count++
+	return true
+}
+
+// Clear marks a chunk as missing again, for example after it failed verification
+func (cb *ChunkBitmap) Clear(index int) {
+	if !cb.Has(index) {
+		return
+	}
+	cb.bits[index/8] &^= 1 << (index % 8)
+	cb.count--
+}
+
+// Has reports whether a chunk is present
+func (cb *ChunkBitmap) Has(index int) bool {
+	if index < 0 || index >= cb.total {
+		return false
+	}
+	return cb.bits[index/8]&(1<<(index%8)) != 0
+}
+
+// Len returns the number of chunks tracked by the bitmap
+func (cb *ChunkBitmap) Len() int {
+	return cb.total
+}
+
+// Count returns the number of chunks present
+func (cb *ChunkBitmap) Count() int {
+	return cb.count
+}
+
+// Complete reports whether every chunk is present
+func (cb *ChunkBitmap) Complete() bool {
+	return cb.count == cb.total
+}
+
+// MissingRanges returns the chunks that are not present as sorted ranges
+func (cb *ChunkBitmap) MissingRanges() []ChunkRange {
+	var ranges []ChunkRange
+	start := -1
+	for i := 0; i < cb.total; i++ {
+		if cb.Has(i) {
+			if start >= 0 {
+				ranges = append(ranges, ChunkRange{Start: start, End: i})
+				start = -1
+			}
+			continue
+		}
+		if start < 0 {
+			start = i
+		}
+	}
+	if start >= 0 {
+		ranges = append(ranges, ChunkRange{Start: start, End: cb.total})
+	}
+	return ranges
+}
+
+// Bytes returns a copy of the bitmap for persistence
+func (cb *ChunkBitmap) Bytes() []byte {
+	return append([]byte(nil), cb.bits...)
+}
+
+// Clone returns an independent copy of the bitmap
+func (cb *ChunkBitmap) Clone() *ChunkBitmap {
+	return &ChunkBitmap{
+		bits:  cb.Bytes(),
+		total: cb.total,
+		count: cb.count,
+	}
+}
+
+// chunkLength returns the size of a chunk, which is only short for the last one
+func chunkLength(metadata FileMetadata, index int) int64 {
+	offset := int64(index) * int64(metadata.ChunkSize)
+	if remaining := metadata.Size - offset; remaining < int64(metadata.ChunkSize) {
+		return remaining
+	}
+	return int64(metadata.ChunkSize)
+}
+
+// rangesBytes returns the number of file bytes covered by chunk ranges
+func rangesBytes(metadata FileMetadata, ranges []ChunkRange) int64 {
+	var total int64
+	for _, r := range ranges {
+		for i := r.Start; i < r.End; i++ {
+			total += chunkLength(metadata, i)
+		}
+	}
+	return total
+}
+
+// FileTransferStore persists file transfer state so interrupted transfers can resume
+type FileTransferStore interface {
+	// SaveFileTransfer inserts or updates a transfer keyed by transfer ID
+	SaveFileTransfer(transfer *FileTransfer) error
+	// LoadResumableTransfers returns pending and active transfers in both directions
+	LoadResumableTransfers() ([]*FileTransfer, error)
+}
+
+// MemoryFileTransferStore is an in-memory FileTransferStore used when no database is available
+type MemoryFileTransferStore struct {
+	transfers map[string]*FileTransfer
+	mu        sync.Mutex
+}
+
+// NewMemoryFileTransferStore creates a new in-memory file transfer store
+func NewMemoryFileTransferStore() *MemoryFileTransferStore {
+	return &MemoryFileTransferStore{
+		transfers: make(map[string]*FileTransfer),
+	}
+}
+
+// SaveFileTransfer stores a snapshot of the transfer state
+func (s *MemoryFileTransferStore) SaveFileTransfer(transfer *FileTransfer) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.transfers[transfer.ID] = transfer.snapshot()
+	return nil
+}
+
+// LoadResumableTransfers returns snapshots of unfinished transfers with progress
+// recomputed from their bitmaps, as after a restart
+func (s *MemoryFileTransferStore) LoadResumableTransfers() ([]*FileTransfer, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var transfers []*FileTransfer
+	for _, transfer := range s.transfers {
+		if transfer.Status == FileTransferPending || transfer.Status == FileTransferActive {
+			restored := transfer.snapshot()
+			restored.RestoreChunks(restored.Chunks)
+			transfers = append(transfers, restored)
+		}
+	}
+	return transfers, nil
+}
@@ -1,18 +1,27 @@
 package message
 
 import (
+	"bytes"
 	"context"
+	"crypto/cipher"
 	"crypto/sha256"
 	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/host"
 	"github.com/libp2p/go-libp2p/core/network"
 	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/routing"
 	"github.com/sirupsen/logrus"
 )
 
@@ -21,6 +30,16 @@ const (
 	FileChunkSize     = 32 * 1024  // 32KB chunks for optimal performance
 	FileHeaderSize    = 1024       // Maximum size for file metadata header
 	FileTransferMagic = 0x58454C56 // "XELV" magic number for file transfers
+
+	// FileMaxFrameSize bounds any frame on the file protocol; chunk data is base64 encoded
+	FileMaxFrameSize = 2*FileChunkSize + FileHeaderSize
+
+	// Session and resume settings
+	FileIdleTimeout       = time.Minute     // Either side gives up on a silent stream
+	FileStateSaveInterval = 32              // Persist the receive bitmap every N chunks
+	FileResumeAttempts    = 3               // Resume attempts per reconnect
+	FileResumeDelay       = 2 * time.Second // Wait between resume attempts
+	fileCompleteRounds    = 3               // Retransmit rounds before a transfer fails
 )
 
 // FileTransferStatus represents the status of a file transfer
@@ -62,16 +81,37 @@ type FileMetadata struct {
 	Timestamp  time.Time `json:"timestamp"`
 	ChunkCount int       `json:"chunk_count"`
 	ChunkSize  int       `json:"chunk_size"`
+	MerkleRoot string    `json:"merkle_root,omitempty"` // Root of the Merkle tree over the chunks
+	ManifestID string    `json:"manifest_id,omitempty"` // Multi-file transfer the file belongs to
+	Path       string    `json:"path,omitempty"`        // Slash-separated path within that transfer
+	Mode       uint32    `json:"mode,omitempty"`        // Permission bits of the sender's file
+
+	Preview *FilePreview `json:"preview,omitempty"` // Dimensions, duration and thumbnail of media files
 }
 
 // FileTransferRequest represents a file transfer request
 type FileTransferRequest struct {
-	Magic    uint32       `json:"magic"`
-	Type     string       `json:"type"` // "request", "accept", "reject", "chunk", "complete"
-	Metadata FileMetadata `json:"metadata,omitempty"`
-	ChunkID  int          `json:"chunk_id,omitempty"`
-	Data     []byte       `json:"data,omitempty"`
-	Error    string       `json:"error,omitempty"`
+	Magic       uint32         `json:"magic"`
+	Type        string         `json:"type"` // "request", "resume", "manifest", "manifest_files", "accept", "reject", "chunk", "credit", "complete", "ack", "retransmit", "get"
+	Metadata    FileMetadata   `json:"metadata,omitempty"`
+	Manifest    *FileManifest  `json:"manifest,omitempty"`    // Files offered as one transfer, with the files that fit (manifest)
+	FileCount   int            `json:"file_count,omitempty"`  // Files in the whole manifest (manifest)
+	MoreFiles   []FileMetadata `json:"more_files,omitempty"`  // Further files of the manifest (manifest_files)
+	Accepted    []byte         `json:"accepted,omitempty"`    // Bitmap of the manifest files the receiver accepted, by index (accept)
+	TransferID  string         `json:"transfer_id,omitempty"` // Transfer a chunk belongs to
+	ChunkID     int            `json:"chunk_id,omitempty"`
+	Data        []byte         `json:"data,omitempty"`
+	ChunkHash   []byte         `json:"chunk_hash,omitempty"`  // SHA-256 of Data
+	Proof       [][]byte       `json:"proof,omitempty"`       // Merkle proof of the chunk
+	Ranges      []ChunkRange   `json:"ranges,omitempty"`      // Chunks requested from a swarm provider (get)
+	Missing     []ChunkRange   `json:"missing,omitempty"`     // Chunks the receiver still needs (accept, retransmit)
+	Signature   []byte         `json:"signature,omitempty"`   // Receiver's signature over the verified file (ack)
+	Credits     int            `json:"credits,omitempty"`     // Chunks the sender may send without waiting (accept, credit)
+	Compression string         `json:"compression,omitempty"` // Codec the sender offers (request, resume) or the receiver agreed to (accept)
+	Compressed  bool           `json:"compressed,omitempty"`  // Data is compressed with the agreed codec (chunk)
+	Encryption  string         `json:"encryption,omitempty"`  // Cipher the sender offers (request, resume) or the receiver agreed to (accept)
+	FileKey     []byte         `json:"file_key,omitempty"`    // Content key sealed to the receiver's identity key (request, resume)
+	Error       string         `json:"error,omitempty"`
 }
 
 // FileTransfer represents an active file transfer session
@@ -88,11 +128,34 @@ type FileTransfer struct {
 	EndTime       time.Time
 	Error         error
 
+	// Compression is the codec agreed for the current session, if any.
+	// ChunkBytes counts chunk data sent or received in it and WireBytes the
+	// same data as it crossed the network.
+	Compression string
+	ChunkBytes  int64
+	WireBytes   int64
+
+	// Encryption is the cipher agreed for the current session, if any. Chunk
+	// data is then sealed with a random key of the file, which never leaves
+	// memory except sealed to the receiver.
+	Encryption string
+
+	// LocalPath is the source file of an outgoing transfer, or the partial and
+	// later final file of an incoming one
+	LocalPath string
+	// Chunks records which chunks the receiver holds
+	Chunks *ChunkBitmap
+	// ChunkHashes holds the SHA-256 of every stored chunk of an incoming
+	// transfer, sha256.Size bytes per chunk, to re-verify the staged file
+	ChunkHashes []byte
+
 	// File handling
 	file       *os.File
+	tree       *MerkleTree // Built lazily from LocalPath to prove outgoing chunks
+	aead       cipher.AEAD // Chunk cipher of the current session if encrypted
 	isOutgoing bool
-	chunks     map[int]bool // Track received chunks
 	logger     *logrus.Logger
+	mu         sync.Mutex
 }
 
 // NewFileTransfer creates a new file transfer session
@@ -105,8 +168,8 @@ func NewFileTransfer(id string, peerID peer.ID, metadata FileMetadata, isOutgoin
 		Progress:   0.0,
 		BytesTotal: metadata.Size,
 		StartTime:  time.Now(),
+		Chunks:     NewChunkBitmap(metadata.ChunkCount),
 		isOutgoing: isOutgoing,
-		chunks:     make(map[int]bool),
 		logger:     logger,
 	}
 }
@@ -144,6 +207,11 @@ func CreateFileMetadata(filePath string) (*FileMetadata, error) {
 		return nil, fmt.Errorf("failed to calculate file hash: %w", err)
 	}
 
+	tree, err := fileMerkleTree(filePath, FileChunkSize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build Merkle tree: %w", err)
+	}
+
 	chunkCount := int((fileInfo.Size() + FileChunkSize - 1) / FileChunkSize)
 
 	metadata := &FileMetadata{
@@ -155,6 +223,12 @@ func CreateFileMetadata(filePath string) (*FileMetadata, error) {
 		Timestamp:  fileInfo.ModTime(),
 		ChunkCount: chunkCount,
 		ChunkSize:  FileChunkSize,
+		MerkleRoot: hex.EncodeToString(tree.Root()),
+	}
+
+	// Previews are best effort; media that cannot be parsed is sent without one
+	if preview, err := CreateFilePreview(filePath, metadata.MimeType); err == nil {
+		metadata.Preview = preview
 	}
 
 	return metadata, nil
@@ -164,8 +238,12 @@ func CreateFileMetadata(filePath string) (*FileMetadata, error) {
 func detectMimeType(filePath string) string {
 	ext := filepath.Ext(filePath)
 	switch ext {
-	case ".txt":
+	case ".txt", ".log":
 		return "text/plain"
+	case ".csv":
+		return "text/csv"
+	case ".json":
+		return "application/json"
 	case ".pdf":
 		return "application/pdf"
 	case ".jpg", ".jpeg":
@@ -174,12 +252,26 @@ func detectMimeType(filePath string) string {
 		return "image/png"
 	case ".gif":
 		return "image/gif"
+	case ".webp":
+		return "image/webp"
 	case ".mp4":
 		return "video/mp4"
+	case ".mov":
+		return "video/quicktime"
 	case ".mp3":
 		return "audio/mpeg"
+	case ".m4a":
+		return "audio/mp4"
+	case ".wav":
+		return "audio/wav"
 	case ".zip":
 		return "application/zip"
+	case ".gz", ".tgz":
+		return "application/gzip"
+	case ".zst":
+		return "application/zstd"
+	case ".7z":
+		return "application/x-7z-compressed"
 	default:
 		return "application/octet-stream"
 	}
@@ -198,11 +290,9 @@ func (ft *FileTransfer) SendFileRequest(stream network.Stream) error {
 
 // SendFileChunk sends a file chunk
 func (ft *FileTransfer) SendFileChunk(stream network.Stream, chunkID int, data []byte) error {
-	request := FileTransferRequest{
-		Magic:   FileTransferMagic,
-		Type:    "chunk",
-		ChunkID: chunkID,
-		Data:    data,
+	request, err := ft.chunkFrame(chunkID, data)
+	if err != nil {
+		return err
 	}
 
 	return ft.sendRequest(stream, request)
@@ -218,25 +308,59 @@ func (ft *FileTransfer) SendFileComplete(stream network.Stream) error {
 	return ft.sendRequest(stream, request)
 }
 
-// sendRequest sends a file transfer request over the stream
-func (ft *FileTransfer) sendRequest(stream network.Stream, request FileTransferRequest) error {
-	data, err := json.Marshal(request)
-	if err != nil {
-		return fmt.Errorf("failed to marshal request: %w", err)
+// chunkFrame builds a chunk frame with the chunk hash and, if the file has a
+// Merkle root, the proof of the chunk
+func (ft *FileTransfer) chunkFrame(chunkID int, data []byte) (FileTransferRequest, error) {
+	hash := sha256.Sum256(data)
+	frame := FileTransferRequest{
+		Magic:      FileTransferMagic,
+		Type:       "chunk",
+		TransferID: ft.ID,
+		ChunkID:    chunkID,
+		Data:       data,
+		ChunkHash:  hash[:],
 	}
 
-	// Write length prefix (4 bytes)
-	length := uint32(len(data))
-	if err := binary.Write(stream, binary.BigEndian, length); err != nil {
-		return fmt.Errorf("failed to write length: %w", err)
+	if ft.Metadata.MerkleRoot != "" {
+		tree, err := ft.merkleTree()
+		if err != nil {
+			return frame, err
+		}
+		if frame.Proof, err = tree.Proof(chunkID); err != nil {
+			return frame, fmt.Errorf("failed to build proof for chunk %d: %w", chunkID, err)
+		}
 	}
 
-	// Write data
-	if _, err := stream.Write(data); err != nil {
-		return fmt.Errorf("failed to write data: %w", err)
+	return frame, nil
+}
+
+// merkleTree returns the Merkle tree of the local file, checking it matches the metadata
+func (ft *FileTransfer) merkleTree() (*MerkleTree, error) {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+
+	if ft.tree != nil {
+		return ft.tree, nil
 	}
 
-	return nil
+	tree, err := fileMerkleTree(ft.LocalPath, ft.Metadata.ChunkSize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build Merkle tree: %w", err)
+	}
+	if hex.EncodeToString(tree.Root()) != ft.Metadata.MerkleRoot {
+		return nil, fmt.Errorf("file %s does not match its Merkle root", ft.LocalPath)
+	}
+
+	ft.tree = tree
+	return tree, nil
+}
+
+// sendRequest sends a file transfer request over the stream
+func (ft *FileTransfer) sendRequest(stream network.Stream, request FileTransferRequest) error {
+	if isBinaryFileStream(stream) {
+		return writeBinaryFileFrame(stream, request)
+	}
+	return writeFileFrame(stream, request)
 }
 
 // UpdateProgress updates the transfer progress
@@ -250,12 +374,65 @@ func (ft *FileTransfer) UpdateProgress() {
 	}
 }
 
+// State returns the current status and progress, safe to call while the transfer runs
+func (ft *FileTransfer) State() (FileTransferStatus, float64) {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	return ft.Status, ft.Progress
+}
+
+// RestoreChunks replaces the chunk bitmap with persisted state and recomputes progress
+func (ft *FileTransfer) RestoreChunks(chunks *ChunkBitmap) {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+
+	ft.Chunks = chunks
+	var present int64
+	for i := 0; i < chunks.Len(); i++ {
+		if chunks.Has(i) {
+			present += chunkLength(ft.Metadata, i)
+		}
+	}
+	if ft.isOutgoing {
+		ft.BytesSent = present
+	} else {
+		ft.BytesReceived = present
+	}
+	ft.UpdateProgress()
+}
+
+// CompressionRatio returns how many bytes of chunk data each byte on the
+// wire carried, or 1 if nothing was compressed
+func (ft *FileTransfer) CompressionRatio() float64 {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+
+	if ft.WireBytes == 0 {
+		return 1
+	}
+	return float64(ft.ChunkBytes) / float64(ft.WireBytes)
+}
+
+// countChunk records a chunk of raw bytes that took wire bytes on the network
+func (ft *FileTransfer) countChunk(raw, wire int) {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+
+	ft.ChunkBytes += int64(raw)
+	ft.WireBytes += int64(wire)
+}
+
 // Close closes the file transfer and cleans up resources
 func (ft *FileTransfer) Close() error {
-	if ft.file != nil {
-		return ft.file.Close()
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+
+	if ft.file == nil {
+		return nil
 	}
-	return nil
+	err := ft.file.Close()
+	ft.file = nil
+	return err
 }
 
 // IsOutgoing returns true if this is an outgoing file transfer
@@ -263,21 +440,242 @@ func (ft *FileTransfer) IsOutgoing() bool {
 	return ft.isOutgoing
 }
 
+// setStatus updates the status and records the error that caused it, if any
+func (ft *FileTransfer) setStatus(status FileTransferStatus, err error) {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+
+	ft.Status = status
+	ft.Error = err
+	if status == FileTransferCompleted || status == FileTransferFailed || status == FileTransferCancelled {
+		ft.EndTime = time.Now()
+	}
+}
+
+// resumable reports whether the transfer can still be continued
+func (ft *FileTransfer) resumable() bool {
+	status, _ := ft.State()
+	return status == FileTransferPending || status == FileTransferActive
+}
+
+// snapshot returns an independent copy of the persistent transfer state
+func (ft *FileTransfer) snapshot() *FileTransfer {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+
+	return &FileTransfer{
+		ID:            ft.ID,
+		PeerID:        ft.PeerID,
+		Metadata:      ft.Metadata,
+		Status:        ft.Status,
+		Progress:      ft.Progress,
+		BytesTotal:    ft.BytesTotal,
+		BytesSent:     ft.BytesSent,
+		BytesReceived: ft.BytesReceived,
+		StartTime:     ft.StartTime,
+		EndTime:       ft.EndTime,
+		Error:         ft.Error,
+		Compression:   ft.Compression,
+		ChunkBytes:    ft.ChunkBytes,
+		WireBytes:     ft.WireBytes,
+		Encryption:    ft.Encryption,
+		LocalPath:     ft.LocalPath,
+		Chunks:        ft.Chunks.Clone(),
+		ChunkHashes:   append([]byte(nil), ft.ChunkHashes...),
+		isOutgoing:    ft.isOutgoing,
+		logger:        ft.logger,
+	}
+}
+
+// writeFileFrame writes a length-prefixed JSON frame on the file protocol
+func writeFileFrame(w io.Writer, request FileTransferRequest) error {
+	request.Magic = FileTransferMagic
+
+	data, err := json.Marshal(request)
+	if err != nil {
+		return fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	frame := make([]byte, 4+len(data))
+	binary.BigEndian.PutUint32(frame, uint32(len(data)))
+	copy(frame[4:], data)
+
+	if _, err := w.Write(frame); err != nil {
+		return fmt.Errorf("failed to write data: %w", err)
+	}
+
+	return nil
+}
+
+// readFileFrame reads a length-prefixed JSON frame on the file protocol
+func readFileFrame(r io.Reader) (*FileTransferRequest, error) {
+	var lenBytes [4]byte
+	if _, err := io.ReadFull(r, lenBytes[:]); err != nil {
+		return nil, fmt.Errorf("failed to read length: %w", err)
+	}
+
+	length := binary.BigEndian.Uint32(lenBytes[:])
+	if length > FileMaxFrameSize {
+		return nil, fmt.Errorf("frame too large: %d bytes", length)
+	}
+
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, fmt.Errorf("failed to read frame data: %w", err)
+	}
+
+	var request FileTransferRequest
+	if err := json.Unmarshal(data, &request); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal frame: %w", err)
+	}
+
+	if request.Magic != FileTransferMagic {
+		return nil, fmt.Errorf("invalid magic number: %x", request.Magic)
+	}
+
+	return &request, nil
+}
+
+// validateFileMetadata checks that offered metadata describes a consistent, acceptable file
+func validateFileMetadata(metadata FileMetadata) error {
+	if !validTransferID(metadata.ID) {
+		return fmt.Errorf("invalid transfer ID")
+	}
+	if !validMimeType(metadata.MimeType) {
+		return fmt.Errorf("invalid MIME type")
+	}
+	if len(metadata.Name) > maxOfferedNameBytes {
+		return fmt.Errorf("file name is too long")
+	}
+	if metadata.Path != "" {
+		if _, err := safeRelativePath(metadata.Path); err != nil {
+			return err
+		}
+	}
+	if metadata.Size < 0 || metadata.Size > MaxFileSize {
+		return fmt.Errorf("file size %d exceeds limit of %d bytes", metadata.Size, MaxFileSize)
+	}
+	if metadata.ChunkSize <= 0 || metadata.ChunkSize > FileChunkSize {
+		return fmt.Errorf("invalid chunk size %d", metadata.ChunkSize)
+	}
+	expected := int((metadata.Size + int64(metadata.ChunkSize) - 1) / int64(metadata.ChunkSize))
+	if metadata.ChunkCount != expected {
+		return fmt.Errorf("chunk count %d does not match file size", metadata.ChunkCount)
+	}
+	if root, err := hex.DecodeString(metadata.MerkleRoot); err != nil || (len(root) != 0 && len(root) != sha256.Size) {
+		return fmt.Errorf("invalid Merkle root")
+	}
+	if metadata.Preview != nil {
+		if err := validateFilePreview(metadata.Preview, metadata.MimeType); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validTransferID reports whether a transfer ID is short and only uses
+// characters that are safe in file names and terminals
+func validTransferID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, r := range id {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r == '-' || r == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+// validMimeType reports whether a MIME type only uses token characters
+func validMimeType(mimeType string) bool {
+	if len(mimeType) > 127 {
+		return false
+	}
+	for _, r := range mimeType {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("!#$&^_.+-/", r)) {
+			return false
+		}
+	}
+	return true
+}
+
+// validateRanges checks chunk ranges reported by a peer
+func validateRanges(ranges []ChunkRange, total int) error {
+	for _, r := range ranges {
+		if r.Start < 0 || r.End > total || r.Start >= r.End {
+			return fmt.Errorf("invalid chunk range [%d, %d)", r.Start, r.End)
+		}
+	}
+	return nil
+}
+
+// sameFile reports whether two metadata records describe the same file content
+func sameFile(a, b FileMetadata) bool {
+	return a.Hash == b.Hash && a.MerkleRoot == b.MerkleRoot && a.Size == b.Size &&
+		a.ChunkSize == b.ChunkSize && a.ChunkCount == b.ChunkCount
+}
+
+// errTransferRejected marks transfers the receiver refused; they are not resumed
+var errTransferRejected = errors.New("file transfer rejected")
+
+// fileSession is a running transfer session on a stream
+type fileSession struct {
+	stream network.Stream // nil for swarm downloads, which use several streams
+	done   chan struct{}
+}
+
 // FileTransferManager manages file transfers
 type FileTransferManager struct {
 	transfers map[string]*FileTransfer
+	sessions  map[string]*fileSession // transfer ID -> running session
 	logger    *logrus.Logger
+
+	// Wired up by the message manager
+	ctx           context.Context
+	host          host.Host
+	store         FileTransferStore // nil keeps transfer state in memory only
+	downloadDir   string
+	encryptAtRest bool // Keep received files encrypted with a key sealed to our identity
+
+	// Acceptance of incoming files (see file_policy.go)
+	policy          *FileAcceptPolicy
+	contacts        ContactStore // nil treats every sender as unknown
+	ownerDID        string
+	offers          map[offerKey]*FileOffer // Offers waiting for a decision
+	onOffer         func(FileOffer)
+	onOffersChanged func()
+	quotas          map[peer.ID]*peerQuota
+	receiving       int
+
+	// Swarm sharing of completed files (see swarm.go)
+	sharing        bool
+	contentRouting routing.ContentRouting // nil disables DHT provider records
+	shared         map[string]*sharedFile // Merkle root -> file
+
+	// Rate limits, message priority and deep sleep pauses (see bandwidth.go)
+	scheduler *transferScheduler
+
+	mu sync.Mutex
 }
 
 // NewFileTransferManager creates a new file transfer manager
 func NewFileTransferManager(logger *logrus.Logger) *FileTransferManager {
 	return &FileTransferManager{
-		transfers: make(map[string]*FileTransfer),
-		logger:    logger,
+		transfers:   make(map[string]*FileTransfer),
+		sessions:    make(map[string]*fileSession),
+		shared:      make(map[string]*sharedFile),
+		policy:      DefaultFileAcceptPolicy(),
+		offers:      make(map[offerKey]*FileOffer),
+		quotas:      make(map[peer.ID]*peerQuota),
+		scheduler:   newTransferScheduler(),
+		logger:      logger,
+		ctx:         context.Background(),
+		downloadDir: filepath.Join(os.Getenv("HOME"), ".xelvra", "downloads"),
 	}
 }
 
-// StartFileTransfer initiates a file transfer
+// StartFileTransfer initiates a file transfer on an open stream
 func (ftm *FileTransferManager) StartFileTransfer(ctx context.Context, stream network.Stream, filePath string, peerID peer.ID) error {
 	// Create file metadata
 	metadata, err := CreateFileMetadata(filePath)
@@ -285,53 +683,118 @@ func (ftm *FileTransferManager) StartFileTransfer(ctx context.Context, stream ne
 		return fmt.Errorf("failed to create file metadata: %w", err)
 	}
 
+	// Keep an absolute source path so the transfer can resume after a restart
+	sourcePath, err := filepath.Abs(filePath)
+	if err != nil {
+		return fmt.Errorf("failed to resolve file path: %w", err)
+	}
+
 	// Create file transfer session
-	transfer := NewFileTransfer(metadata.ID, peerID, *metadata, true, ftm.logger)
+	transfer := ftm.registerOutgoing(peerID, *metadata, sourcePath)
+	return ftm.runOutgoing(ctx, stream, transfer)
+}
+
+// registerOutgoing registers and saves a new outgoing transfer of a local file
+func (ftm *FileTransferManager) registerOutgoing(peerID peer.ID, metadata FileMetadata, sourcePath string) *FileTransfer {
+	transfer := NewFileTransfer(metadata.ID, peerID, metadata, true, ftm.logger)
+	transfer.LocalPath = sourcePath
+
+	ftm.mu.Lock()
 	ftm.transfers[metadata.ID] = transfer
+	ftm.mu.Unlock()
+
+	ftm.save(transfer)
+	return transfer
+}
+
+// runOutgoing sends a registered outgoing transfer on an open stream
+func (ftm *FileTransferManager) runOutgoing(ctx context.Context, stream network.Stream, transfer *FileTransfer) error {
+	session, ok := ftm.claimSession(transfer.ID, stream)
+	if !ok {
+		return fmt.Errorf("file transfer %s is already running", transfer.ID)
+	}
+	defer ftm.endSession(transfer.ID, session)
 
 	ftm.logger.WithFields(logrus.Fields{
-		"transfer_id": metadata.ID,
-		"file_name":   metadata.Name,
-		"file_size":   metadata.Size,
-		"peer_id":     peerID.String(),
+		"transfer_id": transfer.ID,
+		"file_name":   transfer.Metadata.Name,
+		"file_size":   transfer.Metadata.Size,
+		"peer_id":     transfer.PeerID.String(),
 	}).Info("Starting file transfer")
 
-	// Send file transfer request
-	if err := transfer.SendFileRequest(stream); err != nil {
-		transfer.Status = FileTransferFailed
-		transfer.Error = err
-		return fmt.Errorf("failed to send file request: %w", err)
+	return ftm.sendTransfer(ctx, stream, transfer, false)
+}
+
+// sendTransfer runs the sending side of a session: offer, send the chunks the
+// receiver is missing, and repeat until the receiver acknowledges the whole file
+func (ftm *FileTransferManager) sendTransfer(ctx context.Context, stream network.Stream, transfer *FileTransfer, resume bool) error {
+	if err := ftm.checkSource(transfer); err != nil {
+		ftm.fail(transfer, err)
+		return err
+	}
+	if !urgentTransfer(transfer) && ftm.scheduler.isPaused() {
+		return ftm.interrupt(transfer, ErrTransfersPaused)
+	}
+
+	requestType := "request"
+	if resume {
+		requestType = "resume"
+	}
+	// Compression is only offered for files that are not compressed already
+	request := FileTransferRequest{Type: requestType, Metadata: transfer.Metadata}
+	if compressibleMimeType(transfer.Metadata.MimeType) {
+		request.Compression = CompressionZstd
+	}
+	aead, err := ftm.offerEncryption(stream, transfer, &request)
+	if err != nil {
+		err = fmt.Errorf("failed to set up end-to-end encryption: %w", err)
+		ftm.fail(transfer, err)
+		return err
+	}
+	if err := ftm.writeFrame(stream, request); err != nil {
+		return ftm.interrupt(transfer, fmt.Errorf("failed to send file request: %w", err))
 	}
 
-	// Wait for response (simplified - in production would be async)
-	response, err := ftm.readResponse(stream)
+	response, err := ftm.readFrame(stream)
 	if err != nil {
-		transfer.Status = FileTransferFailed
-		transfer.Error = err
-		return fmt.Errorf("failed to read response: %w", err)
+		return ftm.interrupt(transfer, fmt.Errorf("failed to read response: %w", err))
 	}
 
-	if response.Type == "reject" {
-		transfer.Status = FileTransferFailed
-		transfer.Error = fmt.Errorf("file transfer rejected: %s", response.Error)
-		return transfer.Error
+	switch response.Type {
+	case "accept":
+		// Only receivers on older protocols may take the file unencrypted
+		if response.Encryption != request.Encryption && requiresFileEncryption(stream) {
+			err := errors.New("receiver accepted the file without end-to-end encryption")
+			ftm.fail(transfer, err)
+			return err
+		}
+	case "reject":
+		err := fmt.Errorf("%w: %s", errTransferRejected, response.Error)
+		ftm.fail(transfer, err)
+		return err
+	default:
+		err := fmt.Errorf("unexpected response type: %s", response.Type)
+		ftm.fail(transfer, err)
+		return err
 	}
 
-	if response.Type != "accept" {
-		transfer.Status = FileTransferFailed
-		transfer.Error = fmt.Errorf("unexpected response type: %s", response.Type)
-		return transfer.Error
+	// Receivers on the legacy protocol do not grant credits
+	credits := response.Credits
+	if credits <= 0 {
+		credits = -1
 	}
 
-	// Start sending file chunks
-	return ftm.sendFileChunks(ctx, stream, transfer, filePath)
-}
+	missing := response.Missing
+	if err := validateRanges(missing, transfer.Metadata.ChunkCount); err != nil {
+		ftm.fail(transfer, err)
+		return err
+	}
 
-// sendFileChunks sends file data in chunks
-func (ftm *FileTransferManager) sendFileChunks(ctx context.Context, stream network.Stream, transfer *FileTransfer, filePath string) error {
-	file, err := os.Open(filePath)
+	file, err := os.Open(transfer.LocalPath)
 	if err != nil {
-		return fmt.Errorf("failed to open file: %w", err)
+		err = fmt.Errorf("failed to open file: %w", err)
+		ftm.fail(transfer, err)
+		return err
 	}
 	defer func() {
 		if err := file.Close(); err != nil {
@@ -339,110 +802,1139 @@ func (ftm *FileTransferManager) sendFileChunks(ctx context.Context, stream netwo
 		}
 	}()
 
-	transfer.file = file
+	transfer.mu.Lock()
 	transfer.Status = FileTransferActive
+	transfer.Compression = ""
+	if request.Compression != "" && response.Compression == request.Compression {
+		transfer.Compression = response.Compression
+	}
+	transfer.Encryption, transfer.aead = "", nil
+	if aead != nil && response.Encryption == request.Encryption {
+		transfer.Encryption, transfer.aead = response.Encryption, aead
+	}
+	transfer.BytesSent = transfer.Metadata.Size - rangesBytes(transfer.Metadata, missing)
+	transfer.UpdateProgress()
+	transfer.mu.Unlock()
+	ftm.save(transfer)
+
+	if resume {
+		ftm.logger.WithFields(logrus.Fields{
+			"transfer_id":    transfer.ID,
+			"missing_ranges": len(missing),
+			"progress":       fmt.Sprintf("%.1f%%", transfer.Progress*100),
+		}).Info("Resuming file transfer")
+	}
 
-	buffer := make([]byte, FileChunkSize)
-	chunkID := 0
+	for round := 0; ; round++ {
+		if err := ftm.sendChunks(ctx, stream, transfer, file, missing, &credits); err != nil {
+			return ftm.interrupt(transfer, err)
+		}
 
-	for {
-		select {
-		case <-ctx.Done():
-			transfer.Status = FileTransferCancelled
-			return ctx.Err()
+		if err := ftm.writeFrame(stream, FileTransferRequest{Type: "complete"}); err != nil {
+			return ftm.interrupt(transfer, fmt.Errorf("failed to send completion: %w", err))
+		}
+
+		reply, err := ftm.readReply(stream, &credits)
+		if err != nil {
+			return ftm.interrupt(transfer, fmt.Errorf("failed to read acknowledgment: %w", err))
+		}
+
+		switch reply.Type {
+		case "ack":
+		case "retransmit":
+		case "reject":
+			err := fmt.Errorf("%w: %s", errTransferRejected, reply.Error)
+			ftm.fail(transfer, err)
+			return err
 		default:
+			err := fmt.Errorf("unexpected response type: %s", reply.Type)
+			ftm.fail(transfer, err)
+			return err
 		}
 
-		n, err := file.Read(buffer)
-		if err == io.EOF {
+		if reply.Type == "ack" {
+			if !verifyFileAck(stream.Conn().RemotePublicKey(), transfer.Metadata, reply.Signature) {
+				err := fmt.Errorf("invalid acknowledgment signature")
+				ftm.fail(transfer, err)
+				return err
+			}
 			break
 		}
+
+		if round+1 >= fileCompleteRounds {
+			err := fmt.Errorf("receiver still requests %d chunk ranges", len(reply.Missing))
+			ftm.fail(transfer, err)
+			return err
+		}
+		if len(reply.Missing) == 0 {
+			err := fmt.Errorf("retransmit request without chunk ranges")
+			ftm.fail(transfer, err)
+			return err
+		}
+		if err := validateRanges(reply.Missing, transfer.Metadata.ChunkCount); err != nil {
+			ftm.fail(transfer, err)
+			return err
+		}
+
+		ftm.logger.WithFields(logrus.Fields{
+			"transfer_id":    transfer.ID,
+			"missing_ranges": len(reply.Missing),
+		}).Warn("Receiver requested chunk retransmission")
+
+		missing = reply.Missing
+		transfer.mu.Lock()
+		transfer.BytesSent -= rangesBytes(transfer.Metadata, missing)
+		transfer.UpdateProgress()
+		transfer.mu.Unlock()
+	}
+
+	transfer.setStatus(FileTransferCompleted, nil)
+	ftm.save(transfer)
+	ftm.shareCompleted(transfer)
+
+	ftm.logger.WithFields(logrus.Fields{
+		"transfer_id":       transfer.ID,
+		"file_name":         transfer.Metadata.Name,
+		"bytes_sent":        transfer.BytesSent,
+		"duration":          transfer.EndTime.Sub(transfer.StartTime),
+		"compression_ratio": fmt.Sprintf("%.2f", transfer.CompressionRatio()),
+	}).Info("File transfer completed successfully")
+
+	return nil
+}
+
+// sendChunks sends the chunks in the given ranges, waiting for receiver credits
+// whenever the window is used up. Negative credits mean no flow control.
+func (ftm *FileTransferManager) sendChunks(ctx context.Context, stream network.Stream, transfer *FileTransfer, file *os.File, ranges []ChunkRange, credits *int) error {
+	buffer := make([]byte, transfer.Metadata.ChunkSize)
+
+	for _, r := range ranges {
+		for chunkID := r.Start; chunkID < r.End; chunkID++ {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			default:
+			}
+
+			for *credits == 0 {
+				if err := ftm.awaitCredits(stream, credits); err != nil {
+					return err
+				}
+			}
+
+			n := chunkLength(transfer.Metadata, chunkID)
+			chunkData := buffer[:n]
+			if _, err := file.ReadAt(chunkData, int64(chunkID)*int64(transfer.Metadata.ChunkSize)); err != nil {
+				return fmt.Errorf("failed to read file chunk %d: %w", chunkID, err)
+			}
+
+			chunk, err := transfer.chunkFrame(chunkID, chunkData)
+			if err != nil {
+				return err
+			}
+			// Chunks that do not shrink are sent as they are
+			if transfer.Compression == CompressionZstd {
+				if compressed, ok := compressData(chunk.Data); ok {
+					chunk.Data, chunk.Compressed = compressed, true
+				}
+			}
+			transfer.countChunk(int(n), len(chunk.Data))
+			if transfer.aead != nil {
+				chunk.Data = encryptChunk(transfer.aead, transfer.ID, chunkID, chunk.Data)
+			}
+
+			if err := ftm.scheduler.waitUpload(ctx, transfer.PeerID, len(chunk.Data), urgentTransfer(transfer)); err != nil {
+				return err
+			}
+			if err := ftm.writeFrame(stream, chunk); err != nil {
+				return fmt.Errorf("failed to send chunk %d: %w", chunkID, err)
+			}
+			if *credits > 0 {
+				*credits--
+			}
+
+			transfer.mu.Lock()
+			transfer.BytesSent += n
+			transfer.UpdateProgress()
+			transfer.mu.Unlock()
+
+			ftm.logger.WithFields(logrus.Fields{
+				"transfer_id": transfer.ID,
+				"chunk_id":    chunkID,
+				"chunk_size":  n,
+			}).Debug("Sent file chunk")
+		}
+	}
+
+	return nil
+}
+
+// checkSource verifies the source file has not changed since the transfer started
+func (ftm *FileTransferManager) checkSource(transfer *FileTransfer) error {
+	info, err := os.Stat(transfer.LocalPath)
+	if err != nil {
+		return fmt.Errorf("failed to stat source file: %w", err)
+	}
+	if info.Size() != transfer.Metadata.Size || !info.ModTime().Equal(transfer.Metadata.Timestamp) {
+		return fmt.Errorf("source file %s changed since the transfer started", transfer.LocalPath)
+	}
+	return nil
+}
+
+// HandleStream runs the receiving side of a file transfer session
+func (ftm *FileTransferManager) HandleStream(stream network.Stream) {
+	defer func() {
+		if err := stream.Close(); err != nil {
+			ftm.logger.WithError(err).Debug("Failed to close file stream")
+		}
+	}()
+
+	remotePeer := stream.Conn().RemotePeer()
+	if err := ftm.receiveTransfer(stream, remotePeer); err != nil {
+		ftm.logger.WithError(err).WithField("peer", remotePeer.String()).Warn("File transfer session ended")
+	}
+}
+
+// receiveTransfer accepts an offer, reports the chunks still missing and stores
+// chunks until the sender completes the transfer
+func (ftm *FileTransferManager) receiveTransfer(stream network.Stream, remotePeer peer.ID) error {
+	request, err := ftm.readFrame(stream)
+	if err != nil {
+		return fmt.Errorf("failed to read file transfer request: %w", err)
+	}
+	if request.Type == "manifest" {
+		return ftm.receiveManifest(stream, remotePeer, request)
+	}
+	if request.Type != "request" && request.Type != "resume" {
+		return fmt.Errorf("unexpected file transfer request type: %s", request.Type)
+	}
+
+	ftm.logger.WithFields(logrus.Fields{
+		"peer":      remotePeer.String(),
+		"file_name": request.Metadata.Name,
+		"file_size": request.Metadata.Size,
+		"resume":    request.Type == "resume",
+	}).Info("Received file transfer request")
+
+	if err := ftm.checkSender(remotePeer); err != nil {
+		return ftm.reject(stream, err)
+	}
+	if request.Encryption != EncryptionAESGCM && requiresFileEncryption(stream) {
+		return ftm.reject(stream, errors.New("file offer is not end-to-end encrypted"))
+	}
+
+	// Transfers accepted earlier resume without asking again
+	refund := func() {}
+	if !ftm.acceptedBefore(remotePeer, request.Metadata) {
+		if err := validateFileMetadata(request.Metadata); err != nil {
+			return ftm.reject(stream, err)
+		}
+		if err := ftm.checkOffer(remotePeer, request.Metadata); err != nil {
+			return ftm.reject(stream, err)
+		}
+		if _, err := ftm.awaitDecision(remotePeer, request.Metadata, nil); err != nil {
+			return ftm.reject(stream, err)
+		}
+		var err error
+		if refund, err = ftm.reserveQuota(remotePeer, request.Metadata.Size); err != nil {
+			return ftm.reject(stream, err)
+		}
+	}
+
+	release, err := ftm.admit()
+	if err != nil {
+		refund()
+		return ftm.reject(stream, err)
+	}
+	defer release()
+
+	transfer, err := ftm.prepareIncoming(remotePeer, request.Metadata)
+	if err != nil {
+		refund()
+		return ftm.reject(stream, err)
+	}
+
+	session := ftm.takeoverSession(transfer.ID, stream)
+	defer ftm.endSession(transfer.ID, session)
+	defer func() {
+		if err := transfer.Close(); err != nil {
+			ftm.logger.WithError(err).Warn("Failed to close received file")
+		}
+	}()
+
+	if err := ftm.openPartial(transfer); err != nil {
+		return ftm.reject(stream, err)
+	}
+
+	transfer.mu.Lock()
+	missing := transfer.Chunks.MissingRanges()
+	transfer.mu.Unlock()
+
+	// On the binary protocol the sender may have a window of chunks in flight,
+	// and every chunk received is credited back in batches
+	accept := FileTransferRequest{Type: "accept", Missing: missing}
+	if request.Compression == CompressionZstd {
+		accept.Compression = CompressionZstd
+	}
+	var aead cipher.AEAD
+	if request.Encryption == EncryptionAESGCM {
+		if aead, err = ftm.acceptEncryption(transfer.ID, request.FileKey); err != nil {
+			return ftm.reject(stream, err)
+		}
+		accept.Encryption = EncryptionAESGCM
+	}
+	transfer.mu.Lock()
+	transfer.Compression = accept.Compression
+	transfer.Encryption, transfer.aead = accept.Encryption, aead
+	transfer.mu.Unlock()
+
+	flowControl := isBinaryFileStream(stream)
+	if flowControl {
+		accept.Credits = FileWindowChunks
+	}
+	uncredited := 0
+	grantCredits := func() error {
+		if !flowControl || uncredited == 0 {
+			return nil
+		}
+		if err := ftm.writeFrame(stream, FileTransferRequest{Type: "credit", Credits: uncredited}); err != nil {
+			return fmt.Errorf("failed to send credits: %w", err)
+		}
+		uncredited = 0
+		return nil
+	}
+
+	if err := ftm.writeFrame(stream, accept); err != nil {
+		ftm.suspendIncoming(transfer)
+		return fmt.Errorf("failed to send acceptance: %w", err)
+	}
+
+	ftm.logger.WithFields(logrus.Fields{
+		"transfer_id":    transfer.ID,
+		"missing_ranges": len(missing),
+	}).Info("File transfer accepted, ready to receive")
+
+	for {
+		frame, err := ftm.readFrame(stream)
 		if err != nil {
-			transfer.Status = FileTransferFailed
-			transfer.Error = err
-			return fmt.Errorf("failed to read file chunk: %w", err)
+			ftm.suspendIncoming(transfer)
+			return fmt.Errorf("file transfer interrupted: %w", err)
 		}
 
-		// Send chunk
-		chunkData := buffer[:n]
-		if err := transfer.SendFileChunk(stream, chunkID, chunkData); err != nil {
-			transfer.Status = FileTransferFailed
-			transfer.Error = err
-			return fmt.Errorf("failed to send chunk %d: %w", chunkID, err)
+		switch frame.Type {
+		case "chunk":
+			if frame.TransferID != "" && frame.TransferID != transfer.ID {
+				ftm.suspendIncoming(transfer)
+				return fmt.Errorf("chunk for transfer %s on stream of transfer %s", frame.TransferID, transfer.ID)
+			}
+			if err := ftm.decryptFrame(transfer, frame); err != nil {
+				ftm.suspendIncoming(transfer)
+				return err
+			}
+			wire := len(frame.Data)
+			if err := ftm.decompressChunk(transfer, frame); err != nil {
+				ftm.suspendIncoming(transfer)
+				return err
+			}
+			if _, err := ftm.storeChunk(transfer, frame); err != nil {
+				ftm.suspendIncoming(transfer)
+				return err
+			}
+			transfer.countChunk(len(frame.Data), wire)
+			if err := ftm.scheduler.waitDownload(ftm.ctx, remotePeer, wire); err != nil {
+				ftm.suspendIncoming(transfer)
+				return err
+			}
+			if uncredited++; uncredited >= fileCreditBatch {
+				if err := grantCredits(); err != nil {
+					ftm.suspendIncoming(transfer)
+					return err
+				}
+			}
+
+		case "complete":
+			// Return the whole window before a retransmit round
+			if err := grantCredits(); err != nil {
+				ftm.suspendIncoming(transfer)
+				return err
+			}
+
+			missing, err := ftm.verifyIncoming(transfer)
+			if err != nil {
+				ftm.discardIncoming(transfer, err)
+				return ftm.reject(stream, err)
+			}
+
+			if len(missing) > 0 {
+				if err := ftm.writeFrame(stream, FileTransferRequest{Type: "retransmit", Missing: missing}); err != nil {
+					ftm.suspendIncoming(transfer)
+					return fmt.Errorf("failed to send retransmit request: %w", err)
+				}
+				continue
+			}
+
+			if err := ftm.finishIncoming(transfer); err != nil {
+				ftm.discardIncoming(transfer, err)
+				return ftm.reject(stream, err)
+			}
+
+			signature, err := ftm.signFileAck(transfer.Metadata)
+			if err != nil {
+				return fmt.Errorf("failed to sign acknowledgment: %w", err)
+			}
+			if err := ftm.writeFrame(stream, FileTransferRequest{Type: "ack", Signature: signature}); err != nil {
+				return fmt.Errorf("failed to send acknowledgment: %w", err)
+			}
+			return nil
+
+		default:
+			ftm.suspendIncoming(transfer)
+			return fmt.Errorf("unexpected file transfer frame type: %s", frame.Type)
 		}
+	}
+}
+
+// prepareIncoming returns the transfer an offer continues, or registers a new one
+func (ftm *FileTransferManager) prepareIncoming(remotePeer peer.ID, metadata FileMetadata) (*FileTransfer, error) {
+	if err := validateFileMetadata(metadata); err != nil {
+		return nil, err
+	}
 
-		transfer.BytesSent += int64(n)
+	ftm.mu.Lock()
+	existing, exists := ftm.transfers[metadata.ID]
+	if exists {
+		if existing.isOutgoing || existing.PeerID != remotePeer {
+			ftm.mu.Unlock()
+			return nil, fmt.Errorf("transfer ID %s is already in use", metadata.ID)
+		}
+
+		status, _ := existing.State()
+		if sameFile(existing.Metadata, metadata) && status != FileTransferFailed && status != FileTransferCancelled {
+			ftm.mu.Unlock()
+			return existing, nil
+		}
+	}
+
+	transfer := NewFileTransfer(metadata.ID, remotePeer, metadata, false, ftm.logger)
+	transfer.LocalPath = ftm.partialPath(remotePeer, metadata.ID)
+	ftm.transfers[metadata.ID] = transfer
+	ftm.mu.Unlock()
+
+	// The sender started over with different content; drop what we had
+	if exists {
+		if err := os.Remove(transfer.LocalPath); err != nil && !os.IsNotExist(err) {
+			ftm.logger.WithError(err).Warn("Failed to remove stale partial file")
+		}
+	}
+
+	ftm.save(transfer)
+	return transfer, nil
+}
+
+// acceptedBefore reports whether an offer continues a transfer that was already
+// accepted from this peer
+func (ftm *FileTransferManager) acceptedBefore(remotePeer peer.ID, metadata FileMetadata) bool {
+	ftm.mu.Lock()
+	existing, exists := ftm.transfers[metadata.ID]
+	ftm.mu.Unlock()
+
+	if !exists || existing.isOutgoing || existing.PeerID != remotePeer || !sameFile(existing.Metadata, metadata) {
+		return false
+	}
+	status, _ := existing.State()
+	return status != FileTransferFailed && status != FileTransferCancelled
+}
+
+// openPartial opens the partial file of an incoming transfer for writing
+func (ftm *FileTransferManager) openPartial(transfer *FileTransfer) error {
+	transfer.mu.Lock()
+	defer transfer.mu.Unlock()
+
+	if transfer.Status == FileTransferCompleted {
+		return nil
+	}
+
+	if err := ensurePrivateDir(filepath.Dir(transfer.LocalPath)); err != nil {
+		return fmt.Errorf("failed to prepare staging directory: %w", err)
+	}
+
+	// Chunks recorded for a partial file that no longer exists, or without the
+	// hashes to verify them, must be fetched again
+	hashesSize := transfer.Metadata.ChunkCount * sha256.Size
+	if _, err := os.Stat(transfer.LocalPath); os.IsNotExist(err) || len(transfer.ChunkHashes) != hashesSize {
+		if transfer.Chunks.Count() > 0 {
+			transfer.logger.WithField("transfer_id", transfer.ID).Warn("Partial file state lost, restarting transfer")
+		}
+		transfer.Chunks = NewChunkBitmap(transfer.Metadata.ChunkCount)
+		transfer.ChunkHashes = make([]byte, hashesSize)
+		transfer.BytesReceived = 0
 		transfer.UpdateProgress()
+	}
+
+	file, err := os.OpenFile(transfer.LocalPath, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open partial file: %w", err)
+	}
+
+	transfer.file = file
+	transfer.Status = FileTransferActive
+	return nil
+}
+
+// offerEncryption seals a new content key to the receiver's identity key and
+// offers it with the request. Every session gets its own key, so chunks resent
+// after a resume are never sealed twice under one key and nonce. It returns the
+// chunk cipher to use if the receiver agrees.
+func (ftm *FileTransferManager) offerEncryption(stream network.Stream, transfer *FileTransfer, request *FileTransferRequest) (cipher.AEAD, error) {
+	key, err := newFileKey()
+	if err != nil {
+		return nil, err
+	}
 
+	aead, err := fileCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := sealFileKey(stream.Conn().RemotePublicKey(), transfer.ID, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to seal file key: %w", err)
+	}
+
+	request.Encryption, request.FileKey = EncryptionAESGCM, sealed
+	return aead, nil
+}
+
+// acceptEncryption opens the content key of an encrypted offer and returns its chunk cipher
+func (ftm *FileTransferManager) acceptEncryption(transferID string, sealedKey []byte) (cipher.AEAD, error) {
+	if ftm.host == nil {
+		return nil, fmt.Errorf("no host key to open the file key with")
+	}
+	key, err := openFileKey(ftm.host.Peerstore().PrivKey(ftm.host.ID()), transferID, sealedKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file key: %w", err)
+	}
+	return fileCipher(key)
+}
+
+// decryptFrame replaces the data of a chunk with its plaintext if the session is encrypted
+func (ftm *FileTransferManager) decryptFrame(transfer *FileTransfer, frame *FileTransferRequest) error {
+	if transfer.aead == nil {
+		return nil
+	}
+	data, err := decryptChunk(transfer.aead, transfer.ID, frame.ChunkID, frame.Data)
+	if err != nil {
+		return err
+	}
+	frame.Data = data
+	return nil
+}
+
+// decompressChunk replaces the data of a compressed chunk with the original
+func (ftm *FileTransferManager) decompressChunk(transfer *FileTransfer, frame *FileTransferRequest) error {
+	if !frame.Compressed {
+		return nil
+	}
+	if transfer.Compression != CompressionZstd {
+		return fmt.Errorf("chunk %d is compressed but compression was not agreed", frame.ChunkID)
+	}
+
+	data, err := decompressData(frame.Data, transfer.Metadata.ChunkSize)
+	if err != nil {
+		return fmt.Errorf("failed to decompress chunk %d: %w", frame.ChunkID, err)
+	}
+	frame.Data, frame.Compressed = data, false
+	return nil
+}
+
+// storeChunk writes a received chunk at its offset and records it in the bitmap.
+// A chunk that does not match its hash or Merkle proof is dropped, reported as
+// invalid, and requested again later.
+func (ftm *FileTransferManager) storeChunk(transfer *FileTransfer, frame *FileTransferRequest) (bool, error) {
+	chunkID, data := frame.ChunkID, frame.Data
+	if frame.Compressed {
+		return false, fmt.Errorf("chunk %d is still compressed", chunkID)
+	}
+	if chunkID < 0 || chunkID >= transfer.Metadata.ChunkCount {
+		return false, fmt.Errorf("chunk %d out of range", chunkID)
+	}
+	if int64(len(data)) != chunkLength(transfer.Metadata, chunkID) {
+		return false, fmt.Errorf("chunk %d has unexpected size %d", chunkID, len(data))
+	}
+
+	hash := sha256.Sum256(data)
+	if !bytes.Equal(hash[:], frame.ChunkHash) || !verifyChunkProof(transfer.Metadata, chunkID, data, frame.Proof) {
 		ftm.logger.WithFields(logrus.Fields{
 			"transfer_id": transfer.ID,
 			"chunk_id":    chunkID,
-			"chunk_size":  n,
-			"progress":    fmt.Sprintf("%.1f%%", transfer.Progress*100),
-		}).Debug("Sent file chunk")
+		}).Warn("Dropping file chunk that failed verification")
+		return false, nil
+	}
 
-		chunkID++
+	transfer.mu.Lock()
+	if transfer.Chunks.Has(chunkID) {
+		transfer.mu.Unlock()
+		return true, nil // Duplicate after a retransmit
+	}
+	if transfer.file == nil {
+		transfer.mu.Unlock()
+		return false, fmt.Errorf("staged file is not open")
 	}
 
-	// Send completion notification
-	if err := transfer.SendFileComplete(stream); err != nil {
-		transfer.Status = FileTransferFailed
-		transfer.Error = err
-		return fmt.Errorf("failed to send completion: %w", err)
+	if _, err := transfer.file.WriteAt(data, int64(chunkID)*int64(transfer.Metadata.ChunkSize)); err != nil {
+		transfer.mu.Unlock()
+		return false, fmt.Errorf("failed to write chunk %d: %w", chunkID, err)
 	}
 
-	transfer.Status = FileTransferCompleted
-	transfer.EndTime = time.Now()
+	transfer.Chunks.Set(chunkID)
+	copy(transfer.ChunkHashes[chunkID*sha256.Size:], hash[:])
+	transfer.BytesReceived += int64(len(data))
+	transfer.UpdateProgress()
+	checkpoint := transfer.Chunks.Count()%FileStateSaveInterval == 0
+	transfer.mu.Unlock()
 
 	ftm.logger.WithFields(logrus.Fields{
+		"transfer_id": transfer.ID,
+		"chunk_id":    chunkID,
+		"chunk_size":  len(data),
+	}).Debug("Received file chunk")
+
+	if checkpoint {
+		ftm.checkpoint(transfer)
+	}
+	return true, nil
+}
+
+// verifyChunkProof checks a chunk against the Merkle root of its file. Files
+// offered without a root are only protected by the chunk hash.
+func verifyChunkProof(metadata FileMetadata, chunkID int, data []byte, proof [][]byte) bool {
+	if metadata.MerkleRoot == "" {
+		return true
+	}
+	root, err := hex.DecodeString(metadata.MerkleRoot)
+	if err != nil {
+		return false
+	}
+	return VerifyMerkleProof(root, chunkID, metadata.ChunkCount, MerkleLeafHash(data), proof)
+}
+
+// checkpoint flushes the partial file and then persists the bitmap, so a
+// recorded chunk is always on disk
+func (ftm *FileTransferManager) checkpoint(transfer *FileTransfer) {
+	transfer.mu.Lock()
+	file := transfer.file
+	transfer.mu.Unlock()
+
+	if file != nil {
+		if err := file.Sync(); err != nil {
+			ftm.logger.WithError(err).WithField("transfer_id", transfer.ID).Warn("Failed to sync partial file")
+			return
+		}
+	}
+	ftm.save(transfer)
+}
+
+// suspendIncoming records an interrupted incoming transfer so it can resume later
+func (ftm *FileTransferManager) suspendIncoming(transfer *FileTransfer) {
+	ftm.checkpoint(transfer)
+
+	ftm.logger.WithFields(logrus.Fields{
+		"transfer_id": transfer.ID,
+		"progress":    fmt.Sprintf("%.1f%%", transfer.Progress*100),
+	}).Info("File transfer interrupted, waiting for the sender to resume")
+}
+
+// verifyIncoming re-reads the staged file once every chunk has arrived. Chunks
+// that no longer match the hash recorded on arrival are cleared and returned for
+// retransmission; a file that does not match the offered SHA-256 is an error.
+func (ftm *FileTransferManager) verifyIncoming(transfer *FileTransfer) ([]ChunkRange, error) {
+	transfer.mu.Lock()
+	defer transfer.mu.Unlock()
+
+	if transfer.Status == FileTransferCompleted {
+		return nil, nil // Acknowledgment was lost and the sender asked again
+	}
+	if missing := transfer.Chunks.MissingRanges(); len(missing) > 0 {
+		return missing, nil
+	}
+	if transfer.file == nil {
+		return nil, fmt.Errorf("staged file is not open")
+	}
+
+	fileHash := sha256.New()
+	buffer := make([]byte, transfer.Metadata.ChunkSize)
+	corrupted := 0
+
+	for chunkID := 0; chunkID < transfer.Metadata.ChunkCount; chunkID++ {
+		data := buffer[:chunkLength(transfer.Metadata, chunkID)]
+		if _, err := transfer.file.ReadAt(data, int64(chunkID)*int64(transfer.Metadata.ChunkSize)); err != nil {
+			return nil, fmt.Errorf("failed to read staged chunk %d: %w", chunkID, err)
+		}
+
+		chunkHash := sha256.Sum256(data)
+		if !bytes.Equal(chunkHash[:], transfer.ChunkHashes[chunkID*sha256.Size:(chunkID+1)*sha256.Size]) {
+			transfer.Chunks.Clear(chunkID)
+			transfer.BytesReceived -= int64(len(data))
+			corrupted++
+			continue
+		}
+		fileHash.Write(data)
+	}
+
+	if corrupted > 0 {
+		transfer.UpdateProgress()
+		ftm.logger.WithFields(logrus.Fields{
+			"transfer_id": transfer.ID,
+			"corrupted":   corrupted,
+		}).Warn("Staged file has corrupted chunks, requesting retransmission")
+		return transfer.Chunks.MissingRanges(), nil
+	}
+
+	if actual := hex.EncodeToString(fileHash.Sum(nil)); actual != transfer.Metadata.Hash {
+		return nil, fmt.Errorf("file hash mismatch: expected %s, got %s", transfer.Metadata.Hash, actual)
+	}
+
+	return nil, nil
+}
+
+// discardIncoming marks an incoming transfer failed and removes its staged file
+func (ftm *FileTransferManager) discardIncoming(transfer *FileTransfer, reason error) {
+	if err := transfer.Close(); err != nil {
+		ftm.logger.WithError(err).Warn("Failed to close staged file")
+	}
+	if err := os.Remove(transfer.LocalPath); err != nil && !os.IsNotExist(err) {
+		ftm.logger.WithError(err).Warn("Failed to remove staged file")
+	}
+	ftm.fail(transfer, reason)
+
+	ftm.logger.WithError(reason).WithFields(logrus.Fields{
 		"transfer_id": transfer.ID,
 		"file_name":   transfer.Metadata.Name,
-		"bytes_sent":  transfer.BytesSent,
-		"duration":    transfer.EndTime.Sub(transfer.StartTime),
+	}).Error("File transfer failed verification")
+}
+
+// fileAckPayload is what a receiver signs to acknowledge a verified file
+func fileAckPayload(metadata FileMetadata) []byte {
+	payload := []byte("xelvra-file-ack-v1")
+	payload = append(payload, metadata.ID...)
+	payload = append(payload, 0)
+	return append(payload, metadata.Hash...)
+}
+
+// signFileAck signs the acknowledgment for a verified file with the host key
+func (ftm *FileTransferManager) signFileAck(metadata FileMetadata) ([]byte, error) {
+	if ftm.host == nil {
+		return nil, fmt.Errorf("no host to sign with")
+	}
+	privKey := ftm.host.Peerstore().PrivKey(ftm.host.ID())
+	if privKey == nil {
+		return nil, fmt.Errorf("host private key not available")
+	}
+	return privKey.Sign(fileAckPayload(metadata))
+}
+
+// verifyFileAck checks the receiver's signature on a file acknowledgment
+func verifyFileAck(receiverKey crypto.PubKey, metadata FileMetadata, signature []byte) bool {
+	if receiverKey == nil || len(signature) == 0 {
+		return false
+	}
+	valid, err := receiverKey.Verify(fileAckPayload(metadata), signature)
+	return err == nil && valid
+}
+
+// finishIncoming moves a fully received file into the download directory
+func (ftm *FileTransferManager) finishIncoming(transfer *FileTransfer) error {
+	if status, _ := transfer.State(); status == FileTransferCompleted {
+		return nil // Acknowledgment was lost and the sender asked again
+	}
+
+	transfer.mu.Lock()
+	file := transfer.file
+	transfer.file = nil
+	transfer.mu.Unlock()
+
+	if file != nil {
+		if err := file.Sync(); err != nil {
+			return fmt.Errorf("failed to sync received file: %w", err)
+		}
+		if err := file.Close(); err != nil {
+			return fmt.Errorf("failed to close received file: %w", err)
+		}
+	}
+
+	dir, name := ftm.downloadDir, transfer.Metadata.Name
+	if transfer.Metadata.Path != "" {
+		var err error
+		if dir, name, err = ftm.manifestFileDir(transfer.Metadata.Path); err != nil {
+			return err
+		}
+	}
+
+	stagedPath := transfer.LocalPath
+	if ftm.encryptAtRest {
+		encryptedPath, err := ftm.encryptStaged(stagedPath)
+		if err != nil {
+			return err
+		}
+		stagedPath, name = encryptedPath, name+EncryptedFileExt
+	}
+
+	destPath, err := publishFile(stagedPath, dir, name)
+	if err != nil {
+		if stagedPath != transfer.LocalPath {
+			_ = os.Remove(stagedPath)
+		}
+		return err
+	}
+	if stagedPath != transfer.LocalPath {
+		if err := os.Remove(transfer.LocalPath); err != nil {
+			ftm.logger.WithError(err).Warn("Failed to remove staged plaintext file")
+		}
+	} else if transfer.Metadata.Mode != 0 {
+		if err := os.Chmod(destPath, receivedFileMode(transfer.Metadata.Mode)); err != nil {
+			ftm.logger.WithError(err).Warn("Failed to set received file permissions")
+		}
+	}
+
+	transfer.mu.Lock()
+	transfer.LocalPath = destPath
+	transfer.mu.Unlock()
+	transfer.setStatus(FileTransferCompleted, nil)
+	ftm.save(transfer)
+	ftm.shareCompleted(transfer)
+
+	ftm.logger.WithFields(logrus.Fields{
+		"transfer_id":       transfer.ID,
+		"file_name":         transfer.Metadata.Name,
+		"dest_path":         destPath,
+		"bytes_received":    transfer.BytesReceived,
+		"duration":          transfer.EndTime.Sub(transfer.StartTime),
+		"compression_ratio": fmt.Sprintf("%.2f", transfer.CompressionRatio()),
 	}).Info("File transfer completed successfully")
 
 	return nil
 }
 
-// readResponse reads a file transfer response from the stream
-func (ftm *FileTransferManager) readResponse(stream network.Stream) (*FileTransferRequest, error) {
-	// Read length prefix
-	var length uint32
-	if err := binary.Read(stream, binary.BigEndian, &length); err != nil {
-		return nil, fmt.Errorf("failed to read length: %w", err)
+// encryptStaged encrypts a verified staged file for keeping at rest, with a
+// key sealed to our identity key, and returns the encrypted staged file
+func (ftm *FileTransferManager) encryptStaged(stagedPath string) (string, error) {
+	if ftm.host == nil {
+		return "", fmt.Errorf("no host key to encrypt the file for")
 	}
+	keyPair, err := identityKeyPair(ftm.host.Peerstore().PrivKey(ftm.host.ID()))
+	if err != nil {
+		return "", err
+	}
+	keyPair.Destroy()
 
-	if length > FileHeaderSize {
-		return nil, fmt.Errorf("response too large: %d bytes", length)
+	encryptedPath := stagedPath + EncryptedFileExt
+	if err := os.Remove(encryptedPath); err != nil && !os.IsNotExist(err) {
+		return "", fmt.Errorf("failed to remove stale encrypted file: %w", err)
+	}
+	if err := encryptFileAtRest(stagedPath, encryptedPath, keyPair.PublicKey); err != nil {
+		return "", err
 	}
+	return encryptedPath, nil
+}
 
-	// Read data
-	data := make([]byte, length)
-	if _, err := io.ReadFull(stream, data); err != nil {
-		return nil, fmt.Errorf("failed to read response data: %w", err)
+// partialPath returns where an incoming transfer is staged until it completes.
+// The name is derived from the sender and transfer ID so peers cannot choose it.
+func (ftm *FileTransferManager) partialPath(remotePeer peer.ID, transferID string) string {
+	sum := sha256.Sum256([]byte(remotePeer.String() + "/" + transferID))
+	return filepath.Join(ftm.downloadDir, stagingDirName, hex.EncodeToString(sum[:16])+".part")
+}
+
+// ResumePeer resumes unfinished outgoing transfers to a peer in the background
+func (ftm *FileTransferManager) ResumePeer(peerID peer.ID) {
+	if ftm.host == nil {
+		return
+	}
+
+	paused := ftm.scheduler.isPaused()
+
+	ftm.mu.Lock()
+	var pending []*FileTransfer
+	for _, transfer := range ftm.transfers {
+		if transfer.isOutgoing && transfer.PeerID == peerID && ftm.sessions[transfer.ID] == nil && transfer.resumable() &&
+			(!paused || urgentTransfer(transfer)) {
+			pending = append(pending, transfer)
+		}
+	}
+	ftm.mu.Unlock()
+
+	for _, transfer := range pending {
+		go ftm.resumeTransfer(transfer)
+	}
+}
+
+// resumeTransfer retries an outgoing transfer while the peer stays connected
+func (ftm *FileTransferManager) resumeTransfer(transfer *FileTransfer) {
+	for attempt := 0; attempt < FileResumeAttempts; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ftm.ctx.Done():
+				return
+			case <-time.After(FileResumeDelay):
+			}
+		}
+
+		if ftm.host.Network().Connectedness(transfer.PeerID) != network.Connected {
+			return
+		}
+
+		err := ftm.resumeOnce(transfer)
+		if err == nil || !transfer.resumable() || errors.Is(err, ErrTransfersPaused) {
+			return
+		}
+
+		ftm.logger.WithError(err).WithFields(logrus.Fields{
+			"transfer_id": transfer.ID,
+			"attempt":     attempt + 1,
+		}).Debug("File transfer resume attempt failed")
+	}
+}
+
+// resumeOnce opens a stream and continues an outgoing transfer
+func (ftm *FileTransferManager) resumeOnce(transfer *FileTransfer) error {
+	ctx, cancel := context.WithTimeout(ftm.ctx, FileIdleTimeout)
+	stream, err := ftm.host.NewStream(ctx, transfer.PeerID, EncryptedFileStreamProtocolID, FileStreamProtocolID, FileProtocolID)
+	cancel()
+	if err != nil {
+		return fmt.Errorf("failed to open file stream to peer: %w", err)
+	}
+
+	session, ok := ftm.claimSession(transfer.ID, stream)
+	if !ok {
+		// Another attempt is already running
+		if err := stream.Reset(); err != nil {
+			ftm.logger.WithError(err).Debug("Failed to reset file stream")
+		}
+		return nil
+	}
+	defer ftm.endSession(transfer.ID, session)
+	defer func() {
+		if err := stream.Close(); err != nil {
+			ftm.logger.WithError(err).Debug("Failed to close file transfer stream")
+		}
+	}()
+
+	return ftm.sendTransfer(ftm.ctx, stream, transfer, true)
+}
+
+// restore loads unfinished transfers from the store and resumes those whose
+// peer is already connected
+func (ftm *FileTransferManager) restore() {
+	if ftm.store == nil {
+		return
+	}
+
+	transfers, err := ftm.store.LoadResumableTransfers()
+	if err != nil {
+		ftm.logger.WithError(err).Warn("Failed to load unfinished file transfers")
+		return
+	}
+
+	ftm.mu.Lock()
+	for _, transfer := range transfers {
+		if _, exists := ftm.transfers[transfer.ID]; !exists {
+			transfer.logger = ftm.logger
+			ftm.transfers[transfer.ID] = transfer
+		}
+	}
+	ftm.mu.Unlock()
+
+	if len(transfers) > 0 {
+		ftm.logger.WithField("count", len(transfers)).Info("Loaded unfinished file transfers")
+	}
+
+	if ftm.host != nil {
+		for _, peerID := range ftm.host.Network().Peers() {
+			ftm.ResumePeer(peerID)
+		}
+	}
+}
+
+// claimSession registers a session for a transfer unless one is already running
+func (ftm *FileTransferManager) claimSession(id string, stream network.Stream) (*fileSession, bool) {
+	ftm.mu.Lock()
+	defer ftm.mu.Unlock()
+
+	if _, running := ftm.sessions[id]; running {
+		return nil, false
+	}
+	session := &fileSession{stream: stream, done: make(chan struct{})}
+	ftm.sessions[id] = session
+	return session, true
+}
+
+// takeoverSession registers a session for a transfer, resetting a previous
+// session first. A resuming sender may reach us before we notice its old stream died.
+func (ftm *FileTransferManager) takeoverSession(id string, stream network.Stream) *fileSession {
+	for {
+		session, ok := ftm.claimSession(id, stream)
+		if ok {
+			return session
+		}
+
+		ftm.mu.Lock()
+		previous := ftm.sessions[id]
+		ftm.mu.Unlock()
+		if previous == nil {
+			continue
+		}
+
+		if previous.stream != nil {
+			if err := previous.stream.Reset(); err != nil {
+				ftm.logger.WithError(err).Debug("Failed to reset previous file stream")
+			}
+		}
+		<-previous.done
+	}
+}
+
+// endSession unregisters a session
+func (ftm *FileTransferManager) endSession(id string, session *fileSession) {
+	ftm.mu.Lock()
+	if ftm.sessions[id] == session {
+		delete(ftm.sessions, id)
+	}
+	ftm.mu.Unlock()
+	close(session.done)
+}
+
+// Stop interrupts running sessions; their state stays resumable
+func (ftm *FileTransferManager) Stop() {
+	ftm.mu.Lock()
+	sessions := make([]*fileSession, 0, len(ftm.sessions))
+	for _, session := range ftm.sessions {
+		sessions = append(sessions, session)
+	}
+	ftm.mu.Unlock()
+
+	for _, session := range sessions {
+		if session.stream == nil {
+			continue // Swarm downloads stop with the context
+		}
+		if err := session.stream.Reset(); err != nil {
+			ftm.logger.WithError(err).Debug("Failed to reset file stream")
+		}
+	}
+}
+
+// interrupt records a transfer that stopped mid-way and can be resumed
+func (ftm *FileTransferManager) interrupt(transfer *FileTransfer, err error) error {
+	transfer.mu.Lock()
+	transfer.Error = err
+	transfer.mu.Unlock()
+	ftm.save(transfer)
+
+	ftm.logger.WithError(err).WithField("transfer_id", transfer.ID).Warn("File transfer interrupted, will resume when the peer reconnects")
+	return fmt.Errorf("file transfer interrupted: %w", err)
+}
+
+// fail marks a transfer as failed for good
+func (ftm *FileTransferManager) fail(transfer *FileTransfer, err error) {
+	transfer.setStatus(FileTransferFailed, err)
+	ftm.save(transfer)
+}
+
+// reject tells the sender we refuse a transfer and returns the reason
+func (ftm *FileTransferManager) reject(stream network.Stream, reason error) error {
+	if err := ftm.writeFrame(stream, FileTransferRequest{Type: "reject", Error: reason.Error()}); err != nil {
+		ftm.logger.WithError(err).Debug("Failed to send file transfer rejection")
 	}
+	return fmt.Errorf("rejected file transfer: %w", reason)
+}
 
-	// Parse response
-	var response FileTransferRequest
-	if err := json.Unmarshal(data, &response); err != nil {
-		return nil, fmt.Errorf("failed to unmarshal response: %w", err)
+// save persists transfer state if a store is configured
+func (ftm *FileTransferManager) save(transfer *FileTransfer) {
+	if ftm.store == nil {
+		return
+	}
+	if err := ftm.store.SaveFileTransfer(transfer.snapshot()); err != nil {
+		ftm.logger.WithError(err).WithField("transfer_id", transfer.ID).Warn("Failed to save file transfer state")
 	}
+}
 
-	if response.Magic != FileTransferMagic {
-		return nil, fmt.Errorf("invalid magic number: %x", response.Magic)
+// writeFrame writes a frame with a write deadline
+func (ftm *FileTransferManager) writeFrame(stream network.Stream, request FileTransferRequest) error {
+	if err := stream.SetWriteDeadline(time.Now().Add(FileIdleTimeout)); err != nil {
+		ftm.logger.WithError(err).Debug("Failed to set file stream write deadline")
+	}
+	if isBinaryFileStream(stream) {
+		return writeBinaryFileFrame(stream, request)
 	}
+	return writeFileFrame(stream, request)
+}
 
-	return &response, nil
+// readFrame reads a frame with a read deadline
+func (ftm *FileTransferManager) readFrame(stream network.Stream) (*FileTransferRequest, error) {
+	if err := stream.SetReadDeadline(time.Now().Add(FileIdleTimeout)); err != nil {
+		ftm.logger.WithError(err).Debug("Failed to set file stream read deadline")
+	}
+	if isBinaryFileStream(stream) {
+		return readBinaryFileFrame(stream)
+	}
+	return readFileFrame(stream)
+}
+
+// readReply reads the next frame that is not a credit grant, adding any
+// credits it passes to the sender's window
+func (ftm *FileTransferManager) readReply(stream network.Stream, credits *int) (*FileTransferRequest, error) {
+	for {
+		frame, err := ftm.readFrame(stream)
+		if err != nil {
+			return nil, err
+		}
+		if frame.Type != "credit" {
+			return frame, nil
+		}
+		if err := addCredits(credits, frame.Credits); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// awaitCredits blocks until the receiver grants more credits
+func (ftm *FileTransferManager) awaitCredits(stream network.Stream, credits *int) error {
+	frame, err := ftm.readFrame(stream)
+	if err != nil {
+		return fmt.Errorf("failed to wait for credits: %w", err)
+	}
+
+	switch frame.Type {
+	case "credit":
+		return addCredits(credits, frame.Credits)
+	case "reject":
+		return fmt.Errorf("%w: %s", errTransferRejected, frame.Error)
+	default:
+		return fmt.Errorf("unexpected frame while waiting for credits: %s", frame.Type)
+	}
+}
+
+// addCredits adds a credit grant to the sender's window. A receiver never has
+// more than a window of chunks outstanding, so larger grants are a protocol error.
+func addCredits(credits *int, granted int) error {
+	if granted <= 0 || granted > FileWindowChunks {
+		return fmt.Errorf("invalid credit grant: %d", granted)
+	}
+	if *credits >= 0 {
+		*credits += granted
+	}
+	return nil
 }
 
 // GetTransfer returns a file transfer by ID
 func (ftm *FileTransferManager) GetTransfer(id string) (*FileTransfer, bool) {
+	ftm.mu.Lock()
+	defer ftm.mu.Unlock()
 	transfer, exists := ftm.transfers[id]
 	return transfer, exists
 }
 
 // ListTransfers returns all active transfers
 func (ftm *FileTransferManager) ListTransfers() []*FileTransfer {
+	ftm.mu.Lock()
+	defer ftm.mu.Unlock()
 	transfers := make([]*FileTransfer, 0, len(ftm.transfers))
 	for _, transfer := range ftm.transfers {
 		transfers = append(transfers, transfer)
@@ -452,10 +1944,14 @@ func (ftm *FileTransferManager) ListTransfers() []*FileTransfer {
 
 // CleanupTransfer removes a completed or failed transfer
 func (ftm *FileTransferManager) CleanupTransfer(id string) {
-	if transfer, exists := ftm.transfers[id]; exists {
+	ftm.mu.Lock()
+	transfer, exists := ftm.transfers[id]
+	delete(ftm.transfers, id)
+	ftm.mu.Unlock()
+
+	if exists {
 		if err := transfer.Close(); err != nil {
 			ftm.logger.WithError(err).Error("Failed to close transfer")
 		}
-		delete(ftm.transfers, id)
 	}
 }
@@ -3,37 +3,48 @@ package message
 import (
 	"context"
 	"fmt"
+	"strings"
 
 	"github.com/sirupsen/logrus"
 )
 
+const (
+	// replyPreviewLength limits how much of the parent message is quoted in replies
+	replyPreviewLength = 40
+)
+
 // ConsoleMessageHandler handles messages by printing them to console
 type ConsoleMessageHandler struct {
-	logger *logrus.Logger
+	logger  *logrus.Logger
+	history *MessageHistory
 }
 
 // NewConsoleMessageHandler creates a new console message handler
-func NewConsoleMessageHandler(logger *logrus.Logger) *ConsoleMessageHandler {
+func NewConsoleMessageHandler(logger *logrus.Logger, history *MessageHistory) *ConsoleMessageHandler {
 	return &ConsoleMessageHandler{
-		logger: logger,
+		logger:  logger,
+		history: history,
 	}
 }
 
 // HandleMessage handles a message by printing it to console
 func (h *ConsoleMessageHandler) HandleMessage(ctx context.Context, msg *Message) error {
+	number, indent := h.position(msg)
+
 	switch msg.Type {
 	case MessageTypeText:
-		fmt.Printf("\n📨 Message from %s:\n", msg.From)
-		fmt.Printf("   %s\n", string(msg.Content))
-		fmt.Printf("   [%s]\n\n", msg.Timestamp.Format("15:04:05"))
+		fmt.Printf("\n%s📨 %sMessage from %s:\n", indent, number, msg.From)
+		h.printReplyContext(msg, indent)
+		fmt.Printf("%s   %s\n", indent, string(msg.Content))
+		fmt.Printf("%s   [%s]\n\n", indent, msg.Timestamp.Format("15:04:05"))
 
 	case MessageTypeSystem:
-		fmt.Printf("\n🔧 System message from %s:\n", msg.From)
+		fmt.Printf("\n🔧 %sSystem message from %s:\n", number, msg.From)
 		fmt.Printf("   %s\n", string(msg.Content))
 		fmt.Printf("   [%s]\n\n", msg.Timestamp.Format("15:04:05"))
 
 	default:
-		fmt.Printf("\n📦 %s message from %s:\n", msg.Type.String(), msg.From)
+		fmt.Printf("\n📦 %s%s message from %s:\n", number, msg.Type.String(), msg.From)
 		fmt.Printf("   Size: %d bytes\n", len(msg.Content))
 		fmt.Printf("   [%s]\n\n", msg.Timestamp.Format("15:04:05"))
 	}
@@ -42,7 +53,43 @@ func (h *ConsoleMessageHandler) HandleMessage(ctx context.Context, msg *Message)
 		"message_id": msg.ID,
 		"from":       msg.From,
 		"type":       msg.Type.String(),
+		"reply_to":   msg.ReplyTo,
+		"lamport":    msg.Lamport,
 	}).Debug("Message handled by console handler")
 
 	return nil
 }
+
+// position returns the display number label and thread indentation for a message
+func (h *ConsoleMessageHandler) position(msg *Message) (string, string) {
+	if h.history == nil {
+		return "", ""
+	}
+
+	entry, exists := h.history.Lookup(msg.ID)
+	if !exists {
+		return "", ""
+	}
+
+	return fmt.Sprintf("[%d] ", entry.Number), strings.Repeat("    ", entry.Depth)
+}
+
+// printReplyContext prints a short quote of the message being replied to
+func (h *ConsoleMessageHandler) printReplyContext(msg *Message, indent string) {
+	if !msg.IsReply() {
+		return
+	}
+
+	if h.history != nil {
+		if parent, exists := h.history.Lookup(msg.ReplyTo); exists {
+			preview := string(parent.Message.Content)
+			if runes := []rune(preview); len(runes) > replyPreviewLength {
+				preview = string(runes[:replyPreviewLength]) + "..."
+			}
+			fmt.Printf("%s   ↪ in reply to [%d] \"%s\"\n", indent, parent.Number, preview)
+			return
+		}
+	}
+
+	fmt.Printf("%s   ↪ in reply to an earlier message\n", indent)
+}
@@ -0,0 +1,1008 @@
+package message
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	xcrypto "github.com/Xelvra/peerchat/internal/crypto"
+	"github.com/Xelvra/peerchat/internal/user"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// MailboxProtocolID is the protocol for store-and-forward mailboxes
+	MailboxProtocolID = protocol.ID("/xelvra/mailbox/1.0.0")
+
+	// Mailbox limits
+	DefaultMailboxQuotaBytes   = 50 * 1024 * 1024 // 50MB per owner
+	DefaultMailboxMaxEnvelopes = 1000             // Envelopes per owner
+	DefaultMailboxTTL          = 14 * 24 * time.Hour
+	MailboxMaxFrameSize        = 4 * MaxMessageSize
+	MailboxFetchBatch          = 50 // Envelopes per fetch, fewer if they do not fit in one frame
+	MailboxPurgeInterval       = 10 * time.Minute
+
+	// mailboxAuthContext domain-separates mailbox authentication signatures
+	mailboxAuthContext   = "xelvra-mailbox-auth-v1"
+	mailboxChallengeSize = 32
+	// mailboxSealInfo domain-separates envelopes sealed to the owner
+	mailboxSealInfo = "xelvra-mailbox-envelope-v1"
+)
+
+// ErrEnvelopeExists is returned when an owner's mailbox already holds an envelope with the same ID
+var ErrEnvelopeExists = errors.New("envelope already stored")
+
+// Envelope is an opaque message stored by a mailbox node on behalf of its owner
+type Envelope struct {
+	ID         string    `json:"id"`
+	Owner      string    `json:"owner"`       // Recipient DID
+	Sender     string    `json:"sender"`      // Sender DID
+	SenderPeer string    `json:"sender_peer"` // Sender peer ID, used for replies
+	Payload    []byte    `json:"payload"`     // Signed message sealed to the owner's identity key
+	CreatedAt  time.Time `json:"created_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+// MailboxAuth proves control of the owner DID when fetching envelopes
+type MailboxAuth struct {
+	PublicKey   []byte            `json:"public_key"`
+	ProofOfWork *user.ProofOfWork `json:"proof_of_work"`
+	Signature   []byte            `json:"signature"`
+}
+
+// MailboxAnnouncement tells contacts where to leave messages while we are offline
+type MailboxAnnouncement struct {
+	Owner       string            `json:"owner"`
+	Mailboxes   []string          `json:"mailboxes"`     // Multiaddrs including the /p2p/ component
+	ProofOfWork *user.ProofOfWork `json:"proof_of_work"` // Proves the owner DID belongs to the announcing peer's key
+}
+
+// MailboxFrame is a single request or response on the mailbox protocol
+type MailboxFrame struct {
+	Type         string               `json:"type"` // "deposit", "stored", "challenge_request", "challenge", "fetch", "envelopes", "ack", "done", "announce", "error"
+	Owner        string               `json:"owner,omitempty"`
+	Envelope     *Envelope            `json:"envelope,omitempty"`
+	Envelopes    []*Envelope          `json:"envelopes,omitempty"`
+	More         bool                 `json:"more,omitempty"` // More envelopes are waiting after this batch
+	IDs          []string             `json:"ids,omitempty"`
+	Challenge    []byte               `json:"challenge,omitempty"`
+	Auth         *MailboxAuth         `json:"auth,omitempty"`
+	Announcement *MailboxAnnouncement `json:"announcement,omitempty"`
+	Error        string               `json:"error,omitempty"`
+}
+
+// MailboxConfig configures the mailbox service
+type MailboxConfig struct {
+	ServeOwners  []string        // DIDs this node stores envelopes for (empty disables serving)
+	QuotaBytes   int64           // Maximum stored payload bytes per owner
+	MaxEnvelopes int             // Maximum stored envelopes per owner
+	MaxTTL       time.Duration   // Upper bound on envelope lifetime
+	Mailboxes    []peer.AddrInfo // Our own designated always-on mailbox nodes
+}
+
+// DefaultMailboxConfig returns a mailbox configuration with default limits and no mailboxes
+func DefaultMailboxConfig() *MailboxConfig {
+	return &MailboxConfig{
+		QuotaBytes:   DefaultMailboxQuotaBytes,
+		MaxEnvelopes: DefaultMailboxMaxEnvelopes,
+		MaxTTL:       DefaultMailboxTTL,
+	}
+}
+
+// MailboxStore persists envelopes held by a mailbox node and the mailboxes other peers announced
+type MailboxStore interface {
+	// StoreEnvelope saves an envelope, returning ErrEnvelopeExists if the owner already has its ID
+	StoreEnvelope(env *Envelope) error
+	// LoadEnvelopes returns up to limit unexpired envelopes for an owner, oldest first
+	LoadEnvelopes(owner string, limit int) ([]*Envelope, error)
+	// DeleteEnvelopes removes envelopes of an owner by ID
+	DeleteEnvelopes(owner string, ids []string) error
+	// MailboxUsage returns the number of envelopes and payload bytes stored for an owner
+	MailboxUsage(owner string) (int, int64, error)
+	// PurgeExpiredEnvelopes removes expired envelopes, returning the number removed
+	PurgeExpiredEnvelopes(now time.Time) (int, error)
+	// SaveMailboxAnnouncement saves or replaces the mailboxes a peer announced
+	SaveMailboxAnnouncement(peerID string, announcement *MailboxAnnouncement) error
+	// LoadMailboxAnnouncements returns the saved announcements by peer ID
+	LoadMailboxAnnouncements() (map[string]*MailboxAnnouncement, error)
+}
+
+// envelopeKey identifies an envelope; IDs are chosen by senders and only unique per owner
+type envelopeKey struct {
+	owner string
+	id    string
+}
+
+// MemoryMailboxStore is an in-memory MailboxStore
+type MemoryMailboxStore struct {
+	envelopes     map[envelopeKey]*Envelope
+	announcements map[string]*MailboxAnnouncement
+	mu            sync.Mutex
+}
+
+// NewMemoryMailboxStore creates a new in-memory mailbox store
+func NewMemoryMailboxStore() *MemoryMailboxStore {
+	return &MemoryMailboxStore{
+		envelopes:     make(map[envelopeKey]*Envelope),
+		announcements: make(map[string]*MailboxAnnouncement),
+	}
+}
+
+// StoreEnvelope saves an envelope, never replacing one already stored for the owner
+func (s *MemoryMailboxStore) StoreEnvelope(env *Envelope) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := envelopeKey{owner: env.Owner, id: env.ID}
+	if _, exists := s.envelopes[key]; exists {
+		return ErrEnvelopeExists
+	}
+
+	stored := *env
+	s.envelopes[key] = &stored
+	return nil
+}
+
+// LoadEnvelopes returns unexpired envelopes for an owner, oldest first
+func (s *MemoryMailboxStore) LoadEnvelopes(owner string, limit int) ([]*Envelope, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	var envelopes []*Envelope
+	for _, env := range s.envelopes {
+		if env.Owner == owner && now.Before(env.ExpiresAt) {
+			loaded := *env
+			envelopes = append(envelopes, &loaded)
+		}
+	}
+
+	sort.Slice(envelopes, func(i, j int) bool {
+		return envelopes[i].CreatedAt.Before(envelopes[j].CreatedAt)
+	})
+	if limit > 0 && len(envelopes) > limit {
+		envelopes = envelopes[:limit]
+	}
+	return envelopes, nil
+}
+
+// DeleteEnvelopes removes envelopes of an owner by ID
+func (s *MemoryMailboxStore) DeleteEnvelopes(owner string, ids []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, id := range ids {
+		delete(s.envelopes, envelopeKey{owner: owner, id: id})
+	}
+	return nil
+}
+
+// MailboxUsage returns the number of envelopes and payload bytes stored for an owner
+func (s *MemoryMailboxStore) MailboxUsage(owner string) (int, int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	count := 0
+	var size int64
+	for _, env := range s.envelopes {
+		if env.Owner == owner {
+			count++
+			size += int64(len(env.Payload))
+		}
+	}
+	return count, size, nil
+}
+
+// PurgeExpiredEnvelopes removes expired envelopes
+func (s *MemoryMailboxStore) PurgeExpiredEnvelopes(now time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	removed := 0
+	for key, env := range s.envelopes {
+		if !now.Before(env.ExpiresAt) {
+			delete(s.envelopes, key)
+			removed++
+		}
+	}
+	return removed, nil
+}
+
+// SaveMailboxAnnouncement saves or replaces the mailboxes a peer announced
+func (s *MemoryMailboxStore) SaveMailboxAnnouncement(peerID string, announcement *MailboxAnnouncement) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.announcements[peerID] = announcement
+	return nil
+}
+
+// LoadMailboxAnnouncements returns the saved announcements by peer ID
+func (s *MemoryMailboxStore) LoadMailboxAnnouncements() (map[string]*MailboxAnnouncement, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	announcements := make(map[string]*MailboxAnnouncement, len(s.announcements))
+	for peerID, announcement := range s.announcements {
+		announcements[peerID] = announcement
+	}
+	return announcements, nil
+}
+
+// MailboxService implements both sides of the mailbox protocol: it stores envelopes
+// for the owners it serves and deposits to / fetches from mailboxes on our behalf
+type MailboxService struct {
+	host     host.Host
+	identity *user.MessengerID
+	config   *MailboxConfig
+	store    MailboxStore
+	logger   *logrus.Logger
+
+	// Delivers fetched messages into the incoming message pipeline
+	deliver func(msg *Message)
+
+	// Mailboxes announced by other peers: peer ID -> announcement, saved in the store
+	directory   map[peer.ID]*MailboxAnnouncement
+	directoryMu sync.RWMutex
+
+	serveOwners map[string]bool
+	fetching    map[peer.ID]bool
+	fetchingMu  sync.Mutex
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// NewMailboxService creates a mailbox service and registers its stream handler
+func NewMailboxService(ctx context.Context, h host.Host, identity *user.MessengerID, config *MailboxConfig,
+	store MailboxStore, deliver func(msg *Message), logger *logrus.Logger) *MailboxService {
+	if config == nil {
+		config = DefaultMailboxConfig()
+	}
+	if store == nil {
+		store = NewMemoryMailboxStore()
+	}
+
+	serviceCtx, cancel := context.WithCancel(ctx)
+
+	ms := &MailboxService{
+		host:        h,
+		identity:    identity,
+		config:      config,
+		store:       store,
+		logger:      logger,
+		deliver:     deliver,
+		directory:   make(map[peer.ID]*MailboxAnnouncement),
+		serveOwners: make(map[string]bool),
+		fetching:    make(map[peer.ID]bool),
+		ctx:         serviceCtx,
+		cancel:      cancel,
+	}
+
+	for _, owner := range config.ServeOwners {
+		ms.serveOwners[owner] = true
+	}
+	ms.loadDirectory()
+
+	h.SetStreamHandler(MailboxProtocolID, ms.handleStream)
+	return ms
+}
+
+// Start connects to our mailboxes and, when serving, starts envelope expiry
+func (ms *MailboxService) Start() {
+	if ms.IsServing() {
+		ms.logger.WithField("owners", len(ms.serveOwners)).Info("Mailbox service enabled")
+		ms.wg.Add(1)
+		go ms.purgeLoop()
+	}
+
+	// Connecting triggers a fetch through OnPeerConnected
+	for _, mailbox := range ms.config.Mailboxes {
+		mailbox := mailbox
+		ms.wg.Add(1)
+		go func() {
+			defer ms.wg.Done()
+
+			ctx, cancel := context.WithTimeout(ms.ctx, MessageTimeout)
+			defer cancel()
+
+			if err := ms.host.Connect(ctx, mailbox); err != nil {
+				ms.logger.WithError(err).WithField("mailbox", mailbox.ID.String()).Debug("Mailbox not reachable")
+			}
+		}()
+	}
+}
+
+// Stop stops the mailbox service
+func (ms *MailboxService) Stop() {
+	ms.cancel()
+	ms.wg.Wait()
+	ms.host.RemoveStreamHandler(MailboxProtocolID)
+}
+
+// IsServing returns true if this node stores envelopes for other owners
+func (ms *MailboxService) IsServing() bool {
+	return len(ms.serveOwners) > 0
+}
+
+// OnPeerConnected fetches from our mailbox when it connects, and tells other peers
+// where to leave messages for us
+func (ms *MailboxService) OnPeerConnected(peerID peer.ID) {
+	if ms.ctx.Err() != nil {
+		return
+	}
+
+	if ms.isOwnMailbox(peerID) {
+		ms.startFetch(peerID)
+		return
+	}
+
+	if len(ms.config.Mailboxes) > 0 {
+		ms.wg.Add(1)
+		go func() {
+			defer ms.wg.Done()
+			if err := ms.Announce(peerID); err != nil {
+				ms.logger.WithError(err).WithField("peer_id", peerID.String()).Debug("Failed to announce mailboxes")
+			}
+		}()
+	}
+}
+
+// HasMailbox returns true if a peer has announced mailboxes we can deposit to
+func (ms *MailboxService) HasMailbox(peerID peer.ID) bool {
+	ms.directoryMu.RLock()
+	defer ms.directoryMu.RUnlock()
+
+	announcement, exists := ms.directory[peerID]
+	return exists && len(announcement.Mailboxes) > 0
+}
+
+// Announce sends our mailbox list to a peer
+func (ms *MailboxService) Announce(peerID peer.ID) error {
+	addrs := make([]string, 0, len(ms.config.Mailboxes))
+	for _, mailbox := range ms.config.Mailboxes {
+		p2pAddrs, err := peer.AddrInfoToP2pAddrs(&mailbox)
+		if err != nil {
+			continue
+		}
+		for _, addr := range p2pAddrs {
+			addrs = append(addrs, addr.String())
+		}
+	}
+
+	frame := &MailboxFrame{
+		Type: "announce",
+		Announcement: &MailboxAnnouncement{
+			Owner:       ms.identity.GetDID(),
+			Mailboxes:   addrs,
+			ProofOfWork: ms.identity.ProofOfWork,
+		},
+	}
+
+	ctx, cancel := context.WithTimeout(ms.ctx, MessageTimeout)
+	defer cancel()
+
+	stream, err := ms.host.NewStream(ctx, peerID, MailboxProtocolID)
+	if err != nil {
+		return fmt.Errorf("failed to open mailbox stream: %w", err)
+	}
+	defer func() {
+		if err := stream.Close(); err != nil {
+			ms.logger.WithError(err).Debug("Failed to close mailbox stream")
+		}
+	}()
+
+	return writeMailboxFrame(stream, frame)
+}
+
+// Deposit seals a message to the recipient's identity key and stores it in one
+// of the recipient's announced mailboxes
+func (ms *MailboxService) Deposit(recipient peer.ID, msg *Message) error {
+	ms.directoryMu.RLock()
+	announcement, exists := ms.directory[recipient]
+	ms.directoryMu.RUnlock()
+
+	if !exists || len(announcement.Mailboxes) == 0 {
+		return fmt.Errorf("peer %s has no known mailbox", recipient.String())
+	}
+
+	msgData, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("failed to serialize message: %w", err)
+	}
+
+	// The mailbox only ever sees the sealed message
+	ownerKey, err := user.PeerIdentityKey(recipient)
+	if err != nil {
+		return err
+	}
+	sealKey, err := xcrypto.PublicKeyFromEd25519(ownerKey)
+	if err != nil {
+		return fmt.Errorf("failed to convert recipient key: %w", err)
+	}
+	payload, err := xcrypto.SealAnonymous(sealKey, msgData, []byte(mailboxSealInfo))
+	if err != nil {
+		return fmt.Errorf("failed to seal message: %w", err)
+	}
+
+	now := time.Now()
+	envelope := &Envelope{
+		ID:         msg.ID,
+		Owner:      announcement.Owner,
+		Sender:     ms.identity.GetDID(),
+		SenderPeer: ms.host.ID().String(),
+		Payload:    payload,
+		CreatedAt:  now,
+		ExpiresAt:  now.Add(DefaultMailboxTTL),
+	}
+
+	var lastErr error
+	for _, addrStr := range announcement.Mailboxes {
+		mailbox, err := peer.AddrInfoFromString(addrStr)
+		if err != nil {
+			lastErr = fmt.Errorf("invalid mailbox address %s: %w", addrStr, err)
+			continue
+		}
+
+		if err := ms.depositTo(*mailbox, envelope); err != nil {
+			lastErr = err
+			ms.logger.WithError(err).WithField("mailbox", mailbox.ID.String()).Debug("Mailbox deposit failed")
+			continue
+		}
+
+		ms.logger.WithFields(logrus.Fields{
+			"message_id": msg.ID,
+			"recipient":  recipient.String(),
+			"mailbox":    mailbox.ID.String(),
+		}).Info("Message deposited in recipient's mailbox")
+		return nil
+	}
+
+	return fmt.Errorf("all mailboxes failed: %w", lastErr)
+}
+
+// depositTo sends an envelope to a single mailbox node
+func (ms *MailboxService) depositTo(mailbox peer.AddrInfo, envelope *Envelope) error {
+	ctx, cancel := context.WithTimeout(ms.ctx, MessageTimeout)
+	defer cancel()
+
+	if err := ms.host.Connect(ctx, mailbox); err != nil {
+		return fmt.Errorf("failed to connect to mailbox: %w", err)
+	}
+
+	stream, err := ms.host.NewStream(ctx, mailbox.ID, MailboxProtocolID)
+	if err != nil {
+		return fmt.Errorf("failed to open mailbox stream: %w", err)
+	}
+	defer func() {
+		if err := stream.Close(); err != nil {
+			ms.logger.WithError(err).Debug("Failed to close mailbox stream")
+		}
+	}()
+
+	if err := writeMailboxFrame(stream, &MailboxFrame{Type: "deposit", Envelope: envelope}); err != nil {
+		return err
+	}
+
+	var response MailboxFrame
+	if err := readMailboxFrame(stream, &response); err != nil {
+		return err
+	}
+
+	switch response.Type {
+	case "stored":
+		return nil
+	case "error":
+		return fmt.Errorf("mailbox rejected envelope: %s", response.Error)
+	default:
+		return fmt.Errorf("unexpected mailbox response: %s", response.Type)
+	}
+}
+
+// Fetch authenticates to one of our mailboxes and retrieves all stored envelopes
+func (ms *MailboxService) Fetch(mailbox peer.ID) (int, error) {
+	total := 0
+	for {
+		count, more, err := ms.fetchBatch(mailbox)
+		total += count
+		if err != nil {
+			return total, err
+		}
+		if !more || count == 0 {
+			return total, nil
+		}
+	}
+}
+
+// fetchBatch runs one challenge/fetch/ack exchange with a mailbox, reporting
+// whether more envelopes are waiting
+func (ms *MailboxService) fetchBatch(mailbox peer.ID) (int, bool, error) {
+	ctx, cancel := context.WithTimeout(ms.ctx, MessageTimeout)
+	defer cancel()
+
+	stream, err := ms.host.NewStream(ctx, mailbox, MailboxProtocolID)
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to open mailbox stream: %w", err)
+	}
+	defer func() {
+		if err := stream.Close(); err != nil {
+			ms.logger.WithError(err).Debug("Failed to close mailbox stream")
+		}
+	}()
+
+	owner := ms.identity.GetDID()
+	if err := writeMailboxFrame(stream, &MailboxFrame{Type: "challenge_request", Owner: owner}); err != nil {
+		return 0, false, err
+	}
+
+	var challenge MailboxFrame
+	if err := readMailboxFrame(stream, &challenge); err != nil {
+		return 0, false, err
+	}
+	if challenge.Type != "challenge" || len(challenge.Challenge) != mailboxChallengeSize {
+		return 0, false, fmt.Errorf("unexpected mailbox response: %s %s", challenge.Type, challenge.Error)
+	}
+
+	signature, err := ms.identity.Sign(mailboxAuthPayload(mailbox, owner, challenge.Challenge))
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to sign mailbox challenge: %w", err)
+	}
+
+	fetch := &MailboxFrame{
+		Type:  "fetch",
+		Owner: owner,
+		Auth: &MailboxAuth{
+			PublicKey:   ms.identity.PublicKey,
+			ProofOfWork: ms.identity.ProofOfWork,
+			Signature:   signature,
+		},
+	}
+	if err := writeMailboxFrame(stream, fetch); err != nil {
+		return 0, false, err
+	}
+
+	var response MailboxFrame
+	if err := readMailboxFrame(stream, &response); err != nil {
+		return 0, false, err
+	}
+	if response.Type != "envelopes" {
+		return 0, false, fmt.Errorf("mailbox fetch failed: %s %s", response.Type, response.Error)
+	}
+
+	keyPair, err := xcrypto.KeyPairFromEd25519(ms.identity.PrivateKey)
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to derive envelope key: %w", err)
+	}
+	defer keyPair.Destroy()
+
+	ids := make([]string, 0, len(response.Envelopes))
+	for _, envelope := range response.Envelopes {
+		ids = append(ids, envelope.ID)
+		ms.deliverEnvelope(keyPair, envelope)
+	}
+
+	if err := writeMailboxFrame(stream, &MailboxFrame{Type: "ack", Owner: owner, IDs: ids}); err != nil {
+		return len(ids), false, err
+	}
+
+	var done MailboxFrame
+	if err := readMailboxFrame(stream, &done); err != nil {
+		return len(ids), false, err
+	}
+
+	if len(ids) > 0 {
+		ms.logger.WithFields(logrus.Fields{
+			"mailbox": mailbox.String(),
+			"count":   len(ids),
+		}).Info("Fetched messages from mailbox")
+	}
+
+	return len(ids), response.More, nil
+}
+
+// deliverEnvelope opens a fetched envelope and passes the message into the
+// incoming message pipeline, which verifies its signature
+func (ms *MailboxService) deliverEnvelope(keyPair *xcrypto.KeyPair, envelope *Envelope) {
+	msgData, err := xcrypto.OpenAnonymous(keyPair, envelope.Payload, []byte(mailboxSealInfo))
+	if err != nil {
+		ms.logger.WithError(err).WithField("envelope_id", envelope.ID).Warn("Discarding mailbox envelope that cannot be opened")
+		return
+	}
+
+	var msg Message
+	if err := json.Unmarshal(msgData, &msg); err != nil {
+		ms.logger.WithError(err).WithField("envelope_id", envelope.ID).Warn("Discarding malformed mailbox envelope")
+		return
+	}
+	if msg.From != envelope.Sender {
+		ms.logger.WithField("envelope_id", envelope.ID).Warn("Discarding mailbox envelope with a mismatched sender")
+		return
+	}
+
+	if senderPeer, err := peer.Decode(envelope.SenderPeer); err == nil {
+		msg.remotePeer = senderPeer
+	}
+
+	if ms.deliver != nil {
+		ms.deliver(&msg)
+	}
+}
+
+// startFetch fetches from a mailbox in the background, at most once at a time
+func (ms *MailboxService) startFetch(mailbox peer.ID) {
+	ms.fetchingMu.Lock()
+	if ms.fetching[mailbox] {
+		ms.fetchingMu.Unlock()
+		return
+	}
+	ms.fetching[mailbox] = true
+	ms.fetchingMu.Unlock()
+
+	ms.wg.Add(1)
+	go func() {
+		defer ms.wg.Done()
+		defer func() {
+			ms.fetchingMu.Lock()
+			delete(ms.fetching, mailbox)
+			ms.fetchingMu.Unlock()
+		}()
+
+		if _, err := ms.Fetch(mailbox); err != nil {
+			ms.logger.WithError(err).WithField("mailbox", mailbox.String()).Warn("Failed to fetch from mailbox")
+		}
+	}()
+}
+
+// isOwnMailbox returns true if the peer is one of our designated mailboxes
+func (ms *MailboxService) isOwnMailbox(peerID peer.ID) bool {
+	for _, mailbox := range ms.config.Mailboxes {
+		if mailbox.ID == peerID {
+			return true
+		}
+	}
+	return false
+}
+
+// handleStream handles incoming mailbox protocol streams
+func (ms *MailboxService) handleStream(stream network.Stream) {
+	defer func() {
+		if err := stream.Close(); err != nil {
+			ms.logger.WithError(err).Debug("Failed to close mailbox stream")
+		}
+	}()
+
+	if err := stream.SetDeadline(time.Now().Add(MessageTimeout)); err != nil {
+		ms.logger.WithError(err).Debug("Failed to set mailbox stream deadline")
+	}
+
+	remotePeer := stream.Conn().RemotePeer()
+
+	var frame MailboxFrame
+	if err := readMailboxFrame(stream, &frame); err != nil {
+		ms.logger.WithError(err).Debug("Failed to read mailbox frame")
+		return
+	}
+
+	var err error
+	switch frame.Type {
+	case "announce":
+		ms.handleAnnounce(remotePeer, &frame)
+	case "deposit":
+		err = ms.handleDeposit(stream, remotePeer, &frame)
+	case "challenge_request":
+		err = ms.handleFetch(stream, remotePeer, &frame)
+	default:
+		err = writeMailboxFrame(stream, &MailboxFrame{Type: "error", Error: "unknown request type"})
+	}
+
+	if err != nil {
+		ms.logger.WithError(err).WithField("peer", remotePeer.String()).Warn("Mailbox request failed")
+	}
+}
+
+// handleAnnounce records where a peer wants messages left while it is offline
+func (ms *MailboxService) handleAnnounce(remotePeer peer.ID, frame *MailboxFrame) {
+	if frame.Announcement == nil {
+		return
+	}
+
+	// Deposits are sealed to the announcing peer's key, so it must own the DID
+	publicKey, err := user.PeerIdentityKey(remotePeer)
+	if err != nil || !user.VerifyDIDOwnership(frame.Announcement.Owner, publicKey, frame.Announcement.ProofOfWork) {
+		ms.logger.WithField("peer_id", remotePeer.String()).Debug("Ignoring mailbox announcement for a DID the peer does not own")
+		return
+	}
+
+	ms.directoryMu.Lock()
+	ms.directory[remotePeer] = frame.Announcement
+	ms.directoryMu.Unlock()
+
+	// Peers usually announce while connected, so remember them for when they are not
+	if err := ms.store.SaveMailboxAnnouncement(remotePeer.String(), frame.Announcement); err != nil {
+		ms.logger.WithError(err).WithField("peer_id", remotePeer.String()).Warn("Failed to save mailbox announcement")
+	}
+
+	ms.logger.WithFields(logrus.Fields{
+		"peer_id":   remotePeer.String(),
+		"mailboxes": len(frame.Announcement.Mailboxes),
+	}).Debug("Peer announced mailboxes")
+}
+
+// loadDirectory restores the mailboxes other peers announced before a restart
+func (ms *MailboxService) loadDirectory() {
+	announcements, err := ms.store.LoadMailboxAnnouncements()
+	if err != nil {
+		ms.logger.WithError(err).Warn("Failed to load mailbox announcements")
+		return
+	}
+
+	for peerStr, announcement := range announcements {
+		peerID, err := peer.Decode(peerStr)
+		if err != nil {
+			continue
+		}
+		ms.directory[peerID] = announcement
+	}
+}
+
+// handleDeposit stores an envelope for an owner we serve, enforcing quotas
+func (ms *MailboxService) handleDeposit(stream network.Stream, remotePeer peer.ID, frame *MailboxFrame) error {
+	envelope := frame.Envelope
+	if envelope == nil || envelope.ID == "" {
+		return writeMailboxFrame(stream, &MailboxFrame{Type: "error", Error: "missing envelope"})
+	}
+
+	if !ms.serveOwners[envelope.Owner] {
+		return writeMailboxFrame(stream, &MailboxFrame{Type: "error", Error: "owner not served by this mailbox"})
+	}
+
+	count, size, err := ms.store.MailboxUsage(envelope.Owner)
+	if err != nil {
+		return fmt.Errorf("failed to read mailbox usage: %w", err)
+	}
+	if count >= ms.config.MaxEnvelopes || size+int64(len(envelope.Payload)) > ms.config.QuotaBytes {
+		return writeMailboxFrame(stream, &MailboxFrame{Type: "error", Error: "mailbox quota exceeded"})
+	}
+
+	// The mailbox decides retention, not the sender
+	now := time.Now()
+	envelope.CreatedAt = now
+	if envelope.ExpiresAt.IsZero() || envelope.ExpiresAt.After(now.Add(ms.config.MaxTTL)) {
+		envelope.ExpiresAt = now.Add(ms.config.MaxTTL)
+	}
+	envelope.SenderPeer = remotePeer.String()
+
+	// An envelope that cannot be handed over in a frame of its own would never be fetched
+	if fit, err := fetchFrameFit([]*Envelope{envelope}); err != nil || fit == 0 {
+		return writeMailboxFrame(stream, &MailboxFrame{Type: "error", Error: "envelope too large"})
+	}
+
+	if err := ms.store.StoreEnvelope(envelope); errors.Is(err, ErrEnvelopeExists) {
+		return writeMailboxFrame(stream, &MailboxFrame{Type: "error", Error: "duplicate envelope ID"})
+	} else if err != nil {
+		_ = writeMailboxFrame(stream, &MailboxFrame{Type: "error", Error: "failed to store envelope"})
+		return fmt.Errorf("failed to store envelope: %w", err)
+	}
+
+	ms.logger.WithFields(logrus.Fields{
+		"envelope_id": envelope.ID,
+		"owner":       envelope.Owner,
+		"size":        len(envelope.Payload),
+	}).Info("Stored envelope in mailbox")
+
+	return writeMailboxFrame(stream, &MailboxFrame{Type: "stored"})
+}
+
+// handleFetch authenticates the owner with a challenge and hands over stored envelopes
+func (ms *MailboxService) handleFetch(stream network.Stream, remotePeer peer.ID, frame *MailboxFrame) error {
+	owner := frame.Owner
+	if !ms.serveOwners[owner] {
+		return writeMailboxFrame(stream, &MailboxFrame{Type: "error", Error: "owner not served by this mailbox"})
+	}
+
+	challenge := make([]byte, mailboxChallengeSize)
+	if _, err := rand.Read(challenge); err != nil {
+		return fmt.Errorf("failed to generate challenge: %w", err)
+	}
+	if err := writeMailboxFrame(stream, &MailboxFrame{Type: "challenge", Challenge: challenge}); err != nil {
+		return err
+	}
+
+	var fetch MailboxFrame
+	if err := readMailboxFrame(stream, &fetch); err != nil {
+		return err
+	}
+	if fetch.Type != "fetch" || fetch.Owner != owner || fetch.Auth == nil {
+		return writeMailboxFrame(stream, &MailboxFrame{Type: "error", Error: "invalid fetch request"})
+	}
+
+	if !VerifyMailboxAuth(ms.host.ID(), owner, challenge, fetch.Auth) {
+		ms.logger.WithFields(logrus.Fields{
+			"peer":  remotePeer.String(),
+			"owner": owner,
+		}).Warn("Mailbox authentication failed")
+		return writeMailboxFrame(stream, &MailboxFrame{Type: "error", Error: "authentication failed"})
+	}
+
+	envelopes, more, err := ms.loadFetchBatch(owner)
+	if err != nil {
+		_ = writeMailboxFrame(stream, &MailboxFrame{Type: "error", Error: "failed to load envelopes"})
+		return err
+	}
+
+	if err := writeMailboxFrame(stream, &MailboxFrame{Type: "envelopes", Envelopes: envelopes, More: more}); err != nil {
+		return err
+	}
+
+	// Only delete what the owner acknowledged receiving
+	var ack MailboxFrame
+	if err := readMailboxFrame(stream, &ack); err != nil {
+		return err
+	}
+	if ack.Type != "ack" {
+		return writeMailboxFrame(stream, &MailboxFrame{Type: "error", Error: "expected ack"})
+	}
+
+	if err := ms.store.DeleteEnvelopes(owner, ack.IDs); err != nil {
+		return fmt.Errorf("failed to delete acknowledged envelopes: %w", err)
+	}
+
+	ms.logger.WithFields(logrus.Fields{
+		"owner": owner,
+		"count": len(ack.IDs),
+	}).Info("Handed over mailbox envelopes")
+
+	return writeMailboxFrame(stream, &MailboxFrame{Type: "done"})
+}
+
+// loadFetchBatch loads the oldest envelopes of an owner that fit into one frame,
+// reporting whether more are waiting
+func (ms *MailboxService) loadFetchBatch(owner string) ([]*Envelope, bool, error) {
+	for {
+		// Loading one more than a batch tells whether the owner has to fetch again
+		envelopes, err := ms.store.LoadEnvelopes(owner, MailboxFetchBatch+1)
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to load envelopes: %w", err)
+		}
+
+		fit, err := fetchFrameFit(envelopes[:min(len(envelopes), MailboxFetchBatch)])
+		if err != nil {
+			return nil, false, err
+		}
+		if fit > 0 || len(envelopes) == 0 {
+			return envelopes[:fit], fit < len(envelopes), nil
+		}
+
+		// Deposits are checked against the frame size, so this only drops envelopes
+		// that grew in storage; keeping them would block every envelope behind them
+		ms.logger.WithField("envelope_id", envelopes[0].ID).Warn("Dropping mailbox envelope too large to hand over")
+		if err := ms.store.DeleteEnvelopes(owner, []string{envelopes[0].ID}); err != nil {
+			return nil, false, fmt.Errorf("failed to drop oversized envelope: %w", err)
+		}
+	}
+}
+
+// purgeLoop periodically removes expired envelopes
+func (ms *MailboxService) purgeLoop() {
+	defer ms.wg.Done()
+
+	ticker := time.NewTicker(MailboxPurgeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			removed, err := ms.store.PurgeExpiredEnvelopes(time.Now())
+			if err != nil {
+				ms.logger.WithError(err).Error("Failed to purge expired envelopes")
+			} else if removed > 0 {
+				ms.logger.WithField("count", removed).Info("Purged expired mailbox envelopes")
+			}
+		case <-ms.ctx.Done():
+			return
+		}
+	}
+}
+
+// VerifyMailboxAuth checks that auth proves control of the owner DID for a challenge
+// issued by the given mailbox
+func VerifyMailboxAuth(mailbox peer.ID, owner string, challenge []byte, auth *MailboxAuth) bool {
+	if auth == nil || len(auth.PublicKey) != ed25519.PublicKeySize {
+		return false
+	}
+
+	publicKey := ed25519.PublicKey(auth.PublicKey)
+	if !user.VerifyDIDOwnership(owner, publicKey, auth.ProofOfWork) {
+		return false
+	}
+
+	return ed25519.Verify(publicKey, mailboxAuthPayload(mailbox, owner, challenge), auth.Signature)
+}
+
+// mailboxAuthPayload builds the data signed to authenticate to a mailbox. Binding the
+// mailbox peer ID prevents a signature from being replayed against another mailbox.
+func mailboxAuthPayload(mailbox peer.ID, owner string, challenge []byte) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(mailboxAuthContext)
+	buf.WriteString(string(mailbox))
+	buf.WriteString(owner)
+	buf.Write(challenge)
+	return buf.Bytes()
+}
+
+// fetchFrameFit returns how many of the envelopes, in order, fit into one
+// envelopes frame of at most MailboxMaxFrameSize bytes
+func fetchFrameFit(envelopes []*Envelope) (int, error) {
+	empty, err := json.Marshal(&MailboxFrame{Type: "envelopes", More: true})
+	if err != nil {
+		return 0, fmt.Errorf("failed to marshal mailbox frame: %w", err)
+	}
+
+	size := len(empty) + len(`,"envelopes":[]`)
+	for i, envelope := range envelopes {
+		data, err := json.Marshal(envelope)
+		if err != nil {
+			return 0, fmt.Errorf("failed to marshal envelope: %w", err)
+		}
+		// Counting a separating comma for every envelope overestimates by one byte
+		size += len(data) + 1
+		if size > MailboxMaxFrameSize {
+			return i, nil
+		}
+	}
+	return len(envelopes), nil
+}
+
+// writeMailboxFrame writes a length-prefixed JSON frame
+func writeMailboxFrame(w io.Writer, frame *MailboxFrame) error {
+	data, err := json.Marshal(frame)
+	if err != nil {
+		return fmt.Errorf("failed to marshal mailbox frame: %w", err)
+	}
+	if len(data) > MailboxMaxFrameSize {
+		return fmt.Errorf("mailbox frame too large: %d bytes", len(data))
+	}
+
+	if err := binary.Write(w, binary.BigEndian, uint32(len(data))); err != nil {
+		return fmt.Errorf("failed to write length: %w", err)
+	}
+	if _, err := w.Write(data); err != nil {
+		return fmt.Errorf("failed to write mailbox frame: %w", err)
+	}
+	return nil
+}
+
+// readMailboxFrame reads a length-prefixed JSON frame
+func readMailboxFrame(r io.Reader, frame *MailboxFrame) error {
+	var length uint32
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return fmt.Errorf("failed to read length: %w", err)
+	}
+	if length > MailboxMaxFrameSize {
+		return fmt.Errorf("mailbox frame too large: %d bytes", length)
+	}
+
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return fmt.Errorf("failed to read mailbox frame: %w", err)
+	}
+
+	if err := json.Unmarshal(data, frame); err != nil {
+		return fmt.Errorf("failed to unmarshal mailbox frame: %w", err)
+	}
+	return nil
+}
@@ -1,13 +1,16 @@
 package message
 
 import (
+	"bufio"
 	"context"
-	"encoding/binary"
+	"crypto/ed25519"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"slices"
 	"sync"
 	"time"
 
@@ -17,6 +20,7 @@ import (
 	"github.com/libp2p/go-libp2p/core/network"
 	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/libp2p/go-libp2p/core/protocol"
+	"github.com/libp2p/go-libp2p/core/routing"
 	"github.com/sirupsen/logrus"
 )
 
@@ -77,11 +81,19 @@ type Message struct {
 	Content     []byte                 `json:"content"` // Encrypted content
 	Metadata    map[string]interface{} `json:"metadata,omitempty"`
 	Timestamp   time.Time              `json:"timestamp"`
+	ReplyTo     string                 `json:"reply_to,omitempty"`  // ID of the message being replied to
+	ThreadID    string                 `json:"thread_id,omitempty"` // ID of the thread root message
+	Lamport     uint64                 `json:"lamport,omitempty"`   // Per-conversation logical clock
 	Signature   []byte                 `json:"signature"`
+	SenderKey   []byte                 `json:"sender_key,omitempty"`   // Sender's Ed25519 identity key
+	SenderProof *user.ProofOfWork      `json:"sender_proof,omitempty"` // Binds the sender key to the sender DID
 	IsEncrypted bool                   `json:"is_encrypted"`
+
+	// Peer the message arrived from (not serialized)
+	remotePeer peer.ID
 }
 
-// OfflineMessage represents a message stored for offline delivery
+// OfflineMessage represents a message stored in the legacy messages.json file
 type OfflineMessage struct {
 	Message   *Message  `json:"message"`
 	Attempts  int       `json:"attempts"`
@@ -100,10 +112,25 @@ type MessageManager struct {
 	outgoingMessages chan *Message
 	messageHandlers  map[MessageType]MessageHandler
 
-	// Offline message storage
-	offlineMessages map[string][]*OfflineMessage // peer ID -> messages
-	offlineMutex    sync.RWMutex
-	offlineDir      string
+	// Causal ordering and threading
+	clock    *LamportClock
+	history  *MessageHistory
+	messages MessageStore // Nil without a database
+
+	// Durable outbox for peers that are not reachable
+	outbox         OutboxStore
+	outboxWake     chan struct{}
+	outboxInflight map[string]bool // peer ID -> delivery in progress
+	outboxMutex    sync.Mutex
+
+	// Long-lived outgoing message streams
+	streams *StreamPool
+
+	// Store-and-forward mailboxes (nil when disabled)
+	mailbox *MailboxService
+
+	// Multi-hop routing through friendly peers (nil when disabled)
+	router *Router
 
 	// File transfer management
 	fileTransferManager *FileTransferManager
@@ -119,17 +146,14 @@ type MessageHandler interface {
 	HandleMessage(ctx context.Context, msg *Message) error
 }
 
-// NewMessageManager creates a new message manager
-func NewMessageManager(h host.Host, identity *user.MessengerID, logger *logrus.Logger) *MessageManager {
+// NewMessageManager creates a new message manager.
+// If outbox is nil, undelivered messages are only kept in memory.
+func NewMessageManager(h host.Host, identity *user.MessengerID, outbox OutboxStore, logger *logrus.Logger) *MessageManager {
 	ctx, cancel := context.WithCancel(context.Background())
 
-	// Create offline messages directory
-	homeDir, _ := os.UserHomeDir()
-	offlineDir := filepath.Join(homeDir, ".xelvra", "offline_messages")
-	if err := os.MkdirAll(offlineDir, 0700); err != nil {
-		logger.WithError(err).Error("Failed to create offline messages directory")
-		// Continue with empty offline directory path
-		offlineDir = ""
+	if outbox == nil {
+		logger.Warn("No persistent outbox configured, offline messages will not survive restarts")
+		outbox = NewMemoryOutboxStore()
 	}
 
 	mm := &MessageManager{
@@ -139,37 +163,181 @@ func NewMessageManager(h host.Host, identity *user.MessengerID, logger *logrus.L
 		incomingMessages:    make(chan *Message, 100),
 		outgoingMessages:    make(chan *Message, 100),
 		messageHandlers:     make(map[MessageType]MessageHandler),
-		offlineMessages:     make(map[string][]*OfflineMessage),
-		offlineDir:          offlineDir,
+		clock:               NewLamportClock(),
+		history:             NewMessageHistory(MaxHistorySize),
+		outbox:              outbox,
+		outboxWake:          make(chan struct{}, 1),
+		outboxInflight:      make(map[string]bool),
+		streams:             NewStreamPool(h, logger),
 		fileTransferManager: NewFileTransferManager(logger),
 		ctx:                 ctx,
 		cancel:              cancel,
 	}
 
-	// Load offline messages from disk
-	mm.loadOfflineMessages()
+	// Recover messages interrupted mid-delivery
+	if err := outbox.ResetSendingOutbox(); err != nil {
+		logger.WithError(err).Warn("Failed to reset in-flight outbox entries")
+	}
+
+	mm.fileTransferManager.ctx = ctx
+	mm.fileTransferManager.host = h
+	if identity != nil {
+		mm.fileTransferManager.ownerDID = identity.DID
+	}
+
+	// Flush the outbox and resume file transfers as soon as a peer connects
+	h.Network().Notify(&network.NotifyBundle{
+		ConnectedF: func(_ network.Network, conn network.Conn) {
+			mm.flushPeerOutbox(conn.RemotePeer())
+			mm.fileTransferManager.ResumePeer(conn.RemotePeer())
+			if mm.mailbox != nil {
+				mm.mailbox.OnPeerConnected(conn.RemotePeer())
+			}
+		},
+		DisconnectedF: func(n network.Network, conn network.Conn) {
+			if n.Connectedness(conn.RemotePeer()) != network.Connected {
+				mm.streams.Close(conn.RemotePeer())
+				mm.fileTransferManager.scheduler.forgetPeer(conn.RemotePeer())
+			}
+		},
+	})
 
 	// Set up stream handlers
+	h.SetStreamHandler(CompressedMessageProtocolID, mm.handlePipelinedStream)
+	h.SetStreamHandler(MessageStreamProtocolID, mm.handlePipelinedStream)
 	h.SetStreamHandler(MessageProtocolID, mm.handleMessageStream)
+	h.SetStreamHandler(EncryptedFileStreamProtocolID, mm.handleFileStream)
+	h.SetStreamHandler(FileStreamProtocolID, mm.handleFileStream)
 	h.SetStreamHandler(FileProtocolID, mm.handleFileStream)
 	h.SetStreamHandler(GroupProtocolID, mm.handleGroupStream)
 
 	return mm
 }
 
+// SetFileTransferStore persists file transfer state so interrupted transfers
+// resume after a restart. It must be called before Start.
+func (mm *MessageManager) SetFileTransferStore(store FileTransferStore) {
+	mm.fileTransferManager.store = store
+}
+
+// SetMessageStore persists sent and received messages and continues each
+// conversation's Lamport clock from the stored messages. It must be called before Start.
+func (mm *MessageManager) SetMessageStore(store MessageStore) {
+	mm.messages = store
+	mm.clock.SetSeed(func(conversation string) uint64 {
+		lamport, err := store.MaxLamport(conversation)
+		if err != nil {
+			mm.logger.WithError(err).WithField("conversation", conversation).Warn("Failed to load conversation clock")
+		}
+		return lamport
+	})
+}
+
+// SetDownloadDir sets where received files are saved. It must be called before Start.
+func (mm *MessageManager) SetDownloadDir(dir string) {
+	mm.fileTransferManager.downloadDir = dir
+}
+
+// SetEncryptFilesAtRest keeps received files encrypted in the download
+// directory; DecryptFile opens them. It must be called before Start.
+func (mm *MessageManager) SetEncryptFilesAtRest(enabled bool) {
+	mm.fileTransferManager.encryptAtRest = enabled
+}
+
+// SetFileAcceptPolicy sets which incoming files are received and whether the
+// user is asked first. It must be called before Start.
+func (mm *MessageManager) SetFileAcceptPolicy(policy *FileAcceptPolicy) {
+	mm.fileTransferManager.policy = policy
+}
+
+// SetContactStore lets the file acceptance policy check senders against the
+// user's contacts, and routes through contacts. It must be called before Start.
+func (mm *MessageManager) SetContactStore(store ContactStore) {
+	mm.fileTransferManager.contacts = store
+	if mm.router != nil {
+		mm.router.SetContacts(store, mm.fileTransferManager.ownerDID)
+	}
+}
+
+// FileTransfers returns the file transfer manager
+func (mm *MessageManager) FileTransfers() *FileTransferManager {
+	return mm.fileTransferManager
+}
+
+// EnableFileSwarm serves completed file transfers and shared files to swarm
+// downloads from other peers. If contentRouting is set, shared files are
+// announced with DHT provider records. It must be called before Start.
+func (mm *MessageManager) EnableFileSwarm(contentRouting routing.ContentRouting) {
+	mm.fileTransferManager.enableSharing(contentRouting)
+}
+
+// EnableMailbox enables the store-and-forward mailbox protocol. It must be called
+// before Start. If store is nil, envelopes held for others are only kept in memory.
+func (mm *MessageManager) EnableMailbox(config *MailboxConfig, store MailboxStore) {
+	mm.mailbox = NewMailboxService(mm.ctx, mm.host, mm.identity, config, store, mm.deliverIndirectMessage, mm.logger)
+}
+
+// EnableRouting enables multi-hop routing through contacts and the configured
+// friends. It must be called before Start.
+func (mm *MessageManager) EnableRouting(config *RoutingConfig) error {
+	router, err := NewRouter(mm.ctx, mm.host, config, mm.deliverIndirectMessage, mm.logger)
+	if err != nil {
+		return fmt.Errorf("failed to create router: %w", err)
+	}
+	if mm.fileTransferManager.contacts != nil {
+		router.SetContacts(mm.fileTransferManager.contacts, mm.fileTransferManager.ownerDID)
+	}
+	mm.router = router
+	return nil
+}
+
+// Router returns the multi-hop router, or nil if routing is disabled
+func (mm *MessageManager) Router() *Router {
+	return mm.router
+}
+
+// Mailbox returns the mailbox service, or nil if mailboxes are disabled
+func (mm *MessageManager) Mailbox() *MailboxService {
+	return mm.mailbox
+}
+
 // Start begins message processing
 func (mm *MessageManager) Start() error {
 	mm.logger.Info("Starting MessageManager...")
 
+	// Import the legacy JSON outbox once the message store seeds the clocks
+	mm.migrateLegacyOfflineMessages()
+
 	// Start message processing goroutines
 	mm.logger.Debug("Adding goroutines to wait group...")
-	mm.wg.Add(3)
+	mm.wg.Add(4)
 	mm.logger.Debug("Starting processIncomingMessages goroutine...")
 	go mm.processIncomingMessages()
 	mm.logger.Debug("Starting processOutgoingMessages goroutine...")
 	go mm.processOutgoingMessages()
 	mm.logger.Debug("Starting processOfflineMessages goroutine...")
 	go mm.processOfflineMessages()
+	go func() {
+		defer mm.wg.Done()
+		mm.streams.Run(mm.ctx)
+	}()
+
+	if mm.mailbox != nil {
+		mm.mailbox.Start()
+	}
+	if mm.router != nil {
+		if err := mm.router.Start(); err != nil {
+			mm.logger.WithError(err).Warn("Failed to start multi-hop routing")
+		}
+	}
+	mm.fileTransferManager.restore()
+	if mm.fileTransferManager.sharing {
+		mm.wg.Add(1)
+		go func() {
+			defer mm.wg.Done()
+			mm.fileTransferManager.reprovideLoop()
+		}()
+	}
 
 	mm.logger.Info("MessageManager started successfully")
 	return nil
@@ -180,6 +348,13 @@ func (mm *MessageManager) Stop() error {
 	mm.logger.Info("Stopping MessageManager...")
 
 	mm.cancel()
+	mm.fileTransferManager.Stop()
+	if mm.mailbox != nil {
+		mm.mailbox.Stop()
+	}
+	if mm.router != nil {
+		mm.router.Stop()
+	}
 	mm.wg.Wait()
 
 	// Close channels
@@ -192,6 +367,34 @@ func (mm *MessageManager) Stop() error {
 
 // SendMessage sends a message to a peer
 func (mm *MessageManager) SendMessage(to string, content []byte, msgType MessageType) error {
+	return mm.sendMessage(to, content, msgType, nil)
+}
+
+// SendReply sends a message that replies to a previously sent or received message
+func (mm *MessageManager) SendReply(parent *Message, content []byte) error {
+	if parent == nil {
+		return fmt.Errorf("reply target is nil")
+	}
+
+	// Reply to whoever we exchanged the parent message with
+	to := parent.To
+	if parent.From != mm.identity.GetDID() {
+		if parent.remotePeer == "" {
+			return fmt.Errorf("sender peer of message %s is unknown", parent.ID)
+		}
+		to = parent.remotePeer.String()
+	}
+
+	return mm.sendMessage(to, content, MessageTypeText, parent)
+}
+
+// sendMessage creates, signs and queues a message, optionally as a reply
+func (mm *MessageManager) sendMessage(to string, content []byte, msgType MessageType, parent *Message) error {
+	recipientPeerID, err := peer.Decode(to)
+	if err != nil {
+		return fmt.Errorf("invalid recipient peer ID: %w", err)
+	}
+
 	// Create message
 	msg := &Message{
 		ID:          uuid.New().String(),
@@ -203,6 +406,15 @@ func (mm *MessageManager) SendMessage(to string, content []byte, msgType Message
 		IsEncrypted: false,
 	}
 
+	if parent != nil {
+		msg.GroupID = parent.GroupID
+		msg.ReplyTo = parent.ID
+		msg.ThreadID = parent.RootID()
+	}
+
+	// Stamp the message with the conversation's logical clock
+	msg.Lamport = mm.clock.Tick(ConversationKey(msg.GroupID, recipientPeerID))
+
 	// Sign the message
 	if err := mm.signMessage(msg); err != nil {
 		return fmt.Errorf("failed to sign message: %w", err)
@@ -211,6 +423,8 @@ func (mm *MessageManager) SendMessage(to string, content []byte, msgType Message
 	// Queue for sending
 	select {
 	case mm.outgoingMessages <- msg:
+		mm.history.Add(msg)
+		mm.saveMessage(msg)
 		return nil
 	case <-mm.ctx.Done():
 		return fmt.Errorf("message manager stopped")
@@ -219,6 +433,21 @@ func (mm *MessageManager) SendMessage(to string, content []byte, msgType Message
 	}
 }
 
+// saveMessage stores a sent or received message if a message store is set
+func (mm *MessageManager) saveMessage(msg *Message) {
+	if mm.messages == nil {
+		return
+	}
+	if err := mm.messages.SaveMessage(msg); err != nil {
+		mm.logger.WithError(err).WithField("message_id", msg.ID).Warn("Failed to store message")
+	}
+}
+
+// History returns the recent message history used for replies and threading
+func (mm *MessageManager) History() *MessageHistory {
+	return mm.history
+}
+
 // RegisterHandler registers a handler for a specific message type
 func (mm *MessageManager) RegisterHandler(msgType MessageType, handler MessageHandler) {
 	mm.messageHandlers[msgType] = handler
@@ -276,6 +505,11 @@ func (mm *MessageManager) handleIncomingMessage(msg *Message) error {
 		}
 	}
 
+	// Advance the conversation clock past the sender's timestamp
+	mm.clock.Observe(ConversationKey(msg.GroupID, msg.remotePeer), msg.Lamport)
+	mm.history.Add(msg)
+	mm.saveMessage(msg)
+
 	// Route to appropriate handler
 	if handler, exists := mm.messageHandlers[msg.Type]; exists {
 		return handler.HandleMessage(mm.ctx, msg)
@@ -304,51 +538,30 @@ func (mm *MessageManager) handleOutgoingMessage(msg *Message) error {
 
 	// Check if peer is connected
 	if mm.host.Network().Connectedness(recipientPeerID) != network.Connected {
+		if mm.canDeliverIndirectly(recipientPeerID) {
+			err := mm.deliverIndirectly(recipientPeerID, msg)
+			if err == nil {
+				return nil
+			}
+			mm.logger.WithError(err).Warn("Failed to deliver message indirectly")
+		}
+
 		mm.logger.WithField("peer_id", recipientPeerID.String()).Info("Peer not connected, storing message for offline delivery")
 		mm.storeOfflineMessage(msg)
 		return nil
 	}
 
-	// Open a stream to the recipient
-	stream, err := mm.host.NewStream(context.Background(), recipientPeerID, MessageProtocolID)
+	size, err := mm.sendToPeer(recipientPeerID, msg)
 	if err != nil {
-		mm.logger.WithError(err).Error("Failed to open stream to recipient, storing for offline delivery")
+		mm.logger.WithError(err).Error("Failed to send message to recipient, storing for offline delivery")
 		mm.storeOfflineMessage(msg)
 		return nil
 	}
-	defer func() {
-		if err := stream.Close(); err != nil {
-			mm.logger.WithError(err).Error("Failed to close stream")
-		}
-	}()
-
-	// Serialize and send the message
-	msgData, err := json.Marshal(msg)
-	if err != nil {
-		return fmt.Errorf("failed to serialize message: %w", err)
-	}
-
-	// Write message length first (4 bytes)
-	msgLen := uint32(len(msgData))
-	lenBytes := make([]byte, 4)
-	lenBytes[0] = byte(msgLen >> 24)
-	lenBytes[1] = byte(msgLen >> 16)
-	lenBytes[2] = byte(msgLen >> 8)
-	lenBytes[3] = byte(msgLen)
-
-	if _, err := stream.Write(lenBytes); err != nil {
-		return fmt.Errorf("failed to write message length: %w", err)
-	}
-
-	// Write message data
-	if _, err := stream.Write(msgData); err != nil {
-		return fmt.Errorf("failed to write message data: %w", err)
-	}
 
 	mm.logger.WithFields(logrus.Fields{
 		"message_id": msg.ID,
 		"to":         msg.To,
-		"size":       len(msgData),
+		"size":       size,
 	}).Info("Message sent successfully")
 
 	return nil
@@ -367,7 +580,7 @@ func (mm *MessageManager) handleMessageStream(stream network.Stream) {
 
 	// Read message length (4 bytes)
 	lenBytes := make([]byte, 4)
-	if _, err := stream.Read(lenBytes); err != nil {
+	if _, err := io.ReadFull(stream, lenBytes); err != nil {
 		mm.logger.WithError(err).Error("Failed to read message length")
 		return
 	}
@@ -380,7 +593,7 @@ func (mm *MessageManager) handleMessageStream(stream network.Stream) {
 
 	// Read message data
 	msgData := make([]byte, msgLen)
-	if _, err := stream.Read(msgData); err != nil {
+	if _, err := io.ReadFull(stream, msgData); err != nil {
 		mm.logger.WithError(err).Error("Failed to read message data")
 		return
 	}
@@ -391,6 +604,7 @@ func (mm *MessageManager) handleMessageStream(stream network.Stream) {
 		mm.logger.WithError(err).Error("Failed to parse message")
 		return
 	}
+	msg.remotePeer = remotePeer
 
 	mm.logger.WithFields(logrus.Fields{
 		"message_id": msg.ID,
@@ -410,23 +624,83 @@ func (mm *MessageManager) handleMessageStream(stream network.Stream) {
 	}
 }
 
-// handleFileStream handles incoming file streams
-func (mm *MessageManager) handleFileStream(stream network.Stream) {
-	defer func() {
-		if err := stream.Close(); err != nil {
-			mm.logger.WithError(err).Error("Failed to close file stream")
+// handlePipelinedStream reads framed messages from a long-lived message stream
+// until the sender closes it or it stays silent past StreamReadTimeout
+func (mm *MessageManager) handlePipelinedStream(stream network.Stream) {
+	remotePeer := stream.Conn().RemotePeer()
+	mm.logger.WithField("peer", remotePeer.String()).Debug("Handling pipelined message stream")
+
+	reader := bufio.NewReader(stream)
+	var buf []byte
+
+	for {
+		if err := stream.SetReadDeadline(time.Now().Add(StreamReadTimeout)); err != nil {
+			mm.logger.WithError(err).Debug("Failed to set stream read deadline")
 		}
-	}()
 
-	remotePeer := stream.Conn().RemotePeer()
-	mm.logger.WithField("peer", remotePeer.String()).Debug("Handling file stream")
+		frameType, payload, nextBuf, err := readFrame(reader, buf, MaxMessageSize)
+		buf = nextBuf
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				if err := stream.Close(); err != nil {
+					mm.logger.WithError(err).Debug("Failed to close message stream")
+				}
+			} else {
+				mm.logger.WithError(err).WithField("peer", remotePeer.String()).Debug("Message stream ended")
+				if err := stream.Reset(); err != nil {
+					mm.logger.WithError(err).Debug("Failed to reset message stream")
+				}
+			}
+			return
+		}
+
+		switch frameType {
+		case frameTypeMessage:
+		case frameTypeCompressed:
+			if stream.Protocol() != CompressedMessageProtocolID {
+				mm.logger.WithField("peer", remotePeer.String()).Warn("Dropping compressed message on uncompressed stream")
+				continue
+			}
+			if payload, err = decompressData(payload, MaxMessageSize); err != nil {
+				mm.logger.WithError(err).Error("Failed to decompress message")
+				continue
+			}
+		default:
+			continue // Keepalive
+		}
+
+		msg := &Message{}
+		if err := json.Unmarshal(payload, msg); err != nil {
+			mm.logger.WithError(err).Error("Failed to parse message")
+			continue
+		}
+		msg.remotePeer = remotePeer
+
+		mm.logger.WithFields(logrus.Fields{
+			"message_id": msg.ID,
+			"from":       msg.From,
+			"type":       msg.Type.String(),
+			"size":       len(payload),
+		}).Info("Message received")
 
-	// Handle file transfer protocol
-	if err := mm.processFileTransferStream(stream, remotePeer); err != nil {
-		mm.logger.WithError(err).Error("Failed to process file transfer stream")
+		// Block rather than drop: the sender is throttled by stream flow control
+		select {
+		case mm.incomingMessages <- msg:
+		case <-mm.ctx.Done():
+			if err := stream.Reset(); err != nil {
+				mm.logger.WithError(err).Debug("Failed to reset message stream")
+			}
+			return
+		}
 	}
 }
 
+// handleFileStream handles incoming file streams
+func (mm *MessageManager) handleFileStream(stream network.Stream) {
+	mm.logger.WithField("peer", stream.Conn().RemotePeer().String()).Debug("Handling file stream")
+	mm.fileTransferManager.HandleStream(stream)
+}
+
 // handleGroupStream handles incoming group message streams
 func (mm *MessageManager) handleGroupStream(stream network.Stream) {
 	defer func() {
@@ -441,9 +715,56 @@ func (mm *MessageManager) handleGroupStream(stream network.Stream) {
 	// TODO: Implement group message handling
 }
 
-// signMessage signs a message with the identity key
+// signMessage signs a message with the identity key and attaches the key and
+// proof-of-work that let recipients check it against the sender DID
 func (mm *MessageManager) signMessage(msg *Message) error {
-	// Serialize message for signing (excluding signature field)
+	msg.SenderKey = mm.identity.PublicKey
+	msg.SenderProof = mm.identity.ProofOfWork
+
+	msgData, err := messageSigningPayload(msg)
+	if err != nil {
+		return err
+	}
+
+	// Sign the message
+	signature, err := mm.identity.Sign(msgData)
+	if err != nil {
+		return fmt.Errorf("failed to sign message: %w", err)
+	}
+
+	msg.Signature = signature
+	return nil
+}
+
+// verifyMessage checks that a message was signed with the key its sender DID
+// was derived from and, if it is known, that the peer it came from holds that key
+func (mm *MessageManager) verifyMessage(msg *Message) bool {
+	if len(msg.SenderKey) != ed25519.PublicKeySize {
+		return false
+	}
+
+	publicKey := ed25519.PublicKey(msg.SenderKey)
+	if !user.VerifyDIDOwnership(msg.From, publicKey, msg.SenderProof) {
+		return false
+	}
+
+	// Replies go to the remote peer, so it must not differ from the signer
+	if msg.remotePeer != "" {
+		peerKey, err := user.PeerIdentityKey(msg.remotePeer)
+		if err != nil || !peerKey.Equal(publicKey) {
+			return false
+		}
+	}
+
+	msgData, err := messageSigningPayload(msg)
+	if err != nil {
+		return false
+	}
+	return ed25519.Verify(publicKey, msgData, msg.Signature)
+}
+
+// messageSigningPayload serializes the signed fields of a message
+func messageSigningPayload(msg *Message) ([]byte, error) {
 	msgData, err := json.Marshal(struct {
 		ID        string                 `json:"id"`
 		Type      MessageType            `json:"type"`
@@ -453,6 +774,9 @@ func (mm *MessageManager) signMessage(msg *Message) error {
 		Content   []byte                 `json:"content"`
 		Metadata  map[string]interface{} `json:"metadata,omitempty"`
 		Timestamp time.Time              `json:"timestamp"`
+		ReplyTo   string                 `json:"reply_to,omitempty"`
+		ThreadID  string                 `json:"thread_id,omitempty"`
+		Lamport   uint64                 `json:"lamport,omitempty"`
 	}{
 		ID:        msg.ID,
 		Type:      msg.Type,
@@ -462,37 +786,26 @@ func (mm *MessageManager) signMessage(msg *Message) error {
 		Content:   msg.Content,
 		Metadata:  msg.Metadata,
 		Timestamp: msg.Timestamp,
+		ReplyTo:   msg.ReplyTo,
+		ThreadID:  msg.ThreadID,
+		Lamport:   msg.Lamport,
 	})
 	if err != nil {
-		return fmt.Errorf("failed to serialize message: %w", err)
-	}
-
-	// Sign the message
-	signature, err := mm.identity.Sign(msgData)
-	if err != nil {
-		return fmt.Errorf("failed to sign message: %w", err)
+		return nil, fmt.Errorf("failed to serialize message: %w", err)
 	}
-
-	msg.Signature = signature
-	return nil
+	return msgData, nil
 }
 
-// verifyMessage verifies a message signature
-func (mm *MessageManager) verifyMessage(msg *Message) bool {
-	// TODO: Get sender's public key from DID
-	// TODO: Verify signature
-	return true // Placeholder
-}
-
-// SendFile initiates a file transfer to a peer
+// SendFile initiates a file transfer to a peer. If the connection drops, the
+// transfer resumes where it stopped once the peer reconnects.
 func (mm *MessageManager) SendFile(peerID peer.ID, filePath string) error {
 	mm.logger.WithFields(logrus.Fields{
 		"peer_id":   peerID.String(),
 		"file_path": filePath,
 	}).Info("Initiating file transfer")
 
-	// Open a stream to the peer for file transfer
-	stream, err := mm.host.NewStream(context.Background(), peerID, FileProtocolID)
+	// Open a stream to the peer for file transfer, preferring binary chunk frames
+	stream, err := mm.host.NewStream(mm.ctx, peerID, EncryptedFileStreamProtocolID, FileStreamProtocolID, FileProtocolID)
 	if err != nil {
 		return fmt.Errorf("failed to open file stream to peer: %w", err)
 	}
@@ -506,377 +819,376 @@ func (mm *MessageManager) SendFile(peerID peer.ID, filePath string) error {
 	return mm.fileTransferManager.StartFileTransfer(mm.ctx, stream, filePath, peerID)
 }
 
-// processFileTransferStream processes incoming file transfer streams
-func (mm *MessageManager) processFileTransferStream(stream network.Stream, remotePeer peer.ID) error {
-	mm.logger.WithField("peer", remotePeer.String()).Debug("Processing file transfer stream")
+// SendFiles sends files and directories to a peer as one transfer. The peer
+// sees a signed manifest of every file and may accept only some of them.
+func (mm *MessageManager) SendFiles(peerID peer.ID, paths []string) (*FileManifest, error) {
+	mm.logger.WithFields(logrus.Fields{
+		"peer_id": peerID.String(),
+		"paths":   len(paths),
+	}).Info("Initiating multi-file transfer")
 
-	// Read the initial request
-	request, err := mm.readFileTransferRequest(stream)
+	manifest, sources, err := CreateFileManifest(paths)
 	if err != nil {
-		return fmt.Errorf("failed to read file transfer request: %w", err)
+		return nil, fmt.Errorf("failed to create file manifest: %w", err)
 	}
 
-	switch request.Type {
-	case "request":
-		return mm.handleFileTransferRequest(stream, remotePeer, request)
-	case "chunk":
-		return mm.handleFileChunk(stream, remotePeer, request)
-	case "complete":
-		return mm.handleFileComplete(stream, remotePeer, request)
-	default:
-		return fmt.Errorf("unknown file transfer request type: %s", request.Type)
-	}
-}
-
-// readFileTransferRequest reads a file transfer request from stream
-func (mm *MessageManager) readFileTransferRequest(stream network.Stream) (*FileTransferRequest, error) {
-	// Read length prefix
-	var length uint32
-	if err := binary.Read(stream, binary.BigEndian, &length); err != nil {
-		return nil, fmt.Errorf("failed to read length: %w", err)
-	}
-
-	if length > FileHeaderSize {
-		return nil, fmt.Errorf("request too large: %d bytes", length)
-	}
-
-	// Read data
-	data := make([]byte, length)
-	if _, err := io.ReadFull(stream, data); err != nil {
-		return nil, fmt.Errorf("failed to read request data: %w", err)
-	}
-
-	// Parse request
-	var request FileTransferRequest
-	if err := json.Unmarshal(data, &request); err != nil {
-		return nil, fmt.Errorf("failed to unmarshal request: %w", err)
-	}
-
-	if request.Magic != FileTransferMagic {
-		return nil, fmt.Errorf("invalid magic number: %x", request.Magic)
+	stream, err := mm.host.NewStream(mm.ctx, peerID, EncryptedFileStreamProtocolID, FileStreamProtocolID, FileProtocolID)
+	if err != nil {
+		return manifest, fmt.Errorf("failed to open file stream to peer: %w", err)
 	}
+	defer func() {
+		if err := stream.Close(); err != nil {
+			mm.logger.WithError(err).Error("Failed to close file transfer stream")
+		}
+	}()
 
-	return &request, nil
+	return manifest, mm.fileTransferManager.StartManifestTransfer(mm.ctx, stream, manifest, sources, peerID)
 }
 
-// handleFileTransferRequest handles incoming file transfer requests
-func (mm *MessageManager) handleFileTransferRequest(stream network.Stream, remotePeer peer.ID, request *FileTransferRequest) error {
-	mm.logger.WithFields(logrus.Fields{
-		"peer":      remotePeer.String(),
-		"file_name": request.Metadata.Name,
-		"file_size": request.Metadata.Size,
-	}).Info("Received file transfer request")
-
-	// For now, automatically accept all file transfers
-	// In production, this would prompt the user or check policies
-	response := FileTransferRequest{
-		Magic: FileTransferMagic,
-		Type:  "accept",
-	}
+// decryptMessage decrypts a message using Signal Protocol
+func (mm *MessageManager) decryptMessage(msg *Message) error {
+	// TODO: Implement Signal Protocol decryption
+	return nil
+}
 
-	// Send acceptance response
-	if err := mm.sendFileTransferResponse(stream, response); err != nil {
-		return fmt.Errorf("failed to send acceptance: %w", err)
-	}
+// sendToPeer writes a message on the peer's long-lived message stream
+func (mm *MessageManager) sendToPeer(peerID peer.ID, msg *Message) (int, error) {
+	ctx, cancel := context.WithTimeout(mm.ctx, MessageTimeout)
+	defer cancel()
 
-	// Create download directory if it doesn't exist
-	downloadDir := filepath.Join(os.Getenv("HOME"), ".xelvra", "downloads")
-	if err := os.MkdirAll(downloadDir, 0755); err != nil {
-		return fmt.Errorf("failed to create download directory: %w", err)
+	msgData, err := json.Marshal(msg)
+	if err != nil {
+		return 0, fmt.Errorf("failed to serialize message: %w", err)
 	}
 
-	// Create file transfer session for receiving
-	transfer := NewFileTransfer(request.Metadata.ID, remotePeer, request.Metadata, false, mm.logger)
-	mm.fileTransferManager.transfers[request.Metadata.ID] = transfer
+	// File chunks to the peer wait until the message is out
+	defer mm.fileTransferManager.PreemptTransfers(peerID)()
 
-	// Create destination file
-	destPath := filepath.Join(downloadDir, request.Metadata.Name)
-	file, err := os.Create(destPath)
-	if err != nil {
-		return fmt.Errorf("failed to create destination file: %w", err)
+	if err := mm.streams.Send(ctx, peerID, msgData); err != nil {
+		return 0, err
 	}
 
-	transfer.file = file
-	transfer.Status = FileTransferActive
+	return len(msgData), nil
+}
 
-	mm.logger.WithFields(logrus.Fields{
-		"transfer_id": transfer.ID,
-		"dest_path":   destPath,
-	}).Info("File transfer accepted, ready to receive")
+// processOfflineMessages delivers outbox entries when their retry time comes due
+func (mm *MessageManager) processOfflineMessages() {
+	defer mm.wg.Done()
 
-	return nil
-}
+	timer := time.NewTimer(0)
+	defer timer.Stop()
 
-// handleFileChunk handles incoming file chunks
-func (mm *MessageManager) handleFileChunk(stream network.Stream, remotePeer peer.ID, request *FileTransferRequest) error {
-	// Find the active transfer (simplified - would need better lookup)
-	var transfer *FileTransfer
-	for _, t := range mm.fileTransferManager.transfers {
-		if t.PeerID == remotePeer && t.Status == FileTransferActive && !t.isOutgoing {
-			transfer = t
-			break
+	for {
+		select {
+		case <-timer.C:
+		case <-mm.outboxWake:
+		case <-mm.ctx.Done():
+			return
 		}
-	}
 
-	if transfer == nil {
-		return fmt.Errorf("no active file transfer found for peer %s", remotePeer.String())
-	}
+		wait := mm.deliverOfflineMessages()
 
-	// Write chunk to file
-	if _, err := transfer.file.Write(request.Data); err != nil {
-		transfer.Status = FileTransferFailed
-		transfer.Error = err
-		return fmt.Errorf("failed to write chunk: %w", err)
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(wait)
 	}
-
-	transfer.BytesReceived += int64(len(request.Data))
-	transfer.UpdateProgress()
-	transfer.chunks[request.ChunkID] = true
-
-	mm.logger.WithFields(logrus.Fields{
-		"transfer_id": transfer.ID,
-		"chunk_id":    request.ChunkID,
-		"chunk_size":  len(request.Data),
-		"progress":    fmt.Sprintf("%.1f%%", transfer.Progress*100),
-	}).Debug("Received file chunk")
-
-	return nil
 }
 
-// handleFileComplete handles file transfer completion
-func (mm *MessageManager) handleFileComplete(stream network.Stream, remotePeer peer.ID, request *FileTransferRequest) error {
-	// Find the active transfer
-	var transfer *FileTransfer
-	for _, t := range mm.fileTransferManager.transfers {
-		if t.PeerID == remotePeer && t.Status == FileTransferActive && !t.isOutgoing {
-			transfer = t
-			break
-		}
+// wakeOutbox asks the outbox loop to rescan without waiting for its timer
+func (mm *MessageManager) wakeOutbox() {
+	select {
+	case mm.outboxWake <- struct{}{}:
+	default:
 	}
+}
 
-	if transfer == nil {
-		return fmt.Errorf("no active file transfer found for peer %s", remotePeer.String())
-	}
+// deliverOfflineMessages starts delivery for every connected peer with due messages
+// and returns how long to wait before the next scan
+func (mm *MessageManager) deliverOfflineMessages() time.Duration {
+	now := time.Now()
 
-	// Close the file
-	if err := transfer.file.Close(); err != nil {
-		mm.logger.WithError(err).Warn("Failed to close received file")
+	if removed, err := mm.outbox.PurgeOutbox(now); err != nil {
+		mm.logger.WithError(err).Error("Failed to purge outbox")
+	} else if removed > 0 {
+		mm.logger.WithField("count", removed).Info("Removed delivered and expired outbox messages")
 	}
 
-	transfer.Status = FileTransferCompleted
-	transfer.EndTime = time.Now()
-
-	mm.logger.WithFields(logrus.Fields{
-		"transfer_id":    transfer.ID,
-		"file_name":      transfer.Metadata.Name,
-		"bytes_received": transfer.BytesReceived,
-		"duration":       transfer.EndTime.Sub(transfer.StartTime),
-	}).Info("File transfer completed successfully")
-
-	// TODO: Verify file hash
-	// TODO: Send completion acknowledgment
-
-	return nil
-}
-
-// sendFileTransferResponse sends a file transfer response
-func (mm *MessageManager) sendFileTransferResponse(stream network.Stream, response FileTransferRequest) error {
-	data, err := json.Marshal(response)
+	entries, err := mm.outbox.LoadOutbox("")
 	if err != nil {
-		return fmt.Errorf("failed to marshal response: %w", err)
+		mm.logger.WithError(err).Error("Failed to load outbox")
+		return OutboxMaxIdle
 	}
 
-	// Write length prefix
-	length := uint32(len(data))
-	if err := binary.Write(stream, binary.BigEndian, length); err != nil {
-		return fmt.Errorf("failed to write length: %w", err)
+	wait := OutboxMaxIdle
+	duePeers := make(map[string]bool)
+	for _, entry := range entries {
+		if entry.NextAttempt.After(now) {
+			if until := entry.NextAttempt.Sub(now); until < wait {
+				wait = until
+			}
+			continue
+		}
+		duePeers[entry.PeerID] = true
 	}
 
-	// Write data
-	if _, err := stream.Write(data); err != nil {
-		return fmt.Errorf("failed to write response: %w", err)
+	for peerIDStr := range duePeers {
+		peerID, err := peer.Decode(peerIDStr)
+		if err != nil {
+			mm.logger.WithError(err).Error("Invalid peer ID in outbox")
+			continue
+		}
+
+		// Check if peer is reachable; the connect notification flushes it later
+		if mm.host.Network().Connectedness(peerID) != network.Connected && !mm.canDeliverIndirectly(peerID) {
+			continue
+		}
+
+		mm.startPeerDelivery(peerID, false)
 	}
 
-	return nil
+	return wait
 }
 
-// decryptMessage decrypts a message using Signal Protocol
-func (mm *MessageManager) decryptMessage(msg *Message) error {
-	// TODO: Implement Signal Protocol decryption
-	return nil
+// flushPeerOutbox delivers all queued messages for a peer that just connected,
+// ignoring any pending backoff
+func (mm *MessageManager) flushPeerOutbox(peerID peer.ID) {
+	if mm.ctx.Err() != nil {
+		return
+	}
+	mm.startPeerDelivery(peerID, true)
 }
 
-// processOfflineMessages periodically tries to deliver offline messages
-func (mm *MessageManager) processOfflineMessages() {
-	defer mm.wg.Done()
+// startPeerDelivery delivers a peer's outbox in its own goroutine, at most one per peer
+func (mm *MessageManager) startPeerDelivery(peerID peer.ID, ignoreBackoff bool) {
+	key := peerID.String()
 
-	ticker := time.NewTicker(30 * time.Second) // Check every 30 seconds
-	defer ticker.Stop()
-
-	for {
-		select {
-		case <-ticker.C:
-			mm.deliverOfflineMessages()
-		case <-mm.ctx.Done():
-			return
-		}
+	mm.outboxMutex.Lock()
+	if mm.outboxInflight[key] {
+		mm.outboxMutex.Unlock()
+		return
 	}
+	mm.outboxInflight[key] = true
+	mm.outboxMutex.Unlock()
+
+	mm.wg.Add(1)
+	go func() {
+		defer mm.wg.Done()
+		defer func() {
+			mm.outboxMutex.Lock()
+			delete(mm.outboxInflight, key)
+			mm.outboxMutex.Unlock()
+		}()
+
+		mm.deliverPeerOutbox(peerID, ignoreBackoff)
+	}()
 }
 
-// deliverOfflineMessages attempts to deliver stored offline messages
-func (mm *MessageManager) deliverOfflineMessages() {
-	mm.offlineMutex.Lock()
-	defer mm.offlineMutex.Unlock()
+// deliverPeerOutbox sends a peer's queued messages in order, stopping at the first failure
+func (mm *MessageManager) deliverPeerOutbox(peerID peer.ID, ignoreBackoff bool) {
+	entries, err := mm.outbox.LoadOutbox(peerID.String())
+	if err != nil {
+		mm.logger.WithError(err).Error("Failed to load outbox for peer")
+		return
+	}
 
-	now := time.Now()
+	delivered := 0
+	for i, entry := range entries {
+		if i >= OutboxDeliveryLimit || mm.ctx.Err() != nil {
+			mm.wakeOutbox()
+			break
+		}
 
-	for peerIDStr, messages := range mm.offlineMessages {
-		peerID, err := peer.Decode(peerIDStr)
-		if err != nil {
-			mm.logger.WithError(err).Error("Invalid peer ID in offline messages")
+		now := time.Now()
+		if entry.IsExpired(now) {
+			mm.logger.WithField("message_id", entry.Message.ID).Info("Offline message expired")
+			entry.State = OutboxExpired
+			mm.saveOutboxEntry(entry)
 			continue
 		}
-
-		// Check if peer is connected
-		if mm.host.Network().Connectedness(peerID) != network.Connected {
-			continue // Peer not connected, skip for now
+		if !ignoreBackoff && entry.NextAttempt.After(now) {
+			break // Preserve ordering: later messages wait for this one
 		}
 
-		// Try to deliver messages
-		var remainingMessages []*OfflineMessage
-		for _, offlineMsg := range messages {
-			// Check if message has expired
-			if now.After(offlineMsg.ExpiresAt) {
-				mm.logger.WithField("message_id", offlineMsg.Message.ID).Info("Offline message expired")
-				continue
-			}
+		entry.State = OutboxSending
+		mm.saveOutboxEntry(entry)
 
-			// Try to deliver the message
-			if err := mm.deliverOfflineMessage(peerID, offlineMsg); err != nil {
-				offlineMsg.Attempts++
-				if offlineMsg.Attempts < 5 { // Max 5 attempts
-					remainingMessages = append(remainingMessages, offlineMsg)
-				} else {
-					mm.logger.WithField("message_id", offlineMsg.Message.ID).Warn("Offline message delivery failed after max attempts")
-				}
-			} else {
-				mm.logger.WithField("message_id", offlineMsg.Message.ID).Info("Offline message delivered successfully")
-			}
+		if err := mm.deliverOutboxEntry(peerID, entry); err != nil {
+			entry.RecordFailure(err, time.Now())
+			mm.saveOutboxEntry(entry)
+
+			mm.logger.WithError(err).WithFields(logrus.Fields{
+				"message_id":   entry.Message.ID,
+				"attempts":     entry.Attempts,
+				"next_attempt": entry.NextAttempt,
+			}).Warn("Offline message delivery failed, will retry")
+			mm.wakeOutbox()
+			return
 		}
 
-		// Update the offline messages list
-		if len(remainingMessages) == 0 {
-			delete(mm.offlineMessages, peerIDStr)
-		} else {
-			mm.offlineMessages[peerIDStr] = remainingMessages
+		if err := mm.outbox.DeleteOutboxEntry(entry.Message.ID); err != nil {
+			mm.logger.WithError(err).Error("Failed to remove delivered message from outbox")
 		}
+		delivered++
+
+		mm.logger.WithField("message_id", entry.Message.ID).Info("Offline message delivered successfully")
 	}
 
-	// Save updated offline messages to disk
-	mm.saveOfflineMessages()
+	if delivered > 0 {
+		mm.logger.WithFields(logrus.Fields{
+			"peer_id": peerID.String(),
+			"count":   delivered,
+		}).Info("Outbox flushed")
+	}
 }
 
-// deliverOfflineMessage delivers a single offline message
-func (mm *MessageManager) deliverOfflineMessage(peerID peer.ID, offlineMsg *OfflineMessage) error {
-	// Open a stream to the recipient
-	stream, err := mm.host.NewStream(context.Background(), peerID, MessageProtocolID)
-	if err != nil {
-		return fmt.Errorf("failed to open stream: %w", err)
+// deliverOutboxEntry sends a queued message directly if the peer is connected,
+// otherwise through friendly peers or the peer's mailbox
+func (mm *MessageManager) deliverOutboxEntry(peerID peer.ID, entry *OutboxEntry) error {
+	if mm.host.Network().Connectedness(peerID) != network.Connected && mm.canDeliverIndirectly(peerID) {
+		return mm.deliverIndirectly(peerID, entry.Message)
 	}
-	defer func() {
-		if err := stream.Close(); err != nil {
-			mm.logger.WithError(err).Error("Failed to close stream")
-		}
-	}()
 
-	// Serialize and send the message
-	msgData, err := json.Marshal(offlineMsg.Message)
-	if err != nil {
-		return fmt.Errorf("failed to serialize message: %w", err)
-	}
+	_, err := mm.sendToPeer(peerID, entry.Message)
+	return err
+}
 
-	// Write message length first (4 bytes)
-	msgLen := uint32(len(msgData))
-	lenBytes := make([]byte, 4)
-	lenBytes[0] = byte(msgLen >> 24)
-	lenBytes[1] = byte(msgLen >> 16)
-	lenBytes[2] = byte(msgLen >> 8)
-	lenBytes[3] = byte(msgLen)
+// canDeliverIndirectly returns true if a route or mailbox for the peer is known
+func (mm *MessageManager) canDeliverIndirectly(peerID peer.ID) bool {
+	return (mm.router != nil && mm.router.HasRoute(peerID)) ||
+		(mm.mailbox != nil && mm.mailbox.HasMailbox(peerID))
+}
 
-	if _, err := stream.Write(lenBytes); err != nil {
-		return fmt.Errorf("failed to write message length: %w", err)
+// deliverIndirectly delivers a message to a peer we are not connected to. A route
+// through friendly peers delivers immediately, so it is preferred over a mailbox.
+func (mm *MessageManager) deliverIndirectly(peerID peer.ID, msg *Message) error {
+	var routeErr error
+	if mm.router != nil {
+		routeErr = mm.router.Route(peerID, msg)
+		if routeErr == nil {
+			return nil
+		}
 	}
 
-	// Write message data
-	if _, err := stream.Write(msgData); err != nil {
-		return fmt.Errorf("failed to write message data: %w", err)
+	if mm.mailbox != nil && mm.mailbox.HasMailbox(peerID) {
+		return mm.mailbox.Deposit(peerID, msg)
 	}
 
-	return nil
+	if routeErr != nil {
+		return routeErr
+	}
+	return ErrNoRoute
+}
+
+// deliverIndirectMessage feeds a message that arrived through a mailbox or route
+// into the incoming queue
+func (mm *MessageManager) deliverIndirectMessage(msg *Message) {
+	select {
+	case mm.incomingMessages <- msg:
+	case <-mm.ctx.Done():
+	}
 }
 
 // storeOfflineMessage stores a message for offline delivery
 func (mm *MessageManager) storeOfflineMessage(msg *Message) {
-	mm.offlineMutex.Lock()
-	defer mm.offlineMutex.Unlock()
+	entry := NewOutboxEntry(msg, msg.To)
 
-	offlineMsg := &OfflineMessage{
-		Message:   msg,
-		Attempts:  0,
-		CreatedAt: time.Now(),
-		ExpiresAt: time.Now().Add(7 * 24 * time.Hour), // Expire after 7 days
-	}
-
-	mm.offlineMessages[msg.To] = append(mm.offlineMessages[msg.To], offlineMsg)
+	// The first attempt already failed, so start with a backoff
+	entry.RecordFailure(nil, time.Now())
+	mm.saveOutboxEntry(entry)
 
 	mm.logger.WithFields(logrus.Fields{
 		"message_id": msg.ID,
 		"to":         msg.To,
 	}).Info("Message stored for offline delivery")
 
-	// Save to disk
-	mm.saveOfflineMessages()
+	mm.wakeOutbox()
+}
+
+// saveOutboxEntry persists an outbox entry, logging failures
+func (mm *MessageManager) saveOutboxEntry(entry *OutboxEntry) {
+	if err := mm.outbox.SaveOutboxEntry(entry); err != nil {
+		mm.logger.WithError(err).WithField("message_id", entry.Message.ID).Error("Failed to save outbox entry")
+	}
 }
 
-// loadOfflineMessages loads offline messages from disk
-func (mm *MessageManager) loadOfflineMessages() {
-	mm.offlineMutex.Lock()
-	defer mm.offlineMutex.Unlock()
+// migrateLegacyOfflineMessages imports ~/.xelvra/offline_messages/messages.json
+// into the outbox store and renames the file so it is only imported once.
+// Without an identity to sign them with, the messages are left for later.
+func (mm *MessageManager) migrateLegacyOfflineMessages() {
+	homeDir, err := os.UserHomeDir()
+	if err != nil || mm.identity == nil {
+		return
+	}
 
-	offlineFile := filepath.Join(mm.offlineDir, "messages.json")
+	offlineFile := filepath.Join(homeDir, ".xelvra", "offline_messages", "messages.json")
 	data, err := os.ReadFile(offlineFile)
 	if err != nil {
 		if !os.IsNotExist(err) {
-			mm.logger.WithError(err).Error("Failed to read offline messages file")
+			mm.logger.WithError(err).Error("Failed to read legacy offline messages file")
 		}
 		return
 	}
 
-	if err := json.Unmarshal(data, &mm.offlineMessages); err != nil {
-		mm.logger.WithError(err).Error("Failed to parse offline messages file")
+	var legacy map[string][]*OfflineMessage
+	if err := json.Unmarshal(data, &legacy); err != nil {
+		mm.logger.WithError(err).Error("Failed to parse legacy offline messages file")
 		return
 	}
 
-	// Count loaded messages
-	totalMessages := 0
-	for _, messages := range mm.offlineMessages {
-		totalMessages += len(messages)
+	type legacyEntry struct {
+		recipient peer.ID
+		offline   *OfflineMessage
+	}
+	var entries []legacyEntry
+	for peerID, messages := range legacy {
+		recipient, err := peer.Decode(peerID)
+		if err != nil {
+			mm.logger.WithError(err).WithField("peer", peerID).Warn("Skipping legacy offline messages for an invalid peer ID")
+			continue
+		}
+		for _, offlineMsg := range messages {
+			if offlineMsg.Message != nil {
+				entries = append(entries, legacyEntry{recipient, offlineMsg})
+			}
+		}
 	}
 
-	mm.logger.WithField("count", totalMessages).Info("Loaded offline messages from disk")
-}
+	// Legacy messages carry no Lamport time or sender key; they are stamped
+	// and signed like new messages, oldest first so conversations keep their order
+	slices.SortStableFunc(entries, func(a, b legacyEntry) int {
+		return a.offline.CreatedAt.Compare(b.offline.CreatedAt)
+	})
 
-// saveOfflineMessages saves offline messages to disk
-func (mm *MessageManager) saveOfflineMessages() {
-	offlineFile := filepath.Join(mm.offlineDir, "messages.json")
-	data, err := json.MarshalIndent(mm.offlineMessages, "", "  ")
-	if err != nil {
-		mm.logger.WithError(err).Error("Failed to serialize offline messages")
-		return
+	imported := 0
+	for _, item := range entries {
+		msg := item.offline.Message
+		msg.From = mm.identity.GetDID()
+		msg.Lamport = mm.clock.Tick(ConversationKey(msg.GroupID, item.recipient))
+		if err := mm.signMessage(msg); err != nil {
+			mm.logger.WithError(err).Error("Failed to sign legacy offline message")
+			return
+		}
+
+		entry := NewOutboxEntry(msg, item.recipient.String())
+		entry.Attempts = item.offline.Attempts
+		entry.CreatedAt = item.offline.CreatedAt
+		entry.ExpiresAt = item.offline.ExpiresAt
+		if err := mm.outbox.SaveOutboxEntry(entry); err != nil {
+			mm.logger.WithError(err).Error("Failed to import legacy offline message")
+			return
+		}
+		mm.history.Add(msg)
+		mm.saveMessage(msg)
+		imported++
 	}
 
-	if err := os.WriteFile(offlineFile, data, 0600); err != nil {
-		mm.logger.WithError(err).Error("Failed to save offline messages to disk")
-		return
+	if err := os.Rename(offlineFile, offlineFile+".migrated"); err != nil {
+		mm.logger.WithError(err).Warn("Failed to rename legacy offline messages file")
 	}
+
+	mm.logger.WithField("count", imported).Info("Imported legacy offline messages into outbox")
 }
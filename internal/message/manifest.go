@@ -0,0 +1,581 @@
+package message
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/sirupsen/logrus"
+)
+
+// Multi-file transfer limits
+const (
+	MaxManifestFiles  = 10000 // Files in one multi-file transfer
+	maxManifestDepth  = 32    // Directory levels below the download directory
+	maxManifestFrames = 256   // Frames a manifest may be spread over
+
+	manifestMimeType = "inode/directory" // Shown for a multi-file offer
+)
+
+// FileManifest lists the files of a multi-file transfer. The sender signs it
+// with its host key, and every file is then sent as its own resumable transfer
+// checked against the metadata in the manifest.
+type FileManifest struct {
+	ID        string         `json:"id"`
+	Name      string         `json:"name"`  // Shown to the receiver
+	Files     []FileMetadata `json:"files"` // Each with ManifestID, Path and Mode set
+	Created   time.Time      `json:"created"`
+	Signature []byte         `json:"signature,omitempty"`
+}
+
+// TotalSize returns the combined size of the files in the manifest
+func (m *FileManifest) TotalSize() int64 {
+	return totalSize(m.Files)
+}
+
+// totalSize returns the combined size of files
+func totalSize(files []FileMetadata) int64 {
+	var size int64
+	for _, file := range files {
+		size += file.Size
+	}
+	return size
+}
+
+// CreateFileManifest describes files and directories as one transfer.
+// Directories are walked recursively; symbolic links and special files are
+// skipped. It returns the manifest and the local path of each of its files.
+func CreateFileManifest(paths []string) (*FileManifest, []string, error) {
+	manifest := &FileManifest{
+		ID:      fmt.Sprintf("manifest_%d", time.Now().UnixNano()),
+		Created: time.Now(),
+	}
+	var sources []string
+	seen := make(map[string]bool)
+
+	add := func(source, relPath string) error {
+		if len(manifest.Files) >= MaxManifestFiles {
+			return fmt.Errorf("more than %d files", MaxManifestFiles)
+		}
+		if seen[relPath] {
+			return fmt.Errorf("%s is included twice", relPath)
+		}
+		seen[relPath] = true
+
+		info, err := os.Stat(source)
+		if err != nil {
+			return fmt.Errorf("failed to stat file: %w", err)
+		}
+		metadata, err := CreateFileMetadata(source)
+		if err != nil {
+			return err
+		}
+		metadata.ID = fmt.Sprintf("%s_%d", manifest.ID, len(manifest.Files))
+		metadata.ManifestID = manifest.ID
+		metadata.Path = relPath
+		metadata.Mode = uint32(info.Mode().Perm())
+		// Thumbnails of many files would not fit in one manifest frame
+		if metadata.Preview != nil {
+			metadata.Preview.Thumbnail = nil
+		}
+
+		manifest.Files = append(manifest.Files, *metadata)
+		sources = append(sources, source)
+		return nil
+	}
+
+	for _, root := range paths {
+		root, err := filepath.Abs(root)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to resolve path: %w", err)
+		}
+		info, err := os.Stat(root)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to stat path: %w", err)
+		}
+
+		if !info.IsDir() {
+			if err := add(root, filepath.Base(root)); err != nil {
+				return nil, nil, err
+			}
+			continue
+		}
+
+		// Paths keep the directory's own name so it is recreated on the receiver
+		parent := filepath.Dir(root)
+		err = filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if !entry.Type().IsRegular() {
+				return nil
+			}
+			relPath, err := filepath.Rel(parent, path)
+			if err != nil {
+				return err
+			}
+			return add(path, filepath.ToSlash(relPath))
+		})
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read directory %s: %w", root, err)
+		}
+	}
+
+	if len(manifest.Files) == 0 {
+		return nil, nil, fmt.Errorf("no files to send")
+	}
+	if len(paths) == 1 {
+		manifest.Name = filepath.Base(paths[0])
+	} else {
+		manifest.Name = fmt.Sprintf("%d files", len(manifest.Files))
+	}
+	return manifest, sources, nil
+}
+
+// manifestPayload is what the sender signs: the manifest without its signature
+func manifestPayload(manifest *FileManifest) ([]byte, error) {
+	unsigned := *manifest
+	unsigned.Signature = nil
+	data, err := json.Marshal(unsigned)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode manifest: %w", err)
+	}
+	return append([]byte("xelvra-file-manifest-v1"), data...), nil
+}
+
+// signManifest signs the manifest with the host key
+func (ftm *FileTransferManager) signManifest(manifest *FileManifest) error {
+	if ftm.host == nil {
+		return fmt.Errorf("no host to sign with")
+	}
+	privKey := ftm.host.Peerstore().PrivKey(ftm.host.ID())
+	if privKey == nil {
+		return fmt.Errorf("host private key not available")
+	}
+
+	payload, err := manifestPayload(manifest)
+	if err != nil {
+		return err
+	}
+	manifest.Signature, err = privKey.Sign(payload)
+	if err != nil {
+		return fmt.Errorf("failed to sign manifest: %w", err)
+	}
+	return nil
+}
+
+// verifyManifest checks the sender's signature on a manifest
+func verifyManifest(senderKey crypto.PubKey, manifest *FileManifest) bool {
+	if senderKey == nil || len(manifest.Signature) == 0 {
+		return false
+	}
+	payload, err := manifestPayload(manifest)
+	if err != nil {
+		return false
+	}
+	valid, err := senderKey.Verify(payload, manifest.Signature)
+	return err == nil && valid
+}
+
+// validateManifest checks a received manifest before it is offered to the user
+func validateManifest(manifest *FileManifest) error {
+	if manifest == nil {
+		return fmt.Errorf("missing manifest")
+	}
+	if !validTransferID(manifest.ID) {
+		return fmt.Errorf("invalid manifest ID")
+	}
+	if len(manifest.Name) > maxOfferedNameBytes {
+		return fmt.Errorf("manifest name is too long")
+	}
+	if len(manifest.Files) == 0 || len(manifest.Files) > MaxManifestFiles {
+		return fmt.Errorf("manifest has %d files", len(manifest.Files))
+	}
+
+	ids := make(map[string]bool, len(manifest.Files))
+	paths := make(map[string]bool, len(manifest.Files))
+	for _, file := range manifest.Files {
+		if err := validateFileMetadata(file); err != nil {
+			return fmt.Errorf("invalid manifest file: %w", err)
+		}
+		if file.ManifestID != manifest.ID || file.Path == "" {
+			return fmt.Errorf("file %s does not belong to the manifest", file.ID)
+		}
+
+		localPath, err := safeRelativePath(file.Path)
+		if err != nil {
+			return err
+		}
+		if ids[file.ID] || paths[localPath] {
+			return fmt.Errorf("manifest lists %s twice", file.Path)
+		}
+		ids[file.ID], paths[localPath] = true, true
+	}
+	return nil
+}
+
+// safeRelativePath turns a slash-separated path from a manifest into a local
+// relative path made of sanitized names that cannot leave the download directory
+func safeRelativePath(path string) (string, error) {
+	if len(path) > maxOfferedNameBytes {
+		return "", fmt.Errorf("path is too long")
+	}
+
+	parts := strings.Split(path, "/")
+	if len(parts) > maxManifestDepth {
+		return "", fmt.Errorf("path %q is too deep", path)
+	}
+	for i, part := range parts {
+		if part == "" || part == "." || part == ".." {
+			return "", fmt.Errorf("invalid path %q", path)
+		}
+		parts[i] = SanitizeFileName(part)
+	}
+	return filepath.Join(parts...), nil
+}
+
+// receivedFileMode keeps the read and execute bits of the sender's file and
+// always lets the owner read and write it
+func receivedFileMode(mode uint32) os.FileMode {
+	return os.FileMode(mode)&0755 | 0600
+}
+
+// manifestFileDir creates the directories of a manifest file below the
+// download directory and returns the directory and name to publish it under
+func (ftm *FileTransferManager) manifestFileDir(path string) (string, string, error) {
+	localPath, err := safeRelativePath(path)
+	if err != nil {
+		return "", "", err
+	}
+
+	dir := ftm.downloadDir
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", "", fmt.Errorf("failed to create download directory: %w", err)
+	}
+
+	// Create one level at a time so an existing symlink cannot redirect the file
+	parent := filepath.Dir(localPath)
+	if parent != "." {
+		for _, part := range strings.Split(parent, string(filepath.Separator)) {
+			dir = filepath.Join(dir, part)
+			if err := os.Mkdir(dir, 0755); err != nil && !os.IsExist(err) {
+				return "", "", fmt.Errorf("failed to create directory: %w", err)
+			}
+			info, err := os.Lstat(dir)
+			if err != nil {
+				return "", "", fmt.Errorf("failed to inspect directory: %w", err)
+			}
+			if !info.IsDir() {
+				return "", "", fmt.Errorf("%s is not a directory", dir)
+			}
+		}
+	}
+
+	return dir, filepath.Base(localPath), nil
+}
+
+// StartManifestTransfer offers the files of a manifest on an open stream and
+// sends the ones the receiver accepts, each on its own stream
+func (ftm *FileTransferManager) StartManifestTransfer(ctx context.Context, stream network.Stream, manifest *FileManifest, sources []string, peerID peer.ID) error {
+	if len(sources) != len(manifest.Files) {
+		return fmt.Errorf("manifest has %d files but %d sources", len(manifest.Files), len(sources))
+	}
+	if err := ftm.signManifest(manifest); err != nil {
+		return err
+	}
+
+	ftm.logger.WithFields(logrus.Fields{
+		"manifest_id": manifest.ID,
+		"name":        manifest.Name,
+		"files":       len(manifest.Files),
+		"total_size":  manifest.TotalSize(),
+		"peer_id":     peerID.String(),
+	}).Info("Offering files")
+
+	if err := ftm.sendManifest(stream, manifest); err != nil {
+		return fmt.Errorf("failed to send manifest: %w", err)
+	}
+	reply, err := ftm.readFrame(stream)
+	if err != nil {
+		return fmt.Errorf("failed to read response: %w", err)
+	}
+
+	switch reply.Type {
+	case "accept":
+	case "reject":
+		return fmt.Errorf("%w: %s", errTransferRejected, reply.Error)
+	default:
+		return fmt.Errorf("unexpected response type: %s", reply.Type)
+	}
+
+	accepted, err := ChunkBitmapFromBytes(len(manifest.Files), reply.Accepted)
+	if err != nil {
+		return fmt.Errorf("invalid list of accepted files: %w", err)
+	}
+
+	// Register every accepted file first so the rest resume with the peer
+	// if this session breaks off
+	var transfers []*FileTransfer
+	for i, metadata := range manifest.Files {
+		if accepted.Has(i) {
+			transfers = append(transfers, ftm.registerOutgoing(peerID, metadata, sources[i]))
+		}
+	}
+
+	ftm.logger.WithFields(logrus.Fields{
+		"manifest_id": manifest.ID,
+		"accepted":    len(transfers),
+		"offered":     len(manifest.Files),
+	}).Info("Files accepted by receiver")
+
+	var failed []error
+	for _, transfer := range transfers {
+		if err := ftm.sendManifestFile(ctx, transfer); err != nil {
+			if transfer.resumable() {
+				return err
+			}
+			failed = append(failed, fmt.Errorf("%s: %w", transfer.Metadata.Path, err))
+		}
+	}
+	return errors.Join(failed...)
+}
+
+// sendManifest sends a signed manifest in as many frames as its files need:
+// the manifest frame carries the files that fit and manifest_files frames the rest
+func (ftm *FileTransferManager) sendManifest(stream network.Stream, manifest *FileManifest) error {
+	parts, err := splitManifestFiles(manifest)
+	if err != nil {
+		return err
+	}
+
+	header := *manifest
+	header.Files = parts[0]
+	if err := ftm.writeFrame(stream, FileTransferRequest{Type: "manifest", Manifest: &header, FileCount: len(manifest.Files)}); err != nil {
+		return err
+	}
+	for _, files := range parts[1:] {
+		if err := ftm.writeFrame(stream, FileTransferRequest{Type: "manifest_files", MoreFiles: files}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// splitManifestFiles groups the files of a manifest by the frame that carries
+// them, the manifest frame first
+func splitManifestFiles(manifest *FileManifest) ([][]FileMetadata, error) {
+	header := *manifest
+	header.Files = nil
+	first, err := fileFrameOverhead(FileTransferRequest{Type: "manifest", Manifest: &header, FileCount: len(manifest.Files)})
+	if err != nil {
+		return nil, err
+	}
+	rest, err := fileFrameOverhead(FileTransferRequest{Type: "manifest_files"})
+	if err != nil {
+		return nil, err
+	}
+	rest += len(`,"more_files":[]`)
+
+	parts := [][]FileMetadata{nil}
+	size := first
+	for _, file := range manifest.Files {
+		data, err := json.Marshal(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode manifest file: %w", err)
+		}
+		// Counting a separating comma for every file overestimates by one byte
+		if size+len(data)+1 > FileMaxFrameSize {
+			parts = append(parts, nil)
+			size = rest
+			if size+len(data)+1 > FileMaxFrameSize {
+				return nil, fmt.Errorf("%s is described too verbosely for a frame", file.Path)
+			}
+		}
+		parts[len(parts)-1] = append(parts[len(parts)-1], file)
+		size += len(data) + 1
+	}
+
+	if len(parts) > maxManifestFrames {
+		return nil, fmt.Errorf("manifest needs %d frames, at most %d are allowed", len(parts), maxManifestFrames)
+	}
+	return parts, nil
+}
+
+// fileFrameOverhead returns the encoded size of a control frame on either file protocol
+func fileFrameOverhead(request FileTransferRequest) (int, error) {
+	request.Magic = FileTransferMagic
+	data, err := json.Marshal(request)
+	if err != nil {
+		return 0, fmt.Errorf("failed to marshal request: %w", err)
+	}
+	return 1 + len(data), nil // Binary frames start with their kind
+}
+
+// readManifest collects the files of a manifest that follow its manifest frame
+func (ftm *FileTransferManager) readManifest(stream network.Stream, request *FileTransferRequest) (*FileManifest, error) {
+	manifest := request.Manifest
+	if manifest == nil {
+		return nil, fmt.Errorf("missing manifest")
+	}
+
+	count := request.FileCount
+	if count == 0 {
+		count = len(manifest.Files)
+	}
+	if count > MaxManifestFiles || len(manifest.Files) > count {
+		return nil, fmt.Errorf("manifest has %d files", count)
+	}
+
+	for frames := 1; len(manifest.Files) < count; frames++ {
+		if frames >= maxManifestFrames {
+			return nil, fmt.Errorf("manifest is spread over too many frames")
+		}
+		frame, err := ftm.readFrame(stream)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read manifest files: %w", err)
+		}
+		if frame.Type != "manifest_files" || len(frame.MoreFiles) == 0 || len(manifest.Files)+len(frame.MoreFiles) > count {
+			return nil, fmt.Errorf("unexpected manifest frame: %s", frame.Type)
+		}
+		manifest.Files = append(manifest.Files, frame.MoreFiles...)
+	}
+	return manifest, nil
+}
+
+// sendManifestFile sends one accepted file of a manifest on a new stream
+func (ftm *FileTransferManager) sendManifestFile(ctx context.Context, transfer *FileTransfer) error {
+	stream, err := ftm.host.NewStream(ctx, transfer.PeerID, EncryptedFileStreamProtocolID, FileStreamProtocolID, FileProtocolID)
+	if err != nil {
+		return ftm.interrupt(transfer, fmt.Errorf("failed to open file stream to peer: %w", err))
+	}
+	defer func() {
+		if err := stream.Close(); err != nil {
+			ftm.logger.WithError(err).Debug("Failed to close file transfer stream")
+		}
+	}()
+
+	return ftm.runOutgoing(ctx, stream, transfer)
+}
+
+// receiveManifest offers the files of a manifest to the user and registers the
+// accepted ones, which the sender then sends as separate transfers
+func (ftm *FileTransferManager) receiveManifest(stream network.Stream, remotePeer peer.ID, request *FileTransferRequest) error {
+	if err := ftm.checkSender(remotePeer); err != nil {
+		return ftm.reject(stream, err)
+	}
+	manifest, err := ftm.readManifest(stream, request)
+	if err != nil {
+		return ftm.reject(stream, err)
+	}
+	if err := validateManifest(manifest); err != nil {
+		return ftm.reject(stream, err)
+	}
+	if !verifyManifest(stream.Conn().RemotePublicKey(), manifest) {
+		return ftm.reject(stream, fmt.Errorf("invalid manifest signature"))
+	}
+
+	// Only files the policy allows are offered to the user
+	var offered []FileMetadata
+	var refused error
+	for _, file := range manifest.Files {
+		if err := ftm.checkOffer(remotePeer, file); err != nil {
+			if refused == nil {
+				refused = fmt.Errorf("%s: %w", file.Path, err)
+			}
+			continue
+		}
+		offered = append(offered, file)
+	}
+	if len(offered) == 0 {
+		return ftm.reject(stream, refused)
+	}
+
+	ftm.logger.WithFields(logrus.Fields{
+		"peer":        remotePeer.String(),
+		"manifest_id": manifest.ID,
+		"files":       len(manifest.Files),
+		"offered":     len(offered),
+	}).Info("Received multi-file transfer request")
+
+	summary := FileMetadata{
+		ID:       manifest.ID,
+		Name:     manifest.Name,
+		Size:     totalSize(offered),
+		MimeType: manifestMimeType,
+	}
+	paths, err := ftm.awaitDecision(remotePeer, summary, offered)
+	if err != nil {
+		return ftm.reject(stream, err)
+	}
+
+	selected := offered
+	if len(paths) > 0 {
+		picked := make(map[string]bool, len(paths))
+		for _, path := range paths {
+			picked[path] = true
+		}
+		selected = nil
+		for _, file := range offered {
+			if picked[file.Path] {
+				selected = append(selected, file)
+			}
+		}
+	}
+
+	refund, err := ftm.reserveQuota(remotePeer, totalSize(selected))
+	if err != nil {
+		return ftm.reject(stream, err)
+	}
+
+	// Accepted files are sent back as a bitmap, which fits in a frame however many there are
+	indexes := make(map[string]int, len(manifest.Files))
+	for i, file := range manifest.Files {
+		indexes[file.ID] = i
+	}
+	accepted := NewChunkBitmap(len(manifest.Files))
+	for _, file := range selected {
+		if _, err := ftm.prepareIncoming(remotePeer, file); err != nil {
+			refund()
+			return ftm.reject(stream, err)
+		}
+		accepted.Set(indexes[file.ID])
+	}
+
+	if err := ftm.writeFrame(stream, FileTransferRequest{Type: "accept", Accepted: accepted.Bytes()}); err != nil {
+		return fmt.Errorf("failed to send acceptance: %w", err)
+	}
+
+	ftm.logger.WithFields(logrus.Fields{
+		"manifest_id": manifest.ID,
+		"accepted":    accepted.Count(),
+	}).Info("Multi-file transfer accepted, ready to receive")
+	return nil
+}
+
+// ManifestTransfers returns the transfers of the files in a multi-file
+// transfer, ordered by path, for per-file progress
+func (ftm *FileTransferManager) ManifestTransfers(manifestID string) []*FileTransfer {
+	ftm.mu.Lock()
+	var transfers []*FileTransfer
+	for _, transfer := range ftm.transfers {
+		if transfer.Metadata.ManifestID == manifestID {
+			transfers = append(transfers, transfer)
+		}
+	}
+	ftm.mu.Unlock()
+
+	sort.Slice(transfers, func(i, j int) bool {
+		return transfers[i].Metadata.Path < transfers[j].Metadata.Path
+	})
+	return transfers
+}
@@ -0,0 +1,150 @@
+package message
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Merkle tree domain separation prefixes, so a leaf can never be mistaken for a node
+const (
+	merkleLeafPrefix byte = 0x00
+	merkleNodePrefix byte = 0x01
+)
+
+// MerkleTree is a binary hash tree over file chunks. A node without a sibling is
+// promoted to the next level unchanged.
+type MerkleTree struct {
+	levels [][][]byte // levels[0] holds the leaf hashes
+}
+
+// MerkleLeafHash returns the leaf hash of a chunk
+func MerkleLeafHash(chunk []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{merkleLeafPrefix})
+	h.Write(chunk)
+	return h.Sum(nil)
+}
+
+// merkleNodeHash returns the hash of an inner node
+func merkleNodeHash(left, right []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{merkleNodePrefix})
+	h.Write(left)
+	h.Write(right)
+	return h.Sum(nil)
+}
+
+// NewMerkleTree builds a tree from leaf hashes
+func NewMerkleTree(leaves [][]byte) *MerkleTree {
+	tree := &MerkleTree{levels: [][][]byte{leaves}}
+
+	for level := leaves; len(level) > 1; {
+		next := make([][]byte, 0, (len(level)+1)/2)
+		for i := 0; i < len(level); i += 2 {
+			if i+1 < len(level) {
+				next = append(next, merkleNodeHash(level[i], level[i+1]))
+			} else {
+				next = append(next, level[i])
+			}
+		}
+		tree.levels = append(tree.levels, next)
+		level = next
+	}
+
+	return tree
+}
+
+// BuildFileMerkleTree hashes a file in chunks of chunkSize and builds its tree
+func BuildFileMerkleTree(r io.Reader, chunkSize int) (*MerkleTree, error) {
+	var leaves [][]byte
+	buffer := make([]byte, chunkSize)
+
+	for {
+		n, err := io.ReadFull(r, buffer)
+		if n > 0 {
+			leaves = append(leaves, MerkleLeafHash(buffer[:n]))
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read chunk: %w", err)
+		}
+	}
+
+	return NewMerkleTree(leaves), nil
+}
+
+// Root returns the root hash. The root of an empty tree is the hash of no data.
+func (mt *MerkleTree) Root() []byte {
+	top := mt.levels[len(mt.levels)-1]
+	if len(top) == 0 {
+		sum := sha256.Sum256(nil)
+		return sum[:]
+	}
+	return top[0]
+}
+
+// Leaves returns the number of leaves
+func (mt *MerkleTree) Leaves() int {
+	return len(mt.levels[0])
+}
+
+// Proof returns the sibling hashes needed to verify a leaf against the root
+func (mt *MerkleTree) Proof(index int) ([][]byte, error) {
+	if index < 0 || index >= mt.Leaves() {
+		return nil, fmt.Errorf("leaf %d out of range", index)
+	}
+
+	var proof [][]byte
+	for _, level := range mt.levels[:len(mt.levels)-1] {
+		if sibling := index ^ 1; sibling < len(level) {
+			proof = append(proof, level[sibling])
+		}
+		index /= 2
+	}
+	return proof, nil
+}
+
+// VerifyMerkleProof checks that leafHash is leaf index of a tree with total
+// leaves and the given root
+func VerifyMerkleProof(root []byte, index, total int, leafHash []byte, proof [][]byte) bool {
+	if index < 0 || index >= total {
+		return false
+	}
+
+	hash := leafHash
+	for size := total; size > 1; size = (size + 1) / 2 {
+		sibling := index ^ 1
+		if sibling < size {
+			if len(proof) == 0 {
+				return false
+			}
+			if index%2 == 0 {
+				hash = merkleNodeHash(hash, proof[0])
+			} else {
+				hash = merkleNodeHash(proof[0], hash)
+			}
+			proof = proof[1:]
+		}
+		index /= 2
+	}
+
+	return len(proof) == 0 && bytes.Equal(hash, root)
+}
+
+// fileMerkleTree builds the tree of a file on disk
+func fileMerkleTree(path string, chunkSize int) (*MerkleTree, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file: %w", err)
+	}
+	defer func() {
+		_ = file.Close() // Read-only, nothing to flush
+	}()
+
+	return BuildFileMerkleTree(file, chunkSize)
+}
@@ -0,0 +1,200 @@
+package message
+
+import (
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// Outbox retry settings
+	OutboxBaseBackoff   = 5 * time.Second
+	OutboxMaxBackoff    = 30 * time.Minute
+	OutboxMessageTTL    = 7 * 24 * time.Hour
+	OutboxMaxIdle       = 5 * time.Minute // Upper bound between outbox scans
+	OutboxDeliveryLimit = 100             // Max messages flushed per peer per round
+)
+
+// OutboxState represents the delivery state of an outbox entry
+type OutboxState int
+
+const (
+	OutboxPending OutboxState = iota
+	OutboxSending
+	OutboxDelivered
+	OutboxExpired
+)
+
+// String returns string representation of OutboxState
+func (ost OutboxState) String() string {
+	switch ost {
+	case OutboxPending:
+		return "pending"
+	case OutboxSending:
+		return "sending"
+	case OutboxDelivered:
+		return "delivered"
+	case OutboxExpired:
+		return "expired"
+	default:
+		return "unknown"
+	}
+}
+
+// OutboxEntry is a message waiting for delivery to a peer that is not reachable
+type OutboxEntry struct {
+	Message     *Message
+	PeerID      string
+	State       OutboxState
+	Attempts    int
+	NextAttempt time.Time
+	LastError   string
+	CreatedAt   time.Time
+	ExpiresAt   time.Time
+}
+
+// NewOutboxEntry creates a pending outbox entry that is due immediately
+func NewOutboxEntry(msg *Message, peerID string) *OutboxEntry {
+	now := time.Now()
+	return &OutboxEntry{
+		Message:     msg,
+		PeerID:      peerID,
+		State:       OutboxPending,
+		NextAttempt: now,
+		CreatedAt:   now,
+		ExpiresAt:   now.Add(OutboxMessageTTL),
+	}
+}
+
+// IsExpired returns true if the entry can no longer be delivered
+func (e *OutboxEntry) IsExpired(now time.Time) bool {
+	return now.After(e.ExpiresAt)
+}
+
+// RecordFailure increments the attempt counter and schedules the next retry
+func (e *OutboxEntry) RecordFailure(err error, now time.Time) {
+	e.Attempts++
+	e.State = OutboxPending
+	e.NextAttempt = now.Add(OutboxBackoff(e.Attempts))
+	if err != nil {
+		e.LastError = err.Error()
+	}
+}
+
+// OutboxBackoff returns the retry delay after the given number of failed attempts.
+// The delay grows exponentially up to OutboxMaxBackoff with "equal jitter" so that
+// many queued messages do not retry in lockstep.
+func OutboxBackoff(attempts int) time.Duration {
+	if attempts <= 0 {
+		return 0
+	}
+
+	backoff := OutboxBaseBackoff
+	for i := 1; i < attempts && backoff < OutboxMaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > OutboxMaxBackoff {
+		backoff = OutboxMaxBackoff
+	}
+
+	half := backoff / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+// OutboxStore persists outbox entries across restarts
+type OutboxStore interface {
+	// SaveOutboxEntry inserts or updates an entry keyed by message ID
+	SaveOutboxEntry(entry *OutboxEntry) error
+	// LoadOutbox returns undelivered entries for a peer (or all peers if empty), oldest first
+	LoadOutbox(peerID string) ([]*OutboxEntry, error)
+	// DeleteOutboxEntry removes an entry
+	DeleteOutboxEntry(messageID string) error
+	// PurgeOutbox removes delivered and expired entries, returning the number removed
+	PurgeOutbox(now time.Time) (int, error)
+	// ResetSendingOutbox returns entries left in the sending state by a crash to pending
+	ResetSendingOutbox() error
+}
+
+// MemoryOutboxStore is an in-memory OutboxStore used when no database is available
+type MemoryOutboxStore struct {
+	entries map[string]*OutboxEntry
+	mu      sync.Mutex
+}
+
+// NewMemoryOutboxStore creates a new in-memory outbox store
+func NewMemoryOutboxStore() *MemoryOutboxStore {
+	return &MemoryOutboxStore{
+		entries: make(map[string]*OutboxEntry),
+	}
+}
+
+// SaveOutboxEntry inserts or updates an entry
+func (s *MemoryOutboxStore) SaveOutboxEntry(entry *OutboxEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored := *entry
+	s.entries[entry.Message.ID] = &stored
+	return nil
+}
+
+// LoadOutbox returns undelivered entries for a peer, oldest first
+func (s *MemoryOutboxStore) LoadOutbox(peerID string) ([]*OutboxEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var entries []*OutboxEntry
+	for _, entry := range s.entries {
+		if entry.State == OutboxDelivered || entry.State == OutboxExpired {
+			continue
+		}
+		if peerID != "" && entry.PeerID != peerID {
+			continue
+		}
+		loaded := *entry
+		entries = append(entries, &loaded)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].CreatedAt.Before(entries[j].CreatedAt)
+	})
+	return entries, nil
+}
+
+// DeleteOutboxEntry removes an entry
+func (s *MemoryOutboxStore) DeleteOutboxEntry(messageID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.entries, messageID)
+	return nil
+}
+
+// PurgeOutbox removes delivered and expired entries
+func (s *MemoryOutboxStore) PurgeOutbox(now time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	removed := 0
+	for id, entry := range s.entries {
+		if entry.State == OutboxDelivered || entry.State == OutboxExpired || entry.IsExpired(now) {
+			delete(s.entries, id)
+			removed++
+		}
+	}
+	return removed, nil
+}
+
+// ResetSendingOutbox returns in-flight entries to pending
+func (s *MemoryOutboxStore) ResetSendingOutbox() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, entry := range s.entries {
+		if entry.State == OutboxSending {
+			entry.State = OutboxPending
+		}
+	}
+	return nil
+}
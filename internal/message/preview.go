@@ -0,0 +1,361 @@
+package message
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif" // Registers the GIF decoder
+	"image/jpeg"
+	_ "image/png" // Registers the PNG decoder
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// Preview limits
+const (
+	ThumbnailMaxSize  = 96        // Pixels on the longer side of a thumbnail
+	MaxThumbnailBytes = 16 * 1024 // Encoded thumbnail size accepted in an offer
+
+	maxPreviewPixels   = 50_000_000       // Larger images are described but not decoded
+	maxPreviewDuration = 1000 * time.Hour // Longer durations are ignored as bogus
+	maxMP4HeaderBytes  = 8 * 1024 * 1024  // Largest moov box read for metadata
+	thumbnailSamples   = 4                // Samples averaged per side of a thumbnail pixel
+)
+
+// FilePreview describes a media file so the receiver can see what it is
+// before accepting it. It travels inline in the file offer.
+type FilePreview struct {
+	Kind      MessageType   `json:"kind"` // MessageTypeImage, MessageTypeAudio or MessageTypeVideo
+	Width     int           `json:"width,omitempty"`
+	Height    int           `json:"height,omitempty"`
+	Duration  time.Duration `json:"duration,omitempty"`
+	Thumbnail []byte        `json:"thumbnail,omitempty"` // JPEG, at most ThumbnailMaxSize pixels per side
+}
+
+// MediaType returns the message type for files of a MIME type: image, audio,
+// video, or MessageTypeFile for everything else
+func MediaType(mimeType string) MessageType {
+	switch {
+	case strings.HasPrefix(mimeType, "image/"):
+		return MessageTypeImage
+	case strings.HasPrefix(mimeType, "audio/"):
+		return MessageTypeAudio
+	case strings.HasPrefix(mimeType, "video/"):
+		return MessageTypeVideo
+	default:
+		return MessageTypeFile
+	}
+}
+
+// CreateFilePreview reads the dimensions, duration and, for images, a
+// thumbnail of a media file. It returns nil for files that are not media.
+// Anything that cannot be parsed is left out.
+func CreateFilePreview(filePath, mimeType string) (*FilePreview, error) {
+	kind := MediaType(mimeType)
+	if kind == MessageTypeFile {
+		return nil, nil
+	}
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file: %w", err)
+	}
+	defer func() { _ = file.Close() }()
+
+	preview := &FilePreview{Kind: kind}
+	switch mimeType {
+	case "image/png", "image/jpeg", "image/gif":
+		err = imagePreview(file, preview)
+	case "video/mp4", "video/quicktime", "audio/mp4":
+		err = mp4Preview(file, preview)
+	case "audio/wav":
+		err = wavPreview(file, preview)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return preview, nil
+}
+
+// imagePreview reads the dimensions of an image and scales it down to a thumbnail
+func imagePreview(file *os.File, preview *FilePreview) error {
+	config, _, err := image.DecodeConfig(file)
+	if err != nil {
+		return fmt.Errorf("failed to read image header: %w", err)
+	}
+	preview.Width, preview.Height = config.Width, config.Height
+	if config.Width <= 0 || config.Height <= 0 || config.Width*config.Height > maxPreviewPixels {
+		return nil
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to rewind image: %w", err)
+	}
+	img, _, err := image.Decode(file)
+	if err != nil {
+		return fmt.Errorf("failed to decode image: %w", err)
+	}
+
+	thumbnail := scaleImage(img, ThumbnailMaxSize)
+	for _, quality := range []int{75, 50, 25} {
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, thumbnail, &jpeg.Options{Quality: quality}); err != nil {
+			return fmt.Errorf("failed to encode thumbnail: %w", err)
+		}
+		if buf.Len() <= MaxThumbnailBytes {
+			preview.Thumbnail = buf.Bytes()
+			break
+		}
+	}
+	return nil
+}
+
+// scaleImage shrinks an image to fit maxSize pixels per side, averaging a few
+// samples per output pixel. Transparent areas are drawn on white.
+func scaleImage(img image.Image, maxSize int) *image.RGBA {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width > maxSize || height > maxSize {
+		if width >= height {
+			width, height = maxSize, max(1, height*maxSize/width)
+		} else {
+			width, height = max(1, width*maxSize/height), maxSize
+		}
+	}
+
+	scaled := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			var r, g, b, a uint32
+			for sy := 0; sy < thumbnailSamples; sy++ {
+				for sx := 0; sx < thumbnailSamples; sx++ {
+					px := bounds.Min.X + (x*thumbnailSamples+sx)*bounds.Dx()/(width*thumbnailSamples)
+					py := bounds.Min.Y + (y*thumbnailSamples+sy)*bounds.Dy()/(height*thumbnailSamples)
+					cr, cg, cb, ca := img.At(px, py).RGBA()
+					r, g, b, a = r+cr, g+cg, b+cb, a+ca
+				}
+			}
+			// Colors are premultiplied, so adding the uncovered part of white composites them
+			n := uint32(thumbnailSamples * thumbnailSamples)
+			r, g, b, a = r/n, g/n, b/n, a/n
+			scaled.Set(x, y, color.RGBA64{R: uint16(r + 0xffff - a), G: uint16(g + 0xffff - a), B: uint16(b + 0xffff - a), A: 0xffff})
+		}
+	}
+	return scaled
+}
+
+// mp4Preview reads the duration from the movie header and the dimensions of
+// the first visual track of an MP4 or QuickTime file
+func mp4Preview(file *os.File, preview *FilePreview) error {
+	info, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat file: %w", err)
+	}
+
+	moov, err := findMP4Box(file, info.Size(), "moov")
+	if err != nil {
+		return err
+	}
+	if moov.size > maxMP4HeaderBytes {
+		return fmt.Errorf("movie header is too large")
+	}
+	data := make([]byte, moov.size)
+	if _, err := file.ReadAt(data, moov.offset); err != nil {
+		return fmt.Errorf("failed to read movie header: %w", err)
+	}
+
+	for _, box := range mp4Boxes(data) {
+		switch box.kind {
+		case "mvhd":
+			if duration, ok := mvhdDuration(box.data); ok {
+				preview.Duration = duration
+			}
+		case "trak":
+			if preview.Width != 0 {
+				continue
+			}
+			for _, child := range mp4Boxes(box.data) {
+				if child.kind == "tkhd" && len(child.data) >= 8 {
+					// Width and height are 16.16 fixed point at the end of the box
+					tail := child.data[len(child.data)-8:]
+					preview.Width = int(binary.BigEndian.Uint32(tail) >> 16)
+					preview.Height = int(binary.BigEndian.Uint32(tail[4:]) >> 16)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// mp4Box locates a box in a file
+type mp4Box struct {
+	offset int64 // Start of the box contents
+	size   int64
+}
+
+// findMP4Box finds a top-level box in a file of the given size
+func findMP4Box(r io.ReaderAt, end int64, kind string) (mp4Box, error) {
+	var header [16]byte
+	for offset := int64(0); offset+8 <= end; {
+		if _, err := r.ReadAt(header[:8], offset); err != nil {
+			return mp4Box{}, fmt.Errorf("failed to read box header: %w", err)
+		}
+		size, headerSize := int64(binary.BigEndian.Uint32(header[:4])), int64(8)
+		switch size {
+		case 0:
+			size = end - offset // Box extends to the end of the file
+		case 1:
+			if _, err := r.ReadAt(header[8:16], offset+8); err != nil {
+				return mp4Box{}, fmt.Errorf("failed to read box header: %w", err)
+			}
+			size, headerSize = int64(binary.BigEndian.Uint64(header[8:16])), 16
+		}
+		if size < headerSize || size > end-offset {
+			return mp4Box{}, fmt.Errorf("invalid box size")
+		}
+		if string(header[4:8]) == kind {
+			return mp4Box{offset: offset + headerSize, size: size - headerSize}, nil
+		}
+		offset += size
+	}
+	return mp4Box{}, fmt.Errorf("no %s box", kind)
+}
+
+// mp4Child is a box read into memory
+type mp4Child struct {
+	kind string
+	data []byte
+}
+
+// mp4Boxes splits the contents of a container box into its children
+func mp4Boxes(data []byte) []mp4Child {
+	var boxes []mp4Child
+	for len(data) >= 8 {
+		size := int(binary.BigEndian.Uint32(data))
+		if size < 8 || size > len(data) {
+			break
+		}
+		boxes = append(boxes, mp4Child{kind: string(data[4:8]), data: data[8:size]})
+		data = data[size:]
+	}
+	return boxes
+}
+
+// mvhdDuration reads the duration of a movie header box
+func mvhdDuration(data []byte) (time.Duration, bool) {
+	var timescale, duration uint64
+	switch {
+	case len(data) >= 20 && data[0] == 0:
+		timescale = uint64(binary.BigEndian.Uint32(data[12:]))
+		duration = uint64(binary.BigEndian.Uint32(data[16:]))
+	case len(data) >= 32 && data[0] == 1:
+		timescale = uint64(binary.BigEndian.Uint32(data[20:]))
+		duration = binary.BigEndian.Uint64(data[24:])
+	default:
+		return 0, false
+	}
+	return mediaDuration(duration, timescale)
+}
+
+// mediaDuration converts units of 1/timescale seconds, rejecting bogus values
+func mediaDuration(units, timescale uint64) (time.Duration, bool) {
+	if timescale == 0 || units/timescale > uint64(maxPreviewDuration/time.Second) {
+		return 0, false
+	}
+	return time.Duration(units/timescale)*time.Second + time.Duration(units%timescale)*time.Second/time.Duration(timescale), true
+}
+
+// wavPreview reads the duration of a RIFF WAVE file from its format and data chunks
+func wavPreview(file *os.File, preview *FilePreview) error {
+	var header [12]byte
+	if _, err := io.ReadFull(file, header[:]); err != nil {
+		return fmt.Errorf("failed to read WAV header: %w", err)
+	}
+	if string(header[:4]) != "RIFF" || string(header[8:]) != "WAVE" {
+		return fmt.Errorf("not a WAV file")
+	}
+
+	var byteRate uint32
+	for {
+		var chunk [8]byte
+		if _, err := io.ReadFull(file, chunk[:]); err != nil {
+			return fmt.Errorf("no WAV data chunk")
+		}
+		size := binary.LittleEndian.Uint32(chunk[4:])
+
+		switch string(chunk[:4]) {
+		case "fmt ":
+			var format [16]byte
+			if size < 16 {
+				return fmt.Errorf("invalid WAV format chunk")
+			}
+			if _, err := io.ReadFull(file, format[:]); err != nil {
+				return fmt.Errorf("failed to read WAV format: %w", err)
+			}
+			byteRate = binary.LittleEndian.Uint32(format[8:])
+			size -= 16
+		case "data":
+			if duration, ok := mediaDuration(uint64(size), uint64(byteRate)); ok {
+				preview.Duration = duration
+			}
+			return nil
+		}
+
+		// Chunks are padded to an even size
+		if _, err := file.Seek(int64(size+size%2), io.SeekCurrent); err != nil {
+			return fmt.Errorf("failed to skip WAV chunk: %w", err)
+		}
+	}
+}
+
+// validateFilePreview checks a preview received in an offer. The thumbnail
+// must be a small JPEG, so rendering it cannot exhaust memory.
+func validateFilePreview(preview *FilePreview, mimeType string) error {
+	if preview.Kind != MediaType(mimeType) || preview.Kind == MessageTypeFile {
+		return fmt.Errorf("preview does not match the MIME type")
+	}
+	if preview.Width < 0 || preview.Height < 0 || preview.Duration < 0 || preview.Duration > maxPreviewDuration {
+		return fmt.Errorf("invalid preview metadata")
+	}
+	if len(preview.Thumbnail) == 0 {
+		return nil
+	}
+	if len(preview.Thumbnail) > MaxThumbnailBytes {
+		return fmt.Errorf("thumbnail exceeds %d bytes", MaxThumbnailBytes)
+	}
+	config, err := jpeg.DecodeConfig(bytes.NewReader(preview.Thumbnail))
+	if err != nil {
+		return fmt.Errorf("invalid thumbnail: %w", err)
+	}
+	if config.Width <= 0 || config.Height <= 0 || config.Width > ThumbnailMaxSize || config.Height > ThumbnailMaxSize {
+		return fmt.Errorf("thumbnail is %dx%d pixels", config.Width, config.Height)
+	}
+	return nil
+}
+
+// DecodeThumbnail decodes the thumbnail of a preview that passed validation
+func (p *FilePreview) DecodeThumbnail() (image.Image, error) {
+	if len(p.Thumbnail) == 0 {
+		return nil, fmt.Errorf("preview has no thumbnail")
+	}
+	if err := validateFilePreview(&FilePreview{Kind: MessageTypeImage, Thumbnail: p.Thumbnail}, "image/jpeg"); err != nil {
+		return nil, err
+	}
+	return jpeg.Decode(bytes.NewReader(p.Thumbnail))
+}
+
+// String describes the preview in one line, such as "image 1920x1080"
+func (p *FilePreview) String() string {
+	parts := []string{p.Kind.String()}
+	if p.Width > 0 && p.Height > 0 {
+		parts = append(parts, fmt.Sprintf("%dx%d", p.Width, p.Height))
+	}
+	if p.Duration > 0 {
+		parts = append(parts, p.Duration.Round(time.Second).String())
+	}
+	return strings.Join(parts, " ")
+}
@@ -0,0 +1,816 @@
+package message
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"slices"
+	"sync"
+	"time"
+
+	xcrypto "github.com/Xelvra/peerchat/internal/crypto"
+	"github.com/libp2p/go-libp2p/core/event"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/time/rate"
+)
+
+const (
+	// RouteProtocolID is the protocol for multi-hop routing through friendly peers
+	RouteProtocolID = protocol.ID("/xelvra/route/1.0.0")
+
+	// Routing limits
+	DefaultRouteMaxHops  = 4                // Intermediate peers between sender and recipient
+	DefaultRouteHopRate  = rate.Limit(2)    // Packets per second forwarded per previous hop
+	DefaultRouteHopBurst = 20               // Burst of packets per previous hop
+	RouteAdvertInterval  = 1 * time.Minute  // How often we re-advertise our neighbours
+	RouteAdvertTTL       = 5 * time.Minute  // Adverts older than this are ignored
+	RouteSeenTTL         = 10 * time.Minute // How long packet hashes are kept for loop detection
+	RouteMaxFrameSize    = 4 * MaxMessageSize
+
+	// routeSealInfo domain-separates onion layer encryption
+	routeSealInfo = "xelvra-route-onion-v1"
+	// routeAdvertContext domain-separates advert signatures
+	routeAdvertContext = "xelvra-route-advert-v1"
+)
+
+// ErrNoRoute is returned when no path through friendly peers reaches the recipient
+var ErrNoRoute = errors.New("no route to peer")
+
+// RoutingConfig configures multi-hop routing
+type RoutingConfig struct {
+	Relay    bool       // Forward packets for other peers
+	MaxHops  int        // Maximum intermediate peers on a route
+	HopRate  rate.Limit // Forwarding rate per previous hop
+	HopBurst int        // Forwarding burst per previous hop
+	Friends  []peer.ID  // Peers we route through and for in addition to contacts
+}
+
+// DefaultRoutingConfig returns a routing configuration that relays for contacts
+func DefaultRoutingConfig() *RoutingConfig {
+	return &RoutingConfig{
+		Relay:    true,
+		MaxHops:  DefaultRouteMaxHops,
+		HopRate:  DefaultRouteHopRate,
+		HopBurst: DefaultRouteHopBurst,
+	}
+}
+
+// RouteAdvert announces a peer's routing key and direct routing neighbours.
+// Adverts are flooded through the routing overlay and signed by the origin.
+type RouteAdvert struct {
+	Origin     string   `json:"origin"`
+	RoutingKey []byte   `json:"routing_key"` // Curve25519 key for onion layers
+	Neighbors  []string `json:"neighbors"`
+	Relay      bool     `json:"relay"`
+	Sequence   int64    `json:"sequence"` // Unix nanoseconds, newer adverts replace older ones
+	Hops       int      `json:"hops"`     // Times the advert has been forwarded (not signed)
+	Signature  []byte   `json:"signature"`
+}
+
+// RouteFrame is a single message on the routing protocol
+type RouteFrame struct {
+	Type   string       `json:"type"` // "advert" or "packet"
+	Advert *RouteAdvert `json:"advert,omitempty"`
+	TTL    int          `json:"ttl,omitempty"`
+	Onion  []byte       `json:"onion,omitempty"`
+}
+
+// onionLayer is the plaintext of one onion layer. Intermediate layers only name the
+// next hop; the final layer names the origin and carries the message.
+type onionLayer struct {
+	Next    string
+	Origin  string
+	Payload []byte
+}
+
+// Router forwards messages through chains of mutually connected routing peers
+type Router struct {
+	host       host.Host
+	config     *RoutingConfig
+	routingKey *xcrypto.KeyPair
+	logger     *logrus.Logger
+
+	// Delivers messages addressed to us into the incoming message pipeline
+	deliver func(msg *Message)
+
+	// Overlay topology learned from adverts: origin -> latest advert
+	adverts   map[peer.ID]*RouteAdvert
+	advertsMu sync.RWMutex
+
+	// Loop and replay detection: packet hash -> time seen
+	seen   map[[32]byte]time.Time
+	seenMu sync.Mutex
+
+	// Per previous hop forwarding limits
+	limiters   map[peer.ID]*rate.Limiter
+	limitersMu sync.Mutex
+
+	// Routing peers: explicit friends and the owner's unblocked contacts
+	friends  map[peer.ID]bool
+	contacts ContactStore
+	ownerDID string
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// NewRouter creates a router and registers its stream handler
+func NewRouter(ctx context.Context, h host.Host, config *RoutingConfig, deliver func(msg *Message),
+	logger *logrus.Logger) (*Router, error) {
+	if config == nil {
+		config = DefaultRoutingConfig()
+	}
+
+	routingKey, err := xcrypto.GenerateKeyPair()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate routing key: %w", err)
+	}
+
+	routerCtx, cancel := context.WithCancel(ctx)
+
+	r := &Router{
+		host:       h,
+		config:     config,
+		routingKey: routingKey,
+		logger:     logger,
+		deliver:    deliver,
+		adverts:    make(map[peer.ID]*RouteAdvert),
+		seen:       make(map[[32]byte]time.Time),
+		limiters:   make(map[peer.ID]*rate.Limiter),
+		friends:    make(map[peer.ID]bool),
+		ctx:        routerCtx,
+		cancel:     cancel,
+	}
+
+	for _, friend := range config.Friends {
+		r.friends[friend] = true
+	}
+
+	h.SetStreamHandler(RouteProtocolID, r.handleStream)
+	return r, nil
+}
+
+// SetContacts routes through and for owner's contacts. It must be called before Start.
+func (r *Router) SetContacts(contacts ContactStore, ownerDID string) {
+	r.contacts = contacts
+	r.ownerDID = ownerDID
+}
+
+// Start begins advertising our routing neighbours
+func (r *Router) Start() error {
+	sub, err := r.host.EventBus().Subscribe(new(event.EvtPeerIdentificationCompleted))
+	if err != nil {
+		return fmt.Errorf("failed to subscribe to identify events: %w", err)
+	}
+
+	r.wg.Add(2)
+	go r.watchIdentifications(sub)
+	go r.advertiseLoop()
+	return nil
+}
+
+// Stop stops the router and destroys the routing key
+func (r *Router) Stop() {
+	r.cancel()
+	r.wg.Wait()
+	r.host.RemoveStreamHandler(RouteProtocolID)
+	r.routingKey.Destroy()
+}
+
+// watchIdentifications exchanges adverts with peers once identify confirms they speak
+// the routing protocol, since only then are they listed as our neighbours
+func (r *Router) watchIdentifications(sub event.Subscription) {
+	defer r.wg.Done()
+	defer func() {
+		if err := sub.Close(); err != nil {
+			r.logger.WithError(err).Debug("Failed to close identify subscription")
+		}
+	}()
+
+	for {
+		select {
+		case evt, ok := <-sub.Out():
+			if !ok {
+				return
+			}
+			identified := evt.(event.EvtPeerIdentificationCompleted)
+			if !r.isFriend(identified.Peer) || !slices.Contains(identified.Protocols, RouteProtocolID) {
+				continue
+			}
+			r.onNeighborIdentified(identified.Peer)
+		case <-r.ctx.Done():
+			return
+		}
+	}
+}
+
+// onNeighborIdentified shares known topology with a new neighbour and announces the
+// new link to all neighbours
+func (r *Router) onNeighborIdentified(peerID peer.ID) {
+	for _, advert := range r.knownAdverts() {
+		if err := r.sendFrame(peerID, &RouteFrame{Type: "advert", Advert: advert}); err != nil {
+			r.logger.WithError(err).WithField("peer_id", peerID.String()).Debug("Failed to share route adverts")
+			break
+		}
+	}
+	r.broadcastAdvert()
+}
+
+// broadcastAdvert sends a fresh advert to all routing neighbours
+func (r *Router) broadcastAdvert() {
+	advert, err := r.localAdvert()
+	if err != nil {
+		r.logger.WithError(err).Warn("Failed to build route advert")
+		return
+	}
+	for _, neighbor := range r.routingNeighbors() {
+		if err := r.sendFrame(neighbor, &RouteFrame{Type: "advert", Advert: advert}); err != nil {
+			r.logger.WithError(err).WithField("peer_id", neighbor.String()).Debug("Failed to send route advert")
+		}
+	}
+}
+
+// HasRoute returns true if a path to the peer through routing peers is known
+func (r *Router) HasRoute(target peer.ID) bool {
+	return len(r.FindRoute(target)) > 0
+}
+
+// FindRoute returns the shortest chain of intermediate peers ending with the target,
+// using only links that both ends advertise
+func (r *Router) FindRoute(target peer.ID) []peer.ID {
+	self := r.host.ID()
+	if target == self {
+		return nil
+	}
+
+	r.advertsMu.RLock()
+	defer r.advertsMu.RUnlock()
+
+	if _, known := r.adverts[target]; !known {
+		return nil
+	}
+
+	// Breadth-first search starting from our directly connected routing peers
+	previous := map[peer.ID]peer.ID{self: ""}
+	queue := []peer.ID{self}
+	depth := map[peer.ID]int{self: 0}
+
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+
+		if depth[current] > r.config.MaxHops {
+			continue
+		}
+
+		for _, next := range r.neighborsLocked(current) {
+			if _, visited := previous[next]; visited {
+				continue
+			}
+			// Only relaying friends may appear in the middle of a route
+			if next != target && !r.canRelayLocked(next) {
+				continue
+			}
+
+			previous[next] = current
+			depth[next] = depth[current] + 1
+
+			if next == target {
+				var route []peer.ID
+				for hop := target; hop != self; hop = previous[hop] {
+					route = append([]peer.ID{hop}, route...)
+				}
+				return route
+			}
+			queue = append(queue, next)
+		}
+	}
+
+	return nil
+}
+
+// Route sends a message to the target through intermediate peers. Each hop can only
+// decrypt the address of the next hop.
+func (r *Router) Route(target peer.ID, msg *Message) error {
+	route := r.FindRoute(target)
+	if len(route) == 0 {
+		return ErrNoRoute
+	}
+
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("failed to serialize message: %w", err)
+	}
+
+	onion, err := r.buildOnion(route, payload)
+	if err != nil {
+		return err
+	}
+
+	// Random slack on top of the route length keeps intermediates from
+	// telling their position from the TTL
+	ttl := len(route) + rand.Intn(r.config.MaxHops+1)
+	frame := &RouteFrame{Type: "packet", TTL: ttl, Onion: onion}
+	if err := r.sendFrame(route[0], frame); err != nil {
+		return fmt.Errorf("failed to send to first hop: %w", err)
+	}
+
+	r.logger.WithFields(logrus.Fields{
+		"message_id": msg.ID,
+		"target":     target.String(),
+		"hops":       len(route),
+	}).Info("Message routed through friendly peers")
+
+	return nil
+}
+
+// buildOnion wraps the payload in one encrypted layer per hop, innermost first
+func (r *Router) buildOnion(route []peer.ID, payload []byte) ([]byte, error) {
+	r.advertsMu.RLock()
+	defer r.advertsMu.RUnlock()
+
+	data := payload
+	layer := onionLayer{Origin: r.host.ID().String()}
+
+	for i := len(route) - 1; i >= 0; i-- {
+		advert, exists := r.adverts[route[i]]
+		if !exists {
+			return nil, fmt.Errorf("missing routing key for %s", route[i].String())
+		}
+
+		layer.Payload = data
+		sealed, err := xcrypto.SealAnonymous(advert.RoutingKey, encodeOnionLayer(&layer), []byte(routeSealInfo))
+		if err != nil {
+			return nil, fmt.Errorf("failed to seal onion layer: %w", err)
+		}
+
+		data = sealed
+		layer = onionLayer{Next: route[i].String()}
+	}
+
+	return data, nil
+}
+
+// handleStream handles incoming routing streams
+func (r *Router) handleStream(stream network.Stream) {
+	defer func() {
+		if err := stream.Close(); err != nil {
+			r.logger.WithError(err).Debug("Failed to close route stream")
+		}
+	}()
+
+	if err := stream.SetDeadline(time.Now().Add(MessageTimeout)); err != nil {
+		r.logger.WithError(err).Debug("Failed to set route stream deadline")
+	}
+
+	remotePeer := stream.Conn().RemotePeer()
+	if !r.isFriend(remotePeer) {
+		return
+	}
+
+	var frame RouteFrame
+	if err := readRouteFrame(stream, &frame); err != nil {
+		r.logger.WithError(err).Debug("Failed to read route frame")
+		return
+	}
+
+	switch frame.Type {
+	case "advert":
+		r.handleAdvert(remotePeer, frame.Advert)
+	case "packet":
+		if err := r.handlePacket(remotePeer, &frame); err != nil {
+			r.logger.WithError(err).WithField("peer", remotePeer.String()).Debug("Dropped routed packet")
+		}
+	}
+}
+
+// handleAdvert stores a newer advert and floods it to our other routing neighbours
+func (r *Router) handleAdvert(from peer.ID, advert *RouteAdvert) {
+	if advert == nil {
+		return
+	}
+
+	origin, err := peer.Decode(advert.Origin)
+	if err != nil || origin == r.host.ID() {
+		return
+	}
+	if time.Since(time.Unix(0, advert.Sequence)) > RouteAdvertTTL || !verifyRouteAdvert(origin, advert) {
+		return
+	}
+
+	r.advertsMu.Lock()
+	current, exists := r.adverts[origin]
+	if exists && current.Sequence >= advert.Sequence {
+		r.advertsMu.Unlock()
+		return
+	}
+	r.adverts[origin] = advert
+	r.advertsMu.Unlock()
+
+	if advert.Hops >= r.config.MaxHops {
+		return
+	}
+
+	forwarded := *advert
+	forwarded.Hops++
+	for _, neighbor := range r.routingNeighbors() {
+		if neighbor == from || neighbor == origin {
+			continue
+		}
+		if err := r.sendFrame(neighbor, &RouteFrame{Type: "advert", Advert: &forwarded}); err != nil {
+			r.logger.WithError(err).WithField("peer_id", neighbor.String()).Debug("Failed to forward route advert")
+		}
+	}
+}
+
+// handlePacket peels one onion layer and either delivers or forwards the packet
+func (r *Router) handlePacket(from peer.ID, frame *RouteFrame) error {
+	if !r.limiter(from).Allow() {
+		return fmt.Errorf("hop rate limit exceeded")
+	}
+
+	// The same ciphertext arriving twice means a loop or a replay
+	hash := sha256.Sum256(frame.Onion)
+	if r.markSeen(hash) {
+		return fmt.Errorf("duplicate packet")
+	}
+
+	plaintext, err := xcrypto.OpenAnonymous(r.routingKey, frame.Onion, []byte(routeSealInfo))
+	if err != nil {
+		return fmt.Errorf("failed to open onion layer: %w", err)
+	}
+
+	layer, err := decodeOnionLayer(plaintext)
+	if err != nil {
+		return err
+	}
+
+	if layer.Next == "" {
+		return r.deliverPayload(layer)
+	}
+
+	if !r.config.Relay {
+		return fmt.Errorf("relaying disabled")
+	}
+	if frame.TTL <= 1 {
+		return fmt.Errorf("TTL expired")
+	}
+
+	next, err := peer.Decode(layer.Next)
+	if err != nil {
+		return fmt.Errorf("invalid next hop: %w", err)
+	}
+	if next == from || next == r.host.ID() {
+		return fmt.Errorf("routing loop detected")
+	}
+	if r.host.Network().Connectedness(next) != network.Connected {
+		return fmt.Errorf("next hop not connected")
+	}
+
+	return r.sendFrame(next, &RouteFrame{Type: "packet", TTL: frame.TTL - 1, Onion: layer.Payload})
+}
+
+// deliverPayload hands a message that reached its destination to the message pipeline
+func (r *Router) deliverPayload(layer *onionLayer) error {
+	var msg Message
+	if err := json.Unmarshal(layer.Payload, &msg); err != nil {
+		return fmt.Errorf("failed to parse routed message: %w", err)
+	}
+
+	origin, err := peer.Decode(layer.Origin)
+	if err != nil {
+		return fmt.Errorf("invalid origin: %w", err)
+	}
+	// The origin is unauthenticated here, verifyMessage rejects the message
+	// unless it is signed with the origin's identity key
+	msg.remotePeer = origin
+
+	r.logger.WithFields(logrus.Fields{
+		"message_id": msg.ID,
+		"origin":     origin.String(),
+	}).Info("Received routed message")
+
+	if r.deliver != nil {
+		r.deliver(&msg)
+	}
+	return nil
+}
+
+// advertiseLoop periodically floods our advert and expires stale state
+func (r *Router) advertiseLoop() {
+	defer r.wg.Done()
+
+	ticker := time.NewTicker(RouteAdvertInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			r.pruneState()
+			r.broadcastAdvert()
+		case <-r.ctx.Done():
+			return
+		}
+	}
+}
+
+// localAdvert builds and signs our current advert
+func (r *Router) localAdvert() (*RouteAdvert, error) {
+	neighbors := r.routingNeighbors()
+	advert := &RouteAdvert{
+		Origin:     r.host.ID().String(),
+		RoutingKey: r.routingKey.PublicKey,
+		Neighbors:  make([]string, 0, len(neighbors)),
+		Relay:      r.config.Relay,
+		Sequence:   time.Now().UnixNano(),
+	}
+	for _, neighbor := range neighbors {
+		advert.Neighbors = append(advert.Neighbors, neighbor.String())
+	}
+
+	privKey := r.host.Peerstore().PrivKey(r.host.ID())
+	if privKey == nil {
+		return nil, fmt.Errorf("host private key not available")
+	}
+
+	signature, err := privKey.Sign(routeAdvertPayload(advert))
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign route advert: %w", err)
+	}
+	advert.Signature = signature
+	return advert, nil
+}
+
+// routingNeighbors returns connected friends that speak the routing protocol
+func (r *Router) routingNeighbors() []peer.ID {
+	var neighbors []peer.ID
+	for _, peerID := range r.host.Network().Peers() {
+		if !r.isFriend(peerID) {
+			continue
+		}
+		protocols, err := r.host.Peerstore().SupportsProtocols(peerID, RouteProtocolID)
+		if err != nil || len(protocols) == 0 {
+			continue
+		}
+		neighbors = append(neighbors, peerID)
+	}
+	return neighbors
+}
+
+// neighborsLocked returns the mutual routing links of a peer. The caller holds advertsMu.
+func (r *Router) neighborsLocked(peerID peer.ID) []peer.ID {
+	self := r.host.ID()
+	if peerID == self {
+		var neighbors []peer.ID
+		for _, neighbor := range r.routingNeighbors() {
+			if r.listsNeighborLocked(neighbor, self) {
+				neighbors = append(neighbors, neighbor)
+			}
+		}
+		return neighbors
+	}
+
+	advert, exists := r.adverts[peerID]
+	if !exists || time.Since(time.Unix(0, advert.Sequence)) > RouteAdvertTTL {
+		return nil
+	}
+
+	var neighbors []peer.ID
+	for _, neighborStr := range advert.Neighbors {
+		neighbor, err := peer.Decode(neighborStr)
+		if err != nil || neighbor == self {
+			continue
+		}
+		if r.listsNeighborLocked(neighbor, peerID) {
+			neighbors = append(neighbors, neighbor)
+		}
+	}
+	return neighbors
+}
+
+// listsNeighborLocked returns true if peerID's advert lists neighbor. The caller holds advertsMu.
+func (r *Router) listsNeighborLocked(peerID, neighbor peer.ID) bool {
+	advert, exists := r.adverts[peerID]
+	if !exists {
+		return false
+	}
+	for _, listed := range advert.Neighbors {
+		if listed == neighbor.String() {
+			return true
+		}
+	}
+	return false
+}
+
+// canRelayLocked returns true if a peer may be used as an intermediate hop
+func (r *Router) canRelayLocked(peerID peer.ID) bool {
+	advert, exists := r.adverts[peerID]
+	return exists && advert.Relay && r.isFriend(peerID)
+}
+
+// knownAdverts returns a snapshot of fresh adverts
+func (r *Router) knownAdverts() []*RouteAdvert {
+	r.advertsMu.RLock()
+	defer r.advertsMu.RUnlock()
+
+	adverts := make([]*RouteAdvert, 0, len(r.adverts))
+	for _, advert := range r.adverts {
+		if time.Since(time.Unix(0, advert.Sequence)) <= RouteAdvertTTL {
+			adverts = append(adverts, advert)
+		}
+	}
+	return adverts
+}
+
+// isFriend returns true if routing with the peer is allowed
+func (r *Router) isFriend(peerID peer.ID) bool {
+	if r.friends[peerID] {
+		return true
+	}
+	if r.contacts == nil {
+		return false
+	}
+	isContact, blocked, err := r.contacts.ContactStatus(r.ownerDID, peerID)
+	return err == nil && isContact && !blocked
+}
+
+// limiter returns the forwarding rate limiter for a previous hop
+func (r *Router) limiter(peerID peer.ID) *rate.Limiter {
+	r.limitersMu.Lock()
+	defer r.limitersMu.Unlock()
+
+	limiter, exists := r.limiters[peerID]
+	if !exists {
+		limiter = rate.NewLimiter(r.config.HopRate, r.config.HopBurst)
+		r.limiters[peerID] = limiter
+	}
+	return limiter
+}
+
+// markSeen records a packet hash, returning true if it was already seen
+func (r *Router) markSeen(hash [32]byte) bool {
+	r.seenMu.Lock()
+	defer r.seenMu.Unlock()
+
+	if _, exists := r.seen[hash]; exists {
+		return true
+	}
+	r.seen[hash] = time.Now()
+	return false
+}
+
+// pruneState removes stale adverts, seen packets and idle rate limiters
+func (r *Router) pruneState() {
+	now := time.Now()
+
+	r.advertsMu.Lock()
+	for origin, advert := range r.adverts {
+		if now.Sub(time.Unix(0, advert.Sequence)) > RouteAdvertTTL {
+			delete(r.adverts, origin)
+		}
+	}
+	r.advertsMu.Unlock()
+
+	r.seenMu.Lock()
+	for hash, seenAt := range r.seen {
+		if now.Sub(seenAt) > RouteSeenTTL {
+			delete(r.seen, hash)
+		}
+	}
+	r.seenMu.Unlock()
+
+	r.limitersMu.Lock()
+	for peerID := range r.limiters {
+		if r.host.Network().Connectedness(peerID) != network.Connected {
+			delete(r.limiters, peerID)
+		}
+	}
+	r.limitersMu.Unlock()
+}
+
+// sendFrame opens a routing stream to a peer and writes one frame
+func (r *Router) sendFrame(peerID peer.ID, frame *RouteFrame) error {
+	ctx, cancel := context.WithTimeout(r.ctx, MessageTimeout)
+	defer cancel()
+
+	stream, err := r.host.NewStream(ctx, peerID, RouteProtocolID)
+	if err != nil {
+		return fmt.Errorf("failed to open route stream: %w", err)
+	}
+	defer func() {
+		if err := stream.Close(); err != nil {
+			r.logger.WithError(err).Debug("Failed to close route stream")
+		}
+	}()
+
+	return writeRouteFrame(stream, frame)
+}
+
+// verifyRouteAdvert checks an advert's signature against the origin's peer ID
+func verifyRouteAdvert(origin peer.ID, advert *RouteAdvert) bool {
+	pubKey, err := origin.ExtractPublicKey()
+	if err != nil {
+		return false
+	}
+	valid, err := pubKey.Verify(routeAdvertPayload(advert), advert.Signature)
+	return err == nil && valid
+}
+
+// routeAdvertPayload returns the signed part of an advert
+func routeAdvertPayload(advert *RouteAdvert) []byte {
+	data, _ := json.Marshal(struct {
+		Context    string   `json:"context"`
+		Origin     string   `json:"origin"`
+		RoutingKey []byte   `json:"routing_key"`
+		Neighbors  []string `json:"neighbors"`
+		Relay      bool     `json:"relay"`
+		Sequence   int64    `json:"sequence"`
+	}{
+		Context:    routeAdvertContext,
+		Origin:     advert.Origin,
+		RoutingKey: advert.RoutingKey,
+		Neighbors:  advert.Neighbors,
+		Relay:      advert.Relay,
+		Sequence:   advert.Sequence,
+	})
+	return data
+}
+
+// encodeOnionLayer serializes a layer as length-prefixed next hop and origin
+// followed by the payload, avoiding per-layer encoding overhead
+func encodeOnionLayer(layer *onionLayer) []byte {
+	buf := make([]byte, 0, 2*binary.MaxVarintLen64+len(layer.Next)+len(layer.Origin)+len(layer.Payload))
+	buf = binary.AppendUvarint(buf, uint64(len(layer.Next)))
+	buf = append(buf, layer.Next...)
+	buf = binary.AppendUvarint(buf, uint64(len(layer.Origin)))
+	buf = append(buf, layer.Origin...)
+	return append(buf, layer.Payload...)
+}
+
+// decodeOnionLayer parses a layer produced by encodeOnionLayer
+func decodeOnionLayer(data []byte) (*onionLayer, error) {
+	var layer onionLayer
+	fields := []*string{&layer.Next, &layer.Origin}
+
+	for _, field := range fields {
+		length, n := binary.Uvarint(data)
+		if n <= 0 || uint64(len(data)-n) < length {
+			return nil, fmt.Errorf("malformed onion layer")
+		}
+		*field = string(data[n : n+int(length)])
+		data = data[n+int(length):]
+	}
+
+	layer.Payload = data
+	return &layer, nil
+}
+
+// writeRouteFrame writes a length-prefixed JSON frame
+func writeRouteFrame(w io.Writer, frame *RouteFrame) error {
+	data, err := json.Marshal(frame)
+	if err != nil {
+		return fmt.Errorf("failed to marshal route frame: %w", err)
+	}
+	if len(data) > RouteMaxFrameSize {
+		return fmt.Errorf("route frame too large: %d bytes", len(data))
+	}
+
+	if err := binary.Write(w, binary.BigEndian, uint32(len(data))); err != nil {
+		return fmt.Errorf("failed to write length: %w", err)
+	}
+	if _, err := w.Write(data); err != nil {
+		return fmt.Errorf("failed to write route frame: %w", err)
+	}
+	return nil
+}
+
+// readRouteFrame reads a length-prefixed JSON frame
+func readRouteFrame(r io.Reader, frame *RouteFrame) error {
+	var length uint32
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return fmt.Errorf("failed to read length: %w", err)
+	}
+	if length > RouteMaxFrameSize {
+		return fmt.Errorf("route frame too large: %d bytes", length)
+	}
+
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return fmt.Errorf("failed to read route frame: %w", err)
+	}
+
+	if err := json.Unmarshal(data, frame); err != nil {
+		return fmt.Errorf("failed to unmarshal route frame: %w", err)
+	}
+	return nil
+}
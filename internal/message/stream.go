@@ -0,0 +1,312 @@
+package message
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// MessageStreamProtocolID is the long-lived, pipelined message protocol.
+	// MessageProtocolID (one stream per message) is still accepted from older peers.
+	MessageStreamProtocolID = protocol.ID("/xelvra/message/2.0.0")
+	// CompressedMessageProtocolID is MessageStreamProtocolID with large
+	// messages compressed, preferred when both peers speak it
+	CompressedMessageProtocolID = protocol.ID("/xelvra/message/2.1.0")
+
+	// Stream lifetime settings
+	StreamKeepaliveInterval = 15 * time.Second // Ping an idle stream this often
+	StreamReadTimeout       = 45 * time.Second // Receiver gives up on a silent stream
+	StreamIdleTimeout       = 5 * time.Minute  // Sender closes a stream unused this long
+	StreamWriteTimeout      = 10 * time.Second
+
+	// Frame types on the message stream
+	frameTypeMessage    byte = 1
+	frameTypePing       byte = 2
+	frameTypeCompressed byte = 3 // zstd-compressed message, CompressedMessageProtocolID only
+)
+
+// errFrameTooLarge is returned when a peer announces a frame above the size limit
+var errFrameTooLarge = errors.New("frame too large")
+
+// writeFrame writes a varint length-prefixed frame: length covers the type byte and payload
+func writeFrame(w *bufio.Writer, frameType byte, payload []byte) error {
+	var header [binary.MaxVarintLen64 + 1]byte
+	n := binary.PutUvarint(header[:], uint64(len(payload)+1))
+	header[n] = frameType
+
+	if _, err := w.Write(header[:n+1]); err != nil {
+		return fmt.Errorf("failed to write frame header: %w", err)
+	}
+	if _, err := w.Write(payload); err != nil {
+		return fmt.Errorf("failed to write frame payload: %w", err)
+	}
+	return w.Flush()
+}
+
+// readFrame reads one frame into buf, growing it if needed, and returns the frame
+// type and payload. The payload aliases buf and is only valid until the next call.
+func readFrame(r *bufio.Reader, buf []byte, maxSize int) (byte, []byte, []byte, error) {
+	length, err := binary.ReadUvarint(r)
+	if err != nil {
+		return 0, nil, buf, err
+	}
+	if length == 0 {
+		return 0, nil, buf, fmt.Errorf("empty frame")
+	}
+	if length > uint64(maxSize)+1 {
+		return 0, nil, buf, fmt.Errorf("%w: %d bytes", errFrameTooLarge, length)
+	}
+
+	if cap(buf) < int(length) {
+		buf = make([]byte, length)
+	}
+	buf = buf[:length]
+
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return 0, nil, buf, fmt.Errorf("failed to read frame: %w", err)
+	}
+
+	return buf[0], buf[1:], buf, nil
+}
+
+// peerStream is an outgoing long-lived message stream to one peer
+type peerStream struct {
+	stream   network.Stream
+	writer   *bufio.Writer
+	legacy   bool // Peer only speaks MessageProtocolID
+	compress bool // Peer accepts compressed messages
+	lastSent time.Time
+	mu       sync.Mutex
+}
+
+// StreamPool keeps one outgoing message stream per peer and pipelines messages on it
+type StreamPool struct {
+	host    host.Host
+	logger  *logrus.Logger
+	streams map[peer.ID]*peerStream
+	mu      sync.Mutex
+}
+
+// NewStreamPool creates an empty stream pool
+func NewStreamPool(h host.Host, logger *logrus.Logger) *StreamPool {
+	return &StreamPool{
+		host:    h,
+		logger:  logger,
+		streams: make(map[peer.ID]*peerStream),
+	}
+}
+
+// Send writes a serialized message to the peer, reusing its stream. A stream that
+// fails (for example after a reconnect) is replaced once before giving up.
+func (sp *StreamPool) Send(ctx context.Context, peerID peer.ID, data []byte) error {
+	var lastErr error
+	for attempt := 0; attempt < 2; attempt++ {
+		ps, err := sp.getStream(ctx, peerID)
+		if err != nil {
+			return err
+		}
+
+		if ps.legacy {
+			return sp.sendLegacy(ps, peerID, data)
+		}
+
+		frameType, payload := frameTypeMessage, data
+		if ps.compress && len(data) >= MessageCompressionThreshold {
+			if compressed, ok := compressData(data); ok {
+				frameType, payload = frameTypeCompressed, compressed
+			}
+		}
+
+		if lastErr = sp.write(ps, frameType, payload); lastErr == nil {
+			return nil
+		}
+		sp.remove(peerID, ps)
+	}
+
+	return fmt.Errorf("failed to write message: %w", lastErr)
+}
+
+// Run sends keepalives on idle streams and closes unused ones until ctx is done
+func (sp *StreamPool) Run(ctx context.Context) {
+	ticker := time.NewTicker(StreamKeepaliveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			sp.maintain(time.Now())
+		case <-ctx.Done():
+			sp.CloseAll()
+			return
+		}
+	}
+}
+
+// Close closes the stream to a peer, if any
+func (sp *StreamPool) Close(peerID peer.ID) {
+	sp.mu.Lock()
+	ps, exists := sp.streams[peerID]
+	delete(sp.streams, peerID)
+	sp.mu.Unlock()
+
+	if exists {
+		sp.closeStream(ps)
+	}
+}
+
+// CloseAll closes every pooled stream
+func (sp *StreamPool) CloseAll() {
+	sp.mu.Lock()
+	streams := sp.streams
+	sp.streams = make(map[peer.ID]*peerStream)
+	sp.mu.Unlock()
+
+	for _, ps := range streams {
+		sp.closeStream(ps)
+	}
+}
+
+// getStream returns the pooled stream for a peer, opening one if needed
+func (sp *StreamPool) getStream(ctx context.Context, peerID peer.ID) (*peerStream, error) {
+	sp.mu.Lock()
+	ps, exists := sp.streams[peerID]
+	sp.mu.Unlock()
+	if exists {
+		return ps, nil
+	}
+
+	// Prefer the pipelined protocol and fall back to one stream per message
+	stream, err := sp.host.NewStream(ctx, peerID, CompressedMessageProtocolID, MessageStreamProtocolID, MessageProtocolID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open stream: %w", err)
+	}
+
+	ps = &peerStream{
+		stream:   stream,
+		writer:   bufio.NewWriter(stream),
+		legacy:   stream.Protocol() == MessageProtocolID,
+		compress: stream.Protocol() == CompressedMessageProtocolID,
+		lastSent: time.Now(),
+	}
+	if ps.legacy {
+		// Legacy streams carry a single message, so they are never pooled
+		return ps, nil
+	}
+
+	sp.mu.Lock()
+	if current, exists := sp.streams[peerID]; exists {
+		// Another sender opened a stream concurrently; use theirs
+		sp.mu.Unlock()
+		sp.closeStream(ps)
+		return current, nil
+	}
+	sp.streams[peerID] = ps
+	sp.mu.Unlock()
+
+	sp.logger.WithField("peer_id", peerID.String()).Debug("Opened message stream")
+	return ps, nil
+}
+
+// write sends one frame on a stream, serializing concurrent writers
+func (sp *StreamPool) write(ps *peerStream, frameType byte, payload []byte) error {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	if err := ps.stream.SetWriteDeadline(time.Now().Add(StreamWriteTimeout)); err != nil {
+		sp.logger.WithError(err).Debug("Failed to set stream write deadline")
+	}
+
+	if err := writeFrame(ps.writer, frameType, payload); err != nil {
+		return err
+	}
+
+	if frameType != frameTypePing {
+		ps.lastSent = time.Now()
+	}
+	return nil
+}
+
+// sendLegacy writes a single message on a MessageProtocolID stream and closes it
+func (sp *StreamPool) sendLegacy(ps *peerStream, peerID peer.ID, data []byte) error {
+	defer sp.closeStream(ps)
+
+	if err := ps.stream.SetWriteDeadline(time.Now().Add(StreamWriteTimeout)); err != nil {
+		sp.logger.WithError(err).Debug("Failed to set stream write deadline")
+	}
+
+	var lenBytes [4]byte
+	binary.BigEndian.PutUint32(lenBytes[:], uint32(len(data)))
+
+	if _, err := ps.writer.Write(lenBytes[:]); err != nil {
+		return fmt.Errorf("failed to write message length: %w", err)
+	}
+	if _, err := ps.writer.Write(data); err != nil {
+		return fmt.Errorf("failed to write message data: %w", err)
+	}
+	if err := ps.writer.Flush(); err != nil {
+		return fmt.Errorf("failed to send message to %s: %w", peerID.String(), err)
+	}
+	return nil
+}
+
+// maintain pings idle streams and closes streams that have not carried messages recently
+func (sp *StreamPool) maintain(now time.Time) {
+	sp.mu.Lock()
+	streams := make(map[peer.ID]*peerStream, len(sp.streams))
+	for peerID, ps := range sp.streams {
+		streams[peerID] = ps
+	}
+	sp.mu.Unlock()
+
+	for peerID, ps := range streams {
+		ps.mu.Lock()
+		idle := now.Sub(ps.lastSent)
+		ps.mu.Unlock()
+
+		if idle > StreamIdleTimeout {
+			sp.logger.WithField("peer_id", peerID.String()).Debug("Closing idle message stream")
+			sp.Close(peerID)
+			continue
+		}
+		if idle < StreamKeepaliveInterval {
+			continue // Recent messages already keep the stream alive
+		}
+
+		if err := sp.write(ps, frameTypePing, nil); err != nil {
+			sp.logger.WithError(err).WithField("peer_id", peerID.String()).Debug("Message stream keepalive failed")
+			sp.remove(peerID, ps)
+		}
+	}
+}
+
+// remove drops a stream from the pool if it is still the current one and resets it
+func (sp *StreamPool) remove(peerID peer.ID, ps *peerStream) {
+	sp.mu.Lock()
+	if current, exists := sp.streams[peerID]; exists && current == ps {
+		delete(sp.streams, peerID)
+	}
+	sp.mu.Unlock()
+
+	if err := ps.stream.Reset(); err != nil {
+		sp.logger.WithError(err).Debug("Failed to reset message stream")
+	}
+}
+
+// closeStream closes a stream's write side, letting the receiver drain it
+func (sp *StreamPool) closeStream(ps *peerStream) {
+	if err := ps.stream.Close(); err != nil {
+		sp.logger.WithError(err).Debug("Failed to close message stream")
+	}
+}
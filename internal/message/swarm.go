@@ -0,0 +1,549 @@
+package message
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/peerstore"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	"github.com/libp2p/go-libp2p/core/routing"
+	"github.com/multiformats/go-multihash"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// FileSwarmProtocolID serves chunks of shared files to swarm downloads
+	FileSwarmProtocolID = protocol.ID("/xelvra/file-swarm/1.0.0")
+
+	// Swarm download settings
+	FileSwarmBatchChunks      = 64                       // Chunks requested from a provider at a time
+	FileSwarmMaxRequestChunks = 4 * FileSwarmBatchChunks // Largest request a provider serves
+	FileSwarmMaxProviders     = 8                        // Providers used in parallel
+	FileSwarmFindTimeout      = 10 * time.Second         // DHT provider lookup
+	FileProvideTimeout        = time.Minute              // DHT provider record announcement
+	FileReprovideInterval     = 12 * time.Hour           // Provider records expire after 48 hours
+)
+
+// ErrNoProviders is returned when no peer can serve a file
+var ErrNoProviders = errors.New("no providers for file")
+
+// sharedFile is a complete local file served to swarm downloads
+type sharedFile struct {
+	metadata FileMetadata
+	path     string
+	tree     *MerkleTree
+	mu       sync.Mutex
+}
+
+// FileContentID returns the DHT content ID under which holders of a file are announced
+func FileContentID(merkleRoot string) (cid.Cid, error) {
+	root, err := hex.DecodeString(merkleRoot)
+	if err != nil {
+		return cid.Undef, fmt.Errorf("invalid Merkle root: %w", err)
+	}
+
+	hash, err := multihash.Encode(root, multihash.SHA2_256)
+	if err != nil {
+		return cid.Undef, fmt.Errorf("failed to encode multihash: %w", err)
+	}
+
+	return cid.NewCidV1(cid.Raw, hash), nil
+}
+
+// enableSharing serves completed transfers to swarm downloads and announces
+// them through contentRouting, if set
+func (ftm *FileTransferManager) enableSharing(contentRouting routing.ContentRouting) {
+	ftm.sharing = true
+	ftm.contentRouting = contentRouting
+	ftm.host.SetStreamHandler(FileSwarmProtocolID, ftm.handleSwarmStream)
+}
+
+// ShareFile serves a local file to swarm downloads and announces it in the DHT
+func (ftm *FileTransferManager) ShareFile(path string) (*FileMetadata, error) {
+	metadata, err := CreateFileMetadata(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create file metadata: %w", err)
+	}
+
+	ftm.addShared(*metadata, path)
+	return metadata, nil
+}
+
+// shareCompleted serves a completed transfer if sharing is enabled. Files kept
+// encrypted at rest are not shared.
+func (ftm *FileTransferManager) shareCompleted(transfer *FileTransfer) {
+	if !ftm.sharing || transfer.Metadata.MerkleRoot == "" || (ftm.encryptAtRest && !transfer.isOutgoing) {
+		return
+	}
+
+	transfer.mu.Lock()
+	path := transfer.LocalPath
+	transfer.mu.Unlock()
+
+	ftm.addShared(transfer.Metadata, path)
+}
+
+// addShared registers a shared file and announces it
+func (ftm *FileTransferManager) addShared(metadata FileMetadata, path string) {
+	ftm.mu.Lock()
+	ftm.shared[metadata.MerkleRoot] = &sharedFile{metadata: metadata, path: path}
+	ftm.mu.Unlock()
+
+	ftm.logger.WithFields(logrus.Fields{
+		"file_name":   metadata.Name,
+		"merkle_root": metadata.MerkleRoot,
+	}).Info("Sharing file with the swarm")
+
+	go ftm.announce(metadata.MerkleRoot)
+}
+
+// announce publishes a DHT provider record for a shared file
+func (ftm *FileTransferManager) announce(merkleRoot string) {
+	if ftm.contentRouting == nil {
+		return
+	}
+
+	contentID, err := FileContentID(merkleRoot)
+	if err != nil {
+		ftm.logger.WithError(err).Warn("Failed to derive content ID")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ftm.ctx, FileProvideTimeout)
+	defer cancel()
+
+	if err := ftm.contentRouting.Provide(ctx, contentID, true); err != nil {
+		ftm.logger.WithError(err).WithField("merkle_root", merkleRoot).Debug("Failed to announce shared file")
+	}
+}
+
+// reprovideLoop re-announces shared files before their provider records expire
+func (ftm *FileTransferManager) reprovideLoop() {
+	ticker := time.NewTicker(FileReprovideInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			ftm.mu.Lock()
+			roots := make([]string, 0, len(ftm.shared))
+			for root := range ftm.shared {
+				roots = append(roots, root)
+			}
+			ftm.mu.Unlock()
+
+			for _, root := range roots {
+				ftm.announce(root)
+			}
+		case <-ftm.ctx.Done():
+			return
+		}
+	}
+}
+
+// lookupShared returns a shared file if it is still unchanged on disk
+func (ftm *FileTransferManager) lookupShared(merkleRoot string) (*sharedFile, error) {
+	ftm.mu.Lock()
+	shared, exists := ftm.shared[merkleRoot]
+	ftm.mu.Unlock()
+	if !exists {
+		return nil, fmt.Errorf("file not available")
+	}
+
+	shared.mu.Lock()
+	defer shared.mu.Unlock()
+
+	info, err := os.Stat(shared.path)
+	if err != nil || info.Size() != shared.metadata.Size {
+		ftm.mu.Lock()
+		delete(ftm.shared, merkleRoot)
+		ftm.mu.Unlock()
+		return nil, fmt.Errorf("file not available")
+	}
+
+	if shared.tree == nil {
+		tree, err := fileMerkleTree(shared.path, shared.metadata.ChunkSize)
+		if err != nil {
+			return nil, err
+		}
+		if hex.EncodeToString(tree.Root()) != merkleRoot {
+			ftm.mu.Lock()
+			delete(ftm.shared, merkleRoot)
+			ftm.mu.Unlock()
+			return nil, fmt.Errorf("file not available")
+		}
+		shared.tree = tree
+	}
+
+	return shared, nil
+}
+
+// handleSwarmStream serves chunk ranges of shared files until the requester closes the stream
+func (ftm *FileTransferManager) handleSwarmStream(stream network.Stream) {
+	defer func() {
+		if err := stream.Close(); err != nil {
+			ftm.logger.WithError(err).Debug("Failed to close swarm stream")
+		}
+	}()
+
+	remotePeer := stream.Conn().RemotePeer()
+	for {
+		request, err := ftm.readFrame(stream)
+		if err != nil {
+			return // Requester is done
+		}
+
+		if err := ftm.serveRanges(stream, request); err != nil {
+			ftm.logger.WithError(err).WithField("peer", remotePeer.String()).Debug("Swarm request failed")
+			return
+		}
+	}
+}
+
+// serveRanges sends the requested chunks of a shared file with their Merkle proofs
+func (ftm *FileTransferManager) serveRanges(stream network.Stream, request *FileTransferRequest) error {
+	if request.Type != "get" {
+		return ftm.reject(stream, fmt.Errorf("unexpected swarm request type: %s", request.Type))
+	}
+
+	shared, err := ftm.lookupShared(request.Metadata.MerkleRoot)
+	if err != nil {
+		return ftm.reject(stream, err)
+	}
+
+	metadata := shared.metadata
+	if err := validateRanges(request.Ranges, metadata.ChunkCount); err != nil {
+		return ftm.reject(stream, err)
+	}
+	requested := 0
+	for _, r := range request.Ranges {
+		requested += r.End - r.Start
+	}
+	if requested > FileSwarmMaxRequestChunks {
+		return ftm.reject(stream, fmt.Errorf("too many chunks requested: %d", requested))
+	}
+
+	file, err := os.Open(shared.path)
+	if err != nil {
+		return ftm.reject(stream, fmt.Errorf("file not available"))
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			ftm.logger.WithError(err).Debug("Failed to close shared file")
+		}
+	}()
+
+	buffer := make([]byte, metadata.ChunkSize)
+	for _, r := range request.Ranges {
+		for chunkID := r.Start; chunkID < r.End; chunkID++ {
+			data := buffer[:chunkLength(metadata, chunkID)]
+			if err := ftm.scheduler.waitUpload(ftm.ctx, stream.Conn().RemotePeer(), len(data), false); err != nil {
+				return ftm.reject(stream, err)
+			}
+			if _, err := file.ReadAt(data, int64(chunkID)*int64(metadata.ChunkSize)); err != nil {
+				return fmt.Errorf("failed to read shared chunk %d: %w", chunkID, err)
+			}
+
+			proof, err := shared.tree.Proof(chunkID)
+			if err != nil {
+				return err
+			}
+
+			hash := sha256.Sum256(data)
+			frame := FileTransferRequest{Type: "chunk", ChunkID: chunkID, Data: data, ChunkHash: hash[:], Proof: proof}
+			if err := ftm.writeFrame(stream, frame); err != nil {
+				return fmt.Errorf("failed to send chunk %d: %w", chunkID, err)
+			}
+		}
+	}
+
+	return ftm.writeFrame(stream, FileTransferRequest{Type: "complete"})
+}
+
+// Download fetches a file from every peer that holds it, requesting different
+// chunk ranges from each in parallel and verifying every chunk against the
+// Merkle root. Providers are looked up in the DHT in addition to those given.
+// An interrupted download continues from its chunk bitmap when called again.
+func (ftm *FileTransferManager) Download(ctx context.Context, metadata FileMetadata, providers []peer.ID) (*FileTransfer, error) {
+	if metadata.MerkleRoot == "" {
+		return nil, fmt.Errorf("file %s has no Merkle root", metadata.Name)
+	}
+	if err := validateFileMetadata(metadata); err != nil {
+		return nil, err
+	}
+
+	providers = ftm.findProviders(ctx, metadata.MerkleRoot, providers)
+	if len(providers) == 0 {
+		return nil, ErrNoProviders
+	}
+
+	transfer := ftm.prepareDownload(metadata, providers[0])
+
+	session, ok := ftm.claimSession(transfer.ID, nil)
+	if !ok {
+		return nil, fmt.Errorf("file transfer %s is already running", transfer.ID)
+	}
+	defer ftm.endSession(transfer.ID, session)
+	defer func() {
+		if err := transfer.Close(); err != nil {
+			ftm.logger.WithError(err).Warn("Failed to close downloaded file")
+		}
+	}()
+
+	if err := ftm.openPartial(transfer); err != nil {
+		return nil, err
+	}
+
+	ftm.logger.WithFields(logrus.Fields{
+		"transfer_id": transfer.ID,
+		"file_name":   metadata.Name,
+		"providers":   len(providers),
+	}).Info("Starting swarm download")
+
+	// Providers that misbehave or fail are dropped; the rest share the remaining work
+	for round := 0; round < fileCompleteRounds && len(providers) > 0; round++ {
+		transfer.mu.Lock()
+		missing := transfer.Chunks.MissingRanges()
+		transfer.mu.Unlock()
+		if len(missing) == 0 {
+			break
+		}
+		providers = ftm.fetchFromProviders(ctx, transfer, providers, missing)
+	}
+
+	missing, err := ftm.verifyIncoming(transfer)
+	if err != nil {
+		ftm.discardIncoming(transfer, err)
+		return nil, err
+	}
+	if len(missing) > 0 {
+		ftm.checkpoint(transfer)
+		if ctx.Err() != nil {
+			return transfer, ctx.Err()
+		}
+		return transfer, fmt.Errorf("%w: %d chunk ranges still missing", ErrNoProviders, len(missing))
+	}
+
+	if err := ftm.finishIncoming(transfer); err != nil {
+		ftm.discardIncoming(transfer, err)
+		return nil, err
+	}
+	return transfer, nil
+}
+
+// prepareDownload returns the unfinished download of a file or registers a new one
+func (ftm *FileTransferManager) prepareDownload(metadata FileMetadata, firstProvider peer.ID) *FileTransfer {
+	ftm.mu.Lock()
+	defer ftm.mu.Unlock()
+
+	if existing, exists := ftm.transfers[metadata.ID]; exists && !existing.isOutgoing &&
+		sameFile(existing.Metadata, metadata) && existing.resumable() {
+		return existing
+	}
+
+	transfer := NewFileTransfer(metadata.ID, firstProvider, metadata, false, ftm.logger)
+	transfer.LocalPath = ftm.partialPath(firstProvider, metadata.ID)
+	ftm.transfers[metadata.ID] = transfer
+	return transfer
+}
+
+// findProviders merges known providers with those announced in the DHT
+func (ftm *FileTransferManager) findProviders(ctx context.Context, merkleRoot string, known []peer.ID) []peer.ID {
+	seen := make(map[peer.ID]bool)
+	var providers []peer.ID
+	add := func(id peer.ID) {
+		if id == "" || seen[id] || (ftm.host != nil && id == ftm.host.ID()) {
+			return
+		}
+		seen[id] = true
+		providers = append(providers, id)
+	}
+
+	for _, id := range known {
+		add(id)
+	}
+
+	if ftm.contentRouting == nil || len(providers) >= FileSwarmMaxProviders {
+		return providers
+	}
+
+	contentID, err := FileContentID(merkleRoot)
+	if err != nil {
+		return providers
+	}
+
+	findCtx, cancel := context.WithTimeout(ctx, FileSwarmFindTimeout)
+	defer cancel()
+
+	for info := range ftm.contentRouting.FindProvidersAsync(findCtx, contentID, FileSwarmMaxProviders) {
+		if ftm.host != nil && len(info.Addrs) > 0 {
+			ftm.host.Peerstore().AddAddrs(info.ID, info.Addrs, peerstore.TempAddrTTL)
+		}
+		add(info.ID)
+	}
+
+	return providers
+}
+
+// fetchFromProviders downloads the missing ranges in batches from all providers
+// in parallel and returns the providers that stayed healthy
+func (ftm *FileTransferManager) fetchFromProviders(ctx context.Context, transfer *FileTransfer, providers []peer.ID, missing []ChunkRange) []peer.ID {
+	if len(providers) > FileSwarmMaxProviders {
+		providers = providers[:FileSwarmMaxProviders]
+	}
+
+	queue := newSwarmQueue(missing, FileSwarmBatchChunks)
+	healthy := make([]bool, len(providers))
+
+	var wg sync.WaitGroup
+	for i, provider := range providers {
+		wg.Add(1)
+		go func(i int, provider peer.ID) {
+			defer wg.Done()
+			healthy[i] = ftm.swarmWorker(ctx, transfer, provider, queue)
+		}(i, provider)
+	}
+	wg.Wait()
+
+	var remaining []peer.ID
+	for i, provider := range providers {
+		if healthy[i] {
+			remaining = append(remaining, provider)
+		}
+	}
+	return remaining
+}
+
+// swarmWorker fetches batches from one provider until the queue is empty. It
+// returns false if the provider failed, after handing its batch back.
+func (ftm *FileTransferManager) swarmWorker(ctx context.Context, transfer *FileTransfer, provider peer.ID, queue *swarmQueue) bool {
+	logger := ftm.logger.WithFields(logrus.Fields{
+		"transfer_id": transfer.ID,
+		"provider":    provider.String(),
+	})
+
+	stream, err := ftm.host.NewStream(ctx, provider, FileSwarmProtocolID)
+	if err != nil {
+		logger.WithError(err).Debug("Failed to open swarm stream")
+		return false
+	}
+	stop := context.AfterFunc(ctx, func() {
+		_ = stream.Reset() // Unblock reads when the download is cancelled
+	})
+	defer stop()
+	defer func() {
+		if err := stream.Close(); err != nil {
+			logger.WithError(err).Debug("Failed to close swarm stream")
+		}
+	}()
+
+	for {
+		batch, ok := queue.next()
+		if !ok {
+			return true
+		}
+
+		if err := ftm.fetchBatch(stream, transfer, batch); err != nil {
+			logger.WithError(err).Warn("Swarm provider failed")
+
+			// Hand back whatever this provider did not deliver
+			transfer.mu.Lock()
+			var undelivered []ChunkRange
+			for _, r := range transfer.Chunks.MissingRanges() {
+				if r.End > batch.Start && r.Start < batch.End {
+					undelivered = append(undelivered, ChunkRange{Start: max(r.Start, batch.Start), End: min(r.End, batch.End)})
+				}
+			}
+			transfer.mu.Unlock()
+			queue.requeue(undelivered)
+			return false
+		}
+	}
+}
+
+// errBadChunk marks a provider that sent a chunk failing verification
+var errBadChunk = errors.New("provider sent a chunk that failed verification")
+
+// fetchBatch requests one range from a provider and stores the verified chunks
+func (ftm *FileTransferManager) fetchBatch(stream network.Stream, transfer *FileTransfer, batch ChunkRange) error {
+	request := FileTransferRequest{Type: "get", Metadata: transfer.Metadata, Ranges: []ChunkRange{batch}}
+	if err := ftm.writeFrame(stream, request); err != nil {
+		return fmt.Errorf("failed to request chunks: %w", err)
+	}
+
+	for {
+		frame, err := ftm.readFrame(stream)
+		if err != nil {
+			return fmt.Errorf("failed to read chunk: %w", err)
+		}
+
+		switch frame.Type {
+		case "chunk":
+			if frame.ChunkID < batch.Start || frame.ChunkID >= batch.End {
+				return fmt.Errorf("provider sent unrequested chunk %d", frame.ChunkID)
+			}
+			valid, err := ftm.storeChunk(transfer, frame)
+			if err != nil {
+				return err
+			}
+			if !valid {
+				return errBadChunk
+			}
+			if err := ftm.scheduler.waitDownload(ftm.ctx, stream.Conn().RemotePeer(), len(frame.Data)); err != nil {
+				return err
+			}
+		case "complete":
+			return nil
+		case "reject":
+			return fmt.Errorf("provider refused: %s", frame.Error)
+		default:
+			return fmt.Errorf("unexpected swarm frame type: %s", frame.Type)
+		}
+	}
+}
+
+// swarmQueue hands out chunk batches to swarm workers
+type swarmQueue struct {
+	batches []ChunkRange
+	mu      sync.Mutex
+}
+
+// newSwarmQueue splits ranges into batches of at most batchSize chunks
+func newSwarmQueue(ranges []ChunkRange, batchSize int) *swarmQueue {
+	queue := &swarmQueue{}
+	for _, r := range ranges {
+		for start := r.Start; start < r.End; start += batchSize {
+			queue.batches = append(queue.batches, ChunkRange{Start: start, End: min(start+batchSize, r.End)})
+		}
+	}
+	return queue
+}
+
+// next returns the next batch to fetch
+func (q *swarmQueue) next() (ChunkRange, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.batches) == 0 {
+		return ChunkRange{}, false
+	}
+	batch := q.batches[0]
+	q.batches = q.batches[1:]
+	return batch, true
+}
+
+// requeue returns ranges to the queue for another worker
+func (q *swarmQueue) requeue(ranges []ChunkRange) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.batches = append(q.batches, ranges...)
+}
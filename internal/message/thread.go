@@ -0,0 +1,257 @@
+package message
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+const (
+	// MaxHistorySize is the number of recent messages kept for /reply lookups
+	MaxHistorySize = 500
+)
+
+// LamportClock maintains a logical clock per conversation so that messages
+// can be ordered causally regardless of wall-clock skew between peers
+type LamportClock struct {
+	counters map[string]uint64
+	seed     func(conversation string) uint64
+	mu       sync.Mutex
+}
+
+// NewLamportClock creates a new per-conversation Lamport clock
+func NewLamportClock() *LamportClock {
+	return &LamportClock{
+		counters: make(map[string]uint64),
+	}
+}
+
+// SetSeed sets a function returning the last timestamp stored for a
+// conversation, so that the clock continues from it after a restart
+func (lc *LamportClock) SetSeed(seed func(conversation string) uint64) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	lc.seed = seed
+}
+
+// value returns the clock for a conversation, seeding it on first use.
+// The caller must hold lc.mu.
+func (lc *LamportClock) value(conversation string) uint64 {
+	current, exists := lc.counters[conversation]
+	if !exists && lc.seed != nil {
+		current = lc.seed(conversation)
+		lc.counters[conversation] = current
+	}
+	return current
+}
+
+// Tick advances the clock for a conversation before sending and returns the new value
+func (lc *LamportClock) Tick(conversation string) uint64 {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	current := lc.value(conversation) + 1
+	lc.counters[conversation] = current
+	return current
+}
+
+// Observe merges a received timestamp into the conversation clock and returns the new value
+func (lc *LamportClock) Observe(conversation string, remote uint64) uint64 {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	current := lc.value(conversation)
+	if remote > current {
+		current = remote
+	}
+	current++
+	lc.counters[conversation] = current
+	return current
+}
+
+// Current returns the current clock value for a conversation
+func (lc *LamportClock) Current(conversation string) uint64 {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	return lc.value(conversation)
+}
+
+// ConversationKey returns the clock key for a message exchanged with a remote peer.
+// Group messages share the group clock, direct messages are keyed by the remote peer.
+func ConversationKey(groupID string, remotePeer peer.ID) string {
+	if groupID != "" {
+		return "group:" + groupID
+	}
+	return "peer:" + remotePeer.String()
+}
+
+// Conversation returns the clock key of the conversation a sent or received
+// message belongs to
+func (m *Message) Conversation() string {
+	remote := m.remotePeer
+	if remote == "" {
+		remote, _ = peer.Decode(m.To)
+	}
+	return ConversationKey(m.GroupID, remote)
+}
+
+// MessageStore keeps sent and received messages with their thread and
+// Lamport timestamps
+type MessageStore interface {
+	// SaveMessage stores a message, ignoring messages already stored
+	SaveMessage(msg *Message) error
+	// MaxLamport returns the highest Lamport timestamp stored for a conversation
+	MaxLamport(conversation string) (uint64, error)
+}
+
+// RootID returns the ID of the thread a message belongs to
+func (m *Message) RootID() string {
+	if m.ThreadID != "" {
+		return m.ThreadID
+	}
+	return m.ID
+}
+
+// IsReply returns true if the message replies to another message
+func (m *Message) IsReply() bool {
+	return m.ReplyTo != ""
+}
+
+// RemotePeer returns the peer the message was received from, if known
+func (m *Message) RemotePeer() peer.ID {
+	return m.remotePeer
+}
+
+// SortCausally orders messages by Lamport timestamp, falling back to wall-clock
+// time and finally message ID so that every peer derives the same order
+func SortCausally(messages []*Message) {
+	sort.SliceStable(messages, func(i, j int) bool {
+		a, b := messages[i], messages[j]
+		if a.Lamport != b.Lamport {
+			return a.Lamport < b.Lamport
+		}
+		if !a.Timestamp.Equal(b.Timestamp) {
+			return a.Timestamp.Before(b.Timestamp)
+		}
+		return a.ID < b.ID
+	})
+}
+
+// HistoryEntry is a message in the local history with its display number
+type HistoryEntry struct {
+	Number  int
+	Message *Message
+	Depth   int // Reply nesting depth for threaded rendering
+}
+
+// MessageHistory keeps recently sent and received messages so that users can
+// reference them by number (e.g. /reply <n>) and render threads
+type MessageHistory struct {
+	entries []*HistoryEntry
+	byID    map[string]*HistoryEntry
+	next    int
+	maxSize int
+	mu      sync.RWMutex
+}
+
+// NewMessageHistory creates a new bounded message history
+func NewMessageHistory(maxSize int) *MessageHistory {
+	if maxSize <= 0 {
+		maxSize = MaxHistorySize
+	}
+	return &MessageHistory{
+		byID:    make(map[string]*HistoryEntry),
+		next:    1,
+		maxSize: maxSize,
+	}
+}
+
+// Add records a message and returns its display number
+func (mh *MessageHistory) Add(msg *Message) int {
+	mh.mu.Lock()
+	defer mh.mu.Unlock()
+
+	if existing, exists := mh.byID[msg.ID]; exists {
+		return existing.Number
+	}
+
+	depth := 0
+	if parent, exists := mh.byID[msg.ReplyTo]; exists {
+		depth = parent.Depth + 1
+	} else if msg.IsReply() {
+		depth = 1
+	}
+
+	entry := &HistoryEntry{
+		Number:  mh.next,
+		Message: msg,
+		Depth:   depth,
+	}
+	mh.next++
+
+	mh.entries = append(mh.entries, entry)
+	mh.byID[msg.ID] = entry
+
+	// Evict oldest entries beyond capacity
+	for len(mh.entries) > mh.maxSize {
+		delete(mh.byID, mh.entries[0].Message.ID)
+		mh.entries = mh.entries[1:]
+	}
+
+	return entry.Number
+}
+
+// Get returns the message with the given display number
+func (mh *MessageHistory) Get(number int) (*Message, bool) {
+	mh.mu.RLock()
+	defer mh.mu.RUnlock()
+
+	for _, entry := range mh.entries {
+		if entry.Number == number {
+			return entry.Message, true
+		}
+	}
+	return nil, false
+}
+
+// Lookup returns the history entry for a message ID
+func (mh *MessageHistory) Lookup(id string) (*HistoryEntry, bool) {
+	mh.mu.RLock()
+	defer mh.mu.RUnlock()
+
+	entry, exists := mh.byID[id]
+	return entry, exists
+}
+
+// Thread returns all known messages of a thread in causal order
+func (mh *MessageHistory) Thread(rootID string) []*Message {
+	mh.mu.RLock()
+	var messages []*Message
+	for _, entry := range mh.entries {
+		if entry.Message.RootID() == rootID {
+			messages = append(messages, entry.Message)
+		}
+	}
+	mh.mu.RUnlock()
+
+	SortCausally(messages)
+	return messages
+}
+
+// Entries returns the most recent entries, oldest first
+func (mh *MessageHistory) Entries(limit int) []*HistoryEntry {
+	mh.mu.RLock()
+	defer mh.mu.RUnlock()
+
+	start := 0
+	if limit > 0 && len(mh.entries) > limit {
+		start = len(mh.entries) - limit
+	}
+
+	entries := make([]*HistoryEntry, len(mh.entries)-start)
+	copy(entries, mh.entries[start:])
+	return entries
+}
@@ -0,0 +1,371 @@
+package p2p
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Xelvra/peerchat/internal/db"
+	"github.com/Xelvra/peerchat/internal/message"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/p2p/protocol/ping"
+	multiaddr "github.com/multiformats/go-multiaddr"
+	"github.com/sirupsen/logrus"
+)
+
+// Address book settings
+const (
+	AddressTTL   = 7 * 24 * time.Hour  // Addresses not seen for this long are dropped
+	KnownPeerTTL = 30 * 24 * time.Hour // Peers not connected for this long are forgotten
+
+	addressBookInterval = 5 * time.Minute // How often connected peers are saved
+	maxReconnectPeers   = 20              // Known peers dialed on start
+	reconnectParallel   = 4
+	reconnectTimeout    = 10 * time.Second
+	pingTimeout         = 5 * time.Second
+	pingParallel        = 8
+)
+
+// AddressBookStore persists the peers a node has been connected to
+type AddressBookStore interface {
+	SaveKnownPeer(known *db.KnownPeer) error
+	LoadKnownPeers() ([]*db.KnownPeer, error)
+	PruneKnownPeers(addrsBefore, peersBefore time.Time) (int, error)
+}
+
+// AddressBook keeps the addresses, last-seen time, transport and latency of
+// peers across restarts. On start it seeds the peerstore with addresses that
+// have not aged out and reconnects to known peers, contacts first.
+type AddressBook struct {
+	host     host.Host
+	store    AddressBookStore
+	contacts message.ContactStore // nil treats every peer as unknown
+	ownerDID string
+	logger   *logrus.Logger
+
+	ctx      context.Context
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+	notifiee *network.NotifyBundle
+
+	mu           sync.Mutex
+	transports   map[peer.ID]string    // Transport of the latest connection
+	disconnected map[peer.ID]time.Time // Peers that left since the last save
+}
+
+// NewAddressBook creates an address book backed by store
+func NewAddressBook(h host.Host, store AddressBookStore, logger *logrus.Logger) *AddressBook {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &AddressBook{
+		host:         h,
+		store:        store,
+		logger:       logger,
+		ctx:          ctx,
+		cancel:       cancel,
+		transports:   make(map[peer.ID]string),
+		disconnected: make(map[peer.ID]time.Time),
+	}
+}
+
+// SetContacts makes reconnection on start try owner's contacts first and skip
+// blocked ones. It must be called before Start.
+func (ab *AddressBook) SetContacts(contacts message.ContactStore, ownerDID string) {
+	ab.contacts = contacts
+	ab.ownerDID = ownerDID
+}
+
+// Start prunes aged entries, seeds the peerstore, reconnects to known peers
+// in the background and starts recording connections
+func (ab *AddressBook) Start() error {
+	now := time.Now()
+	if removed, err := ab.store.PruneKnownPeers(now.Add(-AddressTTL), now.Add(-KnownPeerTTL)); err != nil {
+		ab.logger.WithError(err).Warn("Failed to prune address book")
+	} else if removed > 0 {
+		ab.logger.WithField("peers", removed).Debug("Forgot peers not seen recently")
+	}
+
+	known, err := ab.store.LoadKnownPeers()
+	if err != nil {
+		return err
+	}
+	seeded := ab.seed(known, now)
+
+	ab.notifiee = &network.NotifyBundle{
+		ConnectedF: func(_ network.Network, conn network.Conn) {
+			ab.mu.Lock()
+			ab.transports[conn.RemotePeer()] = transportName(conn.RemoteMultiaddr())
+			delete(ab.disconnected, conn.RemotePeer())
+			ab.mu.Unlock()
+		},
+		DisconnectedF: func(n network.Network, conn network.Conn) {
+			if n.Connectedness(conn.RemotePeer()) == network.Connected {
+				return
+			}
+			ab.mu.Lock()
+			ab.disconnected[conn.RemotePeer()] = time.Now()
+			ab.mu.Unlock()
+		},
+	}
+	ab.host.Network().Notify(ab.notifiee)
+
+	ab.wg.Add(2)
+	go func() {
+		defer ab.wg.Done()
+		ab.reconnect(seeded)
+	}()
+	go func() {
+		defer ab.wg.Done()
+		ab.run()
+	}()
+
+	ab.logger.WithFields(logrus.Fields{
+		"known_peers": len(known),
+		"seeded":      len(seeded),
+	}).Info("Address book loaded")
+	return nil
+}
+
+// Stop saves the current connections and stops recording
+func (ab *AddressBook) Stop() error {
+	ab.cancel()
+	if ab.notifiee != nil {
+		ab.host.Network().StopNotify(ab.notifiee)
+	}
+	ab.wg.Wait()
+	ab.save(false)
+	return nil
+}
+
+// seed adds addresses that have not aged out to the peerstore, with the time
+// they have left, and returns the peers that got any
+func (ab *AddressBook) seed(known []*db.KnownPeer, now time.Time) []*db.KnownPeer {
+	var seeded []*db.KnownPeer
+	peerstore := ab.host.Peerstore()
+	for _, kp := range known {
+		if kp.ID == ab.host.ID() {
+			continue
+		}
+		added := false
+		for _, addr := range kp.Addrs {
+			ttl := AddressTTL - now.Sub(addr.LastSeen)
+			if ttl <= 0 {
+				continue
+			}
+			peerstore.AddAddr(kp.ID, addr.Addr, ttl)
+			added = true
+		}
+		if !added {
+			continue
+		}
+		if kp.Latency > 0 {
+			peerstore.RecordLatency(kp.ID, kp.Latency)
+		}
+		seeded = append(seeded, kp)
+	}
+	return seeded
+}
+
+// reconnect dials the most relevant known peers: contacts first, then the most
+// recently seen. Blocked contacts are skipped.
+func (ab *AddressBook) reconnect(known []*db.KnownPeer) {
+	type candidate struct {
+		id      peer.ID
+		contact bool
+	}
+	var candidates []candidate
+	for _, kp := range known {
+		isContact, blocked := false, false
+		if ab.contacts != nil {
+			var err error
+			isContact, blocked, err = ab.contacts.ContactStatus(ab.ownerDID, kp.ID)
+			if err != nil {
+				ab.logger.WithError(err).WithField("peer_id", kp.ID.String()).Debug("Failed to look up contact")
+			}
+		}
+		if blocked {
+			continue
+		}
+		candidates = append(candidates, candidate{id: kp.ID, contact: isContact})
+	}
+
+	// Known peers arrive most recently seen first; keep that order within each group
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].contact && !candidates[j].contact
+	})
+	if len(candidates) > maxReconnectPeers {
+		candidates = candidates[:maxReconnectPeers]
+	}
+
+	slots := make(chan struct{}, reconnectParallel)
+	var wg sync.WaitGroup
+	for _, c := range candidates {
+		if ab.host.Network().Connectedness(c.id) == network.Connected {
+			continue
+		}
+		select {
+		case slots <- struct{}{}:
+		case <-ab.ctx.Done():
+			wg.Wait()
+			return
+		}
+		wg.Add(1)
+		go func(c candidate) {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+			ctx, cancel := context.WithTimeout(ab.ctx, reconnectTimeout)
+			defer cancel()
+			logger := ab.logger.WithFields(logrus.Fields{"peer_id": c.id.String(), "contact": c.contact})
+			if err := ab.host.Connect(ctx, peer.AddrInfo{ID: c.id}); err != nil {
+				logger.WithError(err).Debug("Failed to reconnect to known peer")
+				return
+			}
+			logger.Debug("Reconnected to known peer")
+		}(c)
+	}
+	wg.Wait()
+}
+
+// run saves connected peers periodically
+func (ab *AddressBook) run() {
+	ticker := time.NewTicker(addressBookInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ab.ctx.Done():
+			return
+		case <-ticker.C:
+			ab.save(true)
+		}
+	}
+}
+
+// save stores connected peers and peers that disconnected since the last
+// save. With measure, connected peers are pinged to refresh their latency.
+func (ab *AddressBook) save(measure bool) {
+	now := time.Now()
+
+	ab.mu.Lock()
+	lastSeen := make(map[peer.ID]time.Time, len(ab.disconnected))
+	for id, seen := range ab.disconnected {
+		lastSeen[id] = seen
+	}
+	ab.disconnected = make(map[peer.ID]time.Time)
+	transports := make(map[peer.ID]string, len(ab.transports))
+	for id, transport := range ab.transports {
+		transports[id] = transport
+	}
+	ab.mu.Unlock()
+
+	connected := ab.host.Network().Peers()
+	for _, id := range connected {
+		lastSeen[id] = now
+	}
+	if measure {
+		ab.measureLatencies(connected)
+	}
+
+	peerstore := ab.host.Peerstore()
+	for id, seen := range lastSeen {
+		if id == ab.host.ID() {
+			continue
+		}
+
+		known := &db.KnownPeer{
+			ID:        id,
+			LastSeen:  seen,
+			Transport: transports[id],
+			Latency:   peerstore.LatencyEWMA(id),
+		}
+		// Only addresses we are connected through are known to work now
+		used := make(map[string]bool)
+		for _, conn := range ab.host.Network().ConnsToPeer(id) {
+			used[string(conn.RemoteMultiaddr().Bytes())] = true
+			known.Addrs = append(known.Addrs, db.KnownAddr{Addr: conn.RemoteMultiaddr(), LastSeen: seen})
+		}
+		for _, addr := range peerstore.Addrs(id) {
+			// In-process link-local addresses are only valid for one dial
+			if _, err := addr.ValueForProtocol(multiaddr.P_MEMORY); err == nil {
+				continue
+			}
+			if !used[string(addr.Bytes())] {
+				known.Addrs = append(known.Addrs, db.KnownAddr{Addr: addr, LastSeen: seen, Announced: true})
+			}
+		}
+
+		if err := ab.store.SaveKnownPeer(known); err != nil {
+			ab.logger.WithError(err).WithField("peer_id", id.String()).Warn("Failed to save known peer")
+		}
+	}
+
+	ab.mu.Lock()
+	for id := range transports {
+		if ab.host.Network().Connectedness(id) != network.Connected {
+			delete(ab.transports, id)
+		}
+	}
+	ab.mu.Unlock()
+}
+
+// measureLatencies pings peers, a few at a time
+func (ab *AddressBook) measureLatencies(ids []peer.ID) {
+	slots := make(chan struct{}, pingParallel)
+	var wg sync.WaitGroup
+	for _, id := range ids {
+		select {
+		case slots <- struct{}{}:
+		case <-ab.ctx.Done():
+			wg.Wait()
+			return
+		}
+		wg.Add(1)
+		go func(id peer.ID) {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+			ab.measureLatency(id)
+		}(id)
+	}
+	wg.Wait()
+}
+
+// measureLatency pings a peer once; the result is recorded in the peerstore
+func (ab *AddressBook) measureLatency(id peer.ID) {
+	ctx, cancel := context.WithTimeout(ab.ctx, pingTimeout)
+	defer cancel()
+
+	result, ok := <-ping.Ping(ctx, ab.host, id)
+	if ok && result.Error != nil {
+		ab.logger.WithError(result.Error).WithField("peer_id", id.String()).Debug("Failed to ping peer")
+	}
+}
+
+// transportName names the transport of a connection address
+func transportName(addr multiaddr.Multiaddr) string {
+	if addr == nil {
+		return ""
+	}
+	for _, proto := range []struct {
+		code int
+		name string
+	}{
+		{multiaddr.P_CIRCUIT, "relay"},
+		{multiaddr.P_WEBTRANSPORT, "webtransport"},
+		{multiaddr.P_WSS, "websocket"},
+		{multiaddr.P_WS, "websocket"},
+		{multiaddr.P_QUIC_V1, "quic"},
+		{multiaddr.P_QUIC, "quic"},
+		{multiaddr.P_TCP, "tcp"},
+	} {
+		if _, err := addr.ValueForProtocol(proto.code); err == nil {
+			return proto.name
+		}
+	}
+	return ""
+}
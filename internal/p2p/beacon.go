@@ -0,0 +1,298 @@
+package p2p
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	multiaddr "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
+	"golang.org/x/time/rate"
+)
+
+// A LAN beacon announces a peer and its listen addresses on UDP port 42424.
+// It is sent to the directed broadcast address of every IPv4 interface and to
+// the IPv6 all-nodes group, and is signed by the peer key so the peer ID
+// cannot be spoofed. A beacon is accepted while it is fresh and newer than
+// the last one from the same peer.
+const (
+	BeaconPort    = 42424
+	BeaconVersion = 1
+	BeaconMaxAge  = 2 * time.Minute // Accepted clock skew and replay window
+
+	beaconPrefix      = "XELVRA_BEACON:"
+	beaconSigningTag  = "xelvra-beacon:"
+	beaconMaxSize     = 1400 // Fits one datagram on common links
+	beaconMaxAddrs    = 16
+	beaconInterval    = 30 * time.Second
+	beaconIPv6Group   = "ff02::1"
+	beaconRate        = rate.Limit(20) // Beacons processed per second
+	beaconBurst       = 40
+	beaconSourceRate  = rate.Limit(1) // Beacons processed per second per sender address
+	beaconSourceBurst = 3
+	beaconMaxSources  = 256
+)
+
+// Beacon errors
+var (
+	ErrBeaconFormat    = errors.New("not a beacon")
+	ErrBeaconVersion   = errors.New("unsupported beacon version")
+	ErrBeaconSignature = errors.New("invalid beacon signature")
+	ErrBeaconExpired   = errors.New("beacon timestamp outside the accepted window")
+)
+
+// Beacon is a verified LAN announcement of a peer
+type Beacon struct {
+	PeerID    peer.ID
+	Addrs     []multiaddr.Multiaddr
+	Timestamp time.Time
+}
+
+// beaconWire is the signed JSON form of a beacon
+type beaconWire struct {
+	Version   int      `json:"v"`
+	PeerID    string   `json:"id"`
+	Addrs     [][]byte `json:"addrs"`
+	Timestamp int64    `json:"ts"` // Unix milliseconds
+	Signature []byte   `json:"sig,omitempty"`
+}
+
+// signingBytes returns the bytes a beacon signature covers
+func (w beaconWire) signingBytes() ([]byte, error) {
+	w.Signature = nil
+	data, err := json.Marshal(w)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(beaconSigningTag), data...), nil
+}
+
+// SignBeacon builds a beacon announcing addrs, signed by key. Loopback and
+// unspecified addresses are left out, and addresses are dropped from the end
+// until the beacon fits in one datagram.
+func SignBeacon(key crypto.PrivKey, addrs []multiaddr.Multiaddr, now time.Time) ([]byte, error) {
+	id, err := peer.IDFromPrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive peer ID: %w", err)
+	}
+
+	wire := beaconWire{
+		Version:   BeaconVersion,
+		PeerID:    id.String(),
+		Timestamp: now.UnixMilli(),
+	}
+	for _, addr := range addrs {
+		if !announceable(addr) {
+			continue
+		}
+		if len(wire.Addrs) == beaconMaxAddrs {
+			break
+		}
+		wire.Addrs = append(wire.Addrs, addr.Bytes())
+	}
+
+	for {
+		signed, err := wire.signingBytes()
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode beacon: %w", err)
+		}
+		if wire.Signature, err = key.Sign(signed); err != nil {
+			return nil, fmt.Errorf("failed to sign beacon: %w", err)
+		}
+		data, err := json.Marshal(wire)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode beacon: %w", err)
+		}
+		data = append([]byte(beaconPrefix), data...)
+		if len(data) <= beaconMaxSize {
+			return data, nil
+		}
+		if len(wire.Addrs) == 0 {
+			return nil, fmt.Errorf("beacon too large: %d bytes", len(data))
+		}
+		wire.Addrs = wire.Addrs[:len(wire.Addrs)-1]
+		wire.Signature = nil
+	}
+}
+
+// VerifyBeacon decodes a beacon and checks its version, signature and age.
+// Addresses that cannot be dialed are dropped.
+func VerifyBeacon(data []byte, now time.Time) (*Beacon, error) {
+	if len(data) > beaconMaxSize || !bytes.HasPrefix(data, []byte(beaconPrefix)) {
+		return nil, ErrBeaconFormat
+	}
+
+	var wire beaconWire
+	if err := json.Unmarshal(data[len(beaconPrefix):], &wire); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBeaconFormat, err)
+	}
+	if wire.Version != BeaconVersion {
+		return nil, fmt.Errorf("%w: %d", ErrBeaconVersion, wire.Version)
+	}
+	if len(wire.Addrs) > beaconMaxAddrs {
+		return nil, fmt.Errorf("%w: too many addresses", ErrBeaconFormat)
+	}
+
+	id, err := peer.Decode(wire.PeerID)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBeaconFormat, err)
+	}
+	pubKey, err := id.ExtractPublicKey()
+	if err != nil {
+		return nil, fmt.Errorf("%w: peer ID does not carry its key", ErrBeaconSignature)
+	}
+	signed, err := wire.signingBytes()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBeaconFormat, err)
+	}
+	if ok, err := pubKey.Verify(signed, wire.Signature); err != nil || !ok {
+		return nil, ErrBeaconSignature
+	}
+
+	timestamp := time.UnixMilli(wire.Timestamp)
+	if age := now.Sub(timestamp); age > BeaconMaxAge || age < -BeaconMaxAge {
+		return nil, ErrBeaconExpired
+	}
+
+	beacon := &Beacon{PeerID: id, Timestamp: timestamp}
+	for _, raw := range wire.Addrs {
+		addr, err := multiaddr.NewMultiaddrBytes(raw)
+		if err != nil || !announceable(addr) {
+			continue
+		}
+		beacon.Addrs = append(beacon.Addrs, addr)
+	}
+	return beacon, nil
+}
+
+// announceable reports whether an address is worth announcing on the LAN
+func announceable(addr multiaddr.Multiaddr) bool {
+	ip, err := manet.ToIP(addr)
+	if err != nil {
+		// Addresses without an IP, such as DNS names, are kept
+		return true
+	}
+	return !ip.IsLoopback() && !ip.IsUnspecified()
+}
+
+// DirectedBroadcast returns the broadcast address of an IPv4 network, or nil
+// for IPv6 networks and host routes
+func DirectedBroadcast(network *net.IPNet) net.IP {
+	ip := network.IP.To4()
+	if ip == nil || len(network.Mask) != net.IPv4len {
+		return nil
+	}
+	if ones, _ := network.Mask.Size(); ones >= 31 {
+		return nil
+	}
+	broadcast := make(net.IP, net.IPv4len)
+	for i := range ip {
+		broadcast[i] = ip[i] | ^network.Mask[i]
+	}
+	return broadcast
+}
+
+// beaconTargets returns the directed broadcast address of every IPv4
+// interface and the IPv6 all-nodes group of every multicast interface
+func beaconTargets() ([]*net.UDPAddr, error) {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list network interfaces: %w", err)
+	}
+
+	var targets []*net.UDPAddr
+	seen := make(map[string]bool)
+	for _, iface := range interfaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+
+		hasIPv6 := false
+		for _, addr := range addrs {
+			ipnet, ok := addr.(*net.IPNet)
+			if !ok {
+				continue
+			}
+			if ipnet.IP.To4() == nil {
+				hasIPv6 = true
+				continue
+			}
+			if iface.Flags&net.FlagBroadcast == 0 {
+				continue
+			}
+			if broadcast := DirectedBroadcast(ipnet); broadcast != nil && !seen[broadcast.String()] {
+				seen[broadcast.String()] = true
+				targets = append(targets, &net.UDPAddr{IP: broadcast, Port: BeaconPort})
+			}
+		}
+
+		if hasIPv6 && iface.Flags&net.FlagMulticast != 0 {
+			targets = append(targets, &net.UDPAddr{IP: net.ParseIP(beaconIPv6Group), Port: BeaconPort, Zone: iface.Name})
+		}
+	}
+	return targets, nil
+}
+
+// beaconLimiter bounds the beacons processed overall and per sender address
+type beaconLimiter struct {
+	mu      sync.Mutex
+	global  *rate.Limiter
+	sources map[string]*rate.Limiter
+	latest  map[peer.ID]time.Time // Newest accepted beacon per peer
+}
+
+func newBeaconLimiter() *beaconLimiter {
+	return &beaconLimiter{
+		global:  rate.NewLimiter(beaconRate, beaconBurst),
+		sources: make(map[string]*rate.Limiter),
+		latest:  make(map[peer.ID]time.Time),
+	}
+}
+
+// allow reports whether a datagram from source may be processed
+func (l *beaconLimiter) allow(source net.IP) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	key := source.String()
+	limiter, ok := l.sources[key]
+	if !ok {
+		if len(l.sources) >= beaconMaxSources {
+			l.sources = make(map[string]*rate.Limiter)
+		}
+		limiter = rate.NewLimiter(beaconSourceRate, beaconSourceBurst)
+		l.sources[key] = limiter
+	}
+	return limiter.Allow() && l.global.Allow()
+}
+
+// fresh records a verified beacon, reporting false for replays and beacons
+// older than the last one accepted from the same peer
+func (l *beaconLimiter) fresh(beacon *Beacon) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if latest, ok := l.latest[beacon.PeerID]; ok && !beacon.Timestamp.After(latest) {
+		return false
+	}
+	if len(l.latest) >= beaconMaxSources {
+		cutoff := time.Now().Add(-BeaconMaxAge)
+		for id, latest := range l.latest {
+			if latest.Before(cutoff) {
+				delete(l.latest, id)
+			}
+		}
+	}
+	l.latest[beacon.PeerID] = beacon.Timestamp
+	return true
+}
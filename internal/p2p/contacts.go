@@ -0,0 +1,92 @@
+package p2p
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/Xelvra/peerchat/internal/db"
+	"github.com/Xelvra/peerchat/internal/user"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/sirupsen/logrus"
+)
+
+// openContacts opens the database of the identity in the default data
+// directory. A running node keeps using it and sees contact changes on its
+// next lookup.
+func openContacts() (*db.SQLiteDB, *user.MessengerID, error) {
+	dataDir := defaultDataDir()
+	identity, err := user.LoadMessengerID(filepath.Join(dataDir, user.IdentityFileName))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to load identity: %w", err)
+	}
+
+	logger := logrus.New()
+	logger.SetLevel(logrus.WarnLevel)
+	database, err := db.NewSQLiteDB(dataDir, databasePassword("", identity), logger)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open database: %w", err)
+	}
+	return database, identity, nil
+}
+
+// Contacts returns the contacts of the identity in the default data directory
+func Contacts() ([]*user.UserProfile, error) {
+	database, identity, err := openContacts()
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = database.Close() }()
+
+	return database.LoadContacts(identity.DID)
+}
+
+// SaveContact adds a peer to the contacts of the identity in the default data
+// directory, or blocks it. Without a DID the contact keeps the DID it was
+// added with, or is named by its key. An empty name keeps the current one.
+func SaveContact(peerID, did, name string, blocked bool) error {
+	id, err := peer.Decode(peerID)
+	if err != nil {
+		return fmt.Errorf("invalid peer ID: %w", err)
+	}
+	publicKey, err := user.PeerIdentityKey(id)
+	if err != nil {
+		return err
+	}
+	if did != "" && !user.ValidateDID(did) {
+		return fmt.Errorf("invalid DID: %s", did)
+	}
+
+	database, identity, err := openContacts()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = database.Close() }()
+
+	if id == identity.PeerID {
+		return fmt.Errorf("cannot add yourself as a contact")
+	}
+
+	contacts, err := database.LoadContacts(identity.DID)
+	if err != nil {
+		return err
+	}
+	for _, existing := range contacts {
+		if !existing.MessengerID.PublicKey.Equal(publicKey) {
+			continue
+		}
+		if did != "" && did != existing.MessengerID.DID {
+			return fmt.Errorf("peer is already a contact as %s", existing.MessengerID.DID)
+		}
+		did = existing.MessengerID.DID
+		if name == "" {
+			name = existing.DisplayName
+		}
+	}
+	if did == "" {
+		did = user.KeyDID(publicKey)
+	}
+
+	contact := user.CreateUserProfile(&user.MessengerID{DID: did, PublicKey: publicKey, PeerID: id}, name)
+	contact.IsBlocked = blocked
+	return database.SaveContact(identity.DID, contact)
+}
@@ -9,6 +9,8 @@ import (
 	"time"
 
 	"github.com/libp2p/go-libp2p-kad-dht/dual"
+	"github.com/libp2p/go-libp2p/core/discovery"
+	"github.com/libp2p/go-libp2p/core/event"
 	"github.com/libp2p/go-libp2p/core/host"
 	"github.com/libp2p/go-libp2p/core/network"
 	"github.com/libp2p/go-libp2p/core/peer"
@@ -35,6 +37,8 @@ type DiscoveryManager struct {
 
 	// Bootstrap peers for DHT
 	bootstrapPeers []peer.AddrInfo
+	dhtDisabled    bool
+	ownsDHT        bool // The DHT was created by discovery and is closed with it
 
 	// Local discovery cache (LRU)
 	localPeerCache map[peer.ID]*peer.AddrInfo
@@ -45,6 +49,12 @@ type DiscoveryManager struct {
 	mu              sync.RWMutex
 	discoveredPeers map[peer.ID]*peer.AddrInfo
 	status          *DiscoveryStatus
+	beacons         *beaconLimiter // UDP broadcast beacons
+	linkLocal       *beaconLimiter // IPv6 link-local beacons
+
+	// Hole punching strategies; nil dials peers plainly
+	natTraversal *AdvancedNATTraversal
+	relayService bool // Advertise our relay in the DHT while publicly reachable
 
 	// Hierarchical discovery priorities
 	localDiscoveryActive  bool
@@ -65,6 +75,8 @@ func NewDiscoveryManager(h host.Host, logger *logrus.Logger) *DiscoveryManager {
 		cancel:          cancel,
 		bootstrapPeers:  bootstrapPeers,
 		discoveredPeers: make(map[peer.ID]*peer.AddrInfo),
+		beacons:         newBeaconLimiter(),
+		linkLocal:       newBeaconLimiter(),
 		localPeerCache:  make(map[peer.ID]*peer.AddrInfo),
 		cacheMaxSize:    100, // LRU cache for 100 local peers
 		cacheOrder:      make([]peer.ID, 0),
@@ -81,6 +93,39 @@ func NewDiscoveryManager(h host.Host, logger *logrus.Logger) *DiscoveryManager {
 	}
 }
 
+// SetBootstrapPeers replaces the peers connected to on start. Must be called before Start.
+func (dm *DiscoveryManager) SetBootstrapPeers(peers []peer.AddrInfo) {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+
+	dm.bootstrapPeers = peers
+	dm.status.BootstrapPeers = make([]string, len(peers))
+}
+
+// SetDHT makes discovery use the node's DHT instead of creating its own.
+// Must be called before Start.
+func (dm *DiscoveryManager) SetDHT(dht *dual.DHT) {
+	dm.dht = dht
+}
+
+// DisableDHT skips global DHT discovery; bootstrap peers are still connected
+// to. Must be called before Start.
+func (dm *DiscoveryManager) DisableDHT() {
+	dm.dhtDisabled = true
+}
+
+// SetNATTraversal makes hole punching use direct, DCUtR and relay strategies.
+// Must be called before Start.
+func (dm *DiscoveryManager) SetNATTraversal(nat *AdvancedNATTraversal) {
+	dm.natTraversal = nat
+}
+
+// SetRelayService advertises the node's circuit relay in the DHT whenever
+// it is publicly reachable. Must be called before Start.
+func (dm *DiscoveryManager) SetRelayService(enabled bool) {
+	dm.relayService = enabled
+}
+
 // Start begins hierarchical peer discovery: IPv6 → mDNS → hole punching → relay
 func (dm *DiscoveryManager) Start() error {
 	dm.logger.Info("Starting hierarchical peer discovery: IPv6 → mDNS → UDP → DHT → Hole Punching → Relay...")
@@ -108,7 +153,10 @@ func (dm *DiscoveryManager) Start() error {
 	dm.logger.Info("Phase 3: UDP broadcast discovery started")
 
 	// Phase 4: DHT discovery (global network)
-	if err := dm.startDHT(); err != nil {
+	if dm.dhtDisabled {
+		go dm.connectToBootstrapPeers()
+		dm.logger.Info("Phase 4: DHT disabled, connecting to bootstrap peers only")
+	} else if err := dm.startDHT(); err != nil {
 		dm.logger.WithError(err).Warn("Failed to start DHT discovery")
 	} else {
 		dm.mu.Lock()
@@ -142,7 +190,7 @@ func (dm *DiscoveryManager) Stop() error {
 		}
 	}
 
-	if dm.dht != nil {
+	if dm.dht != nil && dm.ownsDHT {
 		if err := dm.dht.Close(); err != nil {
 			dm.logger.WithError(err).Warn("Failed to close DHT")
 		}
@@ -152,6 +200,7 @@ func (dm *DiscoveryManager) Stop() error {
 	dm.status.MDNSActive = false
 	dm.status.DHTActive = false
 	dm.status.UDPBroadcast = false
+	dm.status.IPv6LinkLocal = false
 	dm.mu.Unlock()
 
 	dm.logger.Info("Peer discovery stopped")
@@ -212,15 +261,16 @@ func (dm *DiscoveryManager) startMDNS() error {
 	return nil
 }
 
-// startUDPBroadcast starts UDP broadcast discovery for local network
+// startUDPBroadcast starts signed beacon discovery for the local network
 func (dm *DiscoveryManager) startUDPBroadcast() {
 	dm.logger.Info("Starting UDP broadcast discovery...")
 
 	// Listen for broadcasts
 	go dm.listenUDPBroadcast()
 
-	// Send periodic broadcasts
-	ticker := time.NewTicker(30 * time.Second)
+	// Announce right away, then periodically
+	dm.sendUDPBroadcast()
+	ticker := time.NewTicker(beaconInterval)
 	defer ticker.Stop()
 
 	for {
@@ -233,15 +283,10 @@ func (dm *DiscoveryManager) startUDPBroadcast() {
 	}
 }
 
-// listenUDPBroadcast listens for UDP broadcast messages
+// listenUDPBroadcast listens for beacons sent to IPv4 broadcast and IPv6
+// multicast addresses
 func (dm *DiscoveryManager) listenUDPBroadcast() {
-	addr, err := net.ResolveUDPAddr("udp", ":42424")
-	if err != nil {
-		dm.logger.WithError(err).Error("Failed to resolve UDP broadcast address")
-		return
-	}
-
-	conn, err := net.ListenUDP("udp", addr)
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{Port: BeaconPort})
 	if err != nil {
 		dm.logger.WithError(err).Error("Failed to listen on UDP broadcast")
 		return
@@ -252,9 +297,9 @@ func (dm *DiscoveryManager) listenUDPBroadcast() {
 		}
 	}()
 
-	dm.logger.Info("Listening for UDP broadcasts on :42424")
+	dm.logger.WithField("port", BeaconPort).Info("Listening for UDP broadcasts")
 
-	buffer := make([]byte, 1024)
+	buffer := make([]byte, beaconMaxSize+1)
 	for {
 		select {
 		case <-dm.ctx.Done():
@@ -278,11 +323,27 @@ func (dm *DiscoveryManager) listenUDPBroadcast() {
 	}
 }
 
-// sendUDPBroadcast sends UDP broadcast message
+// sendUDPBroadcast sends a signed beacon to the directed broadcast address of
+// every interface and to the IPv6 all-nodes group
 func (dm *DiscoveryManager) sendUDPBroadcast() {
-	message := fmt.Sprintf("XELVRA_PEER:%s", dm.host.ID().String())
+	key := dm.host.Peerstore().PrivKey(dm.host.ID())
+	if key == nil {
+		dm.logger.Warn("No private key to sign discovery beacons")
+		return
+	}
+	beacon, err := SignBeacon(key, dm.host.Addrs(), time.Now())
+	if err != nil {
+		dm.logger.WithError(err).Warn("Failed to create discovery beacon")
+		return
+	}
+
+	targets, err := beaconTargets()
+	if err != nil {
+		dm.logger.WithError(err).Warn("Failed to find broadcast addresses")
+		return
+	}
 
-	conn, err := net.Dial("udp", "255.255.255.255:42424")
+	conn, err := net.ListenUDP("udp", nil)
 	if err != nil {
 		dm.logger.WithError(err).Warn("Failed to create UDP broadcast connection - check firewall/network")
 		return
@@ -293,53 +354,71 @@ func (dm *DiscoveryManager) sendUDPBroadcast() {
 		}
 	}()
 
-	_, err = conn.Write([]byte(message))
-	if err != nil {
-		dm.logger.WithError(err).Warn("Failed to send UDP broadcast")
-		return
+	sent := 0
+	for _, target := range targets {
+		if _, err := conn.WriteToUDP(beacon, target); err != nil {
+			dm.logger.WithError(err).WithField("target", target.String()).Debug("Failed to send UDP broadcast")
+			continue
+		}
+		sent++
 	}
 
 	dm.logger.WithFields(logrus.Fields{
-		"message": message,
-		"target":  "255.255.255.255:42424",
+		"targets": sent,
+		"size":    len(beacon),
 		"peer_id": dm.host.ID().String(),
-	}).Info("Sent UDP broadcast for peer discovery")
+	}).Debug("Sent discovery beacon")
 }
 
-// handleUDPBroadcast handles received UDP broadcast messages
+// handleUDPBroadcast verifies a received beacon and connects to its sender.
+// Processing is rate limited per sender address and overall, and replayed or
+// older beacons of a peer are ignored.
 func (dm *DiscoveryManager) handleUDPBroadcast(data []byte, remoteAddr *net.UDPAddr) {
-	message := string(data)
-	if len(message) < 12 || message[:12] != "XELVRA_PEER:" {
+	if !dm.beacons.allow(remoteAddr.IP) {
 		return
 	}
 
-	peerIDStr := message[12:]
-	peerID, err := peer.Decode(peerIDStr)
+	beacon, err := VerifyBeacon(data, time.Now())
 	if err != nil {
-		dm.logger.WithError(err).Debug("Invalid peer ID in UDP broadcast")
+		dm.logger.WithError(err).WithField("remote_addr", remoteAddr.String()).Debug("Ignoring invalid discovery beacon")
 		return
 	}
 
 	// Don't discover ourselves
-	if peerID == dm.host.ID() {
+	if beacon.PeerID == dm.host.ID() || !dm.beacons.fresh(beacon) {
 		return
 	}
 
-	dm.logger.WithFields(logrus.Fields{
-		"peer_id":     peerID.String(),
-		"remote_addr": remoteAddr.String(),
-	}).Info("Discovered peer via UDP broadcast")
-
-	// Create basic peer info (UDP broadcast doesn't provide addresses)
-	peerInfo := &peer.AddrInfo{
-		ID:    peerID,
-		Addrs: []multiaddr.Multiaddr{}, // No addresses from UDP broadcast
-	}
+	peerInfo := &peer.AddrInfo{ID: beacon.PeerID, Addrs: beacon.Addrs}
 
 	dm.mu.Lock()
-	dm.discoveredPeers[peerID] = peerInfo
+	_, known := dm.discoveredPeers[beacon.PeerID]
+	dm.discoveredPeers[beacon.PeerID] = peerInfo
 	dm.status.LastDiscovery = time.Now()
 	dm.mu.Unlock()
+
+	logger := dm.logger.WithFields(logrus.Fields{
+		"peer_id":     beacon.PeerID.String(),
+		"remote_addr": remoteAddr.String(),
+		"addrs":       beacon.Addrs,
+	})
+	if !known {
+		logger.Info("Discovered peer via UDP broadcast")
+	}
+
+	if len(beacon.Addrs) == 0 || dm.host.Network().Connectedness(beacon.PeerID) == network.Connected {
+		return
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(dm.ctx, 10*time.Second)
+		defer cancel()
+
+		if err := dm.host.Connect(ctx, *peerInfo); err != nil {
+			logger.WithError(err).Debug("Failed to connect to discovered peer")
+			return
+		}
+		logger.Info("Successfully connected to discovered peer")
+	}()
 }
 
 // discoveryNotifee handles mDNS discovery notifications
@@ -404,14 +483,16 @@ func getBootstrapPeers() []peer.AddrInfo {
 func (dm *DiscoveryManager) startDHT() error {
 	dm.logger.Info("Starting DHT for global peer discovery...")
 
-	// Create DHT with bootstrap peers
-	dht, err := dual.New(dm.ctx, dm.host)
-	if err != nil {
-		return fmt.Errorf("failed to create DHT: %w", err)
+	// Use the node's DHT, or create one when discovery runs on its own
+	if dm.dht == nil {
+		dht, err := dual.New(dm.ctx, dm.host)
+		if err != nil {
+			return fmt.Errorf("failed to create DHT: %w", err)
+		}
+		dm.dht = dht
+		dm.ownsDHT = true
 	}
 
-	dm.dht = dht
-
 	// Bootstrap the DHT
 	if err := dm.dht.Bootstrap(dm.ctx); err != nil {
 		dm.logger.WithError(err).Warn("DHT bootstrap failed, continuing anyway")
@@ -421,10 +502,20 @@ func (dm *DiscoveryManager) startDHT() error {
 	go dm.connectToBootstrapPeers()
 
 	// Create routing discovery
+	dm.mu.Lock()
 	dm.routingDiscovery = drouting.NewRoutingDiscovery(dm.dht)
+	dm.mu.Unlock()
 
 	// Start advertising our presence
 	go dm.advertisePresence()
+	if dm.relayService {
+		sub, err := dm.host.EventBus().Subscribe(new(event.EvtLocalReachabilityChanged))
+		if err != nil {
+			dm.logger.WithError(err).Warn("Failed to subscribe to reachability changes, relay not advertised")
+		} else {
+			go dm.advertiseRelayService(sub)
+		}
+	}
 
 	// Start discovering peers via DHT
 	go dm.discoverViaDHT()
@@ -505,6 +596,66 @@ func (dm *DiscoveryManager) doAdvertise() {
 	}
 }
 
+// advertiseRelayService advertises our relay while AutoNAT finds us publicly
+// reachable, which is also when libp2p runs the relay
+func (dm *DiscoveryManager) advertiseRelayService(sub event.Subscription) {
+	defer func() { _ = sub.Close() }()
+
+	ticker := time.NewTicker(5 * time.Minute)
+	defer ticker.Stop()
+
+	public := false
+	for {
+		select {
+		case <-dm.ctx.Done():
+			return
+		case evt, ok := <-sub.Out():
+			if !ok {
+				return
+			}
+			public = evt.(event.EvtLocalReachabilityChanged).Reachability == network.ReachabilityPublic
+
+			dm.mu.Lock()
+			dm.status.RelayService = public
+			dm.mu.Unlock()
+			dm.logger.WithField("active", public).Info("Relay service availability changed")
+		case <-ticker.C:
+		}
+
+		if public {
+			ctx, cancel := context.WithTimeout(dm.ctx, 30*time.Second)
+			if _, err := dm.routingDiscovery.Advertise(ctx, RelayNamespace); err != nil {
+				dm.logger.WithError(err).Debug("Failed to advertise relay service in DHT")
+			}
+			cancel()
+		}
+	}
+}
+
+// findRelays returns up to limit peers advertising a relay in the DHT
+func (dm *DiscoveryManager) findRelays(ctx context.Context, limit int) []peer.AddrInfo {
+	dm.mu.RLock()
+	routingDiscovery := dm.routingDiscovery
+	dm.mu.RUnlock()
+	if routingDiscovery == nil {
+		return nil
+	}
+
+	peerChan, err := routingDiscovery.FindPeers(ctx, RelayNamespace, discovery.Limit(limit))
+	if err != nil {
+		dm.logger.WithError(err).Debug("Failed to look up relays in DHT")
+		return nil
+	}
+
+	var relays []peer.AddrInfo
+	for info := range peerChan {
+		if info.ID != dm.host.ID() && len(info.Addrs) > 0 {
+			relays = append(relays, info)
+		}
+	}
+	return relays
+}
+
 // discoverViaDHT discovers peers using DHT
 func (dm *DiscoveryManager) discoverViaDHT() {
 	if dm.routingDiscovery == nil {
@@ -647,94 +798,8 @@ func (dm *DiscoveryManager) isLocalPeer(peerInfo *peer.AddrInfo) bool {
 	return false
 }
 
-// startIPv6LinkLocalDiscovery starts IPv6 link-local peer discovery (Phase 1)
-func (dm *DiscoveryManager) startIPv6LinkLocalDiscovery() {
-	dm.logger.Info("Starting IPv6 link-local discovery (Phase 1 - highest priority)...")
-
-	ticker := time.NewTicker(15 * time.Second) // Check every 15 seconds
-	defer ticker.Stop()
-
-	for {
-		select {
-		case <-dm.ctx.Done():
-			return
-		case <-ticker.C:
-			dm.discoverIPv6LinkLocal()
-		}
-	}
-}
-
-// discoverIPv6LinkLocal discovers peers on IPv6 link-local network
-func (dm *DiscoveryManager) discoverIPv6LinkLocal() {
-	// Get all network interfaces
-	interfaces, err := net.Interfaces()
-	if err != nil {
-		dm.logger.WithError(err).Debug("Failed to get network interfaces for IPv6 discovery")
-		return
-	}
-
-	discovered := 0
-	for _, iface := range interfaces {
-		// Skip loopback and down interfaces
-		if iface.Flags&net.FlagLoopback != 0 || iface.Flags&net.FlagUp == 0 {
-			continue
-		}
-
-		addrs, err := iface.Addrs()
-		if err != nil {
-			continue
-		}
-
-		for _, addr := range addrs {
-			if ipnet, ok := addr.(*net.IPNet); ok {
-				if ipnet.IP.IsLinkLocalUnicast() && ipnet.IP.To4() == nil { // IPv6 link-local
-					dm.logger.WithFields(logrus.Fields{
-						"interface": iface.Name,
-						"ipv6_addr": ipnet.IP.String(),
-					}).Debug("Found IPv6 link-local address")
-
-					// Try to discover peers on this link-local network
-					if dm.scanIPv6LinkLocalNetwork(ipnet, iface.Name) {
-						discovered++
-					}
-				}
-			}
-		}
-	}
-
-	if discovered > 0 {
-		dm.logger.WithField("networks_scanned", discovered).Info("IPv6 link-local discovery completed")
-	}
-}
-
-// scanIPv6LinkLocalNetwork scans for peers on IPv6 link-local network
-func (dm *DiscoveryManager) scanIPv6LinkLocalNetwork(network *net.IPNet, interfaceName string) bool {
-	// For IPv6 link-local, we use multicast discovery
-	// Send to all-nodes multicast address ff02::1
-	multicastAddr := "ff02::1"
-
-	conn, err := net.Dial("udp6", fmt.Sprintf("[%s%%25%s]:42425", multicastAddr, interfaceName))
-	if err != nil {
-		dm.logger.WithError(err).Debug("Failed to create IPv6 multicast connection")
-		return false
-	}
-	defer conn.Close()
-
-	message := fmt.Sprintf("XELVRA_IPV6:%s", dm.host.ID().String())
-	_, err = conn.Write([]byte(message))
-	if err != nil {
-		dm.logger.WithError(err).Debug("Failed to send IPv6 multicast discovery")
-		return false
-	}
-
-	dm.logger.WithFields(logrus.Fields{
-		"interface": interfaceName,
-		"target":    multicastAddr,
-		"message":   message,
-	}).Debug("Sent IPv6 link-local discovery multicast")
-
-	return true
-}
+// holePunchingTimeout bounds all strategies tried for one peer
+const holePunchingTimeout = time.Minute
 
 // startHolePunchingService starts NAT hole punching service (Phase 5)
 func (dm *DiscoveryManager) startHolePunchingService() {
@@ -782,49 +847,25 @@ func (dm *DiscoveryManager) attemptHolePunching() {
 func (dm *DiscoveryManager) performHolePunching(peerID peer.ID, peerInfo *peer.AddrInfo) {
 	dm.logger.WithField("peer_id", peerID.String()).Debug("Attempting NAT hole punching")
 
-	// Try multiple connection attempts with different strategies
-	strategies := []string{"direct", "relay-assisted", "simultaneous-open"}
-
-	for _, strategy := range strategies {
-		ctx, cancel := context.WithTimeout(dm.ctx, 10*time.Second)
+	ctx, cancel := context.WithTimeout(dm.ctx, holePunchingTimeout)
+	defer cancel()
 
-		switch strategy {
-		case "direct":
-			err := dm.host.Connect(ctx, *peerInfo)
-			if err == nil {
-				dm.logger.WithFields(logrus.Fields{
-					"peer_id":  peerID.String(),
-					"strategy": strategy,
-				}).Info("NAT hole punching successful")
-				cancel()
-				return
-			}
-		case "relay-assisted":
-			// Use relay for hole punching assistance
-			dm.attemptRelayAssistedConnection(ctx, peerID, peerInfo)
-		case "simultaneous-open":
-			// Coordinate simultaneous connection attempts
-			dm.attemptSimultaneousOpen(ctx, peerID, peerInfo)
+	var err error
+	if dm.natTraversal != nil {
+		addrs := make([]string, len(peerInfo.Addrs))
+		for i, addr := range peerInfo.Addrs {
+			addrs[i] = addr.String()
 		}
-
-		cancel()
+		err = dm.natTraversal.AttemptConnection(ctx, peerID, addrs)
+	} else {
+		err = dm.host.Connect(ctx, *peerInfo)
 	}
 
-	dm.logger.WithField("peer_id", peerID.String()).Debug("NAT hole punching failed, will try relay")
-}
-
-// attemptRelayAssistedConnection uses relay to assist hole punching
-func (dm *DiscoveryManager) attemptRelayAssistedConnection(ctx context.Context, peerID peer.ID, peerInfo *peer.AddrInfo) {
-	// Implementation would coordinate with relay servers to assist NAT traversal
-	dm.logger.WithField("peer_id", peerID.String()).Debug("Attempting relay-assisted hole punching")
-	// This is a placeholder - full implementation would involve relay coordination
-}
-
-// attemptSimultaneousOpen coordinates simultaneous connection attempts
-func (dm *DiscoveryManager) attemptSimultaneousOpen(ctx context.Context, peerID peer.ID, peerInfo *peer.AddrInfo) {
-	// Implementation would coordinate simultaneous outbound connections
-	dm.logger.WithField("peer_id", peerID.String()).Debug("Attempting simultaneous open hole punching")
-	// This is a placeholder - full implementation would involve timing coordination
+	if err != nil {
+		dm.logger.WithError(err).WithField("peer_id", peerID.String()).Debug("NAT hole punching failed")
+		return
+	}
+	dm.logger.WithField("peer_id", peerID.String()).Info("NAT hole punching successful")
 }
 
 // startRelayServerManagement starts relay server management (Phase 6)
@@ -844,18 +885,15 @@ func (dm *DiscoveryManager) startRelayServerManagement() {
 	}
 }
 
-// manageRelayServers manages relay server connections and creation
+// manageRelayServers connects to relays when many peers are unreachable.
+// AutoRelay reserves slots on them; serving as a relay is configured with
+// the node's relay service and run by libp2p while we are publicly reachable.
 func (dm *DiscoveryManager) manageRelayServers() {
-	// Check if we need relay services
-	needsRelay := dm.assessRelayNeed()
-
-	if needsRelay {
+	if dm.assessRelayNeed() {
 		dm.logger.Info("Relay services needed - establishing relay connections")
 
-		// Try to connect to existing relay servers
 		if !dm.connectToExistingRelays() {
-			// If no existing relays available, consider becoming a relay
-			dm.considerBecomingRelay()
+			dm.logger.Debug("No relay server reachable")
 		}
 	}
 }
@@ -907,59 +945,3 @@ func (dm *DiscoveryManager) connectToExistingRelays() bool {
 
 	return relayConnected
 }
-
-// considerBecomingRelay considers whether this node should become a relay
-func (dm *DiscoveryManager) considerBecomingRelay() {
-	// Check if we have good connectivity and resources to become a relay
-	canBeRelay := dm.assessRelayCapability()
-
-	if canBeRelay {
-		dm.logger.Info("Node has good connectivity - considering becoming relay server")
-		dm.enableRelayService()
-	} else {
-		dm.logger.Debug("Node not suitable for relay service")
-	}
-}
-
-// assessRelayCapability determines if this node can serve as a relay
-func (dm *DiscoveryManager) assessRelayCapability() bool {
-	// Check if we have public IP and good connectivity
-	// This is a simplified check - full implementation would be more sophisticated
-
-	// Check if we have any public addresses
-	hasPublicAddr := false
-	for _, addr := range dm.host.Addrs() {
-		addrStr := addr.String()
-		if !strings.Contains(addrStr, "127.0.0.1") &&
-			!strings.Contains(addrStr, "192.168.") &&
-			!strings.Contains(addrStr, "10.") &&
-			!strings.Contains(addrStr, "172.") {
-			hasPublicAddr = true
-			break
-		}
-	}
-
-	// Check if we have good connectivity (connected to multiple peers)
-	connectedPeers := len(dm.host.Network().Peers())
-
-	canBeRelay := hasPublicAddr && connectedPeers >= 3
-
-	dm.logger.WithFields(logrus.Fields{
-		"has_public_addr": hasPublicAddr,
-		"connected_peers": connectedPeers,
-		"can_be_relay":    canBeRelay,
-	}).Debug("Assessed relay capability")
-
-	return canBeRelay
-}
-
-// enableRelayService enables relay service on this node
-func (dm *DiscoveryManager) enableRelayService() {
-	dm.logger.Info("Enabling relay service - this node will help other peers connect")
-
-	// Enable libp2p relay service
-	// This would involve configuring the host to accept and forward relay connections
-	// Implementation depends on libp2p relay configuration
-
-	dm.logger.Info("Relay service enabled - node is now helping with NAT traversal")
-}
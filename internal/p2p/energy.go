@@ -31,7 +31,8 @@ type EnergyManager struct {
 
 	// Deep sleep mode
 	deepSleepMode      bool
-	deepSleepThreshold float64 // Battery level threshold for deep sleep
+	deepSleepThreshold float64           // Battery level threshold for deep sleep
+	onDeepSleep        func(active bool) // Called when deep sleep starts or ends
 
 	// Performance targets from README
 	targetIdleMemoryMB   int
@@ -80,6 +81,10 @@ func NewEnergyManager(ctx context.Context, logger *logrus.Logger) *EnergyManager
 func (em *EnergyManager) Start() error {
 	em.logger.Info("Starting energy optimization manager...")
 
+	// Populate the profile right away instead of after the first tick
+	em.measureEnergyUsage()
+	em.optimizePollingIntervals()
+
 	// Start monitoring goroutine
 	go em.monitorEnergyUsage()
 
@@ -116,19 +121,35 @@ func (em *EnergyManager) GetEnergyProfile() *EnergyProfile {
 // SetBatteryLevel updates the battery level (0.0 - 1.0)
 func (em *EnergyManager) SetBatteryLevel(level float64) {
 	em.mu.Lock()
-	defer em.mu.Unlock()
 
 	em.batteryLevel = level
 	em.energyProfile.BatteryLevel = level
 
 	// Check if we should enter deep sleep mode
+	changed := false
 	if level <= em.deepSleepThreshold && !em.deepSleepMode {
 		em.enterDeepSleepMode()
+		changed = true
 	} else if level > em.deepSleepThreshold && em.deepSleepMode {
 		em.exitDeepSleepMode()
+		changed = true
+	}
+	active, onDeepSleep := em.deepSleepMode, em.onDeepSleep
+	em.mu.Unlock()
+
+	// Notify outside the lock so the handler can query the manager
+	if changed && onDeepSleep != nil {
+		onDeepSleep(active)
 	}
 }
 
+// SetDeepSleepHandler sets a function called when deep sleep mode starts or ends
+func (em *EnergyManager) SetDeepSleepHandler(handler func(active bool)) {
+	em.mu.Lock()
+	defer em.mu.Unlock()
+	em.onDeepSleep = handler
+}
+
 // monitorEnergyUsage continuously monitors energy usage
 func (em *EnergyManager) monitorEnergyUsage() {
 	ticker := time.NewTicker(10 * time.Second) // Monitor every 10 seconds
@@ -208,7 +229,12 @@ func (em *EnergyManager) adaptivePollingOptimization() {
 func (em *EnergyManager) optimizePollingIntervals() {
 	em.mu.Lock()
 	defer em.mu.Unlock()
+	em.applyPollingIntervals()
+}
 
+// applyPollingIntervals sets polling intervals from the battery level. The
+// caller holds em.mu.
+func (em *EnergyManager) applyPollingIntervals() {
 	// Adjust intervals based on battery level
 	batteryFactor := em.batteryLevel
 
@@ -261,7 +287,7 @@ func (em *EnergyManager) exitDeepSleepMode() {
 	em.energyProfile.DeepSleepActive = false
 
 	// Restore normal polling intervals
-	em.optimizePollingIntervals()
+	em.applyPollingIntervals()
 
 	em.logger.WithField("battery_level", em.batteryLevel).Info("Exiting deep sleep mode")
 }
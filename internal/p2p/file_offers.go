@@ -0,0 +1,259 @@
+package p2p
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Xelvra/peerchat/internal/message"
+	"github.com/Xelvra/peerchat/internal/user"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/sirupsen/logrus"
+)
+
+// File offer decisions are exchanged with `peerchat-cli transfers` through the
+// data directory: the node lists pending offers in file_offers.json and picks up
+// <peer>_<id>.accept or <peer>_<id>.reject files dropped into file_decisions/.
+// An accept file may list the paths to receive from a multi-file offer, one per line.
+const (
+	fileOffersFile        = "file_offers.json"
+	fileDecisionsDir      = "file_decisions"
+	fileDecisionAccept    = ".accept"
+	fileDecisionReject    = ".reject"
+	fileDecisionsInterval = time.Second
+)
+
+// nodeDataDir returns the node's data directory, falling back to ~/.xelvra
+func (n *PeerChatNode) nodeDataDir() string {
+	if n.config != nil && n.config.DataDir != "" {
+		return n.config.DataDir
+	}
+	return defaultDataDir()
+}
+
+// PendingFileOffers returns incoming files waiting to be accepted or rejected
+func (n *PeerChatNode) PendingFileOffers() []message.FileOffer {
+	return n.messageManager.FileTransfers().PendingOffers()
+}
+
+// AcceptFileOffer accepts a pending incoming file, or the given paths of a
+// multi-file offer. An empty peer picks the only offer with the ID.
+func (n *PeerChatNode) AcceptFileOffer(from peer.ID, id string, paths ...string) error {
+	return n.messageManager.FileTransfers().AcceptOffer(from, id, paths...)
+}
+
+// RejectFileOffer rejects a pending incoming file
+func (n *PeerChatNode) RejectFileOffer(from peer.ID, id string) error {
+	return n.messageManager.FileTransfers().RejectOffer(from, id)
+}
+
+// announceFileOffer tells the user how to decide on a new offer
+func (n *PeerChatNode) announceFileOffer(offer message.FileOffer) {
+	n.logger.WithFields(logrus.Fields{
+		"transfer_id": offer.ID,
+		"peer":        offer.PeerID.String(),
+		"file_name":   offer.Metadata.Name,
+		"file_size":   offer.Metadata.Size,
+		"files":       len(offer.Files),
+	}).Info("Incoming file offer, run 'peerchat-cli transfers accept|reject <id>'")
+}
+
+// writeFileOffers publishes the pending offers for `peerchat-cli transfers`
+func (n *PeerChatNode) writeFileOffers() {
+	path := filepath.Join(n.nodeDataDir(), fileOffersFile)
+
+	data, err := json.MarshalIndent(n.PendingFileOffers(), "", "  ")
+	if err != nil {
+		n.logger.WithError(err).Warn("Failed to encode file offers")
+		return
+	}
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		n.logger.WithError(err).Warn("Failed to write file offers")
+	}
+}
+
+// watchFileDecisions applies decisions dropped by `peerchat-cli transfers`
+func (n *PeerChatNode) watchFileDecisions() {
+	dir := filepath.Join(n.nodeDataDir(), fileDecisionsDir)
+	ticker := time.NewTicker(fileDecisionsInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-n.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			continue // Nothing decided yet
+		}
+
+		for _, entry := range entries {
+			name := entry.Name()
+			var decide func(peer.ID, string) error
+			var base string
+			switch {
+			case strings.HasSuffix(name, fileDecisionAccept):
+				base = strings.TrimSuffix(name, fileDecisionAccept)
+				paths, err := readDecisionPaths(filepath.Join(dir, name))
+				if err != nil {
+					n.logger.WithError(err).Warn("Failed to read file decision")
+				}
+				decide = func(from peer.ID, id string) error { return n.AcceptFileOffer(from, id, paths...) }
+			case strings.HasSuffix(name, fileDecisionReject):
+				base, decide = strings.TrimSuffix(name, fileDecisionReject), n.RejectFileOffer
+			default:
+				continue
+			}
+
+			from, id := parseDecisionName(base)
+			if err := decide(from, id); err != nil {
+				n.logger.WithError(err).WithField("transfer_id", id).Warn("Failed to apply file decision")
+			}
+			if err := os.Remove(filepath.Join(dir, name)); err != nil {
+				n.logger.WithError(err).Warn("Failed to remove file decision")
+			}
+		}
+	}
+}
+
+// parseDecisionName splits a decision file name into the offering peer and
+// the transfer ID. Peer IDs never contain an underscore, names without a peer
+// apply to the only offer with the ID.
+func parseDecisionName(name string) (peer.ID, string) {
+	prefix, id, found := strings.Cut(name, "_")
+	if !found {
+		return "", name
+	}
+	from, err := peer.Decode(prefix)
+	if err != nil {
+		return "", name
+	}
+	return from, id
+}
+
+// readDecisionPaths reads the paths listed in an accept decision
+func readDecisionPaths(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var paths []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			paths = append(paths, line)
+		}
+	}
+	return paths, nil
+}
+
+// DecryptDownload decrypts a file received with EncryptDownloads into a new
+// file, using the identity in the default data directory
+func DecryptDownload(path, output string) error {
+	identity, err := user.LoadMessengerID(filepath.Join(defaultDataDir(), user.IdentityFileName))
+	if err != nil {
+		return fmt.Errorf("failed to load identity: %w", err)
+	}
+	return message.DecryptFile(path, output, identity.PrivateKey)
+}
+
+// removeFileOffers clears the published offers when the node stops
+func (n *PeerChatNode) removeFileOffers() {
+	path := filepath.Join(n.nodeDataDir(), fileOffersFile)
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		n.logger.WithError(err).Warn("Failed to remove file offers")
+	}
+}
+
+// ReadPendingFileOffers returns the offers the running node is waiting on
+func ReadPendingFileOffers() ([]message.FileOffer, error) {
+	data, err := os.ReadFile(filepath.Join(defaultDataDir(), fileOffersFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var offers []message.FileOffer
+	if err := json.Unmarshal(data, &offers); err != nil {
+		return nil, fmt.Errorf("failed to parse file offers: %w", err)
+	}
+	return offers, nil
+}
+
+// DecideFileOffer asks the running node to accept or reject a pending offer.
+// The peer is only needed when several peers offer files with the same ID.
+// Paths pick the files to accept from a multi-file offer.
+func DecideFileOffer(from string, id string, accept bool, paths ...string) error {
+	if id == "" || id != filepath.Base(id) || strings.HasPrefix(id, ".") {
+		return fmt.Errorf("invalid transfer ID: %s", id)
+	}
+	var fromID peer.ID
+	if from != "" {
+		var err error
+		if fromID, err = peer.Decode(from); err != nil {
+			return fmt.Errorf("invalid peer ID: %w", err)
+		}
+	}
+
+	offers, err := ReadPendingFileOffers()
+	if err != nil {
+		return err
+	}
+	var pending *message.FileOffer
+	for i := range offers {
+		if offers[i].ID != id || (fromID != "" && offers[i].PeerID != fromID) {
+			continue
+		}
+		if pending != nil {
+			return message.ErrAmbiguousOffer
+		}
+		pending = &offers[i]
+	}
+	if pending == nil {
+		return message.ErrUnknownOffer
+	}
+	if err := checkOfferPaths(*pending, paths); err != nil {
+		return err
+	}
+
+	dir := filepath.Join(defaultDataDir(), fileDecisionsDir)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("failed to create decisions directory: %w", err)
+	}
+
+	suffix := fileDecisionReject
+	if accept {
+		suffix = fileDecisionAccept
+	}
+	var content []byte
+	if accept && len(paths) > 0 {
+		content = []byte(strings.Join(paths, "\n") + "\n")
+	}
+	name := pending.PeerID.String() + "_" + id + suffix
+	if err := os.WriteFile(filepath.Join(dir, name), content, 0600); err != nil {
+		return fmt.Errorf("failed to write decision: %w", err)
+	}
+	return nil
+}
+
+// checkOfferPaths verifies that every path is a file of a multi-file offer
+func checkOfferPaths(offer message.FileOffer, paths []string) error {
+	offered := make(map[string]bool, len(offer.Files))
+	for _, file := range offer.Files {
+		offered[file.Path] = true
+	}
+	for _, path := range paths {
+		if !offered[path] {
+			return fmt.Errorf("%s is not part of offer %s", path, offer.ID)
+		}
+	}
+	return nil
+}
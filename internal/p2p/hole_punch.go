@@ -0,0 +1,343 @@
+package p2p
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/p2p/protocol/circuitv2/proto"
+	"github.com/libp2p/go-libp2p/p2p/protocol/holepunch"
+	multiaddr "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
+	"github.com/sirupsen/logrus"
+)
+
+// holePunchHistorySize caps the finished attempts kept for status reporting
+const holePunchHistorySize = 100
+
+// NewHolePuncher creates a hole puncher. Pass it to libp2p.EnableHolePunching
+// with holepunch.WithTracer to record DCUtR upgrades in its history.
+func NewHolePuncher(logger *logrus.Logger) *HolePuncher {
+	return &HolePuncher{
+		strategies: []HolePunchStrategy{
+			StrategyDirect,
+			StrategySimultaneousOpen,
+			StrategyRelayAssisted,
+		},
+		attempts: make(map[peer.ID]*HolePunchAttempt),
+		active:   make(map[peer.ID]*HolePunchAttempt),
+		logger:   logger,
+	}
+}
+
+// String returns the strategy name used in logs
+func (s HolePunchStrategy) String() string {
+	switch s {
+	case StrategyDirect:
+		return "direct"
+	case StrategyRelayAssisted:
+		return "relay"
+	case StrategySimultaneousOpen:
+		return "dcutr"
+	default:
+		return "unknown"
+	}
+}
+
+// History returns finished attempts, oldest first
+func (hp *HolePuncher) History() []HolePunchAttempt {
+	hp.mu.RLock()
+	defer hp.mu.RUnlock()
+
+	return append([]HolePunchAttempt(nil), hp.history...)
+}
+
+// Trace records events of libp2p's hole punching service. DCUtR upgrades
+// are recorded as simultaneous open, the direct dial preceding them as direct.
+func (hp *HolePuncher) Trace(evt *holepunch.Event) {
+	now := time.Unix(0, evt.Timestamp)
+
+	hp.mu.Lock()
+	defer hp.mu.Unlock()
+
+	switch e := evt.Evt.(type) {
+	case *holepunch.DirectDialEvt:
+		hp.appendHistory(HolePunchAttempt{
+			PeerID:    evt.Remote,
+			Strategy:  StrategyDirect,
+			StartTime: now.Add(-e.EllapsedTime),
+			EndTime:   now,
+			Attempts:  1,
+			LastError: traceError(e.Error),
+			Success:   e.Success,
+		})
+	case *holepunch.StartHolePunchEvt:
+		hp.active[evt.Remote] = &HolePunchAttempt{
+			PeerID:    evt.Remote,
+			Strategy:  StrategySimultaneousOpen,
+			StartTime: now,
+			RTT:       e.RTT,
+		}
+	case *holepunch.HolePunchAttemptEvt:
+		if attempt := hp.active[evt.Remote]; attempt != nil {
+			attempt.Attempts = e.Attempt
+		}
+	case *holepunch.EndHolePunchEvt:
+		attempt := hp.active[evt.Remote]
+		if attempt == nil {
+			attempt = &HolePunchAttempt{PeerID: evt.Remote, Strategy: StrategySimultaneousOpen, StartTime: now.Add(-e.EllapsedTime)}
+		}
+		delete(hp.active, evt.Remote)
+		attempt.EndTime = now
+		attempt.Success = e.Success
+		attempt.LastError = traceError(e.Error)
+		hp.appendHistory(*attempt)
+
+		hp.logger.WithFields(logrus.Fields{
+			"peer_id": evt.Remote.String(),
+			"success": e.Success,
+			"rtt":     attempt.RTT,
+		}).Debug("DCUtR hole punch finished")
+	case *holepunch.ProtocolErrorEvt:
+		delete(hp.active, evt.Remote)
+		hp.appendHistory(HolePunchAttempt{
+			PeerID:    evt.Remote,
+			Strategy:  StrategySimultaneousOpen,
+			StartTime: now,
+			EndTime:   now,
+			LastError: traceError(e.Error),
+		})
+	}
+}
+
+// strategiesFrom returns the strategies to try, starting with best
+func (hp *HolePuncher) strategiesFrom(best HolePunchStrategy) []HolePunchStrategy {
+	for i, strategy := range hp.strategies {
+		if strategy == best {
+			return hp.strategies[i:]
+		}
+	}
+	return hp.strategies
+}
+
+// begin records the start of an attempt with one strategy
+func (hp *HolePuncher) begin(peerID peer.ID, strategy HolePunchStrategy) *HolePunchAttempt {
+	attempt := &HolePunchAttempt{
+		PeerID:    peerID,
+		Strategy:  strategy,
+		StartTime: time.Now(),
+		Attempts:  1,
+	}
+
+	hp.mu.Lock()
+	hp.attempts[peerID] = attempt
+	hp.mu.Unlock()
+	return attempt
+}
+
+// finish records the outcome of an attempt
+func (hp *HolePuncher) finish(attempt *HolePunchAttempt, err error) {
+	hp.mu.Lock()
+	defer hp.mu.Unlock()
+
+	attempt.EndTime = time.Now()
+	attempt.Success = err == nil
+	attempt.LastError = err
+	hp.appendHistory(*attempt)
+}
+
+// appendHistory adds a finished attempt, dropping the oldest ones. The caller
+// holds the lock.
+func (hp *HolePuncher) appendHistory(attempt HolePunchAttempt) {
+	hp.history = append(hp.history, attempt)
+	if len(hp.history) > holePunchHistorySize {
+		hp.history = append([]HolePunchAttempt(nil), hp.history[len(hp.history)-holePunchHistorySize:]...)
+	}
+}
+
+// successRate returns the share of finished attempts that succeeded
+func (hp *HolePuncher) successRate() float64 {
+	hp.mu.RLock()
+	defer hp.mu.RUnlock()
+
+	if len(hp.history) == 0 {
+		return 0
+	}
+	succeeded := 0
+	for _, attempt := range hp.history {
+		if attempt.Success {
+			succeeded++
+		}
+	}
+	return float64(succeeded) / float64(len(hp.history))
+}
+
+// traceError converts a traced error message back into an error
+func traceError(message string) error {
+	if message == "" {
+		return nil
+	}
+	return errors.New(message)
+}
+
+// parsePeerAddrs parses multiaddrs, dropping a trailing /p2p component, and
+// host:port TCP addresses. Invalid addresses are skipped.
+func parsePeerAddrs(addrs []string) []multiaddr.Multiaddr {
+	var parsed []multiaddr.Multiaddr
+	for _, addr := range addrs {
+		if maddr, err := multiaddr.NewMultiaddr(addr); err == nil {
+			if transport, _ := peer.SplitAddr(maddr); transport != nil {
+				parsed = append(parsed, transport)
+			}
+			continue
+		}
+
+		tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
+		if err != nil {
+			continue
+		}
+		if maddr, err := manet.FromNetAddr(tcpAddr); err == nil {
+			parsed = append(parsed, maddr)
+		}
+	}
+	return parsed
+}
+
+// isRelayAddr reports whether an address goes through a circuit relay
+func isRelayAddr(addr multiaddr.Multiaddr) bool {
+	_, err := addr.ValueForProtocol(multiaddr.P_CIRCUIT)
+	return err == nil
+}
+
+// filterAddrs returns the relayed addresses, or the direct ones
+func filterAddrs(addrs []multiaddr.Multiaddr, relayed bool) []multiaddr.Multiaddr {
+	var filtered []multiaddr.Multiaddr
+	for _, addr := range addrs {
+		if isRelayAddr(addr) == relayed {
+			filtered = append(filtered, addr)
+		}
+	}
+	return filtered
+}
+
+// circuitAddrs returns addresses reaching a peer through a relay
+func circuitAddrs(h host.Host, relay peer.ID) []multiaddr.Multiaddr {
+	suffix, err := multiaddr.NewMultiaddr("/p2p/" + relay.String() + "/p2p-circuit")
+	if err != nil {
+		return nil
+	}
+
+	var circuits []multiaddr.Multiaddr
+	for _, addr := range filterAddrs(h.Peerstore().Addrs(relay), false) {
+		circuits = append(circuits, addr.Encapsulate(suffix))
+	}
+	return circuits
+}
+
+// hasDirectConnection reports whether a connection to the peer bypasses relays
+func hasDirectConnection(h host.Host, peerID peer.ID) bool {
+	for _, conn := range h.Network().ConnsToPeer(peerID) {
+		if !isRelayAddr(conn.RemoteMultiaddr()) {
+			return true
+		}
+	}
+	return false
+}
+
+// relayCandidates collects relays to reserve slots on: bootstrap peers,
+// connected peers offering circuit relay v2, then relays advertised in the
+// DHT. The host, DHT lookup and relay manager are set once they exist.
+type relayCandidates struct {
+	mu        sync.RWMutex
+	host      host.Host
+	static    []peer.AddrInfo
+	find      func(ctx context.Context, limit int) []peer.AddrInfo
+	preferred func(num int) []peer.AddrInfo
+}
+
+// newRelayCandidates creates a candidate source starting with static peers
+func newRelayCandidates(static []peer.AddrInfo) *relayCandidates {
+	return &relayCandidates{static: static}
+}
+
+// setHost lets the source look at connected peers
+func (rc *relayCandidates) setHost(h host.Host) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	rc.host = h
+}
+
+// setFinder lets the source look up advertised relays
+func (rc *relayCandidates) setFinder(find func(ctx context.Context, limit int) []peer.AddrInfo) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	rc.find = find
+}
+
+// setPreferred hands AutoRelay the relays the relay manager selected
+func (rc *relayCandidates) setPreferred(preferred func(num int) []peer.AddrInfo) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	rc.preferred = preferred
+}
+
+// candidates returns up to num relays, looking them up in the DHT when the
+// bootstrap and connected peers fall short. It is a RelaySource.
+func (rc *relayCandidates) candidates(ctx context.Context, num int) []peer.AddrInfo {
+	rc.mu.RLock()
+	h := rc.host
+	find := rc.find
+	candidates := append([]peer.AddrInfo(nil), rc.static...)
+	rc.mu.RUnlock()
+
+	if h != nil {
+		for _, id := range h.Network().Peers() {
+			if supported, err := h.Peerstore().SupportsProtocols(id, proto.ProtoIDv2Hop); err == nil && len(supported) > 0 {
+				candidates = append(candidates, h.Peerstore().PeerInfo(id))
+			}
+		}
+	}
+	if find != nil && len(candidates) < num {
+		candidates = append(candidates, find(ctx, num-len(candidates))...)
+	}
+	if len(candidates) > num {
+		candidates = candidates[:num]
+	}
+	return candidates
+}
+
+// peers implements autorelay.PeerSource, offering the relays the relay
+// manager selected, or all candidates until it has measured them
+func (rc *relayCandidates) peers(ctx context.Context, num int) <-chan peer.AddrInfo {
+	rc.mu.RLock()
+	preferred := rc.preferred
+	rc.mu.RUnlock()
+
+	out := make(chan peer.AddrInfo, num)
+	go func() {
+		defer close(out)
+
+		var relays []peer.AddrInfo
+		if preferred != nil {
+			relays = preferred(num)
+		}
+		if len(relays) == 0 {
+			relays = rc.candidates(ctx, num)
+		}
+		for _, relay := range relays {
+			select {
+			case out <- relay:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out
+}
@@ -0,0 +1,454 @@
+package p2p
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	libp2p "github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/transport"
+	multiaddr "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/ipv6"
+)
+
+// IPv6 link-local discovery sends signed beacons to a link-scoped multicast
+// group on every interface. The sender's address is only meaningful on the
+// interface the beacon arrived on, so receivers combine it with the zone and
+// the announced IPv6 ports into /ip6zone/<iface>/ip6/fe80::.../tcp/<port>
+// addresses. This lets peers on IPv6-only LANs without mDNS find each other.
+const (
+	IPv6DiscoveryGroup = "ff02::5856:1"
+	IPv6DiscoveryPort  = 42425
+
+	ipv6DiscoveryInterval = 15 * time.Second
+	linkLocalDialTimeout  = 10 * time.Second
+)
+
+// ErrNoLinkLocalAddrs is returned when none of a peer's addresses can be
+// reached over the link-local transport
+var ErrNoLinkLocalAddrs = errors.New("no dialable link-local addresses")
+
+// LinkLocalAddrs turns the IPv6 listen addresses announced in a beacon into
+// scoped addresses of the link-local sender. Only plain TCP addresses are
+// returned since those are the ones ConnectLinkLocal can dial.
+func LinkLocalAddrs(source *net.UDPAddr, announced []multiaddr.Multiaddr) []multiaddr.Multiaddr {
+	if source == nil || source.IP.To4() != nil || !source.IP.IsLinkLocalUnicast() || source.Zone == "" {
+		return nil
+	}
+	prefix, err := multiaddr.NewMultiaddr(fmt.Sprintf("/ip6zone/%s/ip6/%s", source.Zone, source.IP))
+	if err != nil {
+		return nil
+	}
+
+	var addrs []multiaddr.Multiaddr
+	seen := make(map[string]bool)
+	for _, addr := range announced {
+		// Keep what follows the IPv6 address, which must be /tcp/<port>
+		var rest multiaddr.Multiaddr
+		for i, c := range addr {
+			if c.Protocol().Code == multiaddr.P_IP6 {
+				rest = addr[i+1:]
+				break
+			}
+		}
+		if len(rest) != 1 || rest[0].Protocol().Code != multiaddr.P_TCP || seen[rest.String()] {
+			continue
+		}
+		seen[rest.String()] = true
+		addrs = append(addrs, prefix.Encapsulate(rest))
+	}
+	return addrs
+}
+
+// linkLocalTransport hands TCP connections dialed by ConnectLinkLocal to the
+// swarm, which refuses link-local addresses. Each connection is registered
+// under an in-process /memory/<n> address that only this transport serves:
+// nothing listens on it, so no other process can take the connection, and the
+// upgraded connection reports the real link-local addresses.
+type linkLocalTransport struct {
+	upgrader transport.Upgrader
+	rcmgr    network.ResourceManager
+
+	mu    sync.Mutex
+	next  uint64
+	conns map[uint64]manet.Conn
+}
+
+var _ transport.Transport = (*linkLocalTransport)(nil)
+
+// LinkLocalTransport returns the libp2p option installing the transport
+// ConnectLinkLocal needs. Like any libp2p.Transport option it replaces the
+// default transports, so the others must be configured too.
+func LinkLocalTransport() libp2p.Option {
+	return libp2p.Transport(newLinkLocalTransport)
+}
+
+// newLinkLocalTransport creates the transport for a host
+func newLinkLocalTransport(upgrader transport.Upgrader, rcmgr network.ResourceManager) *linkLocalTransport {
+	return &linkLocalTransport{
+		upgrader: upgrader,
+		rcmgr:    rcmgr,
+		conns:    make(map[uint64]manet.Conn),
+	}
+}
+
+// register keeps a dialed connection until the swarm dials its address
+func (t *linkLocalTransport) register(conn manet.Conn) multiaddr.Multiaddr {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.next++
+	t.conns[t.next] = conn
+	return multiaddr.StringCast(fmt.Sprintf("/memory/%d", t.next))
+}
+
+// take removes the connection registered under an address
+func (t *linkLocalTransport) take(addr multiaddr.Multiaddr) (manet.Conn, bool) {
+	value, err := addr.ValueForProtocol(multiaddr.P_MEMORY)
+	if err != nil {
+		return nil, false
+	}
+	id, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return nil, false
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	conn, ok := t.conns[id]
+	delete(t.conns, id)
+	return conn, ok
+}
+
+// Dial implements transport.Transport by upgrading the registered connection
+func (t *linkLocalTransport) Dial(ctx context.Context, raddr multiaddr.Multiaddr, p peer.ID) (transport.CapableConn, error) {
+	conn, ok := t.take(raddr)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrNoLinkLocalAddrs, raddr)
+	}
+	connScope, err := t.rcmgr.OpenConnection(network.DirOutbound, true, conn.RemoteMultiaddr())
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	if err := connScope.SetPeer(p); err != nil {
+		connScope.Done()
+		_ = conn.Close()
+		return nil, err
+	}
+	upgraded, err := t.upgrader.Upgrade(ctx, t, conn, network.DirOutbound, p, connScope)
+	if err != nil {
+		connScope.Done()
+		return nil, err
+	}
+	return upgraded, nil
+}
+
+// CanDial implements transport.Transport
+func (t *linkLocalTransport) CanDial(addr multiaddr.Multiaddr) bool {
+	return len(addr) == 1 && addr[0].Protocol().Code == multiaddr.P_MEMORY
+}
+
+// Listen implements transport.Transport; link-local connections are only dialed
+func (t *linkLocalTransport) Listen(laddr multiaddr.Multiaddr) (transport.Listener, error) {
+	return nil, fmt.Errorf("link-local transport cannot listen on %s", laddr)
+}
+
+// Protocols implements transport.Transport
+func (t *linkLocalTransport) Protocols() []int {
+	return []int{multiaddr.P_MEMORY}
+}
+
+// Proxy implements transport.Transport
+func (t *linkLocalTransport) Proxy() bool {
+	return false
+}
+
+// ConnectLinkLocal connects to a peer over scoped link-local TCP addresses.
+// libp2p does not dial link-local addresses, so the TCP connection is made
+// here and handed to the host's link-local transport; the peer is still
+// authenticated by the security handshake.
+func ConnectLinkLocal(ctx context.Context, h host.Host, id peer.ID, addrs []multiaddr.Multiaddr) error {
+	var lastErr error = ErrNoLinkLocalAddrs
+	for _, addr := range addrs {
+		if err := connectLinkLocalAddr(ctx, h, id, addr); err != nil {
+			lastErr = err
+			continue
+		}
+		return nil
+	}
+	return lastErr
+}
+
+// connectLinkLocalAddr connects over one scoped address
+func connectLinkLocalAddr(ctx context.Context, h host.Host, id peer.ID, addr multiaddr.Multiaddr) error {
+	// Only the part up to and including /tcp/<port> is dialed; connections
+	// are upgraded as plain TCP ones
+	var target, rest multiaddr.Multiaddr
+	for i, c := range addr {
+		if c.Protocol().Code == multiaddr.P_TCP {
+			target, rest = addr[:i+1], addr[i+1:]
+			break
+		}
+	}
+	if target == nil || len(rest) > 0 || !manet.IsIP6LinkLocal(target) {
+		return fmt.Errorf("%w: %s", ErrNoLinkLocalAddrs, addr)
+	}
+
+	var tpt *linkLocalTransport
+	if tn, ok := h.Network().(interface {
+		TransportForDialing(multiaddr.Multiaddr) transport.Transport
+	}); ok {
+		tpt, _ = tn.TransportForDialing(multiaddr.StringCast("/memory/0")).(*linkLocalTransport)
+	}
+	if tpt == nil {
+		return fmt.Errorf("%w: the host has no link-local transport", ErrNoLinkLocalAddrs)
+	}
+
+	var dialer manet.Dialer
+	conn, err := dialer.DialContext(ctx, target)
+	if err != nil {
+		return fmt.Errorf("failed to dial %s: %w", addr, err)
+	}
+
+	local := tpt.register(conn)
+	err = h.Connect(ctx, peer.AddrInfo{ID: id, Addrs: []multiaddr.Multiaddr{local}})
+	// The in-process address only works once, so it is not kept for later
+	// dials nor saved by the address book
+	h.Peerstore().SetAddr(id, local, 0)
+	if conn, ok := tpt.take(local); ok {
+		_ = conn.Close()
+	}
+	if err != nil {
+		return fmt.Errorf("failed to connect over %s: %w", addr, err)
+	}
+	return nil
+}
+
+// startIPv6LinkLocalDiscovery joins the discovery group on every interface,
+// announces this peer and connects to peers announcing themselves (Phase 1)
+func (dm *DiscoveryManager) startIPv6LinkLocalDiscovery() {
+	dm.logger.Info("Starting IPv6 link-local discovery (Phase 1 - highest priority)...")
+
+	conn, err := net.ListenUDP("udp6", &net.UDPAddr{IP: net.IPv6unspecified, Port: IPv6DiscoveryPort})
+	if err != nil {
+		dm.logger.WithError(err).Warn("Failed to listen for IPv6 link-local discovery")
+		return
+	}
+	defer func() {
+		if err := conn.Close(); err != nil {
+			dm.logger.WithError(err).Debug("Failed to close IPv6 discovery connection")
+		}
+	}()
+
+	packetConn := ipv6.NewPacketConn(conn)
+	joined := make(map[int]bool)
+	dm.joinIPv6Group(packetConn, joined)
+
+	dm.mu.Lock()
+	dm.status.IPv6LinkLocal = true
+	dm.mu.Unlock()
+
+	go dm.listenIPv6LinkLocal(conn)
+
+	dm.discoverIPv6LinkLocal(conn)
+	ticker := time.NewTicker(ipv6DiscoveryInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-dm.ctx.Done():
+			return
+		case <-ticker.C:
+			// Interfaces that came up since the last round join the group too
+			dm.joinIPv6Group(packetConn, joined)
+			dm.discoverIPv6LinkLocal(conn)
+		}
+	}
+}
+
+// linkLocalInterfaces returns the up, multicast-capable interfaces that have
+// an IPv6 link-local address
+func linkLocalInterfaces() []net.Interface {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+
+	var linkLocal []net.Interface
+	for _, iface := range interfaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 || iface.Flags&net.FlagMulticast == 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.To4() == nil && ipnet.IP.IsLinkLocalUnicast() {
+				linkLocal = append(linkLocal, iface)
+				break
+			}
+		}
+	}
+	return linkLocal
+}
+
+// joinIPv6Group joins the discovery group on interfaces not joined yet
+func (dm *DiscoveryManager) joinIPv6Group(conn *ipv6.PacketConn, joined map[int]bool) {
+	group := &net.UDPAddr{IP: net.ParseIP(IPv6DiscoveryGroup)}
+	for _, iface := range linkLocalInterfaces() {
+		if joined[iface.Index] {
+			continue
+		}
+		if err := conn.JoinGroup(&iface, group); err != nil {
+			dm.logger.WithError(err).WithField("interface", iface.Name).Debug("Failed to join IPv6 discovery group")
+			continue
+		}
+		joined[iface.Index] = true
+		dm.logger.WithField("interface", iface.Name).Debug("Joined IPv6 link-local discovery group")
+	}
+}
+
+// listenIPv6LinkLocal receives beacons sent to the discovery group
+func (dm *DiscoveryManager) listenIPv6LinkLocal(conn *net.UDPConn) {
+	buffer := make([]byte, beaconMaxSize+1)
+	for {
+		select {
+		case <-dm.ctx.Done():
+			return
+		default:
+			if err := conn.SetReadDeadline(time.Now().Add(1 * time.Second)); err != nil {
+				dm.logger.WithError(err).Debug("Failed to set IPv6 discovery read deadline")
+				continue
+			}
+			n, remoteAddr, err := conn.ReadFromUDP(buffer)
+			if err != nil {
+				if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+					continue
+				}
+				if dm.ctx.Err() != nil {
+					return
+				}
+				dm.logger.WithError(err).Debug("IPv6 discovery read error")
+				continue
+			}
+
+			dm.handleIPv6Beacon(buffer[:n], remoteAddr)
+		}
+	}
+}
+
+// discoverIPv6LinkLocal sends a beacon with this peer's IPv6 listen
+// addresses to the discovery group on every link-local interface
+func (dm *DiscoveryManager) discoverIPv6LinkLocal(conn *net.UDPConn) {
+	key := dm.host.Peerstore().PrivKey(dm.host.ID())
+	if key == nil {
+		return
+	}
+
+	// The host hides link-local addresses, so the interface addresses are
+	// announced; receivers only take the ports from them
+	listenAddrs, err := dm.host.Network().InterfaceListenAddresses()
+	if err != nil {
+		dm.logger.WithError(err).Debug("Failed to get interface listen addresses")
+		return
+	}
+	var addrs []multiaddr.Multiaddr
+	for _, addr := range listenAddrs {
+		if _, err := addr.ValueForProtocol(multiaddr.P_IP6); err == nil {
+			addrs = append(addrs, addr)
+		}
+	}
+	if len(addrs) == 0 {
+		return
+	}
+
+	beacon, err := SignBeacon(key, addrs, time.Now())
+	if err != nil {
+		dm.logger.WithError(err).Debug("Failed to create IPv6 discovery beacon")
+		return
+	}
+
+	sent := 0
+	for _, iface := range linkLocalInterfaces() {
+		target := &net.UDPAddr{IP: net.ParseIP(IPv6DiscoveryGroup), Port: IPv6DiscoveryPort, Zone: iface.Name}
+		if _, err := conn.WriteToUDP(beacon, target); err != nil {
+			dm.logger.WithError(err).WithField("interface", iface.Name).Debug("Failed to send IPv6 discovery beacon")
+			continue
+		}
+		sent++
+	}
+
+	if sent > 0 {
+		dm.logger.WithField("interfaces", sent).Debug("Sent IPv6 link-local discovery beacon")
+	}
+}
+
+// handleIPv6Beacon verifies a link-local beacon and connects to its sender
+// over scoped addresses
+func (dm *DiscoveryManager) handleIPv6Beacon(data []byte, remoteAddr *net.UDPAddr) {
+	if !dm.linkLocal.allow(remoteAddr.IP) {
+		return
+	}
+
+	beacon, err := VerifyBeacon(data, time.Now())
+	if err != nil {
+		dm.logger.WithError(err).WithField("remote_addr", remoteAddr.String()).Debug("Ignoring invalid IPv6 discovery beacon")
+		return
+	}
+	if beacon.PeerID == dm.host.ID() || !dm.linkLocal.fresh(beacon) {
+		return
+	}
+
+	addrs := LinkLocalAddrs(remoteAddr, beacon.Addrs)
+	if len(addrs) == 0 {
+		return
+	}
+
+	dm.mu.Lock()
+	peerInfo, known := dm.discoveredPeers[beacon.PeerID]
+	if !known {
+		peerInfo = &peer.AddrInfo{ID: beacon.PeerID}
+		dm.discoveredPeers[beacon.PeerID] = peerInfo
+	}
+	for _, addr := range addrs {
+		if !multiaddr.Contains(peerInfo.Addrs, addr) {
+			peerInfo.Addrs = append(peerInfo.Addrs, addr)
+		}
+	}
+	dm.status.LastDiscovery = time.Now()
+	dm.mu.Unlock()
+
+	logger := dm.logger.WithFields(logrus.Fields{
+		"peer_id": beacon.PeerID.String(),
+		"addrs":   addrs,
+	})
+	if !known {
+		logger.Info("Discovered peer via IPv6 link-local multicast")
+	}
+
+	if dm.host.Network().Connectedness(beacon.PeerID) == network.Connected {
+		return
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(dm.ctx, linkLocalDialTimeout)
+		defer cancel()
+
+		if err := ConnectLinkLocal(ctx, dm.host, beacon.PeerID, addrs); err != nil {
+			logger.WithError(err).Debug("Failed to connect to link-local peer")
+			return
+		}
+		logger.Info("Successfully connected to link-local peer")
+	}()
+}
@@ -7,8 +7,12 @@ import (
 	"sync"
 	"time"
 
+	"github.com/libp2p/go-libp2p/core/event"
 	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/metrics"
+	"github.com/libp2p/go-libp2p/core/network"
 	"github.com/libp2p/go-libp2p/core/peer"
+	multiaddr "github.com/multiformats/go-multiaddr"
 	"github.com/sirupsen/logrus"
 )
 
@@ -42,23 +46,38 @@ type NATDetector struct {
 	logger          *logrus.Logger
 }
 
-// HolePuncher implements multi-strategy hole punching
+// HolePuncher implements multi-strategy hole punching. It also traces
+// libp2p's DCUtR service, so upgrades started by either side end up in the
+// same history.
 type HolePuncher struct {
 	mu         sync.RWMutex
 	strategies []HolePunchStrategy
-	attempts   map[peer.ID]*HolePunchAttempt
+	attempts   map[peer.ID]*HolePunchAttempt // Latest attempt per peer
+	active     map[peer.ID]*HolePunchAttempt // DCUtR upgrades in progress
+	history    []HolePunchAttempt            // Finished attempts, oldest first
 	logger     *logrus.Logger
 }
 
-// RelayManager manages relay server selection and connections
+// RelayManager measures relay candidates and ranks them for AutoRelay, which
+// holds the circuit relay v2 reservations and advertises them; the manager
+// follows which relays those are
 type RelayManager struct {
 	mu            sync.RWMutex
-	relayServers  map[peer.ID]*RelayServer
-	activeRelays  []peer.ID
+	host          host.Host
+	relayServers  map[peer.ID]*RelayServer // Candidates and their measured health
+	activeRelays  []peer.ID                // Relays AutoRelay holds a reservation with
 	relaySelector *RelaySelector
+	numRelays     int
+	source        RelaySource
+	bandwidth     metrics.Reporter
+	trigger       chan struct{} // Wakes relay management to find replacements
+	notify        *network.NotifyBundle
 	logger        *logrus.Logger
 }
 
+// RelaySource returns up to num relays worth considering
+type RelaySource func(ctx context.Context, num int) []peer.AddrInfo
+
 // STUNClient handles STUN/TURN operations
 type STUNClient struct {
 	mu          sync.RWMutex
@@ -68,6 +87,21 @@ type STUNClient struct {
 	logger      *logrus.Logger
 }
 
+const (
+	// natDetectionTimeout bounds one round of NAT detection over all servers
+	natDetectionTimeout = 30 * time.Second
+
+	directDialTimeout = 10 * time.Second // Direct strategy
+	dcutrTimeout      = 30 * time.Second // Waiting for DCUtR to upgrade a relayed connection
+	dcutrPollInterval = 100 * time.Millisecond
+
+	defaultActiveRelays     = 2 // Reservations kept unless configured otherwise
+	maxRelayCandidates      = 8 // Candidates measured per round
+	relayManagementInterval = time.Minute
+	relayProbeTimeout       = 10 * time.Second
+	maxRelayProbeFailures   = 3 // Failed probes in a row before a candidate is dropped
+)
+
 // Types and enums
 type NATType int
 
@@ -99,10 +133,9 @@ const (
 type HolePunchStrategy int
 
 const (
-	StrategyDirect HolePunchStrategy = iota
-	StrategyRelayAssisted
-	StrategySimultaneousOpen
-	StrategyPortPrediction
+	StrategyDirect           HolePunchStrategy = iota // Dial the peer's own addresses
+	StrategyRelayAssisted                             // Settle for a circuit relay v2 connection
+	StrategySimultaneousOpen                          // Upgrade a relayed connection with DCUtR
 )
 
 // Data structures
@@ -112,7 +145,8 @@ type NATStatus struct {
 	ExternalPort    int
 	MappingBehavior MappingBehavior
 	FilterBehavior  FilterBehavior
-	TraversalRate   float64
+	Reachability    network.Reachability // As determined by AutoNAT
+	TraversalRate   float64              // Share of recorded hole punch attempts that succeeded
 	ActiveRelays    int
 }
 
@@ -120,42 +154,46 @@ type HolePunchAttempt struct {
 	PeerID    peer.ID
 	Strategy  HolePunchStrategy
 	StartTime time.Time
+	EndTime   time.Time // Zero while the attempt is in progress
 	Attempts  int
 	LastError error
 	Success   bool
+	RTT       time.Duration // Relayed round trip measured by DCUtR
 }
 
+// RelayServer is a relay candidate and its measured health
 type RelayServer struct {
-	PeerID      peer.ID
-	Address     string
-	Latency     time.Duration
-	Reliability float64
-	Capacity    int
-	CurrentLoad int
+	PeerID       peer.ID       `json:"peer_id"`
+	Address      string        `json:"address,omitempty"`
+	Reachable    bool          `json:"reachable"`    // The last probe got a ping answer
+	Latency      time.Duration `json:"latency"`      // Round trip of the last ping
+	Reliability  float64       `json:"reliability"`  // Share of probes answered
+	Probes       int           `json:"probes"`       // Probes made
+	Reservations int           `json:"reservations"` // Reservations AutoRelay gained
+	Lost         int           `json:"lost"`         // Reservations lost before we let them go
+	Throughput   float64       `json:"throughput"`   // Bytes per second exchanged with the relay
+	Active       bool          `json:"active"`       // AutoRelay holds a reservation
+	LastProbe    time.Time     `json:"last_probe"`
+
+	answered int
+	failures int // Probes failed in a row
 }
 
 type RelaySelector struct {
 	mu              sync.RWMutex
 	selectionPolicy RelaySelectionPolicy
-	metrics         map[peer.ID]*RelayMetrics
+	next            int // Round-robin position
 }
 
 type RelaySelectionPolicy int
 
 const (
-	PolicyLowestLatency RelaySelectionPolicy = iota
-	PolicyHighestReliability
-	PolicyLowestLoad
-	PolicyBalanced
+	PolicyLowestLatency      RelaySelectionPolicy = iota // Lowest ping round trip
+	PolicyHighestReliability                             // Most probes answered and reservations kept
+	PolicyRandom                                         // Spread reservations and connections at random
+	PolicyRoundRobin                                     // Take turns
 )
 
-type RelayMetrics struct {
-	Latency     time.Duration
-	Reliability float64
-	Load        float64
-	LastUsed    time.Time
-}
-
 type TURNCredentials struct {
 	Username string
 	Password string
@@ -177,27 +215,11 @@ func NewAdvancedNATTraversal(h host.Host, logger *logrus.Logger) *AdvancedNATTra
 			filterBehavior:  FilterEndpointIndependent,
 			logger:          logger,
 		},
-		holePuncher: &HolePuncher{
-			strategies: []HolePunchStrategy{
-				StrategyDirect,
-				StrategyRelayAssisted,
-				StrategySimultaneousOpen,
-				StrategyPortPrediction,
-			},
-			attempts: make(map[peer.ID]*HolePunchAttempt),
-			logger:   logger,
-		},
-		relayManager: &RelayManager{
-			relayServers: make(map[peer.ID]*RelayServer),
-			activeRelays: make([]peer.ID, 0),
-			relaySelector: &RelaySelector{
-				selectionPolicy: PolicyBalanced,
-				metrics:         make(map[peer.ID]*RelayMetrics),
-			},
-			logger: logger,
-		},
+		holePuncher:  NewHolePuncher(logger),
+		relayManager: newRelayManager(h, logger),
 		stunClient: &STUNClient{
 			stunServers: []string{
+				"stun.stunprotocol.org:3478", // Supports RFC 5780 behavior discovery
 				"stun.l.google.com:19302",
 				"stun1.l.google.com:19302",
 				"stun2.l.google.com:19302",
@@ -232,8 +254,24 @@ func (ant *AdvancedNATTraversal) Start() error {
 	// Initialize STUN client
 	ant.initializeSTUNClient()
 
-	// Initialize relay manager
-	ant.initializeRelayManager()
+	// Look for replacements as soon as a relay we hold a reservation with goes away
+	ant.host.Network().Notify(ant.relayManager.notify)
+
+	// Follow the reservations AutoRelay holds
+	relaySub, err := ant.host.EventBus().Subscribe(new(event.EvtAutoRelayAddrsUpdated))
+	if err != nil {
+		ant.logger.WithError(err).Warn("Failed to subscribe to relay address changes")
+	} else {
+		go ant.runRelayAddrMonitoring(relaySub)
+	}
+
+	// Follow AutoNAT's verdict on our reachability
+	sub, err := ant.host.EventBus().Subscribe(new(event.EvtLocalReachabilityChanged))
+	if err != nil {
+		ant.logger.WithError(err).Warn("Failed to subscribe to reachability changes")
+	} else {
+		go ant.runReachabilityMonitoring(sub)
+	}
 
 	// Start background processes
 	go ant.runNATMonitoring()
@@ -254,11 +292,60 @@ func (ant *AdvancedNATTraversal) Stop() error {
 	ant.logger.Info("Stopping Advanced NAT Traversal system...")
 
 	ant.cancel()
+	ant.host.Network().StopNotify(ant.relayManager.notify)
 
 	ant.logger.Info("Advanced NAT Traversal system stopped")
 	return nil
 }
 
+// SetSTUNServers replaces the RFC 5780 capable STUN servers (host:port) used
+// for NAT detection. Must be called before Start.
+func (ant *AdvancedNATTraversal) SetSTUNServers(servers []string) {
+	ant.stunClient.mu.Lock()
+	defer ant.stunClient.mu.Unlock()
+
+	ant.stunClient.stunServers = append([]string(nil), servers...)
+}
+
+// SetHolePuncher replaces the hole puncher, typically with one passed to
+// libp2p.EnableHolePunching as tracer. Must be called before Start.
+func (ant *AdvancedNATTraversal) SetHolePuncher(hp *HolePuncher) {
+	ant.holePuncher = hp
+}
+
+// SetRelaySelection sets the policy picking relays and how many relays to
+// hold reservations with. Must be called before Start.
+func (ant *AdvancedNATTraversal) SetRelaySelection(policy RelaySelectionPolicy, numRelays int) {
+	ant.relayManager.relaySelector.selectionPolicy = policy
+	if numRelays > 0 {
+		ant.relayManager.numRelays = numRelays
+	}
+}
+
+// SetRelaySource sets where relay candidates come from. Must be called
+// before Start.
+func (ant *AdvancedNATTraversal) SetRelaySource(source RelaySource) {
+	ant.relayManager.source = source
+}
+
+// SetBandwidthReporter measures relay throughput with the reporter passed
+// to libp2p.BandwidthReporter. Must be called before Start.
+func (ant *AdvancedNATTraversal) SetBandwidthReporter(reporter metrics.Reporter) {
+	ant.relayManager.bandwidth = reporter
+}
+
+// PreferredRelays returns up to num relays for AutoRelay to reserve slots
+// on, for use in its peer source: those it holds reservations with, then the
+// best ranked candidates
+func (ant *AdvancedNATTraversal) PreferredRelays(num int) []peer.AddrInfo {
+	return ant.relayManager.preferred(num)
+}
+
+// RelayHealth returns the measured relay candidates, active ones first
+func (ant *AdvancedNATTraversal) RelayHealth() []RelayServer {
+	return ant.relayManager.health()
+}
+
 // GetStatus returns current NAT traversal status
 func (ant *AdvancedNATTraversal) GetStatus() *NATStatus {
 	ant.mu.RLock()
@@ -266,146 +353,123 @@ func (ant *AdvancedNATTraversal) GetStatus() *NATStatus {
 
 	// Create copy to avoid race conditions
 	status := *ant.status
+	status.TraversalRate = ant.holePuncher.successRate()
+	status.ActiveRelays = ant.relayManager.activeCount()
 	return &status
 }
 
-// AttemptConnection attempts to establish connection using best strategy
+// HolePunchHistory returns finished connection attempts, oldest first
+func (ant *AdvancedNATTraversal) HolePunchHistory() []HolePunchAttempt {
+	return ant.holePuncher.History()
+}
+
+// AttemptConnection connects to a peer, starting with the best strategy for
+// our NAT and falling back to the following ones. Addresses are multiaddrs,
+// including relay circuits, or host:port for TCP.
 func (ant *AdvancedNATTraversal) AttemptConnection(ctx context.Context, peerID peer.ID, peerAddrs []string) error {
 	ant.logger.WithField("peer_id", peerID.String()).Info("Attempting NAT traversal connection")
 
-	// Select best strategy based on NAT type and peer characteristics
-	strategy := ant.selectBestStrategy(peerID)
+	addrs := parsePeerAddrs(peerAddrs)
+	var err error
+	for _, strategy := range ant.holePuncher.strategiesFrom(ant.selectBestStrategy(peerID)) {
+		attempt := ant.holePuncher.begin(peerID, strategy)
+		err = ant.executeStrategy(ctx, strategy, peerID, addrs)
+		ant.holePuncher.finish(attempt, err)
 
-	// Create hole punch attempt
-	attempt := &HolePunchAttempt{
-		PeerID:    peerID,
-		Strategy:  strategy,
-		StartTime: time.Now(),
-		Attempts:  0,
-		Success:   false,
-	}
-
-	ant.holePuncher.mu.Lock()
-	ant.holePuncher.attempts[peerID] = attempt
-	ant.holePuncher.mu.Unlock()
-
-	// Execute strategy
-	err := ant.executeStrategy(ctx, strategy, peerID, peerAddrs)
-
-	// Update attempt result
-	ant.holePuncher.mu.Lock()
-	attempt.Success = (err == nil)
-	attempt.LastError = err
-	ant.holePuncher.mu.Unlock()
+		if err == nil {
+			ant.logger.WithFields(logrus.Fields{
+				"peer_id":  peerID.String(),
+				"strategy": strategy,
+				"duration": attempt.EndTime.Sub(attempt.StartTime),
+			}).Info("NAT traversal successful")
+			return nil
+		}
 
-	if err == nil {
-		ant.logger.WithFields(logrus.Fields{
+		ant.logger.WithError(err).WithFields(logrus.Fields{
 			"peer_id":  peerID.String(),
 			"strategy": strategy,
-			"duration": time.Since(attempt.StartTime),
-		}).Info("NAT traversal successful")
+		}).Debug("NAT traversal strategy failed")
+		if ctx.Err() != nil {
+			break
+		}
 	}
 
 	return err
 }
 
-// detectNATType detects the type of NAT we're behind
+// detectNATType detects the type of NAT we're behind with RFC 5780 tests.
+// When no server can tell, a symmetric NAT is assumed so that connections
+// fall back to relays.
 func (ant *AdvancedNATTraversal) detectNATType() error {
 	ant.logger.Info("Detecting NAT type and characteristics...")
 
-	// Use STUN to detect public IP and port mapping behavior
-	publicIP, externalPort, err := ant.stunClient.getPublicAddress()
-	if err != nil {
-		return fmt.Errorf("failed to get public address: %w", err)
-	}
+	ant.stunClient.mu.RLock()
+	servers := append([]string(nil), ant.stunClient.stunServers...)
+	ant.stunClient.mu.RUnlock()
 
-	ant.natDetector.mu.Lock()
-	ant.natDetector.publicIP = publicIP
-	ant.natDetector.externalPort = externalPort
-	ant.natDetector.mu.Unlock()
+	ctx, cancel := context.WithTimeout(ant.ctx, natDetectionTimeout)
+	defer cancel()
 
-	// Detect mapping and filtering behavior
-	mappingBehavior, err := ant.detectMappingBehavior()
+	behavior, err := discoverNATBehavior(ctx, servers, DefaultSTUNTimeout)
 	if err != nil {
-		ant.logger.WithError(err).Warn("Failed to detect mapping behavior")
+		if behavior == nil {
+			behavior = &NATBehavior{}
+		}
+		behavior.Type = NATTypeSymmetric
+		behavior.Mapping = MappingAddressPortDependent
+		behavior.Filtering = FilterAddressPortDependent
 	}
 
-	filterBehavior, err := ant.detectFilterBehavior()
-	if err != nil {
-		ant.logger.WithError(err).Warn("Failed to detect filter behavior")
+	var publicIP net.IP
+	var externalPort int
+	if behavior.MappedAddr != nil {
+		publicIP, externalPort = behavior.MappedAddr.IP, behavior.MappedAddr.Port
 	}
 
-	// Determine NAT type based on behaviors
-	natType := ant.determineNATType(mappingBehavior, filterBehavior)
+	ant.natDetector.mu.Lock()
+	ant.natDetector.natType = behavior.Type
+	ant.natDetector.publicIP = publicIP
+	ant.natDetector.externalPort = externalPort
+	ant.natDetector.mappingBehavior = behavior.Mapping
+	ant.natDetector.filterBehavior = behavior.Filtering
+	ant.natDetector.mu.Unlock()
 
 	// Update status
 	ant.mu.Lock()
-	ant.status.Type = natType
-	ant.status.PublicIP = publicIP.String()
+	ant.status.Type = behavior.Type
+	if publicIP != nil {
+		ant.status.PublicIP = publicIP.String()
+	}
 	ant.status.ExternalPort = externalPort
-	ant.status.MappingBehavior = mappingBehavior
-	ant.status.FilterBehavior = filterBehavior
+	ant.status.MappingBehavior = behavior.Mapping
+	ant.status.FilterBehavior = behavior.Filtering
 	ant.mu.Unlock()
 
+	if err != nil {
+		return fmt.Errorf("failed to determine NAT behavior: %w", err)
+	}
+
 	ant.logger.WithFields(logrus.Fields{
-		"nat_type":         natType,
+		"nat_type":         behavior.Type,
 		"public_ip":        publicIP.String(),
 		"external_port":    externalPort,
-		"mapping_behavior": mappingBehavior,
-		"filter_behavior":  filterBehavior,
+		"mapping_behavior": behavior.Mapping,
+		"filter_behavior":  behavior.Filtering,
+		"server":           behavior.Server,
 	}).Info("NAT detection completed")
 
 	return nil
 }
 
-// Helper methods for STUN client
-func (sc *STUNClient) getPublicAddress() (net.IP, int, error) {
-	// This is a simplified implementation
-	// Real implementation would use STUN protocol
-
-	// Try to connect to external service to get public IP
-	conn, err := net.Dial("udp", "8.8.8.8:80")
-	if err != nil {
-		return nil, 0, err
-	}
-	defer conn.Close()
-
-	localAddr := conn.LocalAddr().(*net.UDPAddr)
-
-	// For demonstration, return local address
-	// Real implementation would use STUN servers
-	return localAddr.IP, localAddr.Port, nil
-}
-
-// detectMappingBehavior detects NAT mapping behavior
-func (ant *AdvancedNATTraversal) detectMappingBehavior() (MappingBehavior, error) {
-	// Simplified detection - real implementation would use multiple STUN requests
-	return MappingEndpointIndependent, nil
-}
-
-// detectFilterBehavior detects NAT filtering behavior
-func (ant *AdvancedNATTraversal) detectFilterBehavior() (FilterBehavior, error) {
-	// Simplified detection - real implementation would test filtering rules
-	return FilterEndpointIndependent, nil
-}
-
-// determineNATType determines NAT type from behaviors
-func (ant *AdvancedNATTraversal) determineNATType(mapping MappingBehavior, filter FilterBehavior) NATType {
-	// Simplified logic - real implementation would be more sophisticated
-	if mapping == MappingEndpointIndependent && filter == FilterEndpointIndependent {
-		return NATTypeFullCone
-	}
-	if mapping == MappingEndpointIndependent && filter == FilterAddressDependent {
-		return NATTypeRestrictedCone
-	}
-	if mapping == MappingEndpointIndependent && filter == FilterAddressPortDependent {
-		return NATTypePortRestricted
-	}
-	return NATTypeSymmetric
-}
-
 // selectBestStrategy selects the best hole punching strategy
 func (ant *AdvancedNATTraversal) selectBestStrategy(peerID peer.ID) HolePunchStrategy {
+	ant.mu.RLock()
+	reachability := ant.status.Reachability
+	ant.mu.RUnlock()
+	if reachability == network.ReachabilityPublic {
+		return StrategyDirect
+	}
+
 	ant.natDetector.mu.RLock()
 	natType := ant.natDetector.natType
 	ant.natDetector.mu.RUnlock()
@@ -423,7 +487,7 @@ func (ant *AdvancedNATTraversal) selectBestStrategy(peerID peer.ID) HolePunchStr
 }
 
 // executeStrategy executes the selected hole punching strategy
-func (ant *AdvancedNATTraversal) executeStrategy(ctx context.Context, strategy HolePunchStrategy, peerID peer.ID, peerAddrs []string) error {
+func (ant *AdvancedNATTraversal) executeStrategy(ctx context.Context, strategy HolePunchStrategy, peerID peer.ID, peerAddrs []multiaddr.Multiaddr) error {
 	switch strategy {
 	case StrategyDirect:
 		return ant.executeDirect(ctx, peerID, peerAddrs)
@@ -431,79 +495,77 @@ func (ant *AdvancedNATTraversal) executeStrategy(ctx context.Context, strategy H
 		return ant.executeRelayAssisted(ctx, peerID, peerAddrs)
 	case StrategySimultaneousOpen:
 		return ant.executeSimultaneousOpen(ctx, peerID, peerAddrs)
-	case StrategyPortPrediction:
-		return ant.executePortPrediction(ctx, peerID, peerAddrs)
 	default:
 		return fmt.Errorf("unknown strategy: %v", strategy)
 	}
 }
 
-// executeDirect executes direct connection strategy
-func (ant *AdvancedNATTraversal) executeDirect(ctx context.Context, peerID peer.ID, peerAddrs []string) error {
+// executeDirect dials the peer's own addresses, skipping relays
+func (ant *AdvancedNATTraversal) executeDirect(ctx context.Context, peerID peer.ID, peerAddrs []multiaddr.Multiaddr) error {
 	ant.logger.WithField("peer_id", peerID.String()).Debug("Executing direct connection strategy")
 
-	// Try direct connection to peer addresses
-	for _, addr := range peerAddrs {
-		conn, err := net.DialTimeout("tcp", addr, 10*time.Second)
-		if err == nil {
-			conn.Close()
-			return nil
-		}
+	if hasDirectConnection(ant.host, peerID) {
+		return nil
 	}
 
-	return fmt.Errorf("direct connection failed")
+	ctx, cancel := context.WithTimeout(ctx, directDialTimeout)
+	defer cancel()
+	ctx = network.WithForceDirectDial(ctx, "direct strategy")
+
+	info := peer.AddrInfo{ID: peerID, Addrs: filterAddrs(peerAddrs, false)}
+	if err := ant.host.Connect(ctx, info); err != nil {
+		return fmt.Errorf("direct connection failed: %w", err)
+	}
+	return nil
 }
 
-// executeRelayAssisted executes relay-assisted connection strategy
-func (ant *AdvancedNATTraversal) executeRelayAssisted(ctx context.Context, peerID peer.ID, peerAddrs []string) error {
+// executeRelayAssisted connects through a circuit relay v2 relay: one the
+// peer holds a reservation with, or our best relay
+func (ant *AdvancedNATTraversal) executeRelayAssisted(ctx context.Context, peerID peer.ID, peerAddrs []multiaddr.Multiaddr) error {
 	ant.logger.WithField("peer_id", peerID.String()).Debug("Executing relay-assisted connection strategy")
 
-	// Select best relay server
-	relayPeer := ant.relayManager.selectBestRelay()
-	if relayPeer == "" {
-		return fmt.Errorf("no relay servers available")
+	if ant.host.Network().Connectedness(peerID) != network.NotConnected {
+		return nil
 	}
 
-	// Use relay to establish connection
-	// This is a placeholder - real implementation would coordinate with relay
-	ant.logger.WithFields(logrus.Fields{
-		"peer_id": peerID.String(),
-		"relay":   relayPeer,
-	}).Debug("Using relay for connection")
+	circuits := append(filterAddrs(peerAddrs, true), filterAddrs(ant.host.Peerstore().Addrs(peerID), true)...)
+	if relayPeer := ant.relayManager.selectBestRelay(); relayPeer != "" {
+		circuits = append(circuits, circuitAddrs(ant.host, relayPeer)...)
+	}
+	if len(circuits) == 0 {
+		return fmt.Errorf("no relay servers available")
+	}
 
+	ctx = network.WithAllowLimitedConn(ctx, "relay strategy")
+	if err := ant.host.Connect(ctx, peer.AddrInfo{ID: peerID, Addrs: circuits}); err != nil {
+		return fmt.Errorf("relayed connection failed: %w", err)
+	}
 	return nil
 }
 
-// executeSimultaneousOpen executes simultaneous open strategy
-func (ant *AdvancedNATTraversal) executeSimultaneousOpen(ctx context.Context, peerID peer.ID, peerAddrs []string) error {
+// executeSimultaneousOpen opens a relayed connection and waits for DCUtR to
+// upgrade it: the peer receiving the relayed connection starts the
+// synchronized dials through the relay
+func (ant *AdvancedNATTraversal) executeSimultaneousOpen(ctx context.Context, peerID peer.ID, peerAddrs []multiaddr.Multiaddr) error {
 	ant.logger.WithField("peer_id", peerID.String()).Debug("Executing simultaneous open strategy")
 
-	// Coordinate simultaneous connection attempts
-	// This is a placeholder - real implementation would use signaling
-	return nil
-}
-
-// executePortPrediction executes port prediction strategy
-func (ant *AdvancedNATTraversal) executePortPrediction(ctx context.Context, peerID peer.ID, peerAddrs []string) error {
-	ant.logger.WithField("peer_id", peerID.String()).Debug("Executing port prediction strategy")
-
-	// Predict likely ports based on NAT behavior
-	// This is a placeholder - real implementation would analyze port patterns
-	return nil
-}
+	if err := ant.executeRelayAssisted(ctx, peerID, peerAddrs); err != nil {
+		return fmt.Errorf("no relayed connection to upgrade: %w", err)
+	}
 
-// Helper methods for RelayManager
-func (rm *RelayManager) selectBestRelay() peer.ID {
-	rm.mu.RLock()
-	defer rm.mu.RUnlock()
+	ctx, cancel := context.WithTimeout(ctx, dcutrTimeout)
+	defer cancel()
 
-	if len(rm.activeRelays) == 0 {
-		return ""
+	ticker := time.NewTicker(dcutrPollInterval)
+	defer ticker.Stop()
+	for !hasDirectConnection(ant.host, peerID) {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("relayed connection was not upgraded: %w", ctx.Err())
+		case <-ticker.C:
+		}
 	}
-
-	// Simple selection - return first active relay
-	// Real implementation would use sophisticated selection algorithm
-	return rm.activeRelays[0]
+	return nil
 }
 
 // initializeSTUNClient initializes the STUN client
@@ -520,12 +582,45 @@ func (ant *AdvancedNATTraversal) initializeSTUNClient() {
 	}
 }
 
-// initializeRelayManager initializes the relay manager
-func (ant *AdvancedNATTraversal) initializeRelayManager() {
-	ant.logger.Debug("Initializing relay manager...")
+// runReachabilityMonitoring records AutoNAT reachability changes
+func (ant *AdvancedNATTraversal) runReachabilityMonitoring(sub event.Subscription) {
+	defer func() { _ = sub.Close() }()
 
-	// Initialize relay selection policy
-	ant.relayManager.relaySelector.selectionPolicy = PolicyBalanced
+	for {
+		select {
+		case <-ant.ctx.Done():
+			return
+		case evt, ok := <-sub.Out():
+			if !ok {
+				return
+			}
+			reachability := evt.(event.EvtLocalReachabilityChanged).Reachability
+
+			ant.mu.Lock()
+			ant.status.Reachability = reachability
+			ant.mu.Unlock()
+
+			ant.logger.WithField("reachability", reachability.String()).Info("Reachability changed")
+		}
+	}
+}
+
+// runRelayAddrMonitoring marks the relays in AutoRelay's circuit addresses
+// as active
+func (ant *AdvancedNATTraversal) runRelayAddrMonitoring(sub event.Subscription) {
+	defer func() { _ = sub.Close() }()
+
+	for {
+		select {
+		case <-ant.ctx.Done():
+			return
+		case evt, ok := <-sub.Out():
+			if !ok {
+				return
+			}
+			ant.relayManager.setReserved(evt.(event.EvtAutoRelayAddrsUpdated).RelayAddrs)
+		}
+	}
 }
 
 // runNATMonitoring runs NAT monitoring loop
@@ -551,26 +646,35 @@ func (ant *AdvancedNATTraversal) monitorNATChanges() {
 	}
 }
 
-// runRelayManagement runs relay management loop
+// runRelayManagement manages relays right away, then periodically and
+// whenever a relay we hold a reservation with disconnects
 func (ant *AdvancedNATTraversal) runRelayManagement() {
-	ticker := time.NewTicker(2 * time.Minute)
+	ticker := time.NewTicker(relayManagementInterval)
 	defer ticker.Stop()
 
 	for {
+		ant.manageRelays()
+
 		select {
 		case <-ant.ctx.Done():
 			return
 		case <-ticker.C:
-			ant.manageRelays()
+		case <-ant.relayManager.trigger:
 		}
 	}
 }
 
-// manageRelays manages relay server connections
+// manageRelays measures relay candidates for AutoRelay while we are not
+// publicly reachable; AutoRelay drops its reservations once we are
 func (ant *AdvancedNATTraversal) manageRelays() {
-	// Update relay metrics and select best relays
-	ant.relayManager.updateRelayMetrics()
-	ant.relayManager.selectActiveRelays()
+	ant.mu.RLock()
+	public := ant.status.Reachability == network.ReachabilityPublic
+	ant.mu.RUnlock()
+
+	if public {
+		return
+	}
+	ant.relayManager.updateRelayMetrics(ant.ctx)
 }
 
 // runHolePunchingService runs hole punching service
@@ -599,14 +703,9 @@ func (ant *AdvancedNATTraversal) cleanupAttempts() {
 			delete(ant.holePuncher.attempts, peerID)
 		}
 	}
-}
-
-func (rm *RelayManager) updateRelayMetrics() {
-	// Update metrics for all known relay servers
-	// This is a placeholder for actual metric collection
-}
-
-func (rm *RelayManager) selectActiveRelays() {
-	// Select best relay servers based on metrics
-	// This is a placeholder for actual selection algorithm
+	for peerID, attempt := range ant.holePuncher.active {
+		if now.Sub(attempt.StartTime) > 10*time.Minute {
+			delete(ant.holePuncher.active, peerID)
+		}
+	}
 }
@@ -0,0 +1,321 @@
+package p2p
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/pion/stun"
+)
+
+// NAT behavior discovery follows RFC 5780. Mapping is tested by comparing the
+// address a server reports for requests sent to its primary address, its
+// alternate IP and its alternate IP and port from the same socket. Filtering
+// is tested from a fresh socket by asking the server, with CHANGE-REQUEST, to
+// answer from its alternate IP and port, or from its alternate port only.
+// Servers have to report their alternate address in OTHER-ADDRESS.
+const (
+	DefaultSTUNTimeout = 3 * time.Second // Per request, including retransmissions
+
+	stunRetransmits = 3
+	changeIPFlag    = 0x04
+	changePortFlag  = 0x02
+)
+
+// ErrNoAlternateAddress is returned by servers that do not support RFC 5780
+var ErrNoAlternateAddress = errors.New("STUN server has no alternate address")
+
+// errNoSTUNResponse means a request went unanswered, which filtering tests expect
+var errNoSTUNResponse = errors.New("no STUN response")
+
+// NATBehavior is the result of RFC 5780 behavior discovery against one server
+type NATBehavior struct {
+	Type       NATType
+	Mapping    MappingBehavior
+	Filtering  FilterBehavior
+	MappedAddr *net.UDPAddr // Public address reported by the primary address
+	Server     string
+}
+
+// String returns the name used in node status files
+func (t NATType) String() string {
+	switch t {
+	case NATTypeOpen:
+		return "none"
+	case NATTypeFullCone:
+		return "full_cone"
+	case NATTypeRestrictedCone:
+		return "restricted"
+	case NATTypePortRestricted:
+		return "port_restricted"
+	case NATTypeSymmetric:
+		return "symmetric"
+	default:
+		return "unknown"
+	}
+}
+
+// classifyNAT maps RFC 5780 behaviors onto the classic NAT types
+func classifyNAT(mapping MappingBehavior, filter FilterBehavior) NATType {
+	if mapping != MappingEndpointIndependent {
+		return NATTypeSymmetric
+	}
+	switch filter {
+	case FilterEndpointIndependent:
+		return NATTypeFullCone
+	case FilterAddressDependent:
+		return NATTypeRestrictedCone
+	default:
+		return NATTypePortRestricted
+	}
+}
+
+// DiscoverNATBehavior runs the mapping and filtering tests against a server.
+// A timeout of zero uses DefaultSTUNTimeout. When the server answers but does
+// not support RFC 5780, the mapped address is returned with
+// ErrNoAlternateAddress.
+func DiscoverNATBehavior(ctx context.Context, server string, timeout time.Duration) (*NATBehavior, error) {
+	if timeout <= 0 {
+		timeout = DefaultSTUNTimeout
+	}
+	serverAddr, err := net.ResolveUDPAddr("udp", server)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve STUN server %s: %w", server, err)
+	}
+
+	behavior := &NATBehavior{Type: NATTypeUnknown, Server: server}
+	mapping, err := detectMappingBehavior(ctx, serverAddr, timeout)
+	if mapping != nil {
+		behavior.MappedAddr = mapping.mapped
+	}
+	if err != nil {
+		return behavior, err
+	}
+	behavior.Mapping = mapping.behavior
+	if mapping.open {
+		behavior.Type = NATTypeOpen
+		return behavior, nil
+	}
+
+	if behavior.Filtering, err = detectFilterBehavior(ctx, serverAddr, timeout); err != nil {
+		return behavior, err
+	}
+	behavior.Type = classifyNAT(behavior.Mapping, behavior.Filtering)
+	return behavior, nil
+}
+
+// discoverNATBehavior tries servers in order and returns the first complete
+// result. If none supports RFC 5780, the last partial result is returned with
+// the error.
+func discoverNATBehavior(ctx context.Context, servers []string, timeout time.Duration) (*NATBehavior, error) {
+	var partial *NATBehavior
+	err := errors.New("no STUN servers configured")
+	for _, server := range servers {
+		var behavior *NATBehavior
+		behavior, err = DiscoverNATBehavior(ctx, server, timeout)
+		if err == nil {
+			return behavior, nil
+		}
+		if behavior != nil && behavior.MappedAddr != nil {
+			partial = behavior
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return partial, err
+}
+
+// mappingResult holds what the mapping tests learned
+type mappingResult struct {
+	mapped   *net.UDPAddr
+	behavior MappingBehavior
+	open     bool // The mapped address is our own: there is no NAT
+}
+
+// detectMappingBehavior runs RFC 5780 section 4.3 from one socket
+func detectMappingBehavior(ctx context.Context, server *net.UDPAddr, timeout time.Duration) (*mappingResult, error) {
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open STUN socket: %w", err)
+	}
+	defer func() { _ = conn.Close() }()
+
+	// Test I: primary address
+	response, err := stunRequest(ctx, conn, server, 0, timeout)
+	if err != nil {
+		return nil, fmt.Errorf("binding request failed: %w", err)
+	}
+	result := &mappingResult{mapped: response.mapped}
+	if isOwnAddress(response.mapped, conn.LocalAddr().(*net.UDPAddr).Port) {
+		result.open = true
+		result.behavior = MappingEndpointIndependent
+		return result, nil
+	}
+	if response.other == nil {
+		return result, ErrNoAlternateAddress
+	}
+
+	// Test II: alternate IP, primary port
+	alternate := &net.UDPAddr{IP: response.other.IP, Port: server.Port}
+	second, err := stunRequest(ctx, conn, alternate, 0, timeout)
+	if err != nil {
+		return result, fmt.Errorf("binding request to alternate address failed: %w", err)
+	}
+	if sameUDPAddr(second.mapped, response.mapped) {
+		result.behavior = MappingEndpointIndependent
+		return result, nil
+	}
+
+	// Test III: alternate IP and port
+	third, err := stunRequest(ctx, conn, response.other, 0, timeout)
+	if err != nil {
+		return result, fmt.Errorf("binding request to alternate port failed: %w", err)
+	}
+	if sameUDPAddr(third.mapped, second.mapped) {
+		result.behavior = MappingAddressDependent
+	} else {
+		result.behavior = MappingAddressPortDependent
+	}
+	return result, nil
+}
+
+// detectFilterBehavior runs RFC 5780 section 4.4 from a fresh socket, so the
+// mapping tests have not opened the filter towards the alternate address
+func detectFilterBehavior(ctx context.Context, server *net.UDPAddr, timeout time.Duration) (FilterBehavior, error) {
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return FilterAddressPortDependent, fmt.Errorf("failed to open STUN socket: %w", err)
+	}
+	defer func() { _ = conn.Close() }()
+
+	// Test I: opens the filter towards the primary address only
+	if _, err := stunRequest(ctx, conn, server, 0, timeout); err != nil {
+		return FilterAddressPortDependent, fmt.Errorf("binding request failed: %w", err)
+	}
+
+	// Test II: answer from the alternate IP and port
+	_, err = stunRequest(ctx, conn, server, changeIPFlag|changePortFlag, timeout)
+	if err == nil {
+		return FilterEndpointIndependent, nil
+	}
+	if !errors.Is(err, errNoSTUNResponse) {
+		return FilterAddressPortDependent, err
+	}
+
+	// Test III: answer from the primary IP and alternate port
+	_, err = stunRequest(ctx, conn, server, changePortFlag, timeout)
+	if err == nil {
+		return FilterAddressDependent, nil
+	}
+	if !errors.Is(err, errNoSTUNResponse) {
+		return FilterAddressPortDependent, err
+	}
+	return FilterAddressPortDependent, nil
+}
+
+// stunResponse holds the attributes of a binding response used by the tests
+type stunResponse struct {
+	mapped *net.UDPAddr
+	other  *net.UDPAddr // OTHER-ADDRESS, nil if the server does not send it
+}
+
+// stunRequest sends a binding request, retransmitting until timeout, and
+// returns the matching response. changeFlags asks the server to answer from
+// another address.
+func stunRequest(ctx context.Context, conn *net.UDPConn, server *net.UDPAddr, changeFlags byte, timeout time.Duration) (*stunResponse, error) {
+	setters := []stun.Setter{stun.TransactionID, stun.BindingRequest}
+	if changeFlags != 0 {
+		setters = append(setters, stun.RawAttribute{Type: stun.AttrChangeRequest, Value: []byte{0, 0, 0, changeFlags}})
+	}
+	setters = append(setters, stun.Fingerprint)
+	request, err := stun.Build(setters...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build STUN request: %w", err)
+	}
+
+	buf := make([]byte, 1500)
+	for attempt := 0; attempt < stunRetransmits; attempt++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if _, err := conn.WriteToUDP(request.Raw, server); err != nil {
+			return nil, fmt.Errorf("failed to send STUN request: %w", err)
+		}
+
+		deadline := time.Now().Add(timeout / stunRetransmits)
+		if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+			deadline = ctxDeadline
+		}
+		if err := conn.SetReadDeadline(deadline); err != nil {
+			return nil, fmt.Errorf("failed to set deadline: %w", err)
+		}
+
+		for {
+			n, _, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+					break
+				}
+				return nil, fmt.Errorf("failed to read STUN response: %w", err)
+			}
+
+			response := &stun.Message{Raw: append([]byte(nil), buf[:n]...)}
+			if err := response.Decode(); err != nil || response.TransactionID != request.TransactionID {
+				continue // Not ours, or a late answer to an earlier request
+			}
+			if response.Type != stun.BindingSuccess {
+				return nil, fmt.Errorf("STUN server returned %s", response.Type)
+			}
+			return parseSTUNResponse(response)
+		}
+	}
+	return nil, errNoSTUNResponse
+}
+
+// parseSTUNResponse reads the mapped and alternate addresses of a response
+func parseSTUNResponse(response *stun.Message) (*stunResponse, error) {
+	var xorMapped stun.XORMappedAddress
+	mapped := &net.UDPAddr{}
+	if err := xorMapped.GetFrom(response); err == nil {
+		mapped.IP, mapped.Port = xorMapped.IP, xorMapped.Port
+	} else {
+		var plain stun.MappedAddress
+		if err := plain.GetFrom(response); err != nil {
+			return nil, fmt.Errorf("no mapped address in STUN response")
+		}
+		mapped.IP, mapped.Port = plain.IP, plain.Port
+	}
+
+	result := &stunResponse{mapped: mapped}
+	var other stun.OtherAddress
+	if err := other.GetFrom(response); err == nil {
+		result.other = &net.UDPAddr{IP: other.IP, Port: other.Port}
+	}
+	return result, nil
+}
+
+// isOwnAddress reports whether a mapped address is one of this host's
+// addresses with the socket's own port
+func isOwnAddress(mapped *net.UDPAddr, localPort int) bool {
+	if mapped.Port != localPort {
+		return false
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.Equal(mapped.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// sameUDPAddr compares addresses by IP and port
+func sameUDPAddr(a, b *net.UDPAddr) bool {
+	return a.Port == b.Port && a.IP.Equal(b.IP)
+}
@@ -0,0 +1,309 @@
+package p2p
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/pnet"
+	multiaddr "github.com/multiformats/go-multiaddr"
+)
+
+// A private network is defined by a pre-shared key kept in the data directory
+// in the swarm.key format used by IPFS. Only nodes holding the key can connect
+// to each other. Bootstrap peers are listed in bootstrap.txt, one multiaddr
+// with /p2p/ per line; blank lines and lines starting with # are ignored.
+const (
+	NetworkKeyFile   = "swarm.key"
+	BootstrapFile    = "bootstrap.txt"
+	networkKeyHeader = "/key/swarm/psk/1.0.0/\n/base16/\n"
+	networkKeySize   = 32
+)
+
+// ErrNetworkKeyExists is returned when a network key would replace an existing one
+var ErrNetworkKeyExists = errors.New("a private network key already exists")
+
+// GenerateNetworkKey returns a random pre-shared key for a new private network
+func GenerateNetworkKey() (pnet.PSK, error) {
+	key := make([]byte, networkKeySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, fmt.Errorf("failed to generate network key: %w", err)
+	}
+	return key, nil
+}
+
+// EncodeNetworkKey returns the key as the hex string shared with other members
+func EncodeNetworkKey(psk pnet.PSK) string {
+	return hex.EncodeToString(psk)
+}
+
+// ParseNetworkKey reads a key shared as a hex string or as swarm.key contents
+func ParseNetworkKey(key string) (pnet.PSK, error) {
+	key = strings.TrimSpace(key)
+	if strings.HasPrefix(key, "/key/") {
+		psk, err := pnet.DecodeV1PSK(strings.NewReader(key))
+		if err != nil {
+			return nil, fmt.Errorf("invalid network key: %w", err)
+		}
+		return psk, nil
+	}
+
+	psk, err := hex.DecodeString(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid network key: %w", err)
+	}
+	if len(psk) != networkKeySize {
+		return nil, fmt.Errorf("invalid network key size: %d bytes", len(psk))
+	}
+	return psk, nil
+}
+
+// NetworkKeyFingerprint returns a short identifier of a key that is safe to show
+func NetworkKeyFingerprint(psk pnet.PSK) string {
+	digest := sha256.Sum256(psk)
+	return hex.EncodeToString(digest[:8])
+}
+
+// LoadNetworkKey reads the private network key of a data directory, or nil if
+// the node is on the public network
+func LoadNetworkKey(dataDir string) (pnet.PSK, error) {
+	data, err := os.ReadFile(filepath.Join(dataDir, NetworkKeyFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read network key: %w", err)
+	}
+	return ParseNetworkKey(string(data))
+}
+
+// SaveNetworkKey writes the private network key of a data directory. An
+// existing key is only replaced with force, since that leaves its network.
+func SaveNetworkKey(dataDir string, psk pnet.PSK, force bool) error {
+	if err := os.MkdirAll(dataDir, 0700); err != nil {
+		return fmt.Errorf("failed to create data directory: %w", err)
+	}
+
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if !force {
+		flags |= os.O_EXCL
+	}
+	file, err := os.OpenFile(filepath.Join(dataDir, NetworkKeyFile), flags, 0600)
+	if err != nil {
+		if os.IsExist(err) {
+			return ErrNetworkKeyExists
+		}
+		return fmt.Errorf("failed to create network key: %w", err)
+	}
+
+	_, err = file.WriteString(networkKeyHeader + EncodeNetworkKey(psk) + "\n")
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write network key: %w", err)
+	}
+	return nil
+}
+
+// RemoveNetworkKey deletes the private network key, returning the node to the
+// public network
+func RemoveNetworkKey(dataDir string) error {
+	if err := os.Remove(filepath.Join(dataDir, NetworkKeyFile)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove network key: %w", err)
+	}
+	return nil
+}
+
+// ParseBootstrapPeers parses bootstrap multiaddrs, merging addresses of the same peer
+func ParseBootstrapPeers(addrs []string) ([]peer.AddrInfo, error) {
+	var peers []peer.AddrInfo
+	index := make(map[peer.ID]int)
+	for _, addr := range addrs {
+		maddr, err := multiaddr.NewMultiaddr(strings.TrimSpace(addr))
+		if err != nil {
+			return nil, fmt.Errorf("invalid bootstrap address %s: %w", addr, err)
+		}
+		info, err := peer.AddrInfoFromP2pAddr(maddr)
+		if err != nil {
+			return nil, fmt.Errorf("bootstrap address %s has no peer ID: %w", addr, err)
+		}
+
+		// Merge addresses of one peer, keeping peers in the order listed
+		if i, ok := index[info.ID]; ok {
+			peers[i].Addrs = append(peers[i].Addrs, info.Addrs...)
+			continue
+		}
+		index[info.ID] = len(peers)
+		peers = append(peers, *info)
+	}
+	return peers, nil
+}
+
+// readBootstrapFile returns the addresses listed in the bootstrap file of a data directory
+func readBootstrapFile(dataDir string) ([]string, error) {
+	data, err := os.ReadFile(filepath.Join(dataDir, BootstrapFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read bootstrap list: %w", err)
+	}
+
+	var addrs []string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		addrs = append(addrs, line)
+	}
+	return addrs, scanner.Err()
+}
+
+// LoadBootstrapPeers reads the bootstrap list of a data directory
+func LoadBootstrapPeers(dataDir string) ([]peer.AddrInfo, error) {
+	addrs, err := readBootstrapFile(dataDir)
+	if err != nil {
+		return nil, err
+	}
+	return ParseBootstrapPeers(addrs)
+}
+
+// AddBootstrapPeers appends addresses that are not listed yet to the bootstrap
+// list of a data directory
+func AddBootstrapPeers(dataDir string, addrs []string) error {
+	if _, err := ParseBootstrapPeers(addrs); err != nil {
+		return err
+	}
+	existing, err := readBootstrapFile(dataDir)
+	if err != nil {
+		return err
+	}
+	listed := make(map[string]bool, len(existing))
+	for _, addr := range existing {
+		listed[addr] = true
+	}
+
+	var lines strings.Builder
+	for _, addr := range addrs {
+		addr = strings.TrimSpace(addr)
+		if listed[addr] {
+			continue
+		}
+		listed[addr] = true
+		lines.WriteString(addr + "\n")
+	}
+	if lines.Len() == 0 {
+		return nil
+	}
+
+	if err := os.MkdirAll(dataDir, 0700); err != nil {
+		return fmt.Errorf("failed to create data directory: %w", err)
+	}
+	file, err := os.OpenFile(filepath.Join(dataDir, BootstrapFile), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open bootstrap list: %w", err)
+	}
+	_, err = file.WriteString(lines.String())
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write bootstrap list: %w", err)
+	}
+	return nil
+}
+
+// resolveNetwork returns the network key and bootstrap peers of a node, adding
+// those kept in its data directory. Nodes on the public network without a
+// bootstrap list of their own use the public IPFS bootstrap nodes, unless the
+// DHT is disabled.
+func resolveNetwork(config *NodeConfig) (pnet.PSK, []peer.AddrInfo, error) {
+	psk := config.NetworkKey
+	bootstrap := append([]peer.AddrInfo(nil), config.BootstrapPeers...)
+
+	if config.DataDir != "" {
+		if psk == nil {
+			var err error
+			if psk, err = LoadNetworkKey(config.DataDir); err != nil {
+				return nil, nil, err
+			}
+		}
+
+		peers, err := LoadBootstrapPeers(config.DataDir)
+		if err != nil {
+			return nil, nil, err
+		}
+		bootstrap = append(bootstrap, peers...)
+	}
+
+	if len(bootstrap) == 0 && psk == nil && !config.DisableDHT {
+		bootstrap = getBootstrapPeers()
+	}
+	return psk, bootstrap, nil
+}
+
+// CreatePrivateNetwork generates a network key in the default data directory
+// and returns it for sharing with the other members
+func CreatePrivateNetwork(force bool) (pnet.PSK, error) {
+	psk, err := GenerateNetworkKey()
+	if err != nil {
+		return nil, err
+	}
+	if err := SaveNetworkKey(defaultDataDir(), psk, force); err != nil {
+		return nil, err
+	}
+	return psk, nil
+}
+
+// JoinPrivateNetwork stores a shared network key and bootstrap addresses in
+// the default data directory
+func JoinPrivateNetwork(key string, bootstrap []string, force bool) (pnet.PSK, error) {
+	psk, err := ParseNetworkKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := ParseBootstrapPeers(bootstrap); err != nil {
+		return nil, err
+	}
+	// Joining the same network again only adds bootstrap addresses
+	if err := SaveNetworkKey(defaultDataDir(), psk, force); errors.Is(err, ErrNetworkKeyExists) {
+		existing, loadErr := LoadNetworkKey(defaultDataDir())
+		if loadErr != nil || !bytes.Equal(existing, psk) {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	}
+	return psk, AddBootstrapPeers(defaultDataDir(), bootstrap)
+}
+
+// LeavePrivateNetwork removes the network key from the default data directory
+func LeavePrivateNetwork() error {
+	return RemoveNetworkKey(defaultDataDir())
+}
+
+// PrivateNetwork returns the network key and bootstrap peers of the default
+// data directory; the key is nil on the public network
+func PrivateNetwork() (pnet.PSK, []peer.AddrInfo, error) {
+	psk, err := LoadNetworkKey(defaultDataDir())
+	if err != nil {
+		return nil, nil, err
+	}
+	peers, err := LoadBootstrapPeers(defaultDataDir())
+	if err != nil {
+		return nil, nil, err
+	}
+	return psk, peers, nil
+}
@@ -2,6 +2,7 @@ package p2p
 
 import (
 	"context"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"log"
@@ -12,16 +13,21 @@ import (
 	"sync"
 	"time"
 
+	"github.com/Xelvra/peerchat/internal/db"
 	"github.com/Xelvra/peerchat/internal/message"
 	"github.com/Xelvra/peerchat/internal/user"
 	libp2p "github.com/libp2p/go-libp2p"
 	"github.com/libp2p/go-libp2p-kad-dht/dual"
 	"github.com/libp2p/go-libp2p/core/crypto"
 	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/metrics"
 	"github.com/libp2p/go-libp2p/core/network"
 	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/pnet"
 	"github.com/libp2p/go-libp2p/core/protocol"
 	"github.com/libp2p/go-libp2p/core/routing"
+	"github.com/libp2p/go-libp2p/p2p/host/autorelay"
+	"github.com/libp2p/go-libp2p/p2p/protocol/holepunch"
 	libp2pquic "github.com/libp2p/go-libp2p/p2p/transport/quic"
 	"github.com/libp2p/go-libp2p/p2p/transport/tcp"
 	"github.com/sirupsen/logrus"
@@ -61,9 +67,11 @@ type NATInfo struct {
 
 // DiscoveryStatus represents peer discovery status
 type DiscoveryStatus struct {
+	IPv6LinkLocal  bool      `json:"ipv6_link_local"`
 	MDNSActive     bool      `json:"mdns_active"`
 	DHTActive      bool      `json:"dht_active"`
 	UDPBroadcast   bool      `json:"udp_broadcast"`
+	RelayService   bool      `json:"relay_service"` // Relaying for others while publicly reachable
 	BootstrapPeers []string  `json:"bootstrap_peers"`
 	KnownPeers     int       `json:"known_peers"`
 	LastDiscovery  time.Time `json:"last_discovery"`
@@ -85,6 +93,7 @@ type NodeStatus struct {
 	Transports     []NetworkTransport `json:"transports"`
 	NATInfo        *NATInfo           `json:"nat_info,omitempty"`
 	Discovery      *DiscoveryStatus   `json:"discovery,omitempty"`
+	Relays         []RelayServer      `json:"relays,omitempty"`
 	NetworkQuality string             `json:"network_quality"` // "excellent", "good", "poor", "offline"
 }
 
@@ -106,22 +115,63 @@ type PeerChatNode struct {
 	// Message handling
 	messageManager *message.MessageManager
 	identity       *user.MessengerID
+	database       *db.SQLiteDB
 
 	// Network components
 	stunClient       *LegacySTUNClient
+	dht              *dual.DHT // Nil when the DHT is disabled
 	discoveryManager *DiscoveryManager
+	natTraversal     *AdvancedNATTraversal
+	addressBook      *AddressBook // Nil without a database
 	energyManager    *EnergyManager
 	natInfo          *NATInfo
 }
 
 // NodeConfig holds configuration for the P2P node
 type NodeConfig struct {
-	ListenAddrs    []string
-	BootstrapPeers []peer.AddrInfo
-	EnableQUIC     bool
-	EnableTCP      bool
-	LogLevel       logrus.Level
-	Logger         *logrus.Logger // External logger to use
+	ListenAddrs      []string
+	BootstrapPeers   []peer.AddrInfo // Added to the bootstrap list in the data directory
+	NetworkKey       pnet.PSK        // Pre-shared key of a private network; nil loads swarm.key from the data directory
+	DisableDHT       bool            // Run without the Kademlia DHT; peers are found through bootstrap peers and local discovery
+	STUNServers      []string        // STUN servers (host:port) for NAT discovery; empty uses the defaults
+	EnableQUIC       bool
+	EnableTCP        bool
+	DataDir          string   // Directory for the local database (empty disables persistence)
+	DatabasePassword string   // Password used to derive the database encryption key (empty derives it from the identity key)
+	Mailboxes        []string // Multiaddrs (with /p2p/) of always-on peers holding our messages
+	MailboxOwners    []string // DIDs this node stores messages for while they are offline
+	EnableRouting    bool     // Route messages through friendly peers when no direct connection exists
+	RoutingFriends   []string // Peer IDs allowed as routing hops besides contacts
+	ShareFiles       bool     // Serve transferred files to swarm downloads and announce them in the DHT
+	EncryptDownloads bool     // Keep received files encrypted at rest; `peerchat-cli decrypt` opens them
+	LogLevel         logrus.Level
+	Logger           *logrus.Logger // External logger to use
+
+	// FileAcceptPolicy decides which incoming files are received; nil asks before every file
+	FileAcceptPolicy *message.FileAcceptPolicy
+	// Bandwidth caps file transfer rates; zero values are unlimited
+	Bandwidth message.BandwidthLimits
+	// RelayService relays for contacts, or private network members, while publicly reachable
+	RelayService bool
+	// RelayLimits caps the relay service; zero values use the defaults
+	RelayLimits RelayServiceConfig
+	// RelayPolicy picks the relays we reserve slots on and route through
+	RelayPolicy RelaySelectionPolicy
+	// ActiveRelays is the number of relay reservations kept while NATed; zero keeps two
+	ActiveRelays int
+	// EnableWebSocket listens and dials over WebSocket, which passes
+	// firewalls and proxies letting only HTTP(S) through
+	EnableWebSocket bool
+	// WebSocketListenAddrs replace the default /tcp/0/ws addresses, e.g. /ip4/0.0.0.0/tcp/443/tls/ws
+	WebSocketListenAddrs []string
+	// WebSocketCertFile and WebSocketKeyFile hold a PEM certificate and key
+	// for secure WebSocket (/tls/ws) listeners; without them listeners are plain
+	WebSocketCertFile string
+	WebSocketKeyFile  string
+	// EnableWebTransport listens and dials over WebTransport, outside private networks
+	EnableWebTransport bool
+	// WebTransportListenAddrs replace the default /udp/0/quic-v1/webtransport addresses
+	WebTransportListenAddrs []string
 }
 
 // DefaultNodeConfig returns a default configuration optimized for performance
@@ -130,13 +180,72 @@ func DefaultNodeConfig() *NodeConfig {
 		ListenAddrs: []string{
 			"/ip4/0.0.0.0/tcp/0",
 			"/ip4/0.0.0.0/udp/0/quic-v1",
+			"/ip6/::/tcp/0", // Also reachable over IPv6 link-local addresses
+			"/ip6/::/udp/0/quic-v1",
 		},
-		EnableQUIC: true,
-		EnableTCP:  true,
-		LogLevel:   logrus.InfoLevel,
+		EnableQUIC:    true,
+		EnableTCP:     true,
+		DataDir:       defaultDataDir(),
+		EnableRouting: true,
+		LogLevel:      logrus.InfoLevel,
 	}
 }
 
+// databasePassword returns the configured database password, or one derived
+// from the identity key
+func databasePassword(password string, identity *user.MessengerID) string {
+	if password != "" {
+		return password
+	}
+	return hex.EncodeToString(identity.DeriveSecret("xelvra database key"))
+}
+
+// enableRouting configures multi-hop routing on the message manager
+func enableRouting(mm *message.MessageManager, config *NodeConfig) error {
+	routingConfig := message.DefaultRoutingConfig()
+
+	for _, friend := range config.RoutingFriends {
+		friendID, err := peer.Decode(friend)
+		if err != nil {
+			return fmt.Errorf("invalid routing friend %s: %w", friend, err)
+		}
+		routingConfig.Friends = append(routingConfig.Friends, friendID)
+	}
+
+	return mm.EnableRouting(routingConfig)
+}
+
+// buildMailboxConfig converts node configuration into a mailbox configuration
+func buildMailboxConfig(config *NodeConfig) (*message.MailboxConfig, error) {
+	mailboxConfig := message.DefaultMailboxConfig()
+
+	for _, owner := range config.MailboxOwners {
+		if !user.ValidateDID(owner) {
+			return nil, fmt.Errorf("invalid mailbox owner DID: %s", owner)
+		}
+		mailboxConfig.ServeOwners = append(mailboxConfig.ServeOwners, owner)
+	}
+
+	for _, addr := range config.Mailboxes {
+		info, err := peer.AddrInfoFromString(addr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid mailbox address %s: %w", addr, err)
+		}
+		mailboxConfig.Mailboxes = append(mailboxConfig.Mailboxes, *info)
+	}
+
+	return mailboxConfig, nil
+}
+
+// defaultDataDir returns ~/.xelvra, or an empty string if the home directory is unknown
+func defaultDataDir() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".xelvra")
+}
+
 // NewPeerChatNode creates a new P2P node with optimized settings
 func NewPeerChatNode(ctx context.Context, config *NodeConfig) (*PeerChatNode, error) {
 	if config == nil {
@@ -155,10 +264,16 @@ func NewPeerChatNode(ctx context.Context, config *NodeConfig) (*PeerChatNode, er
 		})
 	}
 
-	// Generate MessengerID (which includes Ed25519 keys)
-	identity, err := user.GenerateMessengerID()
+	// Load the persistent identity, or generate an ephemeral one without a data directory
+	var identity *user.MessengerID
+	var err error
+	if config.DataDir != "" {
+		identity, err = user.LoadOrCreateMessengerID(filepath.Join(config.DataDir, user.IdentityFileName))
+	} else {
+		identity, err = user.GenerateMessengerID()
+	}
 	if err != nil {
-		return nil, fmt.Errorf("failed to generate messenger identity: %w", err)
+		return nil, fmt.Errorf("failed to load messenger identity: %w", err)
 	}
 
 	// Convert to libp2p private key
@@ -167,33 +282,82 @@ func NewPeerChatNode(ctx context.Context, config *NodeConfig) (*PeerChatNode, er
 		return nil, fmt.Errorf("failed to convert private key: %w", err)
 	}
 
+	// Private networks and bootstrap peers may come from the data directory
+	networkKey, bootstrapPeers, err := resolveNetwork(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load network configuration: %w", err)
+	}
+
 	// Create context with cancellation
 	nodeCtx, cancel := context.WithCancel(ctx)
 
 	// Configure libp2p options for optimal performance
+	listenAddrs := append([]string(nil), config.ListenAddrs...)
+	webOpts, webListenAddrs, err := webTransportOptions(config, networkKey != nil, logger)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	listenAddrs = append(listenAddrs, webListenAddrs...)
+
+	var kadDHT *dual.DHT
+	holePuncher := NewHolePuncher(logger)
+	relays := newRelayCandidates(bootstrapPeers)
+	bandwidth := metrics.NewBandwidthCounter()
+	activeRelays := config.ActiveRelays
+	if activeRelays <= 0 {
+		activeRelays = defaultActiveRelays
+	}
 	opts := []libp2p.Option{
 		libp2p.Identity(privKey),
-		libp2p.ListenAddrStrings(config.ListenAddrs...),
-		libp2p.Ping(false),   // Disable built-in ping to save resources
+		libp2p.ListenAddrStrings(listenAddrs...),
+		libp2p.Ping(true),    // Answer pings so peers can measure latency for their address books
 		libp2p.EnableRelay(), // Enable relay for NAT traversal (basic relay support)
-		libp2p.Routing(func(h host.Host) (routing.PeerRouting, error) {
+		// Behind a NAT: learn it with AutoNAT, reserve circuit relay v2 slots
+		// and upgrade relayed connections to direct ones with DCUtR
+		libp2p.EnableAutoNATv2(),
+		libp2p.EnableAutoRelayWithPeerSource(relays.peers, autorelay.WithNumRelays(activeRelays)),
+		libp2p.EnableHolePunching(holepunch.WithTracer(holePuncher)),
+		libp2p.BandwidthReporter(bandwidth), // Relay throughput
+	}
+
+	if !config.DisableDHT {
+		opts = append(opts, libp2p.Routing(func(h host.Host) (routing.PeerRouting, error) {
 			// Create DHT for routing
 			dht, err := dual.New(nodeCtx, h)
 			if err != nil {
 				return nil, err
 			}
+			kadDHT = dht
 			return dht, nil
-		}),
+		}))
+	}
+
+	// Opt-in circuit relay v2 service for NATed contacts or network members
+	var relayAllowlist *RelayAllowlist
+	if config.RelayService {
+		relayAllowlist = NewRelayAllowlist(networkKey != nil)
+		opts = append(opts, config.RelayLimits.Option(relayAllowlist))
+	}
+
+	// Only peers holding the pre-shared key can connect to a private network
+	if networkKey != nil {
+		opts = append(opts, libp2p.PrivateNetwork(networkKey))
+		logger.WithField("network", NetworkKeyFingerprint(networkKey)).Info("Private network enabled")
 	}
 
 	// Add TCP transport
 	if config.EnableTCP {
-		opts = append(opts, libp2p.Transport(tcp.NewTCPTransport))
+		// Link-local peers found by IPv6 discovery are reached over TCP too
+		opts = append(opts, libp2p.Transport(tcp.NewTCPTransport), LinkLocalTransport())
 		logger.Info("TCP transport enabled")
 	}
 
-	// Add QUIC transport with buffer size configuration
-	if config.EnableQUIC {
+	// Add QUIC transport with buffer size configuration; QUIC cannot protect
+	// connections with a pre-shared key, so private networks run over TCP
+	if config.EnableQUIC && networkKey != nil {
+		logger.Info("QUIC transport disabled in a private network")
+	} else if config.EnableQUIC {
 		// Try to increase UDP buffer sizes for QUIC
 		if err := increaseUDPBufferSizes(logger); err != nil {
 			logger.WithError(err).Warn("Failed to increase UDP buffer sizes, QUIC performance may be reduced")
@@ -208,6 +372,12 @@ func NewPeerChatNode(ctx context.Context, config *NodeConfig) (*PeerChatNode, er
 		logger.Info("QUIC transport enabled")
 	}
 
+	// Dial WebSocket and WebTransport first where TCP and QUIC keep failing
+	if len(webOpts) > 0 {
+		opts = append(opts, webOpts...)
+		opts = append(opts, newTransportFallback(logger).options()...)
+	}
+
 	// Create the libp2p host
 	h, err := libp2p.New(opts...)
 	if err != nil {
@@ -223,15 +393,114 @@ func NewPeerChatNode(ctx context.Context, config *NodeConfig) (*PeerChatNode, er
 		startTime: time.Now(),
 		config:    config,
 		identity:  identity,
+		dht:       kadDHT,
 	}
 
 	// Create network components
+	relays.setHost(h)
 	node.stunClient = NewLegacySTUNClient(logger)
+	node.natTraversal = NewAdvancedNATTraversal(h, logger)
+	node.natTraversal.SetHolePuncher(holePuncher)
+	node.natTraversal.SetRelaySelection(config.RelayPolicy, activeRelays)
+	node.natTraversal.SetRelaySource(relays.candidates)
+	node.natTraversal.SetBandwidthReporter(bandwidth)
+	relays.setPreferred(node.natTraversal.PreferredRelays)
+	if len(config.STUNServers) > 0 {
+		node.stunClient.SetServers(config.STUNServers)
+		node.natTraversal.SetSTUNServers(config.STUNServers)
+	}
 	node.discoveryManager = NewDiscoveryManager(h, logger)
+	node.discoveryManager.SetBootstrapPeers(bootstrapPeers)
+	node.discoveryManager.SetNATTraversal(node.natTraversal)
+	node.discoveryManager.SetRelayService(config.RelayService)
+	relays.setFinder(node.discoveryManager.findRelays)
+	if kadDHT != nil {
+		node.discoveryManager.SetDHT(kadDHT)
+	} else {
+		node.discoveryManager.DisableDHT()
+	}
 	node.energyManager = NewEnergyManager(nodeCtx, logger)
 
+	// Open the local database for durable state such as the outbox
+	var outbox message.OutboxStore
+	if config.DataDir != "" {
+		database, err := db.NewSQLiteDB(config.DataDir, databasePassword(config.DatabasePassword, identity), logger)
+		if err != nil {
+			logger.WithError(err).Warn("Failed to open database, offline messages will be kept in memory")
+		} else {
+			node.database = database
+			outbox = database
+		}
+	}
+
 	// Create message manager
-	node.messageManager = message.NewMessageManager(h, identity, logger)
+	node.messageManager = message.NewMessageManager(h, identity, outbox, logger)
+	if config.DataDir != "" {
+		node.messageManager.SetDownloadDir(filepath.Join(config.DataDir, "downloads"))
+	}
+	if node.database != nil {
+		node.messageManager.SetMessageStore(node.database)
+		node.messageManager.SetFileTransferStore(node.database)
+		node.messageManager.SetContactStore(node.database)
+
+		// Remember peer addresses across restarts
+		node.addressBook = NewAddressBook(h, node.database, logger)
+		node.addressBook.SetContacts(node.database, identity.DID)
+	}
+	if relayAllowlist != nil {
+		if node.database != nil {
+			relayAllowlist.SetContacts(node.database, identity.DID)
+		} else if networkKey == nil {
+			logger.Warn("Relay service needs contacts or a private network, no peer will be relayed")
+		}
+	}
+	if config.FileAcceptPolicy != nil {
+		node.messageManager.SetFileAcceptPolicy(config.FileAcceptPolicy)
+	}
+	if config.EncryptDownloads {
+		node.messageManager.SetEncryptFilesAtRest(true)
+	}
+	node.messageManager.FileTransfers().SetOfferHandlers(node.announceFileOffer, node.writeFileOffers)
+
+	// Throttle file transfers and pause large ones while the battery is low
+	node.messageManager.FileTransfers().SetBandwidthLimits(config.Bandwidth)
+	node.messageManager.FileTransfers().SetPauseCheck(node.energyManager.IsDeepSleepMode)
+	node.energyManager.SetDeepSleepHandler(node.onDeepSleep)
+
+	// Let peers download files we hold in parallel with other holders
+	if config.ShareFiles {
+		var contentRouting routing.ContentRouting
+		if kadDHT != nil {
+			contentRouting = kadDHT
+		}
+		node.messageManager.EnableFileSwarm(contentRouting)
+	}
+
+	// Enable multi-hop routing as a fallback when peers cannot connect directly
+	if config.EnableRouting {
+		if node.database == nil && len(config.RoutingFriends) == 0 {
+			logger.Warn("Routing needs contacts or routing friends, no peer will be routed through")
+		}
+		if err := enableRouting(node.messageManager, config); err != nil {
+			node.closeUnstarted()
+			return nil, err
+		}
+	}
+
+	// Enable store-and-forward mailboxes when we use or serve one
+	if len(config.Mailboxes) > 0 || len(config.MailboxOwners) > 0 {
+		mailboxConfig, err := buildMailboxConfig(config)
+		if err != nil {
+			node.closeUnstarted()
+			return nil, err
+		}
+
+		var mailboxStore message.MailboxStore
+		if node.database != nil {
+			mailboxStore = node.database
+		}
+		node.messageManager.EnableMailbox(mailboxConfig, mailboxStore)
+	}
 
 	// Set up stream handler for Xelvra protocol
 	h.SetStreamHandler(XelvraProtocolID, node.handleStream)
@@ -244,6 +513,30 @@ func NewPeerChatNode(ctx context.Context, config *NodeConfig) (*PeerChatNode, er
 	return node, nil
 }
 
+// closeUnstarted releases everything NewPeerChatNode set up when it fails
+// after the host was created
+func (n *PeerChatNode) closeUnstarted() {
+	if n.messageManager != nil {
+		if err := n.messageManager.Stop(); err != nil {
+			n.logger.WithError(err).Warn("Failed to stop message manager")
+		}
+	}
+	if n.dht != nil {
+		if err := n.dht.Close(); err != nil {
+			n.logger.WithError(err).Warn("Failed to close DHT")
+		}
+	}
+	if n.database != nil {
+		if err := n.database.Close(); err != nil {
+			n.logger.WithError(err).Warn("Failed to close database")
+		}
+	}
+	n.cancel()
+	if err := n.host.Close(); err != nil {
+		n.logger.WithError(err).Warn("Failed to close host")
+	}
+}
+
 // Start begins the P2P node operations
 func (n *PeerChatNode) Start() error {
 	n.logger.Info("Starting PeerChatNode...")
@@ -264,14 +557,22 @@ func (n *PeerChatNode) Start() error {
 
 	// Register console message handler for text messages
 	n.logger.Debug("Creating console message handler...")
-	consoleHandler := message.NewConsoleMessageHandler(n.logger)
+	consoleHandler := message.NewConsoleMessageHandler(n.logger, n.messageManager.History())
 	n.messageManager.RegisterHandler(message.MessageTypeText, consoleHandler)
 	n.messageManager.RegisterHandler(message.MessageTypeSystem, consoleHandler)
 	n.logger.Debug("Message handlers registered, writing status file...")
 
+	// Pick up file offer decisions from peerchat-cli transfers
+	go n.watchFileDecisions()
+
 	// Start NAT discovery
 	n.logger.Debug("Starting NAT discovery...")
 	go n.discoverNAT()
+	go func() {
+		if err := n.natTraversal.Start(); err != nil {
+			n.logger.WithError(err).Warn("Failed to start NAT traversal")
+		}
+	}()
 
 	// Start energy management
 	n.logger.Debug("Starting energy management...")
@@ -279,6 +580,13 @@ func (n *PeerChatNode) Start() error {
 		n.logger.WithError(err).Warn("Failed to start energy management")
 	}
 
+	// Reconnect to known peers before discovering new ones
+	if n.addressBook != nil {
+		if err := n.addressBook.Start(); err != nil {
+			n.logger.WithError(err).Warn("Failed to load address book")
+		}
+	}
+
 	// Start peer discovery
 	n.logger.Debug("Starting peer discovery...")
 	if err := n.discoveryManager.Start(); err != nil {
@@ -313,6 +621,12 @@ func (n *PeerChatNode) Stop() error {
 		}
 	}
 
+	if n.natTraversal != nil {
+		if err := n.natTraversal.Stop(); err != nil {
+			n.logger.WithError(err).Error("Failed to stop NAT traversal")
+		}
+	}
+
 	// Stop message manager
 	if n.messageManager != nil {
 		if err := n.messageManager.Stop(); err != nil {
@@ -320,7 +634,28 @@ func (n *PeerChatNode) Stop() error {
 		}
 	}
 
-	// Remove status file
+	// Save known peers while their connections are still open
+	if n.addressBook != nil {
+		if err := n.addressBook.Stop(); err != nil {
+			n.logger.WithError(err).Error("Failed to stop address book")
+		}
+	}
+
+	if n.dht != nil {
+		if err := n.dht.Close(); err != nil {
+			n.logger.WithError(err).Error("Failed to close DHT")
+		}
+	}
+
+	// Close the database after everything that writes to it has stopped
+	if n.database != nil {
+		if err := n.database.Close(); err != nil {
+			n.logger.WithError(err).Error("Failed to close database")
+		}
+	}
+
+	// Remove status and offer files
+	n.removeFileOffers()
 	if err := n.removeStatusFile(); err != nil {
 		n.logger.WithError(err).Warn("Failed to remove status file")
 	}
@@ -365,6 +700,27 @@ func (n *PeerChatNode) SendMessage(to string, content []byte, msgType message.Me
 	return n.messageManager.SendMessage(to, content, msgType)
 }
 
+// ReplyToMessage sends a reply to a message from the recent history
+func (n *PeerChatNode) ReplyToMessage(number int, content []byte) error {
+	if n.messageManager == nil {
+		return fmt.Errorf("message manager not initialized")
+	}
+
+	parent, exists := n.messageManager.History().Get(number)
+	if !exists {
+		return fmt.Errorf("message [%d] not found in history", number)
+	}
+	return n.messageManager.SendReply(parent, content)
+}
+
+// GetMessageHistory returns the recent message history
+func (n *PeerChatNode) GetMessageHistory() *message.MessageHistory {
+	if n.messageManager == nil {
+		return nil
+	}
+	return n.messageManager.History()
+}
+
 // SendFile sends a file to a peer
 func (n *PeerChatNode) SendFile(peerID peer.ID, filePath string) error {
 	if n.messageManager == nil {
@@ -373,6 +729,20 @@ func (n *PeerChatNode) SendFile(peerID peer.ID, filePath string) error {
 	return n.messageManager.SendFile(peerID, filePath)
 }
 
+// SendFiles sends files and directories to a peer as one multi-file transfer
+func (n *PeerChatNode) SendFiles(peerID peer.ID, paths []string) (*message.FileManifest, error) {
+	if n.messageManager == nil {
+		return nil, fmt.Errorf("message manager not initialized")
+	}
+	return n.messageManager.SendFiles(peerID, paths)
+}
+
+// HolePunchHistory returns recent direct, DCUtR and relayed connection
+// attempts, oldest first
+func (n *PeerChatNode) HolePunchHistory() []HolePunchAttempt {
+	return n.natTraversal.HolePunchHistory()
+}
+
 // GetIdentity returns the node's identity
 func (n *PeerChatNode) GetIdentity() *user.MessengerID {
 	return n.identity
@@ -393,6 +763,16 @@ func (n *PeerChatNode) SetBatteryLevel(level float64) {
 	}
 }
 
+// onDeepSleep pauses file transfers in deep sleep and resumes them when power returns
+func (n *PeerChatNode) onDeepSleep(active bool) {
+	if active {
+		n.logger.WithField("urgent_file_size", message.UrgentFileSize).Info("Pausing file transfers until power returns")
+		return
+	}
+	n.logger.Info("Resuming paused file transfers")
+	n.messageManager.FileTransfers().ResumeAll()
+}
+
 // GetStats returns basic node statistics
 func (n *PeerChatNode) GetStats() map[string]interface{} {
 	n.mu.RLock()
@@ -464,7 +844,7 @@ func (n *PeerChatNode) writeStatusFile() error {
 	transports := []NetworkTransport{}
 	for _, addr := range n.host.Addrs() {
 		transport := NetworkTransport{
-			Type:      "tcp", // Simplified - would need to detect actual transport
+			Type:      transportName(addr),
 			LocalAddr: addr.String(),
 			IsActive:  true,
 		}
@@ -494,6 +874,7 @@ func (n *PeerChatNode) writeStatusFile() error {
 		Transports:        transports,
 		NATInfo:           natInfo,
 		Discovery:         discoveryStatus,
+		Relays:            n.natTraversal.RelayHealth(),
 		NetworkQuality:    n.GetNetworkQuality(),
 	}
 
@@ -629,7 +1010,7 @@ func (n *PeerChatNode) GetNetworkQuality() string {
 			return "excellent"
 		}
 		return "good"
-	case "full_cone", "port_restricted":
+	case "full_cone", "restricted", "port_restricted":
 		if connectedPeers > 0 {
 			return "good"
 		}
@@ -0,0 +1,340 @@
+package p2p
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/p2p/protocol/ping"
+	multiaddr "github.com/multiformats/go-multiaddr"
+	"github.com/sirupsen/logrus"
+)
+
+// String returns the policy name used in flags and logs
+func (p RelaySelectionPolicy) String() string {
+	switch p {
+	case PolicyLowestLatency:
+		return "latency"
+	case PolicyHighestReliability:
+		return "reliability"
+	case PolicyRandom:
+		return "random"
+	case PolicyRoundRobin:
+		return "round-robin"
+	default:
+		return "unknown"
+	}
+}
+
+// ParseRelaySelectionPolicy parses a policy name as returned by String
+func ParseRelaySelectionPolicy(name string) (RelaySelectionPolicy, error) {
+	for _, policy := range []RelaySelectionPolicy{PolicyLowestLatency, PolicyHighestReliability, PolicyRandom, PolicyRoundRobin} {
+		if strings.EqualFold(name, policy.String()) {
+			return policy, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown relay selection policy %q (latency, reliability, random or round-robin)", name)
+}
+
+// newRelayManager creates a relay manager ranking the lowest latency relays
+// first for defaultActiveRelays reservations
+func newRelayManager(h host.Host, logger *logrus.Logger) *RelayManager {
+	rm := &RelayManager{
+		host:          h,
+		relayServers:  make(map[peer.ID]*RelayServer),
+		activeRelays:  make([]peer.ID, 0),
+		relaySelector: &RelaySelector{selectionPolicy: PolicyLowestLatency},
+		numRelays:     defaultActiveRelays,
+		trigger:       make(chan struct{}, 1),
+		logger:        logger,
+	}
+	rm.notify = &network.NotifyBundle{DisconnectedF: rm.disconnected}
+	return rm
+}
+
+// rank orders copies of relay records by the policy, leaving out unreachable
+// relays
+func (rs *RelaySelector) rank(servers []RelayServer) []RelayServer {
+	ranked := make([]RelayServer, 0, len(servers))
+	for _, server := range servers {
+		if server.Reachable {
+			ranked = append(ranked, server)
+		}
+	}
+
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	switch rs.selectionPolicy {
+	case PolicyHighestReliability:
+		slices.SortStableFunc(ranked, func(a, b RelayServer) int {
+			if c := cmp.Compare(b.expectedReliability(), a.expectedReliability()); c != 0 {
+				return c
+			}
+			return cmp.Compare(a.Latency, b.Latency)
+		})
+	case PolicyRandom:
+		rand.Shuffle(len(ranked), func(i, j int) {
+			ranked[i], ranked[j] = ranked[j], ranked[i]
+		})
+	case PolicyRoundRobin:
+		slices.SortFunc(ranked, func(a, b RelayServer) int {
+			return strings.Compare(string(a.PeerID), string(b.PeerID))
+		})
+		if len(ranked) > 0 {
+			start := rs.next % len(ranked)
+			ranked = append(ranked[start:], ranked[:start]...)
+		}
+		rs.next++
+	default:
+		slices.SortStableFunc(ranked, func(a, b RelayServer) int {
+			return cmp.Compare(a.Latency, b.Latency)
+		})
+	}
+	return ranked
+}
+
+// expectedReliability estimates the chance of a probe being answered and a
+// reservation being kept, giving relays we know little about the benefit of the doubt
+func (s *RelayServer) expectedReliability() float64 {
+	answered := float64(s.answered+1) / float64(s.Probes+2)
+	kept := float64(s.Reservations-s.Lost+1) / float64(s.Reservations+2)
+	return answered * kept
+}
+
+// selectBestRelay returns the relay to route a connection through: one we
+// hold a reservation with, picked by the policy
+func (rm *RelayManager) selectBestRelay() peer.ID {
+	rm.mu.RLock()
+	active := make([]RelayServer, 0, len(rm.activeRelays))
+	for _, id := range rm.activeRelays {
+		active = append(active, *rm.relayServers[id])
+	}
+	rm.mu.RUnlock()
+
+	if ranked := rm.relaySelector.rank(active); len(ranked) > 0 {
+		return ranked[0].PeerID
+	}
+	return ""
+}
+
+// preferred returns up to num relays for AutoRelay to reserve slots on: the
+// active ones, then the best ranked candidates
+func (rm *RelayManager) preferred(num int) []peer.AddrInfo {
+	rm.mu.RLock()
+	var candidates []RelayServer
+	relays := make([]peer.AddrInfo, 0, num)
+	for _, server := range rm.relayServers {
+		if server.Active {
+			relays = append(relays, rm.host.Peerstore().PeerInfo(server.PeerID))
+		} else {
+			candidates = append(candidates, *server)
+		}
+	}
+	rm.mu.RUnlock()
+
+	for _, server := range rm.relaySelector.rank(candidates) {
+		relays = append(relays, rm.host.Peerstore().PeerInfo(server.PeerID))
+	}
+	if len(relays) > num {
+		relays = relays[:num]
+	}
+	return relays
+}
+
+// updateRelayMetrics adds new candidates from the source and measures the
+// round trip and throughput of every candidate. Candidates we hold no
+// reservation with are dropped after maxRelayProbeFailures failed probes in
+// a row, until the source returns them again.
+func (rm *RelayManager) updateRelayMetrics(ctx context.Context) {
+	if rm.source != nil {
+		for _, info := range rm.source(ctx, maxRelayCandidates) {
+			if info.ID == rm.host.ID() {
+				continue
+			}
+			rm.host.Peerstore().AddAddrs(info.ID, info.Addrs, time.Hour)
+
+			rm.mu.Lock()
+			if _, ok := rm.relayServers[info.ID]; !ok && len(rm.relayServers) < maxRelayCandidates+rm.numRelays {
+				rm.relayServers[info.ID] = &RelayServer{PeerID: info.ID}
+			}
+			rm.mu.Unlock()
+		}
+	}
+
+	rm.mu.RLock()
+	ids := make([]peer.ID, 0, len(rm.relayServers))
+	for id := range rm.relayServers {
+		ids = append(ids, id)
+	}
+	rm.mu.RUnlock()
+
+	var wg sync.WaitGroup
+	for _, id := range ids {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rm.probe(ctx, id)
+		}()
+	}
+	wg.Wait()
+
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+
+	for id, server := range rm.relayServers {
+		if !server.Active && server.failures >= maxRelayProbeFailures {
+			delete(rm.relayServers, id)
+		}
+	}
+}
+
+// probe pings a relay, connecting first if needed
+func (rm *RelayManager) probe(ctx context.Context, id peer.ID) {
+	ctx, cancel := context.WithTimeout(ctx, relayProbeTimeout)
+	defer cancel()
+
+	var rtt time.Duration
+	err := rm.host.Connect(ctx, rm.host.Peerstore().PeerInfo(id))
+	if err == nil {
+		result := <-ping.Ping(ctx, rm.host, id)
+		rtt, err = result.RTT, result.Error
+	}
+
+	var throughput float64
+	if rm.bandwidth != nil {
+		stats := rm.bandwidth.GetBandwidthForPeer(id)
+		throughput = stats.RateIn + stats.RateOut
+	}
+	var address string
+	if conns := rm.host.Network().ConnsToPeer(id); len(conns) > 0 {
+		address = conns[0].RemoteMultiaddr().String()
+	}
+
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+
+	server, ok := rm.relayServers[id]
+	if !ok {
+		return
+	}
+	server.Probes++
+	if err == nil {
+		server.answered++
+		server.failures = 0
+	} else {
+		server.failures++
+	}
+	server.Reachable = err == nil
+	server.Reliability = float64(server.answered) / float64(server.Probes)
+	server.Latency = rtt
+	server.Throughput = throughput
+	server.LastProbe = time.Now()
+	if address != "" {
+		server.Address = address
+	}
+	if err != nil {
+		rm.logger.WithError(err).WithField("relay", id.String()).Debug("Relay probe failed")
+	}
+}
+
+// setReserved marks the relays in AutoRelay's circuit addresses as active,
+// adding the ones that were no candidates, and counts reservations gained and lost
+func (rm *RelayManager) setReserved(circuits []multiaddr.Multiaddr) {
+	reserved := make(map[peer.ID]bool)
+	for _, addr := range circuits {
+		// <relay address>/p2p/<relay>/p2p-circuit
+		if value, err := addr.ValueForProtocol(multiaddr.P_P2P); err == nil {
+			if id, err := peer.Decode(value); err == nil {
+				reserved[id] = true
+			}
+		}
+	}
+
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+
+	for id := range reserved {
+		if _, ok := rm.relayServers[id]; !ok {
+			rm.relayServers[id] = &RelayServer{PeerID: id, Reachable: true}
+		}
+	}
+	rm.activeRelays = rm.activeRelays[:0]
+	for id, server := range rm.relayServers {
+		switch {
+		case reserved[id] && !server.Active:
+			server.Reservations++
+			rm.logger.WithFields(logrus.Fields{
+				"relay":   id.String(),
+				"latency": server.Latency,
+				"policy":  rm.relaySelector.selectionPolicy.String(),
+			}).Info("Holding relay reservation")
+		case !reserved[id] && server.Active:
+			server.Lost++
+			rm.logger.WithField("relay", id.String()).Info("Relay reservation lost")
+		}
+		server.Active = reserved[id]
+		if server.Active {
+			rm.activeRelays = append(rm.activeRelays, id)
+		}
+	}
+}
+
+// disconnected looks for replacement candidates when the last connection to
+// an active relay closes, taking the reservation with it
+func (rm *RelayManager) disconnected(n network.Network, conn network.Conn) {
+	id := conn.RemotePeer()
+	if n.Connectedness(id) == network.Connected {
+		return
+	}
+
+	rm.mu.RLock()
+	active := slices.Contains(rm.activeRelays, id)
+	rm.mu.RUnlock()
+	if !active {
+		return
+	}
+
+	rm.logger.WithField("relay", id.String()).Info("Relay disconnected, failing over")
+	select {
+	case rm.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// activeCount returns the number of reservations we hold
+func (rm *RelayManager) activeCount() int {
+	rm.mu.RLock()
+	defer rm.mu.RUnlock()
+
+	return len(rm.activeRelays)
+}
+
+// health returns copies of the relay records, active relays first
+func (rm *RelayManager) health() []RelayServer {
+	rm.mu.RLock()
+	servers := make([]RelayServer, 0, len(rm.relayServers))
+	for _, server := range rm.relayServers {
+		servers = append(servers, *server)
+	}
+	rm.mu.RUnlock()
+
+	slices.SortFunc(servers, func(a, b RelayServer) int {
+		if a.Active != b.Active {
+			if a.Active {
+				return -1
+			}
+			return 1
+		}
+		return strings.Compare(string(a.PeerID), string(b.PeerID))
+	})
+	return servers
+}
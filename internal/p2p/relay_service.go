@@ -0,0 +1,115 @@
+package p2p
+
+import (
+	"sync"
+	"time"
+
+	"github.com/Xelvra/peerchat/internal/message"
+	libp2p "github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/peer"
+	relayv2 "github.com/libp2p/go-libp2p/p2p/protocol/circuitv2/relay"
+	multiaddr "github.com/multiformats/go-multiaddr"
+)
+
+// RelayNamespace is the DHT namespace our relays advertise themselves under
+const RelayNamespace = "xelvra-relay"
+
+// RelayServiceConfig limits the circuit relay v2 service. Zero values use
+// DefaultRelayServiceConfig.
+type RelayServiceConfig struct {
+	MaxReservations int           // Peers holding a reservation at once
+	MaxCircuits     int           // Open relayed connections per peer
+	Duration        time.Duration // Lifetime of a relayed connection
+	Data            int64         // Bytes relayed per connection in each direction
+}
+
+// DefaultRelayServiceConfig returns limits sized for a team relay on a home
+// connection: enough for chat and small files, not for bulk transfers
+func DefaultRelayServiceConfig() RelayServiceConfig {
+	return RelayServiceConfig{
+		MaxReservations: 32,
+		MaxCircuits:     4,
+		Duration:        10 * time.Minute,
+		Data:            4 << 20,
+	}
+}
+
+// Option returns the libp2p option running the relay. libp2p starts it only
+// while AutoNAT finds the node publicly reachable.
+func (c RelayServiceConfig) Option(allowlist *RelayAllowlist) libp2p.Option {
+	return libp2p.EnableRelayService(relayv2.WithResources(c.resources()), relayv2.WithACL(allowlist))
+}
+
+// resources converts the limits into relay resources
+func (c RelayServiceConfig) resources() relayv2.Resources {
+	defaults := DefaultRelayServiceConfig()
+	if c.MaxReservations <= 0 {
+		c.MaxReservations = defaults.MaxReservations
+	}
+	if c.MaxCircuits <= 0 {
+		c.MaxCircuits = defaults.MaxCircuits
+	}
+	if c.Duration <= 0 {
+		c.Duration = defaults.Duration
+	}
+	if c.Data <= 0 {
+		c.Data = defaults.Data
+	}
+
+	resources := relayv2.DefaultResources()
+	resources.MaxReservations = c.MaxReservations
+	resources.MaxCircuits = c.MaxCircuits
+	resources.Limit = &relayv2.RelayLimit{Duration: c.Duration, Data: c.Data}
+	return resources
+}
+
+// RelayAllowlist decides who may use the relay: every peer in a private
+// network, since only members can connect, and otherwise the owner's
+// contacts that are not blocked. Both ends of a relayed connection must be
+// allowed.
+type RelayAllowlist struct {
+	mu             sync.RWMutex
+	privateNetwork bool
+	contacts       message.ContactStore
+	ownerDID       string
+}
+
+// NewRelayAllowlist creates an allowlist. Outside a private network it
+// denies everyone until SetContacts is called.
+func NewRelayAllowlist(privateNetwork bool) *RelayAllowlist {
+	return &RelayAllowlist{privateNetwork: privateNetwork}
+}
+
+// SetContacts allows owner's contacts
+func (a *RelayAllowlist) SetContacts(contacts message.ContactStore, ownerDID string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.contacts = contacts
+	a.ownerDID = ownerDID
+}
+
+// AllowReserve implements relayv2.ACLFilter
+func (a *RelayAllowlist) AllowReserve(p peer.ID, _ multiaddr.Multiaddr) bool {
+	return a.allowed(p)
+}
+
+// AllowConnect implements relayv2.ACLFilter
+func (a *RelayAllowlist) AllowConnect(src peer.ID, _ multiaddr.Multiaddr, dest peer.ID) bool {
+	return a.allowed(src) && a.allowed(dest)
+}
+
+// allowed reports whether a peer may use the relay
+func (a *RelayAllowlist) allowed(p peer.ID) bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	if a.privateNetwork {
+		return true
+	}
+	if a.contacts == nil {
+		return false
+	}
+	isContact, blocked, err := a.contacts.ContactStatus(a.ownerDID, p)
+	return err == nil && isContact && !blocked
+}
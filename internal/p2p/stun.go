@@ -4,9 +4,7 @@ import (
 	"context"
 	"fmt"
 	"net"
-	"time"
 
-	"github.com/pion/stun"
 	"github.com/sirupsen/logrus"
 )
 
@@ -20,6 +18,7 @@ type LegacySTUNClient struct {
 func NewLegacySTUNClient(logger *logrus.Logger) *LegacySTUNClient {
 	return &LegacySTUNClient{
 		servers: []string{
+			"stun.stunprotocol.org:3478", // Supports RFC 5780 behavior discovery
 			"stun.l.google.com:19302",
 			"stun1.l.google.com:19302",
 			"stun2.l.google.com:19302",
@@ -30,12 +29,19 @@ func NewLegacySTUNClient(logger *logrus.Logger) *LegacySTUNClient {
 	}
 }
 
-// DiscoverNAT discovers NAT type and public IP address
+// SetServers replaces the STUN servers (host:port) used for NAT discovery
+func (s *LegacySTUNClient) SetServers(servers []string) {
+	s.servers = append([]string(nil), servers...)
+}
+
+// DiscoverNAT discovers NAT type and public IP address. The type is found
+// with RFC 5780 tests; if no server supports them, only the public address is
+// reported and the type stays unknown.
 func (s *LegacySTUNClient) DiscoverNAT(ctx context.Context, localPort int) (*NATInfo, error) {
 	s.logger.Info("Starting NAT discovery via STUN...")
 
 	natInfo := &NATInfo{
-		Type:        "unknown",
+		Type:        NATTypeUnknown.String(),
 		STUNServers: s.servers,
 		LocalPort:   localPort,
 		UsingRelay:  false,
@@ -50,103 +56,32 @@ func (s *LegacySTUNClient) DiscoverNAT(ctx context.Context, localPort int) (*NAT
 		natInfo.LocalIP = localIP
 	}
 
-	// Try each STUN server
-	for _, server := range s.servers {
-		s.logger.WithField("server", server).Debug("Trying STUN server")
-
-		publicIP, publicPort, natType, err := s.querySTUNServer(ctx, server, localPort)
-		if err != nil {
-			s.logger.WithError(err).WithField("server", server).Debug("STUN query failed")
-			continue
-		}
-
-		natInfo.PublicIP = publicIP
-		natInfo.PublicPort = publicPort
-		natInfo.Type = natType
-
-		s.logger.WithFields(logrus.Fields{
-			"public_ip":   publicIP,
-			"public_port": publicPort,
-			"nat_type":    natType,
-			"server":      server,
-		}).Info("NAT discovery successful")
-
-		return natInfo, nil
+	behavior, err := discoverNATBehavior(ctx, s.servers, DefaultSTUNTimeout)
+	if behavior != nil && behavior.MappedAddr != nil {
+		natInfo.PublicIP = behavior.MappedAddr.IP.String()
+		natInfo.PublicPort = behavior.MappedAddr.Port
 	}
-
-	s.logger.Warn("All STUN servers failed, assuming symmetric NAT")
-	natInfo.Type = "symmetric"
-	return natInfo, fmt.Errorf("all STUN servers failed")
-}
-
-// querySTUNServer queries a single STUN server
-func (s *LegacySTUNClient) querySTUNServer(ctx context.Context, server string, localPort int) (string, int, string, error) {
-	// Create UDP connection
-	conn, err := net.DialTimeout("udp", server, 5*time.Second)
 	if err != nil {
-		return "", 0, "", fmt.Errorf("failed to connect to STUN server: %w", err)
-	}
-	defer func() {
-		if err := conn.Close(); err != nil {
-			// Log error but don't fail the function - STUN query can continue
-			_ = err // Explicitly ignore error
-		}
-	}()
-
-	// Set deadline
-	deadline, ok := ctx.Deadline()
-	if ok {
-		if err := conn.SetDeadline(deadline); err != nil {
-			return "", 0, "", fmt.Errorf("failed to set deadline: %w", err)
-		}
-	} else {
-		if err := conn.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
-			return "", 0, "", fmt.Errorf("failed to set deadline: %w", err)
+		if natInfo.PublicIP != "" {
+			s.logger.WithError(err).WithField("public_ip", natInfo.PublicIP).Warn("NAT type could not be determined")
+			return natInfo, nil
 		}
-	}
-
-	// Create STUN binding request
-	message := stun.MustBuild(stun.TransactionID, stun.BindingRequest)
-
-	// Send request
-	_, err = conn.Write(message.Raw)
-	if err != nil {
-		return "", 0, "", fmt.Errorf("failed to send STUN request: %w", err)
-	}
-
-	// Read response
-	buf := make([]byte, 1024)
-	n, err := conn.Read(buf)
-	if err != nil {
-		return "", 0, "", fmt.Errorf("failed to read STUN response: %w", err)
-	}
-
-	// Parse response
-	response := &stun.Message{Raw: buf[:n]}
-	if err := response.Decode(); err != nil {
-		return "", 0, "", fmt.Errorf("failed to decode STUN response: %w", err)
-	}
-
-	// Extract mapped address
-	var mappedAddr stun.XORMappedAddress
-	if err := mappedAddr.GetFrom(response); err != nil {
-		// Try regular mapped address as fallback
-		var regularAddr stun.MappedAddress
-		if err := regularAddr.GetFrom(response); err != nil {
-			return "", 0, "", fmt.Errorf("no mapped address in STUN response")
-		}
-		mappedAddr.IP = regularAddr.IP
-		mappedAddr.Port = regularAddr.Port
-	}
-
-	publicIP := mappedAddr.IP.String()
-	publicPort := mappedAddr.Port
-
-	// Determine NAT type (simplified)
-	localIP, _ := s.getLocalIP()
-	natType := s.determineNATType(localIP, localPort, publicIP, publicPort)
-
-	return publicIP, publicPort, natType, nil
+		s.logger.Warn("All STUN servers failed, assuming symmetric NAT")
+		natInfo.Type = NATTypeSymmetric.String()
+		return natInfo, fmt.Errorf("all STUN servers failed: %w", err)
+	}
+
+	natInfo.Type = behavior.Type.String()
+	s.logger.WithFields(logrus.Fields{
+		"public_ip":   natInfo.PublicIP,
+		"public_port": natInfo.PublicPort,
+		"nat_type":    natInfo.Type,
+		"mapping":     behavior.Mapping,
+		"filtering":   behavior.Filtering,
+		"server":      behavior.Server,
+	}).Info("NAT discovery successful")
+
+	return natInfo, nil
 }
 
 // getLocalIP gets the local IP address
@@ -165,42 +100,3 @@ func (s *LegacySTUNClient) getLocalIP() (string, error) {
 	localAddr := conn.LocalAddr().(*net.UDPAddr)
 	return localAddr.IP.String(), nil
 }
-
-// determineNATType determines NAT type based on addresses
-func (s *LegacySTUNClient) determineNATType(localIP string, localPort int, publicIP string, publicPort int) string {
-	// If public IP equals local IP, no NAT
-	if publicIP == localIP {
-		return "none"
-	}
-
-	// If ports are the same, likely full cone NAT
-	if publicPort == localPort {
-		return "full_cone"
-	}
-
-	// Check if it's a private IP range
-	if s.isPrivateIP(localIP) {
-		// Different ports suggest port-restricted or symmetric NAT
-		// This is a simplified detection - real implementation would need multiple tests
-		return "port_restricted"
-	}
-
-	return "symmetric"
-}
-
-// isPrivateIP checks if an IP is in private range
-func (s *LegacySTUNClient) isPrivateIP(ip string) bool {
-	privateRanges := []string{
-		"10.0.0.0/8",
-		"172.16.0.0/12",
-		"192.168.0.0/16",
-	}
-
-	for _, cidr := range privateRanges {
-		_, network, _ := net.ParseCIDR(cidr)
-		if network.Contains(net.ParseIP(ip)) {
-			return true
-		}
-	}
-	return false
-}
@@ -0,0 +1,228 @@
+package p2p
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/pion/stun"
+)
+
+// STUNServer is a minimal RFC 5780 STUN server listening on two IPs and two
+// ports. It answers binding requests with the mapped address, its alternate
+// address and the address it answered from, honouring CHANGE-REQUEST. It can
+// emulate a NAT of a given type in front of its clients, so NAT behavior
+// discovery can be exercised on one machine without the internet; on Linux
+// 127.0.0.1 and 127.0.0.2 serve as the two IPs.
+type STUNServer struct {
+	conns   [2][2]*net.UDPConn // Indexed by [alternate IP][alternate port]
+	emulate NATType
+	wg      sync.WaitGroup
+
+	mu        sync.Mutex
+	mappings  map[string]int             // Emulated mapping key -> external port
+	contacted map[string]map[string]bool // Client -> IPs and addresses it has sent to
+	nextPort  int
+}
+
+// emulatedPublicIP is the address emulated NATs map clients to (TEST-NET-3)
+var emulatedPublicIP = net.IPv4(203, 0, 113, 7)
+
+// NewSTUNServer starts a STUN server on primaryIP and alternateIP. With
+// emulate set to a NAT type other than NATTypeUnknown and NATTypeOpen, clients
+// see the mapping and filtering of that type.
+func NewSTUNServer(primaryIP, alternateIP net.IP, emulate NATType) (*STUNServer, error) {
+	s := &STUNServer{
+		emulate:   emulate,
+		mappings:  make(map[string]int),
+		contacted: make(map[string]map[string]bool),
+		nextPort:  40000,
+	}
+
+	// Both IPs need the same two ports; retry if a port is taken on the alternate IP
+	var err error
+	for attempt := 0; attempt < 10; attempt++ {
+		if err = s.listen(primaryIP, alternateIP); err == nil {
+			break
+		}
+		s.closeConns()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range s.conns {
+		for j := range s.conns[i] {
+			s.wg.Add(1)
+			go s.serve(s.conns[i][j])
+		}
+	}
+	return s, nil
+}
+
+// listen binds the four sockets
+func (s *STUNServer) listen(primaryIP, alternateIP net.IP) error {
+	for port := 0; port < 2; port++ {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: primaryIP})
+		if err != nil {
+			return fmt.Errorf("failed to listen on %s: %w", primaryIP, err)
+		}
+		s.conns[0][port] = conn
+
+		alternate := &net.UDPAddr{IP: alternateIP, Port: conn.LocalAddr().(*net.UDPAddr).Port}
+		if s.conns[1][port], err = net.ListenUDP("udp", alternate); err != nil {
+			return fmt.Errorf("failed to listen on %s: %w", alternate, err)
+		}
+	}
+	return nil
+}
+
+// Addr returns the primary address clients are configured with
+func (s *STUNServer) Addr() *net.UDPAddr {
+	return s.conns[0][0].LocalAddr().(*net.UDPAddr)
+}
+
+// Close stops the server
+func (s *STUNServer) Close() error {
+	err := s.closeConns()
+	s.wg.Wait()
+	return err
+}
+
+func (s *STUNServer) closeConns() error {
+	var errs []error
+	for i := range s.conns {
+		for j := range s.conns[i] {
+			if s.conns[i][j] != nil {
+				errs = append(errs, s.conns[i][j].Close())
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// serve answers requests arriving on one socket
+func (s *STUNServer) serve(conn *net.UDPConn) {
+	defer s.wg.Done()
+
+	buf := make([]byte, 1500)
+	for {
+		n, client, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+
+		request := &stun.Message{Raw: append([]byte(nil), buf[:n]...)}
+		if err := request.Decode(); err != nil || request.Type != stun.BindingRequest {
+			continue
+		}
+		s.respond(conn, client, request)
+	}
+}
+
+// respond sends the binding response from the socket CHANGE-REQUEST selects,
+// unless the emulated NAT would filter it
+func (s *STUNServer) respond(received *net.UDPConn, client *net.UDPAddr, request *stun.Message) {
+	ipIndex, portIndex := s.index(received)
+	if value, err := request.Get(stun.AttrChangeRequest); err == nil && len(value) == 4 {
+		if value[3]&changeIPFlag != 0 {
+			ipIndex ^= 1
+		}
+		if value[3]&changePortFlag != 0 {
+			portIndex ^= 1
+		}
+	}
+	from := s.conns[ipIndex][portIndex]
+	fromAddr := from.LocalAddr().(*net.UDPAddr)
+
+	mapped, allowed := s.translate(client, received.LocalAddr().(*net.UDPAddr), fromAddr)
+	if !allowed {
+		return
+	}
+
+	other := s.conns[1][1].LocalAddr().(*net.UDPAddr)
+	response, err := stun.Build(
+		stun.NewTransactionIDSetter(request.TransactionID),
+		stun.BindingSuccess,
+		&stun.XORMappedAddress{IP: mapped.IP, Port: mapped.Port},
+		&stun.OtherAddress{IP: other.IP, Port: other.Port},
+		&stun.ResponseOrigin{IP: fromAddr.IP, Port: fromAddr.Port},
+		stun.Fingerprint,
+	)
+	if err != nil {
+		return
+	}
+	_, _ = from.WriteToUDP(response.Raw, client)
+}
+
+// index returns the position of a socket
+func (s *STUNServer) index(conn *net.UDPConn) (int, int) {
+	for i := range s.conns {
+		for j := range s.conns[i] {
+			if s.conns[i][j] == conn {
+				return i, j
+			}
+		}
+	}
+	return 0, 0
+}
+
+// translate applies the emulated NAT to a request from client to dest and
+// its response from source, returning the mapped address and whether the
+// response passes the filter
+func (s *STUNServer) translate(client, dest, source *net.UDPAddr) (*net.UDPAddr, bool) {
+	var mapping MappingBehavior
+	var filter FilterBehavior
+	switch s.emulate {
+	case NATTypeFullCone:
+		mapping, filter = MappingEndpointIndependent, FilterEndpointIndependent
+	case NATTypeRestrictedCone:
+		mapping, filter = MappingEndpointIndependent, FilterAddressDependent
+	case NATTypePortRestricted:
+		mapping, filter = MappingEndpointIndependent, FilterAddressPortDependent
+	case NATTypeSymmetric:
+		mapping, filter = MappingAddressPortDependent, FilterAddressPortDependent
+	default:
+		return client, true
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Outgoing packets open the filter towards their destination
+	contacted := s.contacted[client.String()]
+	if contacted == nil {
+		contacted = make(map[string]bool)
+		s.contacted[client.String()] = contacted
+	}
+	contacted[dest.IP.String()] = true
+	contacted[dest.String()] = true
+
+	key := client.String()
+	switch mapping {
+	case MappingAddressDependent:
+		key += "|" + dest.IP.String()
+	case MappingAddressPortDependent:
+		key += "|" + dest.String()
+	}
+	port, ok := s.mappings[key]
+	if !ok {
+		port = s.nextPort
+		s.nextPort++
+		s.mappings[key] = port
+	}
+	mapped := &net.UDPAddr{IP: emulatedPublicIP, Port: port}
+
+	switch filter {
+	case FilterAddressDependent:
+		return mapped, contacted[source.IP.String()]
+	case FilterAddressPortDependent:
+		return mapped, contacted[source.String()]
+	default:
+		return mapped, true
+	}
+}
@@ -0,0 +1,219 @@
+package p2p
+
+import (
+	"cmp"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	libp2p "github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/p2p/net/swarm"
+	"github.com/libp2p/go-libp2p/p2p/transport/websocket"
+	webtransport "github.com/libp2p/go-libp2p/p2p/transport/webtransport"
+	multiaddr "github.com/multiformats/go-multiaddr"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// restrictedNetworkThreshold is the number of TCP and QUIC dials failing
+	// in a row, with none succeeding, after which web transports are dialed first
+	restrictedNetworkThreshold = 5
+	// restrictedDialDelay holds back TCP and QUIC dials on a restricted network
+	restrictedDialDelay = time.Second
+	// restrictedSuccessWindow is how long a TCP or QUIC connection succeeding
+	// shows the network lets them through; failures within it are put down to
+	// the peers, such as stale DHT addresses, and not counted
+	restrictedSuccessWindow = 10 * time.Minute
+)
+
+// webTransportOptions returns the options and listen addresses of the
+// WebSocket and WebTransport transports enabled in the configuration.
+// WebTransport cannot protect connections with a pre-shared key and is left
+// out of private networks.
+func webTransportOptions(config *NodeConfig, privateNetwork bool, logger *logrus.Logger) ([]libp2p.Option, []string, error) {
+	var opts []libp2p.Option
+	var listenAddrs []string
+
+	if config.EnableWebSocket {
+		secure := config.WebSocketCertFile != "" || config.WebSocketKeyFile != ""
+		var wsOpts []interface{}
+		if secure {
+			cert, err := tls.LoadX509KeyPair(config.WebSocketCertFile, config.WebSocketKeyFile)
+			if err != nil {
+				return nil, nil, fmt.Errorf("failed to load WebSocket certificate: %w", err)
+			}
+			wsOpts = append(wsOpts, websocket.WithTLSConfig(&tls.Config{Certificates: []tls.Certificate{cert}}))
+		}
+		opts = append(opts, libp2p.Transport(websocket.New, wsOpts...))
+
+		addrs := config.WebSocketListenAddrs
+		if len(addrs) == 0 {
+			scheme := "ws"
+			if secure {
+				scheme = "tls/ws"
+			}
+			addrs = []string{"/ip4/0.0.0.0/tcp/0/" + scheme, "/ip6/::/tcp/0/" + scheme}
+		}
+		listenAddrs = append(listenAddrs, addrs...)
+		logger.WithField("secure", secure).Info("WebSocket transport enabled")
+	}
+
+	if config.EnableWebTransport && privateNetwork {
+		logger.Info("WebTransport transport disabled in a private network")
+	} else if config.EnableWebTransport {
+		opts = append(opts, libp2p.Transport(webtransport.New))
+
+		addrs := config.WebTransportListenAddrs
+		if len(addrs) == 0 {
+			addrs = []string{"/ip4/0.0.0.0/udp/0/quic-v1/webtransport", "/ip6/::/udp/0/quic-v1/webtransport"}
+		}
+		listenAddrs = append(listenAddrs, addrs...)
+		logger.Info("WebTransport transport enabled")
+	}
+
+	return opts, listenAddrs, nil
+}
+
+// isWebAddr reports whether an address is dialed over WebSocket or
+// WebTransport, which pass networks letting only HTTPS out. Relayed
+// addresses are neither web nor direct transport addresses.
+func isWebAddr(addr multiaddr.Multiaddr) bool {
+	switch transportName(addr) {
+	case "websocket", "webtransport":
+		return true
+	default:
+		return false
+	}
+}
+
+// isDirectTransportAddr reports whether an address is dialed over plain TCP
+// or QUIC
+func isDirectTransportAddr(addr multiaddr.Multiaddr) bool {
+	switch transportName(addr) {
+	case "tcp", "quic":
+		return true
+	default:
+		return false
+	}
+}
+
+// transportFallback watches TCP and QUIC dials as the swarm's metrics tracer.
+// When they keep failing with none succeeding for a while, as on networks
+// letting only HTTPS out, its dial ranker dials WebSocket and WebTransport
+// addresses first; a TCP or QUIC connection succeeding restores the default
+// order.
+type transportFallback struct {
+	mu          sync.Mutex
+	failures    int       // TCP and QUIC dials failed since the last one succeeded
+	lastSuccess time.Time // When a TCP or QUIC connection last succeeded
+	logger      *logrus.Logger
+}
+
+var _ swarm.MetricsTracer = (*transportFallback)(nil)
+
+// newTransportFallback creates a fallback for a host's swarm
+func newTransportFallback(logger *logrus.Logger) *transportFallback {
+	return &transportFallback{logger: logger}
+}
+
+// options returns the libp2p options installing the fallback, which is only
+// needed with a web transport to fall back to. libp2p's Prometheus metrics
+// are turned off: nothing collects them, and their swarm tracer would
+// replace ours.
+func (tf *transportFallback) options() []libp2p.Option {
+	return []libp2p.Option{
+		libp2p.DisableMetrics(),
+		libp2p.SwarmOpts(swarm.WithDialRanker(tf.rank), swarm.WithMetricsTracer(tf)),
+	}
+}
+
+// restricted reports whether TCP and QUIC dials are failing repeatedly
+func (tf *transportFallback) restricted() bool {
+	tf.mu.Lock()
+	defer tf.mu.Unlock()
+
+	return tf.failures >= restrictedNetworkThreshold
+}
+
+// rank implements network.DialRanker on top of swarm.DefaultDialRanker
+func (tf *transportFallback) rank(addrs []multiaddr.Multiaddr) []network.AddrDelay {
+	ranked := swarm.DefaultDialRanker(addrs)
+	if !tf.restricted() || !slices.ContainsFunc(addrs, isWebAddr) {
+		return ranked
+	}
+
+	for i := range ranked {
+		if isWebAddr(ranked[i].Addr) {
+			ranked[i].Delay = 0
+		} else {
+			ranked[i].Delay += restrictedDialDelay
+		}
+	}
+	slices.SortStableFunc(ranked, func(a, b network.AddrDelay) int {
+		return cmp.Compare(a.Delay, b.Delay)
+	})
+	return ranked
+}
+
+// record counts a TCP or QUIC dial outcome, logging when the network starts
+// or stops looking restricted. Failures shortly after a success are not
+// counted: the network let TCP or QUIC through, so the peer was at fault.
+func (tf *transportFallback) record(success bool) {
+	tf.mu.Lock()
+	defer tf.mu.Unlock()
+
+	wasRestricted := tf.failures >= restrictedNetworkThreshold
+	switch {
+	case success:
+		tf.failures = 0
+		tf.lastSuccess = time.Now()
+	case tf.lastSuccess.IsZero() || time.Since(tf.lastSuccess) >= restrictedSuccessWindow:
+		tf.failures++
+	}
+
+	switch restricted := tf.failures >= restrictedNetworkThreshold; {
+	case restricted && !wasRestricted:
+		tf.logger.WithField("failed_dials", tf.failures).Info("TCP and QUIC dials keep failing, dialing WebSocket and WebTransport first")
+	case !restricted && wasRestricted:
+		tf.logger.Info("TCP or QUIC dial succeeded, dialing in the default order again")
+	}
+}
+
+// OpenedConnection implements swarm.MetricsTracer
+func (tf *transportFallback) OpenedConnection(dir network.Direction, _ crypto.PubKey, _ network.ConnectionState, laddr multiaddr.Multiaddr) {
+	if dir == network.DirOutbound && isDirectTransportAddr(laddr) {
+		tf.record(true)
+	}
+}
+
+// FailedDialing implements swarm.MetricsTracer. Dials canceled because
+// another address connected first or the caller gave up are not failures.
+func (tf *transportFallback) FailedDialing(addr multiaddr.Multiaddr, dialErr, _ error) {
+	if isDirectTransportAddr(addr) && !errors.Is(dialErr, context.Canceled) {
+		tf.record(false)
+	}
+}
+
+// ClosedConnection implements swarm.MetricsTracer
+func (tf *transportFallback) ClosedConnection(network.Direction, time.Duration, network.ConnectionState, multiaddr.Multiaddr) {
+}
+
+// CompletedHandshake implements swarm.MetricsTracer
+func (tf *transportFallback) CompletedHandshake(time.Duration, network.ConnectionState, multiaddr.Multiaddr) {
+}
+
+// DialCompleted implements swarm.MetricsTracer
+func (tf *transportFallback) DialCompleted(bool, int, time.Duration) {}
+
+// DialRankingDelay implements swarm.MetricsTracer
+func (tf *transportFallback) DialRankingDelay(time.Duration) {}
+
+// UpdatedBlackHoleSuccessCounter implements swarm.MetricsTracer
+func (tf *transportFallback) UpdatedBlackHoleSuccessCounter(string, swarm.BlackHoleState, int, float64) {
+}
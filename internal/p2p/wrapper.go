@@ -21,6 +21,7 @@ type P2PWrapper struct {
 	realNode      *PeerChatNode
 	ctx           context.Context
 	logger        *logrus.Logger
+	configure     func(*NodeConfig) // Optional overrides applied before the node is created
 }
 
 // NodeInfo contains basic node information
@@ -41,6 +42,12 @@ func NewP2PWrapper(ctx context.Context, useSimulation bool) *P2PWrapper {
 	}
 }
 
+// ConfigureNode registers a function that adjusts the node configuration before
+// the real P2P node is started
+func (w *P2PWrapper) ConfigureNode(configure func(*NodeConfig)) {
+	w.configure = configure
+}
+
 // setupLogger configures logging to file with rotation
 func setupLogger() *logrus.Logger {
 	logger := logrus.New()
@@ -162,6 +169,61 @@ func (w *P2PWrapper) SendMessage(peerID, messageText string) error {
 	return w.realNode.SendMessage(peerID, []byte(messageText), message.MessageTypeText)
 }
 
+// ReplyToMessage replies to a message from the recent history by its display number
+func (w *P2PWrapper) ReplyToMessage(number int, messageText string) error {
+	if w.useSimulation {
+		w.logger.WithFields(logrus.Fields{
+			"reply_to": number,
+			"message":  messageText,
+		}).Info("Simulated reply sent")
+		return nil
+	}
+
+	if w.realNode == nil {
+		return fmt.Errorf("node not started")
+	}
+
+	w.logger.WithFields(logrus.Fields{
+		"reply_to": number,
+		"message":  messageText,
+	}).Info("Sending reply")
+
+	return w.realNode.ReplyToMessage(number, []byte(messageText))
+}
+
+// GetRecentMessages returns recent messages with their display numbers, oldest first
+func (w *P2PWrapper) GetRecentMessages(limit int) []*message.HistoryEntry {
+	if w.useSimulation || w.realNode == nil {
+		return nil
+	}
+
+	history := w.realNode.GetMessageHistory()
+	if history == nil {
+		return nil
+	}
+	return history.Entries(limit)
+}
+
+// PendingFileOffers returns incoming files waiting to be accepted or rejected
+func (w *P2PWrapper) PendingFileOffers() []message.FileOffer {
+	if w.useSimulation || w.realNode == nil {
+		return nil
+	}
+	return w.realNode.PendingFileOffers()
+}
+
+// DecideFileOffer accepts or rejects a pending incoming file. Paths pick
+// the files to accept from a multi-file offer.
+func (w *P2PWrapper) DecideFileOffer(id string, accept bool, paths ...string) error {
+	if w.useSimulation || w.realNode == nil {
+		return fmt.Errorf("node not started")
+	}
+	if accept {
+		return w.realNode.AcceptFileOffer("", id, paths...)
+	}
+	return w.realNode.RejectFileOffer("", id)
+}
+
 // startSimulation starts simulation mode
 func (w *P2PWrapper) startSimulation() error {
 	// Simulate startup delay
@@ -181,6 +243,9 @@ func (w *P2PWrapper) startReal() error {
 	config := DefaultNodeConfig()
 	config.LogLevel = w.logger.Level // Use our log level
 	config.Logger = w.logger         // Use our file logger
+	if w.configure != nil {
+		w.configure(config)
+	}
 
 	// Use a channel to handle timeout
 	type result struct {
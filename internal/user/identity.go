@@ -2,6 +2,7 @@ package user
 
 import (
 	"crypto/ed25519"
+	"crypto/hmac"
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/binary"
@@ -10,6 +11,7 @@ import (
 	"time"
 
 	"github.com/libp2p/go-libp2p/core/crypto"
+	pb "github.com/libp2p/go-libp2p/core/crypto/pb"
 	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/mr-tron/base58"
 )
@@ -150,6 +152,14 @@ func (mid *MessengerID) Verify(data, signature []byte) bool {
 	return ed25519.Verify(mid.PublicKey, data, signature)
 }
 
+// DeriveSecret derives a secret for the given purpose from the private key, so
+// that data protected with it can only be read together with the identity
+func (mid *MessengerID) DeriveSecret(purpose string) []byte {
+	mac := hmac.New(sha256.New, mid.PrivateKey.Seed())
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
+
 // VerifySignature verifies a signature from another MessengerID
 func VerifySignature(publicKey ed25519.PublicKey, data, signature []byte) bool {
 	return ed25519.Verify(publicKey, data, signature)
@@ -191,6 +201,29 @@ func generateDID(publicKey ed25519.PublicKey) string {
 	return DIDPrefix + encoded
 }
 
+// KeyDID returns a DID for a public key whose proof-of-work is not known, such
+// as a contact added by peer ID. It does not pass VerifyDIDOwnership.
+func KeyDID(publicKey ed25519.PublicKey) string {
+	return generateDID(publicKey)
+}
+
+// PeerIdentityKey returns the Ed25519 identity key a peer ID was derived from
+func PeerIdentityKey(id peer.ID) (ed25519.PublicKey, error) {
+	pubKey, err := id.ExtractPublicKey()
+	if err != nil {
+		return nil, fmt.Errorf("failed to extract public key of %s: %w", id.String(), err)
+	}
+	if pubKey.Type() != pb.KeyType_Ed25519 {
+		return nil, fmt.Errorf("peer %s does not have an Ed25519 identity key", id.String())
+	}
+
+	raw, err := pubKey.Raw()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read public key of %s: %w", id.String(), err)
+	}
+	return ed25519.PublicKey(raw), nil
+}
+
 // generateDIDWithPOW creates a DID from a public key with PoW validation
 func generateDIDWithPOW(publicKey ed25519.PublicKey, pow *ProofOfWork) string {
 	// Create combined data: publicKey + nonce + difficulty
@@ -227,6 +260,20 @@ func ParseDID(did string) ([]byte, error) {
 	return hash, nil
 }
 
+// VerifyDIDOwnership checks that a DID was derived from the given public key and
+// proof-of-work, so that a signature by that key proves control of the DID
+func VerifyDIDOwnership(did string, publicKey ed25519.PublicKey, pow *ProofOfWork) bool {
+	if len(publicKey) != Ed25519PublicKeySize {
+		return false
+	}
+
+	if !ValidateProofOfWork(publicKey, pow) {
+		return false
+	}
+
+	return generateDIDWithPOW(publicKey, pow) == did
+}
+
 // ValidateDID validates a DID format
 func ValidateDID(did string) bool {
 	_, err := ParseDID(did)
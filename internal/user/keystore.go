@@ -0,0 +1,117 @@
+package user
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// IdentityFileName is the name of the identity key file in the data directory
+const IdentityFileName = "identity.key"
+
+// identityFile is the on-disk representation of a MessengerID
+type identityFile struct {
+	PrivateKey  []byte       `json:"private_key"`
+	ProofOfWork *ProofOfWork `json:"proof_of_work"`
+	CreatedAt   time.Time    `json:"created_at"`
+}
+
+// SaveMessengerID writes the identity to path, readable only by the owner
+func SaveMessengerID(mid *MessengerID, path string) error {
+	data, err := json.Marshal(&identityFile{
+		PrivateKey:  mid.PrivateKey,
+		ProofOfWork: mid.ProofOfWork,
+		CreatedAt:   mid.CreatedAt,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal identity: %w", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("failed to create identity directory: %w", err)
+	}
+
+	// Write to a temporary file first so a crash never leaves a truncated key
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0600); err != nil {
+		return fmt.Errorf("failed to write identity: %w", err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("failed to save identity: %w", err)
+	}
+
+	return nil
+}
+
+// LoadMessengerID reads an identity from path and verifies that its DID is intact
+func LoadMessengerID(path string) (*MessengerID, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read identity: %w", err)
+	}
+
+	var stored identityFile
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return nil, fmt.Errorf("failed to parse identity: %w", err)
+	}
+
+	if len(stored.PrivateKey) != Ed25519PrivateKeySize {
+		return nil, fmt.Errorf("invalid private key size: %d", len(stored.PrivateKey))
+	}
+
+	privateKey := ed25519.PrivateKey(stored.PrivateKey)
+	publicKey := privateKey.Public().(ed25519.PublicKey)
+
+	if !ValidateProofOfWork(publicKey, stored.ProofOfWork) {
+		return nil, fmt.Errorf("invalid proof-of-work in identity file")
+	}
+
+	libp2pPrivKey, err := crypto.UnmarshalEd25519PrivateKey(privateKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create libp2p private key: %w", err)
+	}
+
+	peerID, err := peer.IDFromPrivateKey(libp2pPrivKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create peer ID: %w", err)
+	}
+
+	return &MessengerID{
+		DID:         generateDIDWithPOW(publicKey, stored.ProofOfWork),
+		PublicKey:   publicKey,
+		PrivateKey:  privateKey,
+		PeerID:      peerID,
+		CreatedAt:   stored.CreatedAt,
+		ProofOfWork: stored.ProofOfWork,
+	}, nil
+}
+
+// LoadOrCreateMessengerID loads the identity at path, generating and saving a new
+// one if the file does not exist
+func LoadOrCreateMessengerID(path string) (*MessengerID, error) {
+	mid, err := LoadMessengerID(path)
+	if err == nil {
+		return mid, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	mid, err = GenerateMessengerID()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := SaveMessengerID(mid, path); err != nil {
+		return nil, err
+	}
+
+	return mid, nil
+}
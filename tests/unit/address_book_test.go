@@ -0,0 +1,179 @@
+package unit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Xelvra/peerchat/internal/db"
+	"github.com/Xelvra/peerchat/internal/p2p"
+	"github.com/Xelvra/peerchat/internal/user"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/test"
+	multiaddr "github.com/multiformats/go-multiaddr"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKnownPeerStore(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.ErrorLevel)
+
+	database, err := db.NewSQLiteDB(t.TempDir(), "test-password", logger)
+	require.NoError(t, err)
+	defer func() {
+		assert.NoError(t, database.Close())
+	}()
+
+	addr := func(s string) multiaddr.Multiaddr {
+		maddr, err := multiaddr.NewMultiaddr(s)
+		require.NoError(t, err)
+		return maddr
+	}
+	now := time.Now()
+	older, newer := test.RandPeerIDFatal(t), test.RandPeerIDFatal(t)
+
+	require.NoError(t, database.SaveKnownPeer(&db.KnownPeer{
+		ID:        older,
+		LastSeen:  now.Add(-10 * 24 * time.Hour),
+		Transport: "quic",
+		Latency:   30 * time.Millisecond,
+		Addrs: []db.KnownAddr{
+			{Addr: addr("/ip4/10.0.0.1/tcp/4001"), LastSeen: now.Add(-10 * 24 * time.Hour)},
+		},
+	}))
+	require.NoError(t, database.SaveKnownPeer(&db.KnownPeer{
+		ID:        newer,
+		LastSeen:  now.Add(-time.Hour),
+		Transport: "tcp",
+		Addrs: []db.KnownAddr{
+			{Addr: addr("/ip4/10.0.0.2/tcp/4001"), LastSeen: now.Add(-8 * 24 * time.Hour)},
+			{Addr: addr("/ip4/10.0.0.2/udp/4001/quic-v1"), LastSeen: now.Add(-time.Hour)},
+		},
+	}))
+
+	// Saving again merges addresses and keeps what is not known now
+	require.NoError(t, database.SaveKnownPeer(&db.KnownPeer{
+		ID:       older,
+		LastSeen: now.Add(-20 * 24 * time.Hour),
+		Addrs: []db.KnownAddr{
+			{Addr: addr("/ip4/10.0.0.3/tcp/4001"), LastSeen: now.Add(-20 * 24 * time.Hour)},
+		},
+	}))
+	// Announcing an address again does not make it look recently used
+	require.NoError(t, database.SaveKnownPeer(&db.KnownPeer{
+		ID:       newer,
+		LastSeen: now.Add(-time.Hour),
+		Addrs: []db.KnownAddr{
+			{Addr: addr("/ip4/10.0.0.2/tcp/4001"), LastSeen: now, Announced: true},
+		},
+	}))
+
+	known, err := database.LoadKnownPeers()
+	require.NoError(t, err)
+	require.Len(t, known, 2)
+	assert.Equal(t, newer, known[0].ID, "most recently seen first")
+	assert.Equal(t, "tcp", known[0].Transport)
+	require.Len(t, known[0].Addrs, 2)
+	assert.Equal(t, "/ip4/10.0.0.2/udp/4001/quic-v1", known[0].Addrs[0].Addr.String())
+
+	assert.Equal(t, older, known[1].ID)
+	assert.Equal(t, "quic", known[1].Transport)
+	assert.Equal(t, 30*time.Millisecond, known[1].Latency)
+	assert.WithinDuration(t, now.Add(-10*24*time.Hour), known[1].LastSeen, time.Second)
+	assert.Len(t, known[1].Addrs, 2)
+
+	// Addresses age out before the peers themselves are forgotten
+	removed, err := database.PruneKnownPeers(now.Add(-p2p.AddressTTL), now.Add(-15*24*time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, 0, removed)
+	known, err = database.LoadKnownPeers()
+	require.NoError(t, err)
+	require.Len(t, known, 2)
+	assert.Len(t, known[0].Addrs, 1)
+	assert.Empty(t, known[1].Addrs)
+
+	removed, err = database.PruneKnownPeers(now.Add(-p2p.AddressTTL), now.Add(-p2p.AddressTTL))
+	require.NoError(t, err)
+	assert.Equal(t, 1, removed)
+	known, err = database.LoadKnownPeers()
+	require.NoError(t, err)
+	require.Len(t, known, 1)
+	assert.Equal(t, newer, known[0].ID)
+}
+
+func TestAddressBook(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.ErrorLevel)
+
+	database, err := db.NewSQLiteDB(t.TempDir(), "test-password", logger)
+	require.NoError(t, err)
+	defer func() {
+		assert.NoError(t, database.Close())
+	}()
+
+	friendHost, friendIdentity, _ := newMailboxTestPeer(t, logger)
+	blockedHost, blockedIdentity, _ := newMailboxTestPeer(t, logger)
+	_, ownerIdentity, _ := newMailboxTestPeer(t, logger)
+
+	// A first run meets both peers and saves them when it stops
+	firstHost, _, _ := newMailboxTestPeer(t, logger)
+	first := p2p.NewAddressBook(firstHost, database, logger)
+	require.NoError(t, first.Start())
+	connectHosts(t, firstHost, friendHost)
+	connectHosts(t, firstHost, blockedHost)
+	require.NoError(t, first.Stop())
+
+	known, err := database.LoadKnownPeers()
+	require.NoError(t, err)
+	require.Len(t, known, 2)
+	for _, kp := range known {
+		assert.Equal(t, "tcp", kp.Transport)
+		assert.NotEmpty(t, kp.Addrs)
+	}
+
+	blocked := user.CreateUserProfile(blockedIdentity, "blocked")
+	blocked.IsBlocked = true
+	require.NoError(t, database.SaveContact(ownerIdentity.DID, blocked))
+	require.NoError(t, database.SaveContact(ownerIdentity.DID, user.CreateUserProfile(friendIdentity, "friend")))
+
+	// A restarted node knows the addresses and reconnects without discovery
+	secondHost, _, _ := newMailboxTestPeer(t, logger)
+	second := p2p.NewAddressBook(secondHost, database, logger)
+	second.SetContacts(database, ownerIdentity.DID)
+	require.NoError(t, second.Start())
+	defer func() {
+		assert.NoError(t, second.Stop())
+	}()
+
+	assert.NotEmpty(t, secondHost.Peerstore().Addrs(friendHost.ID()))
+	assert.Eventually(t, func() bool {
+		return secondHost.Network().Connectedness(friendHost.ID()) == network.Connected
+	}, 10*time.Second, 50*time.Millisecond)
+
+	// Blocked contacts are known but not dialed
+	assert.NotEmpty(t, secondHost.Peerstore().Addrs(blockedHost.ID()))
+	assert.NotEqual(t, network.Connected, secondHost.Network().Connectedness(blockedHost.ID()))
+
+	t.Run("aged addresses are not seeded", func(t *testing.T) {
+		staleHost, _, _ := newMailboxTestPeer(t, logger)
+		stale := time.Now().Add(-p2p.AddressTTL - time.Minute)
+		require.NoError(t, database.SaveKnownPeer(&db.KnownPeer{
+			ID:       staleHost.ID(),
+			LastSeen: time.Now(),
+			Addrs:    []db.KnownAddr{{Addr: staleHost.Addrs()[0], LastSeen: stale}},
+		}))
+
+		thirdHost, _, _ := newMailboxTestPeer(t, logger)
+		third := p2p.NewAddressBook(thirdHost, database, logger)
+		require.NoError(t, third.Start())
+		defer func() {
+			assert.NoError(t, third.Stop())
+		}()
+
+		assert.Empty(t, thirdHost.Peerstore().Addrs(staleHost.ID()))
+		require.NoError(t, thirdHost.Connect(context.Background(), peer.AddrInfo{ID: friendHost.ID()}))
+	})
+}
@@ -0,0 +1,133 @@
+package unit
+
+import (
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Xelvra/peerchat/internal/message"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTransferScheduling(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.ErrorLevel)
+
+	sourceDir := t.TempDir()
+
+	newPeers := func(t *testing.T) (*message.MessageManager, host.Host, *message.MessageManager, string) {
+		downloadDir := t.TempDir()
+		receiverHost, _, receiverManager := newMailboxTestPeer(t, logger)
+		receiverManager.SetDownloadDir(downloadDir)
+		receiverManager.SetFileAcceptPolicy(autoAcceptPolicy())
+		require.NoError(t, receiverManager.Start())
+		t.Cleanup(func() {
+			assert.NoError(t, receiverManager.Stop())
+		})
+
+		senderHost, _, senderManager := newMailboxTestPeer(t, logger)
+		connectHosts(t, senderHost, receiverHost)
+		require.NoError(t, senderManager.Start())
+		t.Cleanup(func() {
+			assert.NoError(t, senderManager.Stop())
+		})
+		return senderManager, receiverHost, receiverManager, downloadDir
+	}
+
+	t.Run("upload limit", func(t *testing.T) {
+		senderManager, receiverHost, _, _ := newPeers(t)
+		senderManager.FileTransfers().SetBandwidthLimits(message.BandwidthLimits{Upload: 512 << 10})
+
+		// The first second's worth is the burst, the rest is paced
+		source := writeRandomFile(t, sourceDir, "upload.bin", 1<<20)
+		start := time.Now()
+		require.NoError(t, senderManager.SendFile(receiverHost.ID(), source))
+		assert.GreaterOrEqual(t, time.Since(start), 900*time.Millisecond)
+	})
+
+	t.Run("encrypted chunks under a low upload limit", func(t *testing.T) {
+		senderManager, receiverHost, _, downloadDir := newPeers(t)
+		senderManager.FileTransfers().SetBandwidthLimits(message.BandwidthLimits{Upload: 32 << 10})
+
+		// Encrypted chunks are larger than the limit, and a burst's worth goes out at once
+		source := writeRandomFile(t, sourceDir, "encrypted.bin", 96<<10)
+		start := time.Now()
+		require.NoError(t, senderManager.SendFile(receiverHost.ID(), source))
+		assert.GreaterOrEqual(t, time.Since(start), 700*time.Millisecond)
+
+		transfer := findTransfer(t, senderManager.FileTransfers(), "encrypted.bin")
+		assert.Equal(t, message.EncryptionAESGCM, transfer.Encryption)
+		_, err := os.Stat(filepath.Join(downloadDir, "encrypted.bin"))
+		assert.NoError(t, err)
+	})
+
+	t.Run("per-peer download limit", func(t *testing.T) {
+		senderManager, receiverHost, receiverManager, downloadDir := newPeers(t)
+		receiverManager.FileTransfers().SetBandwidthLimits(message.BandwidthLimits{PeerDownload: 512 << 10})
+
+		source := writeRandomFile(t, sourceDir, "download.bin", 1<<20)
+		start := time.Now()
+		require.NoError(t, senderManager.SendFile(receiverHost.ID(), source))
+		assert.GreaterOrEqual(t, time.Since(start), 900*time.Millisecond)
+
+		_, err := os.Stat(filepath.Join(downloadDir, "download.bin"))
+		assert.NoError(t, err)
+	})
+
+	t.Run("messages preempt file chunks", func(t *testing.T) {
+		senderManager, receiverHost, _, _ := newPeers(t)
+
+		release := senderManager.FileTransfers().PreemptTransfers(receiverHost.ID())
+		result := make(chan error, 1)
+		go func() {
+			result <- senderManager.SendFile(receiverHost.ID(), writeRandomFile(t, sourceDir, "held.bin", 100))
+		}()
+
+		select {
+		case err := <-result:
+			t.Fatalf("transfer finished while a message was in flight: %v", err)
+		case <-time.After(300 * time.Millisecond):
+		}
+
+		release()
+		select {
+		case err := <-result:
+			assert.NoError(t, err)
+		case <-time.After(5 * time.Second):
+			t.Fatal("transfer did not continue after the message was sent")
+		}
+	})
+
+	t.Run("deep sleep pauses large transfers", func(t *testing.T) {
+		senderManager, receiverHost, _, downloadDir := newPeers(t)
+
+		var sleeping atomic.Bool
+		sleeping.Store(true)
+		senderManager.FileTransfers().SetPauseCheck(sleeping.Load)
+
+		large := writeRandomFile(t, sourceDir, "large.bin", message.UrgentFileSize+1)
+		err := senderManager.SendFile(receiverHost.ID(), large)
+		assert.ErrorIs(t, err, message.ErrTransfersPaused)
+
+		small := writeRandomFile(t, sourceDir, "small.bin", message.UrgentFileSize)
+		require.NoError(t, senderManager.SendFile(receiverHost.ID(), small))
+
+		// Paused transfers stay paused until power returns
+		senderManager.FileTransfers().ResumeAll()
+		time.Sleep(200 * time.Millisecond)
+		_, err = os.Stat(filepath.Join(downloadDir, "large.bin"))
+		assert.True(t, os.IsNotExist(err))
+
+		sleeping.Store(false)
+		senderManager.FileTransfers().ResumeAll()
+		require.Eventually(t, func() bool {
+			_, err := os.Stat(filepath.Join(downloadDir, "large.bin"))
+			return err == nil
+		}, 5*time.Second, 50*time.Millisecond)
+	})
+}
@@ -0,0 +1,115 @@
+package unit
+
+import (
+	"bytes"
+	"crypto/rand"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Xelvra/peerchat/internal/p2p"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	multiaddr "github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBeacon(t *testing.T) {
+	key, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	require.NoError(t, err)
+	id, err := peer.IDFromPrivateKey(key)
+	require.NoError(t, err)
+
+	addrs := []multiaddr.Multiaddr{
+		multiaddr.StringCast("/ip4/127.0.0.1/tcp/4001"),
+		multiaddr.StringCast("/ip4/192.168.1.20/tcp/4001"),
+		multiaddr.StringCast("/ip4/192.168.1.20/udp/4001/quic-v1"),
+		multiaddr.StringCast("/ip6/::/tcp/4001"),
+	}
+	now := time.Now()
+	data, err := p2p.SignBeacon(key, addrs, now)
+	require.NoError(t, err)
+
+	beacon, err := p2p.VerifyBeacon(data, now.Add(time.Second))
+	require.NoError(t, err)
+	assert.Equal(t, id, beacon.PeerID)
+	assert.Equal(t, now.UnixMilli(), beacon.Timestamp.UnixMilli())
+	require.Len(t, beacon.Addrs, 2, "loopback and unspecified addresses are not announced")
+	assert.Equal(t, addrs[1], beacon.Addrs[0])
+	assert.Equal(t, addrs[2], beacon.Addrs[1])
+
+	t.Run("stale and future beacons are rejected", func(t *testing.T) {
+		_, err := p2p.VerifyBeacon(data, now.Add(p2p.BeaconMaxAge+time.Second))
+		assert.ErrorIs(t, err, p2p.ErrBeaconExpired)
+		_, err = p2p.VerifyBeacon(data, now.Add(-p2p.BeaconMaxAge-time.Second))
+		assert.ErrorIs(t, err, p2p.ErrBeaconExpired)
+	})
+
+	t.Run("spoofed peer IDs are rejected", func(t *testing.T) {
+		otherKey, _, err := crypto.GenerateEd25519Key(rand.Reader)
+		require.NoError(t, err)
+		other, err := peer.IDFromPrivateKey(otherKey)
+		require.NoError(t, err)
+
+		spoofed := bytes.Replace(data, []byte(id.String()), []byte(other.String()), 1)
+		_, err = p2p.VerifyBeacon(spoofed, now)
+		assert.ErrorIs(t, err, p2p.ErrBeaconSignature)
+	})
+
+	t.Run("changed addresses are rejected", func(t *testing.T) {
+		forged, err := p2p.SignBeacon(key, []multiaddr.Multiaddr{multiaddr.StringCast("/ip4/192.168.1.21/tcp/4001")}, now)
+		require.NoError(t, err)
+		original, err := p2p.SignBeacon(key, []multiaddr.Multiaddr{multiaddr.StringCast("/ip4/192.168.1.20/tcp/4001")}, now)
+		require.NoError(t, err)
+
+		// Swap the signature of one beacon onto the other
+		sig := func(b []byte) []byte { return b[bytes.Index(b, []byte(`"sig"`)):] }
+		tampered := append(append([]byte(nil), forged[:bytes.Index(forged, []byte(`"sig"`))]...), sig(original)...)
+		_, err = p2p.VerifyBeacon(tampered, now)
+		assert.ErrorIs(t, err, p2p.ErrBeaconSignature)
+	})
+
+	t.Run("other payloads are not beacons", func(t *testing.T) {
+		for _, payload := range [][]byte{
+			[]byte("XELVRA_PEER:" + id.String()),
+			[]byte("XELVRA_BEACON:{"),
+			bytes.Repeat([]byte("x"), 2000),
+		} {
+			_, err := p2p.VerifyBeacon(payload, now)
+			assert.ErrorIs(t, err, p2p.ErrBeaconFormat)
+		}
+		versioned := bytes.Replace(data, []byte(`"v":1`), []byte(`"v":2`), 1)
+		_, err := p2p.VerifyBeacon(versioned, now)
+		assert.ErrorIs(t, err, p2p.ErrBeaconVersion)
+	})
+
+	t.Run("beacons fit in one datagram", func(t *testing.T) {
+		var many []multiaddr.Multiaddr
+		for i := 0; i < 64; i++ {
+			many = append(many, multiaddr.StringCast("/dns4/relay-node.example.com/tcp/443/wss"))
+		}
+		data, err := p2p.SignBeacon(key, many, now)
+		require.NoError(t, err)
+		assert.LessOrEqual(t, len(data), 1400)
+		beacon, err := p2p.VerifyBeacon(data, now)
+		require.NoError(t, err)
+		assert.NotEmpty(t, beacon.Addrs)
+	})
+}
+
+func TestDirectedBroadcast(t *testing.T) {
+	for cidr, want := range map[string]string{
+		"192.168.1.20/24": "192.168.1.255",
+		"10.1.2.3/8":      "10.255.255.255",
+		"172.16.5.4/20":   "172.16.15.255",
+		"10.0.0.1/31":     "<nil>",
+		"10.0.0.1/32":     "<nil>",
+		"fe80::1/64":      "<nil>",
+	} {
+		ip, network, err := net.ParseCIDR(cidr)
+		require.NoError(t, err)
+		network.IP = ip
+		assert.Equal(t, want, p2p.DirectedBroadcast(network).String(), cidr)
+	}
+}
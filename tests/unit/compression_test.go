@@ -0,0 +1,180 @@
+package unit
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Xelvra/peerchat/internal/message"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeLogFile writes size bytes of repetitive log lines to a new file in dir
+func writeLogFile(t *testing.T, dir, name string, size int) string {
+	var b strings.Builder
+	for i := 0; b.Len() < size; i++ {
+		fmt.Fprintf(&b, "2025-06-17T12:00:%02d INFO peer connected peer_id=12D3KooW%d attempt=%d\n", i%60, i%7, i)
+	}
+	path := filepath.Join(dir, name)
+	require.NoError(t, os.WriteFile(path, []byte(b.String()[:size]), 0644))
+	return path
+}
+
+// findTransfer returns the transfer of the named file
+func findTransfer(t *testing.T, ftm *message.FileTransferManager, name string) *message.FileTransfer {
+	for _, transfer := range ftm.ListTransfers() {
+		if transfer.Metadata.Name == name {
+			return transfer
+		}
+	}
+	t.Fatalf("no transfer of %s", name)
+	return nil
+}
+
+func TestTransferCompression(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.ErrorLevel)
+
+	sourceDir := t.TempDir()
+
+	// newPeers connects a sender to a receiver that accepts every file. A
+	// legacy receiver only speaks /xelvra/file/1.0.0.
+	newPeers := func(t *testing.T, legacy bool) (host.Host, *message.MessageManager, host.Host, string) {
+		downloadDir := t.TempDir()
+		receiverHost, _, receiverManager := newMailboxTestPeer(t, logger)
+		receiverManager.SetDownloadDir(downloadDir)
+		receiverManager.SetFileAcceptPolicy(autoAcceptPolicy())
+		require.NoError(t, receiverManager.Start())
+		t.Cleanup(func() {
+			assert.NoError(t, receiverManager.Stop())
+		})
+		if legacy {
+			receiverHost.RemoveStreamHandler(message.EncryptedFileStreamProtocolID)
+			receiverHost.RemoveStreamHandler(message.FileStreamProtocolID)
+		}
+
+		senderHost, _, senderManager := newMailboxTestPeer(t, logger)
+		connectHosts(t, senderHost, receiverHost)
+		require.NoError(t, senderManager.Start())
+		t.Cleanup(func() {
+			assert.NoError(t, senderManager.Stop())
+		})
+		return senderHost, senderManager, receiverHost, downloadDir
+	}
+
+	for _, legacy := range []bool{false, true} {
+		t.Run(fmt.Sprintf("text file is compressed (legacy=%v)", legacy), func(t *testing.T) {
+			_, senderManager, receiverHost, downloadDir := newPeers(t, legacy)
+
+			name := fmt.Sprintf("node-%v.log", legacy)
+			source := writeLogFile(t, sourceDir, name, 300*1024)
+			require.NoError(t, senderManager.SendFile(receiverHost.ID(), source))
+
+			expected, err := os.ReadFile(source)
+			require.NoError(t, err)
+			received, err := os.ReadFile(filepath.Join(downloadDir, name))
+			require.NoError(t, err)
+			assert.Equal(t, expected, received)
+
+			transfer := findTransfer(t, senderManager.FileTransfers(), name)
+			assert.Equal(t, message.CompressionZstd, transfer.Compression)
+			assert.Equal(t, int64(len(expected)), transfer.ChunkBytes)
+			assert.Greater(t, transfer.CompressionRatio(), 2.0)
+		})
+	}
+
+	t.Run("compressed formats are sent as they are", func(t *testing.T) {
+		_, senderManager, receiverHost, downloadDir := newPeers(t, false)
+
+		// Compressible content, but the extension says it is already compressed
+		source := writeLogFile(t, sourceDir, "photo.jpg", 100*1024)
+		require.NoError(t, senderManager.SendFile(receiverHost.ID(), source))
+
+		_, err := os.Stat(filepath.Join(downloadDir, "photo.jpg"))
+		require.NoError(t, err)
+
+		transfer := findTransfer(t, senderManager.FileTransfers(), "photo.jpg")
+		assert.Empty(t, transfer.Compression)
+		assert.Equal(t, 1.0, transfer.CompressionRatio())
+	})
+
+	t.Run("compression must be agreed", func(t *testing.T) {
+		senderHost, _, receiverHost, downloadDir := newPeers(t, false)
+
+		source := writeLogFile(t, sourceDir, "unagreed.log", 1000)
+		metadata, err := message.CreateFileMetadata(source)
+		require.NoError(t, err)
+
+		stream, err := senderHost.NewStream(context.Background(), receiverHost.ID(), message.FileProtocolID)
+		require.NoError(t, err)
+		defer func() { _ = stream.Close() }()
+
+		writeTestFileFrame(t, stream, message.FileTransferRequest{Type: "request", Metadata: *metadata})
+		accept := readTestFileFrame(t, stream)
+		require.Equal(t, "accept", accept.Type)
+		assert.Empty(t, accept.Compression)
+
+		writeTestFileFrame(t, stream, message.FileTransferRequest{
+			Type:       "chunk",
+			TransferID: metadata.ID,
+			Data:       []byte("not agreed"),
+			Compressed: true,
+		})
+		writeTestFileFrame(t, stream, message.FileTransferRequest{Type: "complete"})
+
+		time.Sleep(200 * time.Millisecond)
+		_, err = os.Stat(filepath.Join(downloadDir, "unagreed.log"))
+		assert.True(t, os.IsNotExist(err))
+	})
+}
+
+func TestMessageCompression(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.ErrorLevel)
+
+	large := strings.Repeat("a large message that compresses well ", 1000)
+
+	for _, compressed := range []bool{true, false} {
+		t.Run(fmt.Sprintf("compressed=%v", compressed), func(t *testing.T) {
+			senderHost, _, senderManager := newMailboxTestPeer(t, logger)
+			receiverHost, _, receiverManager := newMailboxTestPeer(t, logger)
+
+			handler := &recordingHandler{}
+			receiverManager.RegisterHandler(message.MessageTypeText, handler)
+
+			require.NoError(t, senderManager.Start())
+			require.NoError(t, receiverManager.Start())
+			defer func() {
+				assert.NoError(t, senderManager.Stop())
+				assert.NoError(t, receiverManager.Stop())
+			}()
+
+			// Peers from before compression only speak /xelvra/message/2.0.0
+			protocolID := message.CompressedMessageProtocolID
+			if !compressed {
+				receiverHost.RemoveStreamHandler(message.CompressedMessageProtocolID)
+				protocolID = message.MessageStreamProtocolID
+			}
+			connectHosts(t, senderHost, receiverHost)
+
+			require.NoError(t, senderManager.SendMessage(receiverHost.ID().String(), []byte("small"), message.MessageTypeText))
+			require.NoError(t, senderManager.SendMessage(receiverHost.ID().String(), []byte(large), message.MessageTypeText))
+
+			require.Eventually(t, func() bool {
+				return len(handler.received()) == 2
+			}, 10*time.Second, 20*time.Millisecond)
+
+			received := handler.received()
+			assert.Equal(t, "small", string(received[0].Content))
+			assert.Equal(t, large, string(received[1].Content))
+			assert.Equal(t, 1, countStreams(senderHost.Network(), receiverHost.ID(), string(protocolID)))
+		})
+	}
+}
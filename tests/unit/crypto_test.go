@@ -1,6 +1,7 @@
 package unit
 
 import (
+	"crypto/ed25519"
 	"testing"
 
 	"github.com/Xelvra/peerchat/internal/crypto"
@@ -142,3 +143,24 @@ func TestDecryptInvalidCiphertext(t *testing.T) {
 	_, err = sc.DecryptMessage(corruptedCiphertext, chainKey)
 	assert.Error(t, err)
 }
+
+func TestEd25519KeyConversion(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+
+	keyPair, err := crypto.KeyPairFromEd25519(privateKey)
+	require.NoError(t, err)
+	curvePublicKey, err := crypto.PublicKeyFromEd25519(publicKey)
+	require.NoError(t, err)
+	assert.Equal(t, keyPair.PublicKey, curvePublicKey)
+
+	// Data sealed to the identity key opens with the identity's key pair
+	sealed, err := crypto.SealAnonymous(curvePublicKey, []byte("file key"), []byte("test"))
+	require.NoError(t, err)
+	opened, err := crypto.OpenAnonymous(keyPair, sealed, []byte("test"))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("file key"), opened)
+
+	_, err = crypto.PublicKeyFromEd25519(publicKey[:16])
+	assert.Error(t, err)
+}
@@ -0,0 +1,180 @@
+package unit
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/Xelvra/peerchat/internal/message"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSanitizeFileName(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expected string
+	}{
+		{"plain", "report.pdf", "report.pdf"},
+		{"unix traversal", "../../etc/passwd", "passwd"},
+		{"windows traversal", `..\..\Windows\System32\cmd.exe`, "cmd.exe"},
+		{"absolute path", "/home/user/.ssh/authorized_keys", "authorized_keys"},
+		{"dot dot", "..", "download"},
+		{"empty", "", "download"},
+		{"trailing separator", "dir/", "download"},
+		{"hidden file", ".bashrc", "bashrc"},
+		{"trailing dots and spaces", "notes. . ", "notes"},
+		{"control characters", "a\x00b\x1b[31m.txt", "ab[31m.txt"},
+		{"right-to-left override", "invoice‮fdp.exe", "invoicefdp.exe"},
+		{"invalid characters", `a<b>:c"d|e?f*.txt`, "a_b__c_d_e_f_.txt"},
+		{"reserved name", "CON", "_CON"},
+		{"reserved name with extension", "lpt1.txt", "_lpt1.txt"},
+		{"not reserved", "CONSOLE.txt", "CONSOLE.txt"},
+		{"invalid UTF-8", "caf\xe9.txt", "caf_.txt"},
+		{"unicode", "Übersicht 日本.txt", "Übersicht 日本.txt"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, message.SanitizeFileName(tt.input))
+		})
+	}
+
+	t.Run("long names keep their extension", func(t *testing.T) {
+		sanitized := message.SanitizeFileName(strings.Repeat("日", 200) + ".txt")
+		assert.LessOrEqual(t, len(sanitized), message.MaxFileNameLength)
+		assert.True(t, strings.HasSuffix(sanitized, "日.txt"))
+		assert.True(t, utf8.ValidString(sanitized))
+	})
+}
+
+func FuzzSanitizeFileName(f *testing.F) {
+	for _, seed := range []string{
+		"report.pdf", "../../etc/passwd", `..\x`, "..", "", ".", " . ", "CON", "aux.tar.gz",
+		"a\x00b", "‮gpj.exe", strings.Repeat("a", 300) + ".txt", "caf\xe9",
+	} {
+		f.Add(seed)
+	}
+
+	dir := filepath.Join(os.TempDir(), "downloads")
+	f.Fuzz(func(t *testing.T, name string) {
+		sanitized := message.SanitizeFileName(name)
+
+		if sanitized == "" || sanitized == "." || sanitized == ".." {
+			t.Fatalf("unsafe name %q from %q", sanitized, name)
+		}
+		if strings.ContainsAny(sanitized, `/\<>:"|?*`) {
+			t.Fatalf("name %q from %q contains a reserved character", sanitized, name)
+		}
+		if strings.HasPrefix(sanitized, ".") || strings.HasSuffix(sanitized, ".") || strings.HasSuffix(sanitized, " ") {
+			t.Fatalf("name %q from %q has leading or trailing dots or spaces", sanitized, name)
+		}
+		if !utf8.ValidString(sanitized) || len(sanitized) > message.MaxFileNameLength {
+			t.Fatalf("name %q from %q is invalid or too long", sanitized, name)
+		}
+		for _, r := range sanitized {
+			if unicode.IsControl(r) || unicode.Is(unicode.Cf, r) {
+				t.Fatalf("name %q from %q contains control character %U", sanitized, name, r)
+			}
+		}
+		if filepath.Dir(filepath.Join(dir, sanitized)) != dir {
+			t.Fatalf("name %q from %q escapes the download directory", sanitized, name)
+		}
+		if again := message.SanitizeFileName(sanitized); again != sanitized {
+			t.Fatalf("sanitizing %q is not stable: %q", sanitized, again)
+		}
+	})
+}
+
+func TestDownloadStaging(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.ErrorLevel)
+
+	downloadDir := filepath.Join(t.TempDir(), "downloads")
+	receiverHost, _, receiverManager := newMailboxTestPeer(t, logger)
+	receiverManager.SetDownloadDir(downloadDir)
+	receiverManager.SetFileAcceptPolicy(autoAcceptPolicy())
+	require.NoError(t, receiverManager.Start())
+	defer func() {
+		assert.NoError(t, receiverManager.Stop())
+	}()
+
+	senderHost, _, _ := newMailboxTestPeer(t, logger)
+	connectHosts(t, senderHost, receiverHost)
+
+	sourceDir := t.TempDir()
+	send := func(t *testing.T, offeredName, content string) {
+		source := filepath.Join(sourceDir, "source.bin")
+		require.NoError(t, os.WriteFile(source, []byte(content), 0644))
+		sendNamedFile(t, senderHost, receiverHost, source, offeredName, logger)
+	}
+
+	t.Run("hostile names stay in the download directory", func(t *testing.T) {
+		send(t, "../escape.txt", "escape")
+		send(t, `..\..\evil.bat`, "evil")
+
+		_, err := os.Stat(filepath.Join(filepath.Dir(downloadDir), "escape.txt"))
+		assert.True(t, os.IsNotExist(err))
+		received, err := os.ReadFile(filepath.Join(downloadDir, "escape.txt"))
+		require.NoError(t, err)
+		assert.Equal(t, "escape", string(received))
+		_, err = os.Stat(filepath.Join(downloadDir, "evil.bat"))
+		assert.NoError(t, err)
+	})
+
+	t.Run("collisions are renamed instead of overwritten", func(t *testing.T) {
+		require.NoError(t, os.WriteFile(filepath.Join(downloadDir, "notes.txt"), []byte("mine"), 0644))
+		send(t, "notes.txt", "first")
+		send(t, "notes.txt", "second")
+
+		for name, content := range map[string]string{
+			"notes.txt":     "mine",
+			"notes (1).txt": "first",
+			"notes (2).txt": "second",
+		} {
+			received, err := os.ReadFile(filepath.Join(downloadDir, name))
+			require.NoError(t, err)
+			assert.Equal(t, content, string(received), name)
+		}
+	})
+
+	t.Run("staging directory is private", func(t *testing.T) {
+		info, err := os.Stat(filepath.Join(downloadDir, ".partial"))
+		require.NoError(t, err)
+		assert.Equal(t, os.FileMode(0700), info.Mode().Perm())
+
+		staged, err := os.ReadDir(filepath.Join(downloadDir, ".partial"))
+		require.NoError(t, err)
+		assert.Empty(t, staged, "verified files leave the staging directory")
+	})
+}
+
+// sendNamedFile sends a file under an arbitrary offered name and waits for the ack
+func sendNamedFile(t *testing.T, senderHost, receiverHost host.Host, source, offeredName string, logger *logrus.Logger) {
+	metadata, err := message.CreateFileMetadata(source)
+	require.NoError(t, err)
+	metadata.Name = offeredName
+
+	transfer := message.NewFileTransfer(metadata.ID, receiverHost.ID(), *metadata, true, logger)
+	transfer.LocalPath = source
+
+	stream, err := senderHost.NewStream(context.Background(), receiverHost.ID(), message.FileProtocolID)
+	require.NoError(t, err)
+	defer func() { _ = stream.Close() }()
+
+	require.NoError(t, transfer.SendFileRequest(stream))
+	require.Equal(t, "accept", readTestFileFrame(t, stream).Type)
+
+	data, err := os.ReadFile(source)
+	require.NoError(t, err)
+	require.NoError(t, transfer.SendFileChunk(stream, 0, data))
+	require.NoError(t, transfer.SendFileComplete(stream))
+	require.Equal(t, "ack", readTestFileFrame(t, stream).Type)
+}
@@ -291,3 +291,30 @@ func BenchmarkBatteryLevelUpdate(b *testing.B) {
 		em.SetBatteryLevel(level)
 	}
 }
+
+// TestDeepSleepHandler tests deep sleep notifications
+func TestDeepSleepHandler(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	logger := logrus.New()
+	logger.SetLevel(logrus.ErrorLevel)
+	em := p2p.NewEnergyManager(ctx, logger)
+
+	var changes []bool
+	em.SetDeepSleepHandler(func(active bool) {
+		// The handler runs outside the manager's lock
+		if em.IsDeepSleepMode() != active {
+			t.Error("Handler called with a stale deep sleep state")
+		}
+		changes = append(changes, active)
+	})
+
+	em.SetBatteryLevel(0.1)
+	em.SetBatteryLevel(0.05) // Still in deep sleep, no notification
+	em.SetBatteryLevel(0.8)
+
+	if len(changes) != 2 || !changes[0] || changes[1] {
+		t.Errorf("Expected deep sleep to start and end once, got %v", changes)
+	}
+}
@@ -0,0 +1,240 @@
+package unit
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Xelvra/peerchat/internal/message"
+	"github.com/Xelvra/peerchat/internal/user"
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileTransferEncryption(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.ErrorLevel)
+
+	sourceDir := t.TempDir()
+
+	// newPeers connects a sender to a receiver that accepts every file
+	newPeers := func(t *testing.T, atRest bool) (*message.MessageManager, host.Host, *user.MessengerID, string) {
+		downloadDir := t.TempDir()
+		receiverHost, receiverIdentity, receiverManager := newMailboxTestPeer(t, logger)
+		receiverManager.SetDownloadDir(downloadDir)
+		receiverManager.SetFileAcceptPolicy(autoAcceptPolicy())
+		receiverManager.SetEncryptFilesAtRest(atRest)
+		require.NoError(t, receiverManager.Start())
+		t.Cleanup(func() {
+			assert.NoError(t, receiverManager.Stop())
+		})
+
+		senderHost, _, senderManager := newMailboxTestPeer(t, logger)
+		connectHosts(t, senderHost, receiverHost)
+		require.NoError(t, senderManager.Start())
+		t.Cleanup(func() {
+			assert.NoError(t, senderManager.Stop())
+		})
+		return senderManager, receiverHost, receiverIdentity, downloadDir
+	}
+
+	t.Run("chunks are encrypted on the wire", func(t *testing.T) {
+		senderHost, _, senderManager := newMailboxTestPeer(t, logger)
+		require.NoError(t, senderManager.Start())
+		defer func() {
+			assert.NoError(t, senderManager.Stop())
+		}()
+
+		// A receiver on the JSON protocol that records what it is sent
+		receiverHost, _, _ := newMailboxTestPeer(t, logger)
+		receiverHost.RemoveStreamHandler(message.EncryptedFileStreamProtocolID)
+		receiverHost.RemoveStreamHandler(message.FileStreamProtocolID)
+		chunks := make(chan *message.FileTransferRequest, 1)
+		receiverHost.SetStreamHandler(message.FileProtocolID, func(stream network.Stream) {
+			defer func() { _ = stream.Reset() }()
+			offer := readTestFileFrame(t, stream)
+			if offer.Encryption != message.EncryptionAESGCM || len(offer.FileKey) == 0 {
+				close(chunks)
+				return
+			}
+			writeTestFileFrame(t, stream, message.FileTransferRequest{
+				Type:       "accept",
+				Missing:    []message.ChunkRange{{Start: 0, End: offer.Metadata.ChunkCount}},
+				Encryption: message.EncryptionAESGCM,
+			})
+			chunks <- readTestFileFrame(t, stream)
+		})
+		connectHosts(t, senderHost, receiverHost)
+
+		source := filepath.Join(sourceDir, "secret.bin")
+		plaintext := bytes.Repeat([]byte("top secret "), 100)
+		require.NoError(t, os.WriteFile(source, plaintext, 0644))
+		go func() { _ = senderManager.SendFile(receiverHost.ID(), source) }()
+
+		select {
+		case chunk, ok := <-chunks:
+			require.True(t, ok, "sender did not offer encryption")
+			assert.Equal(t, "chunk", chunk.Type)
+			assert.Len(t, chunk.Data, len(plaintext)+16)
+			assert.False(t, bytes.Contains(chunk.Data, []byte("top secret")))
+		case <-time.After(10 * time.Second):
+			t.Fatal("no chunk received")
+		}
+	})
+
+	for _, size := range []int{0, 1000, 200*1024 + 7} {
+		t.Run(fmt.Sprintf("file of %d bytes arrives intact", size), func(t *testing.T) {
+			senderManager, receiverHost, _, downloadDir := newPeers(t, false)
+
+			name := fmt.Sprintf("plain-%d.bin", size)
+			source := writeLogFile(t, sourceDir, name, size)
+			require.NoError(t, senderManager.SendFile(receiverHost.ID(), source))
+
+			expected, err := os.ReadFile(source)
+			require.NoError(t, err)
+			received, err := os.ReadFile(filepath.Join(downloadDir, name))
+			require.NoError(t, err)
+			assert.Equal(t, expected, received)
+
+			transfer := findTransfer(t, senderManager.FileTransfers(), name)
+			assert.Equal(t, message.EncryptionAESGCM, transfer.Encryption)
+		})
+	}
+
+	t.Run("offer with a key for someone else is rejected", func(t *testing.T) {
+		senderHost, _, _ := newMailboxTestPeer(t, logger)
+		_, receiverHost, _, downloadDir := newPeers(t, false)
+		connectHosts(t, senderHost, receiverHost)
+
+		source := writeLogFile(t, sourceDir, "forged.log", 1000)
+		metadata, err := message.CreateFileMetadata(source)
+		require.NoError(t, err)
+
+		stream, err := senderHost.NewStream(context.Background(), receiverHost.ID(), message.FileProtocolID)
+		require.NoError(t, err)
+		defer func() { _ = stream.Close() }()
+
+		writeTestFileFrame(t, stream, message.FileTransferRequest{
+			Type:       "request",
+			Metadata:   *metadata,
+			Encryption: message.EncryptionAESGCM,
+			FileKey:    bytes.Repeat([]byte{1}, 92),
+		})
+		reply := readTestFileFrame(t, stream)
+		assert.Equal(t, "reject", reply.Type)
+
+		_, err = os.Stat(filepath.Join(downloadDir, "forged.log"))
+		assert.True(t, os.IsNotExist(err))
+	})
+
+	t.Run("unencrypted offers are only accepted on older protocols", func(t *testing.T) {
+		senderHost, _, _ := newMailboxTestPeer(t, logger)
+		_, receiverHost, _, _ := newPeers(t, false)
+		connectHosts(t, senderHost, receiverHost)
+
+		source := writeLogFile(t, sourceDir, "unencrypted.log", 1000)
+		metadata, err := message.CreateFileMetadata(source)
+		require.NoError(t, err)
+
+		for protocol, expected := range map[protocol.ID]string{
+			message.EncryptedFileStreamProtocolID: "reject",
+			message.FileStreamProtocolID:          "accept",
+		} {
+			transfer := message.NewFileTransfer(metadata.ID, receiverHost.ID(), *metadata, true, logger)
+			stream, err := senderHost.NewStream(context.Background(), receiverHost.ID(), protocol)
+			require.NoError(t, err)
+
+			require.NoError(t, transfer.SendFileRequest(stream))
+			assert.Equal(t, expected, readTestBinaryFileFrame(t, stream).Type, protocol)
+			_ = stream.Reset()
+		}
+	})
+
+	t.Run("files are not sent unencrypted when no key can be sealed", func(t *testing.T) {
+		senderHost, _, senderManager := newMailboxTestPeer(t, logger)
+		require.NoError(t, senderManager.Start())
+		defer func() {
+			assert.NoError(t, senderManager.Stop())
+		}()
+
+		// File keys are sealed to Ed25519 identity keys only
+		privKey, _, err := crypto.GenerateECDSAKeyPair(rand.Reader)
+		require.NoError(t, err)
+		receiverHost, err := libp2p.New(libp2p.Identity(privKey), libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+		require.NoError(t, err)
+		defer func() { _ = receiverHost.Close() }()
+		receiverManager := message.NewMessageManager(receiverHost, nil, nil, logger)
+		receiverManager.SetDownloadDir(t.TempDir())
+		receiverManager.SetFileAcceptPolicy(autoAcceptPolicy())
+		require.NoError(t, receiverManager.Start())
+		defer func() {
+			assert.NoError(t, receiverManager.Stop())
+		}()
+		connectHosts(t, senderHost, receiverHost)
+
+		source := writeLogFile(t, sourceDir, "unsealed.log", 1000)
+		err = senderManager.SendFile(receiverHost.ID(), source)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "encryption")
+
+		transfer := findTransfer(t, senderManager.FileTransfers(), "unsealed.log")
+		assert.Equal(t, message.FileTransferFailed, transfer.Status)
+	})
+
+	t.Run("files are kept encrypted at rest", func(t *testing.T) {
+		senderManager, receiverHost, receiverIdentity, downloadDir := newPeers(t, true)
+
+		source := writeLogFile(t, sourceDir, "report.log", 100*1024+3)
+		require.NoError(t, senderManager.SendFile(receiverHost.ID(), source))
+
+		expected, err := os.ReadFile(source)
+		require.NoError(t, err)
+
+		_, err = os.Stat(filepath.Join(downloadDir, "report.log"))
+		assert.True(t, os.IsNotExist(err))
+		encryptedPath := filepath.Join(downloadDir, "report.log"+message.EncryptedFileExt)
+		encrypted, err := os.ReadFile(encryptedPath)
+		require.NoError(t, err)
+		assert.False(t, bytes.Contains(encrypted, expected[:64]))
+
+		// Only the receiver's identity opens the file
+		decryptedPath := filepath.Join(t.TempDir(), "report.log")
+		require.NoError(t, message.DecryptFile(encryptedPath, decryptedPath, receiverIdentity.PrivateKey))
+		decrypted, err := os.ReadFile(decryptedPath)
+		require.NoError(t, err)
+		assert.Equal(t, expected, decrypted)
+
+		other, err := user.GenerateMessengerIDWithDifficulty(1)
+		require.NoError(t, err)
+		assert.Error(t, message.DecryptFile(encryptedPath, filepath.Join(t.TempDir(), "other"), other.PrivateKey))
+
+		// Existing files are not replaced
+		assert.Error(t, message.DecryptFile(encryptedPath, decryptedPath, receiverIdentity.PrivateKey))
+
+		// Tampered files and files cut off after a chunk are refused and leave nothing behind
+		tampered := append([]byte(nil), encrypted...)
+		tampered[len(tampered)-100] ^= 0xff
+		for name, corrupt := range map[string][]byte{
+			"tampered":  tampered,
+			"truncated": encrypted[:len(encrypted)-(len(expected)%message.FileChunkSize+16)],
+		} {
+			corruptPath := filepath.Join(t.TempDir(), name+message.EncryptedFileExt)
+			require.NoError(t, os.WriteFile(corruptPath, corrupt, 0600))
+			outputPath := filepath.Join(t.TempDir(), name)
+			assert.Error(t, message.DecryptFile(corruptPath, outputPath, receiverIdentity.PrivateKey), name)
+			_, err := os.Stat(outputPath)
+			assert.True(t, os.IsNotExist(err), name)
+		}
+	})
+}
@@ -0,0 +1,277 @@
+package unit
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Xelvra/peerchat/internal/db"
+	"github.com/Xelvra/peerchat/internal/message"
+	"github.com/Xelvra/peerchat/internal/user"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileAcceptPolicy(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.ErrorLevel)
+
+	sourceDir := t.TempDir()
+	writeSource := func(name string, size int) string {
+		path := filepath.Join(sourceDir, name)
+		require.NoError(t, os.WriteFile(path, make([]byte, size), 0644))
+		return path
+	}
+
+	// newReceiver starts a receiver with the policy and a contacts database
+	newReceiver := func(t *testing.T, policy *message.FileAcceptPolicy) (host.Host, *user.MessengerID, *message.MessageManager, *db.SQLiteDB, string) {
+		database, err := db.NewSQLiteDB(t.TempDir(), "test-password", logger)
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = database.Close() })
+
+		downloadDir := t.TempDir()
+		receiverHost, identity, receiverManager := newMailboxTestPeer(t, logger)
+		receiverManager.SetDownloadDir(downloadDir)
+		receiverManager.SetContactStore(database)
+		receiverManager.SetFileAcceptPolicy(policy)
+		require.NoError(t, receiverManager.Start())
+		t.Cleanup(func() {
+			assert.NoError(t, receiverManager.Stop())
+		})
+		return receiverHost, identity, receiverManager, database, downloadDir
+	}
+
+	newSender := func(t *testing.T, receiverHost host.Host) (*user.MessengerID, *message.MessageManager) {
+		senderHost, identity, senderManager := newMailboxTestPeer(t, logger)
+		connectHosts(t, senderHost, receiverHost)
+		require.NoError(t, senderManager.Start())
+		t.Cleanup(func() {
+			assert.NoError(t, senderManager.Stop())
+		})
+		return identity, senderManager
+	}
+
+	t.Run("user accepts an offer", func(t *testing.T) {
+		receiverHost, _, receiverManager, _, downloadDir := newReceiver(t, message.DefaultFileAcceptPolicy())
+		_, senderManager := newSender(t, receiverHost)
+
+		result := make(chan error, 1)
+		go func() {
+			result <- senderManager.SendFile(receiverHost.ID(), writeSource("accepted.txt", 100))
+		}()
+
+		var offers []message.FileOffer
+		require.Eventually(t, func() bool {
+			offers = receiverManager.FileTransfers().PendingOffers()
+			return len(offers) == 1
+		}, 5*time.Second, 20*time.Millisecond)
+		assert.Equal(t, "accepted.txt", offers[0].Metadata.Name)
+		require.NoError(t, receiverManager.FileTransfers().AcceptOffer("", offers[0].ID))
+
+		require.NoError(t, <-result)
+		_, err := os.Stat(filepath.Join(downloadDir, "accepted.txt"))
+		assert.NoError(t, err)
+		assert.Empty(t, receiverManager.FileTransfers().PendingOffers())
+		assert.ErrorIs(t, receiverManager.FileTransfers().AcceptOffer("", offers[0].ID), message.ErrUnknownOffer)
+	})
+
+	t.Run("user rejects an offer", func(t *testing.T) {
+		receiverHost, _, receiverManager, _, downloadDir := newReceiver(t, message.DefaultFileAcceptPolicy())
+		_, senderManager := newSender(t, receiverHost)
+
+		result := make(chan error, 1)
+		go func() {
+			result <- senderManager.SendFile(receiverHost.ID(), writeSource("rejected.txt", 100))
+		}()
+
+		require.Eventually(t, func() bool {
+			return len(receiverManager.FileTransfers().PendingOffers()) == 1
+		}, 5*time.Second, 20*time.Millisecond)
+		require.NoError(t, receiverManager.FileTransfers().RejectOffer("", receiverManager.FileTransfers().PendingOffers()[0].ID))
+
+		err := <-result
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "declined")
+		_, err = os.Stat(filepath.Join(downloadDir, "rejected.txt"))
+		assert.True(t, os.IsNotExist(err))
+	})
+
+	t.Run("unanswered offer times out", func(t *testing.T) {
+		policy := message.DefaultFileAcceptPolicy()
+		policy.OfferTimeout = 200 * time.Millisecond
+		receiverHost, _, receiverManager, _, _ := newReceiver(t, policy)
+		_, senderManager := newSender(t, receiverHost)
+
+		err := senderManager.SendFile(receiverHost.ID(), writeSource("ignored.txt", 100))
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), message.ErrOfferTimeout.Error())
+		assert.Empty(t, receiverManager.FileTransfers().PendingOffers())
+	})
+
+	t.Run("contacts only", func(t *testing.T) {
+		policy := autoAcceptPolicy()
+		policy.ContactsOnly = true
+		receiverHost, receiverIdentity, _, database, _ := newReceiver(t, policy)
+		senderIdentity, senderManager := newSender(t, receiverHost)
+
+		err := senderManager.SendFile(receiverHost.ID(), writeSource("stranger.txt", 100))
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "not a contact")
+
+		contact := user.CreateUserProfile(senderIdentity, "friend")
+		require.NoError(t, database.SaveContact(receiverIdentity.DID, contact))
+		assert.NoError(t, senderManager.SendFile(receiverHost.ID(), writeSource("friend.txt", 100)))
+
+		contact.IsBlocked = true
+		require.NoError(t, database.SaveContact(receiverIdentity.DID, contact))
+		err = senderManager.SendFile(receiverHost.ID(), writeSource("blocked.txt", 100))
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "blocked")
+
+		contacts, err := database.LoadContacts(receiverIdentity.DID)
+		require.NoError(t, err)
+		require.Len(t, contacts, 1)
+		assert.Equal(t, senderIdentity.PeerID, contacts[0].MessengerID.PeerID)
+		assert.Equal(t, "friend", contacts[0].DisplayName)
+		assert.True(t, contacts[0].IsBlocked)
+	})
+
+	t.Run("default limits admit the largest transferable file", func(t *testing.T) {
+		policy := message.DefaultFileAcceptPolicy()
+		assert.Equal(t, int64(message.MaxFileSize), policy.MaxFileSize)
+		assert.GreaterOrEqual(t, policy.PeerQuota, int64(message.MaxFileSize))
+	})
+
+	t.Run("size and type limits", func(t *testing.T) {
+		policy := autoAcceptPolicy()
+		policy.MaxFileSize = 1000
+		policy.AllowedMimeTypes = []string{"text/*", "image/png"}
+		policy.BlockedMimeTypes = []string{"image/*"}
+		receiverHost, _, _, _, _ := newReceiver(t, policy)
+		_, senderManager := newSender(t, receiverHost)
+
+		err := senderManager.SendFile(receiverHost.ID(), writeSource("large.txt", 1001))
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "larger than")
+
+		err = senderManager.SendFile(receiverHost.ID(), writeSource("archive.zip", 100))
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "application/zip is not accepted")
+
+		err = senderManager.SendFile(receiverHost.ID(), writeSource("picture.png", 100))
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "image/png is not accepted")
+
+		assert.NoError(t, senderManager.SendFile(receiverHost.ID(), writeSource("small.txt", 1000)))
+	})
+
+	t.Run("per-peer quota", func(t *testing.T) {
+		policy := autoAcceptPolicy()
+		policy.PeerQuota = 1500
+		receiverHost, _, _, _, _ := newReceiver(t, policy)
+		_, senderManager := newSender(t, receiverHost)
+
+		assert.NoError(t, senderManager.SendFile(receiverHost.ID(), writeSource("first.txt", 1000)))
+		err := senderManager.SendFile(receiverHost.ID(), writeSource("second.txt", 1000))
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "quota")
+		assert.NoError(t, senderManager.SendFile(receiverHost.ID(), writeSource("third.txt", 500)))
+	})
+
+	t.Run("quota is reserved for concurrent offers", func(t *testing.T) {
+		policy := message.DefaultFileAcceptPolicy()
+		policy.PeerQuota = 1500
+		receiverHost, _, receiverManager, _, _ := newReceiver(t, policy)
+		_, senderManager := newSender(t, receiverHost)
+
+		// Both offers fit the quota on their own and wait for a decision together
+		results := make(chan error, 2)
+		for _, name := range []string{"left.txt", "right.txt"} {
+			source := writeSource(name, 1000)
+			go func() {
+				results <- senderManager.SendFile(receiverHost.ID(), source)
+			}()
+		}
+		require.Eventually(t, func() bool {
+			return len(receiverManager.FileTransfers().PendingOffers()) == 2
+		}, 5*time.Second, 20*time.Millisecond)
+		for _, offer := range receiverManager.FileTransfers().PendingOffers() {
+			require.NoError(t, receiverManager.FileTransfers().AcceptOffer(offer.PeerID, offer.ID))
+		}
+
+		var failed []error
+		for i := 0; i < 2; i++ {
+			if err := <-results; err != nil {
+				failed = append(failed, err)
+			}
+		}
+		require.Len(t, failed, 1)
+		assert.Contains(t, failed[0].Error(), "quota")
+	})
+
+	t.Run("offers from different peers may share an ID", func(t *testing.T) {
+		receiverHost, _, receiverManager, _, _ := newReceiver(t, message.DefaultFileAcceptPolicy())
+		metadata, err := message.CreateFileMetadata(writeSource("shared.txt", 100))
+		require.NoError(t, err)
+
+		// The second sender reuses the first one's transfer ID
+		streams := make(map[peer.ID]network.Stream)
+		for i := 0; i < 2; i++ {
+			senderHost, _, _ := newMailboxTestPeer(t, logger)
+			connectHosts(t, senderHost, receiverHost)
+			transfer := message.NewFileTransfer(metadata.ID, receiverHost.ID(), *metadata, true, logger)
+			stream, err := senderHost.NewStream(context.Background(), receiverHost.ID(), message.FileProtocolID)
+			require.NoError(t, err)
+			require.NoError(t, transfer.SendFileRequest(stream))
+			streams[senderHost.ID()] = stream
+		}
+
+		require.Eventually(t, func() bool {
+			return len(receiverManager.FileTransfers().PendingOffers()) == 2
+		}, 5*time.Second, 20*time.Millisecond)
+		assert.ErrorIs(t, receiverManager.FileTransfers().AcceptOffer("", metadata.ID), message.ErrAmbiguousOffer)
+
+		for senderID, stream := range streams {
+			require.NoError(t, receiverManager.FileTransfers().RejectOffer(senderID, metadata.ID))
+			assert.Equal(t, "reject", readTestFileFrame(t, stream).Type)
+			_ = stream.Reset()
+		}
+	})
+
+	t.Run("concurrent transfers", func(t *testing.T) {
+		policy := autoAcceptPolicy()
+		policy.MaxConcurrent = 1
+		receiverHost, _, _, _, _ := newReceiver(t, policy)
+		senderHost, _, senderManager := newMailboxTestPeer(t, logger)
+		connectHosts(t, senderHost, receiverHost)
+		require.NoError(t, senderManager.Start())
+		defer func() {
+			assert.NoError(t, senderManager.Stop())
+		}()
+
+		// A transfer that was accepted but not finished holds the only slot
+		source := writeSource("slow.txt", 100)
+		metadata, err := message.CreateFileMetadata(source)
+		require.NoError(t, err)
+		transfer := message.NewFileTransfer(metadata.ID, receiverHost.ID(), *metadata, true, logger)
+		stream, err := senderHost.NewStream(context.Background(), receiverHost.ID(), message.FileProtocolID)
+		require.NoError(t, err)
+		require.NoError(t, transfer.SendFileRequest(stream))
+		require.Equal(t, "accept", readTestFileFrame(t, stream).Type)
+
+		err = senderManager.SendFile(receiverHost.ID(), writeSource("waiting.txt", 100))
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "too many concurrent transfers")
+
+		require.NoError(t, stream.Reset())
+		require.Eventually(t, func() bool {
+			return senderManager.SendFile(receiverHost.ID(), writeSource("later.txt", 100)) == nil
+		}, 5*time.Second, 100*time.Millisecond)
+	})
+}
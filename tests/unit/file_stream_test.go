@@ -0,0 +1,244 @@
+package unit
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/Xelvra/peerchat/internal/message"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// readTestBinaryFileFrame reads one frame sent to a /xelvra/file/2.0.0 sender:
+// a JSON control frame or a credit grant
+func readTestBinaryFileFrame(t *testing.T, r io.Reader) *message.FileTransferRequest {
+	var length uint32
+	require.NoError(t, binary.Read(r, binary.BigEndian, &length))
+	data := make([]byte, length)
+	_, err := io.ReadFull(r, data)
+	require.NoError(t, err)
+
+	switch data[0] {
+	case 1:
+		var frame message.FileTransferRequest
+		require.NoError(t, json.Unmarshal(data[1:], &frame))
+		return &frame
+	case 3:
+		require.Len(t, data, 5)
+		return &message.FileTransferRequest{Type: "credit", Credits: int(binary.BigEndian.Uint32(data[1:]))}
+	default:
+		t.Fatalf("unexpected frame kind %d", data[0])
+		return nil
+	}
+}
+
+// writeRandomFile writes size random bytes to a new file in dir
+func writeRandomFile(t testing.TB, dir, name string, size int) string {
+	data := make([]byte, size)
+	_, err := rand.Read(data)
+	require.NoError(t, err)
+
+	path := filepath.Join(dir, name)
+	require.NoError(t, os.WriteFile(path, data, 0644))
+	return path
+}
+
+func TestFileStreamProtocol(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.ErrorLevel)
+
+	sourceDir := t.TempDir()
+
+	// newPeers connects a sender to a receiver that accepts every file. A
+	// legacy receiver only speaks /xelvra/file/1.0.0.
+	newPeers := func(t *testing.T, legacy bool) (host.Host, *message.MessageManager, host.Host, string) {
+		downloadDir := t.TempDir()
+		receiverHost, _, receiverManager := newMailboxTestPeer(t, logger)
+		receiverManager.SetDownloadDir(downloadDir)
+		receiverManager.SetFileAcceptPolicy(autoAcceptPolicy())
+		require.NoError(t, receiverManager.Start())
+		t.Cleanup(func() {
+			assert.NoError(t, receiverManager.Stop())
+		})
+		if legacy {
+			receiverHost.RemoveStreamHandler(message.EncryptedFileStreamProtocolID)
+			receiverHost.RemoveStreamHandler(message.FileStreamProtocolID)
+		}
+
+		senderHost, _, senderManager := newMailboxTestPeer(t, logger)
+		connectHosts(t, senderHost, receiverHost)
+		require.NoError(t, senderManager.Start())
+		t.Cleanup(func() {
+			assert.NoError(t, senderManager.Stop())
+		})
+		return senderHost, senderManager, receiverHost, downloadDir
+	}
+
+	t.Run("concurrent transfers to one peer", func(t *testing.T) {
+		_, senderManager, receiverHost, downloadDir := newPeers(t, false)
+
+		// Each file is larger than the window, so senders wait for credits
+		size := (message.FileWindowChunks + 20) * message.FileChunkSize
+		sources := make([]string, 3)
+		for i := range sources {
+			sources[i] = writeRandomFile(t, sourceDir, fmt.Sprintf("concurrent-%d.bin", i), size)
+		}
+
+		var wg sync.WaitGroup
+		errs := make([]error, len(sources))
+		for i, source := range sources {
+			wg.Add(1)
+			go func(i int, source string) {
+				defer wg.Done()
+				errs[i] = senderManager.SendFile(receiverHost.ID(), source)
+			}(i, source)
+		}
+		wg.Wait()
+
+		for i, source := range sources {
+			require.NoError(t, errs[i])
+			expected, err := os.ReadFile(source)
+			require.NoError(t, err)
+			received, err := os.ReadFile(filepath.Join(downloadDir, filepath.Base(source)))
+			require.NoError(t, err)
+			assert.True(t, bytes.Equal(expected, received), "file %d differs", i)
+		}
+	})
+
+	t.Run("receiver returns credits", func(t *testing.T) {
+		senderHost, _, receiverHost, downloadDir := newPeers(t, false)
+
+		chunks := message.FileWindowChunks/4 + 4
+		source := writeRandomFile(t, sourceDir, "credits.bin", chunks*message.FileChunkSize)
+		metadata, err := message.CreateFileMetadata(source)
+		require.NoError(t, err)
+		transfer := message.NewFileTransfer(metadata.ID, receiverHost.ID(), *metadata, true, logger)
+		transfer.LocalPath = source
+
+		stream, err := senderHost.NewStream(context.Background(), receiverHost.ID(), message.FileStreamProtocolID)
+		require.NoError(t, err)
+		defer func() { _ = stream.Close() }()
+
+		require.NoError(t, transfer.SendFileRequest(stream))
+		accept := readTestBinaryFileFrame(t, stream)
+		require.Equal(t, "accept", accept.Type)
+		assert.Equal(t, message.FileWindowChunks, accept.Credits)
+
+		data, err := os.ReadFile(source)
+		require.NoError(t, err)
+		for chunkID := 0; chunkID < chunks; chunkID++ {
+			chunk := data[chunkID*message.FileChunkSize : (chunkID+1)*message.FileChunkSize]
+			require.NoError(t, transfer.SendFileChunk(stream, chunkID, chunk))
+		}
+
+		// One full batch while chunks arrive, the rest when the sender completes
+		credit := readTestBinaryFileFrame(t, stream)
+		require.Equal(t, "credit", credit.Type)
+		assert.Equal(t, message.FileWindowChunks/4, credit.Credits)
+
+		require.NoError(t, transfer.SendFileComplete(stream))
+		credit = readTestBinaryFileFrame(t, stream)
+		require.Equal(t, "credit", credit.Type)
+		assert.Equal(t, 4, credit.Credits)
+		assert.Equal(t, "ack", readTestBinaryFileFrame(t, stream).Type)
+
+		received, err := os.ReadFile(filepath.Join(downloadDir, "credits.bin"))
+		require.NoError(t, err)
+		assert.True(t, bytes.Equal(data, received))
+	})
+
+	t.Run("chunks of another transfer are refused", func(t *testing.T) {
+		senderHost, _, receiverHost, downloadDir := newPeers(t, false)
+
+		source := writeRandomFile(t, sourceDir, "mixed.bin", 100)
+		metadata, err := message.CreateFileMetadata(source)
+		require.NoError(t, err)
+		transfer := message.NewFileTransfer(metadata.ID, receiverHost.ID(), *metadata, true, logger)
+		transfer.LocalPath = source
+		other := message.NewFileTransfer("file_other", receiverHost.ID(), *metadata, true, logger)
+		other.LocalPath = source
+
+		stream, err := senderHost.NewStream(context.Background(), receiverHost.ID(), message.FileStreamProtocolID)
+		require.NoError(t, err)
+		defer func() { _ = stream.Close() }()
+
+		require.NoError(t, transfer.SendFileRequest(stream))
+		require.Equal(t, "accept", readTestBinaryFileFrame(t, stream).Type)
+
+		data, err := os.ReadFile(source)
+		require.NoError(t, err)
+		require.NoError(t, other.SendFileChunk(stream, 0, data))
+		require.NoError(t, transfer.SendFileComplete(stream))
+
+		// The receiver drops the stream without acknowledging the file
+		reply, _ := io.ReadAll(stream)
+		assert.Empty(t, reply)
+		_, err = os.Stat(filepath.Join(downloadDir, "mixed.bin"))
+		assert.True(t, os.IsNotExist(err))
+	})
+
+	t.Run("falls back to the legacy protocol", func(t *testing.T) {
+		_, senderManager, receiverHost, downloadDir := newPeers(t, true)
+
+		size := (message.FileWindowChunks + 4) * message.FileChunkSize
+		source := writeRandomFile(t, sourceDir, "legacy.bin", size)
+		require.NoError(t, senderManager.SendFile(receiverHost.ID(), source))
+
+		expected, err := os.ReadFile(source)
+		require.NoError(t, err)
+		received, err := os.ReadFile(filepath.Join(downloadDir, "legacy.bin"))
+		require.NoError(t, err)
+		assert.True(t, bytes.Equal(expected, received))
+	})
+}
+
+// BenchmarkFileTransferProtocols compares JSON frames on /xelvra/file/1.0.0
+// with binary frames and flow control on /xelvra/file/2.0.0
+func BenchmarkFileTransferProtocols(b *testing.B) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.ErrorLevel)
+
+	const size = 4 << 20
+	source := writeRandomFile(b, b.TempDir(), "bench.bin", size)
+
+	for _, protocol := range []string{"json-1.0.0", "binary-2.0.0"} {
+		b.Run(protocol, func(b *testing.B) {
+			downloadDir := b.TempDir()
+			receiverHost, _, receiverManager := newMailboxTestPeer(b, logger)
+			receiverManager.SetDownloadDir(downloadDir)
+			receiverManager.SetFileAcceptPolicy(autoAcceptPolicy())
+			require.NoError(b, receiverManager.Start())
+			defer func() { _ = receiverManager.Stop() }()
+			if protocol == "json-1.0.0" {
+				receiverHost.RemoveStreamHandler(message.EncryptedFileStreamProtocolID)
+				receiverHost.RemoveStreamHandler(message.FileStreamProtocolID)
+			}
+
+			senderHost, _, senderManager := newMailboxTestPeer(b, logger)
+			connectHosts(b, senderHost, receiverHost)
+			require.NoError(b, senderManager.Start())
+			defer func() { _ = senderManager.Stop() }()
+
+			b.SetBytes(size)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				require.NoError(b, senderManager.SendFile(receiverHost.ID(), source))
+
+				b.StopTimer()
+				require.NoError(b, os.Remove(filepath.Join(downloadDir, "bench.bin")))
+				b.StartTimer()
+			}
+		})
+	}
+}
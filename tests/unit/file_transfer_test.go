@@ -1,11 +1,20 @@
 package unit
 
 import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"io"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/Xelvra/peerchat/internal/db"
 	"github.com/Xelvra/peerchat/internal/message"
 	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/sirupsen/logrus"
@@ -217,3 +226,360 @@ func TestFileTransferConstants(t *testing.T) {
 	assert.Equal(t, 1024, message.FileHeaderSize)                          // 1KB header limit
 	assert.Equal(t, uint32(0x58454C56), uint32(message.FileTransferMagic)) // "XELV" magic
 }
+
+func TestChunkBitmap(t *testing.T) {
+	bitmap := message.NewChunkBitmap(20)
+	for _, i := range []int{0, 1, 2, 3, 4, 10, 19} {
+		assert.True(t, bitmap.Set(i))
+	}
+	assert.False(t, bitmap.Set(10), "setting a chunk twice reports no change")
+	assert.False(t, bitmap.Set(20), "out of range chunks are ignored")
+
+	assert.Equal(t, 7, bitmap.Count())
+	assert.False(t, bitmap.Complete())
+	assert.Equal(t, []message.ChunkRange{{Start: 5, End: 10}, {Start: 11, End: 19}}, bitmap.MissingRanges())
+
+	restored, err := message.ChunkBitmapFromBytes(20, bitmap.Bytes())
+	require.NoError(t, err)
+	assert.Equal(t, bitmap.Count(), restored.Count())
+	assert.Equal(t, bitmap.MissingRanges(), restored.MissingRanges())
+
+	_, err = message.ChunkBitmapFromBytes(100, bitmap.Bytes())
+	assert.Error(t, err)
+
+	for _, r := range bitmap.MissingRanges() {
+		for i := r.Start; i < r.End; i++ {
+			bitmap.Set(i)
+		}
+	}
+	assert.True(t, bitmap.Complete())
+	assert.Empty(t, bitmap.MissingRanges())
+	assert.True(t, message.NewChunkBitmap(0).Complete())
+}
+
+func TestFileTransferStores(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.ErrorLevel)
+
+	sqliteStore, err := db.NewSQLiteDB(t.TempDir(), "test-password", logger)
+	require.NoError(t, err)
+	defer func() {
+		assert.NoError(t, sqliteStore.Close())
+	}()
+
+	stores := map[string]message.FileTransferStore{
+		"memory": message.NewMemoryFileTransferStore(),
+		"sqlite": sqliteStore,
+	}
+
+	peerID, err := peer.Decode("12D3KooWBhSxema2VqCGWW3dBkNQjzuUoTAozK9XP6y8JZtQZtjJ")
+	require.NoError(t, err)
+
+	metadata := message.FileMetadata{
+		ID:         "resume-me",
+		Name:       "big.bin",
+		Size:       10*message.FileChunkSize + 100,
+		Hash:       "hash",
+		Timestamp:  time.Now(),
+		ChunkCount: 11,
+		ChunkSize:  message.FileChunkSize,
+	}
+
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			incoming := message.NewFileTransfer(metadata.ID, peerID, metadata, false, logger)
+			incoming.Status = message.FileTransferActive
+			incoming.LocalPath = "/tmp/partial.part"
+			incoming.Chunks.Set(0)
+			incoming.Chunks.Set(10)
+			incoming.ChunkHashes = bytes.Repeat([]byte{0xab}, 11*sha256.Size)
+			require.NoError(t, store.SaveFileTransfer(incoming))
+
+			done := message.NewFileTransfer("done", peerID, metadata, true, logger)
+			done.Status = message.FileTransferCompleted
+			require.NoError(t, store.SaveFileTransfer(done))
+
+			transfers, err := store.LoadResumableTransfers()
+			require.NoError(t, err)
+			require.Len(t, transfers, 1)
+
+			loaded := transfers[0]
+			assert.Equal(t, metadata.ID, loaded.ID)
+			assert.Equal(t, peerID, loaded.PeerID)
+			assert.False(t, loaded.IsOutgoing())
+			assert.Equal(t, message.FileTransferActive, loaded.Status)
+			assert.Equal(t, "/tmp/partial.part", loaded.LocalPath)
+			assert.Equal(t, metadata.Hash, loaded.Metadata.Hash)
+			assert.True(t, metadata.Timestamp.Equal(loaded.Metadata.Timestamp))
+			assert.Equal(t, []message.ChunkRange{{Start: 1, End: 10}}, loaded.Chunks.MissingRanges())
+			assert.Equal(t, int64(message.FileChunkSize+100), loaded.BytesReceived)
+			assert.Equal(t, incoming.ChunkHashes, loaded.ChunkHashes)
+
+			// Finishing the transfer removes it from the resumable set
+			incoming.Status = message.FileTransferCompleted
+			require.NoError(t, store.SaveFileTransfer(incoming))
+			transfers, err = store.LoadResumableTransfers()
+			require.NoError(t, err)
+			assert.Empty(t, transfers)
+		})
+	}
+}
+
+// autoAcceptPolicy returns the default limits without asking before each file
+func autoAcceptPolicy() *message.FileAcceptPolicy {
+	policy := message.DefaultFileAcceptPolicy()
+	policy.AutoAccept = true
+	return policy
+}
+
+// readTestFileFrame reads one length-prefixed file protocol frame
+func readTestFileFrame(t *testing.T, r io.Reader) *message.FileTransferRequest {
+	var length uint32
+	require.NoError(t, binary.Read(r, binary.BigEndian, &length))
+	data := make([]byte, length)
+	_, err := io.ReadFull(r, data)
+	require.NoError(t, err)
+
+	var frame message.FileTransferRequest
+	require.NoError(t, json.Unmarshal(data, &frame))
+	return &frame
+}
+
+// writeTestFileFrame writes one length-prefixed file protocol frame
+func writeTestFileFrame(t *testing.T, w io.Writer, frame message.FileTransferRequest) {
+	frame.Magic = message.FileTransferMagic
+	data, err := json.Marshal(frame)
+	require.NoError(t, err)
+	require.NoError(t, binary.Write(w, binary.BigEndian, uint32(len(data))))
+	_, err = w.Write(data)
+	require.NoError(t, err)
+}
+
+func TestFileTransferVerification(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.ErrorLevel)
+	ctx := context.Background()
+
+	downloadDir := t.TempDir()
+	receiverDB, err := db.NewSQLiteDB(t.TempDir(), "test-password", logger)
+	require.NoError(t, err)
+	defer func() {
+		assert.NoError(t, receiverDB.Close())
+	}()
+
+	receiverHost, _, receiverManager := newMailboxTestPeer(t, logger)
+	receiverManager.SetDownloadDir(downloadDir)
+	receiverManager.SetFileTransferStore(receiverDB)
+	receiverManager.SetFileAcceptPolicy(autoAcceptPolicy())
+	require.NoError(t, receiverManager.Start())
+	defer func() {
+		assert.NoError(t, receiverManager.Stop())
+	}()
+
+	senderHost, _, senderManager := newMailboxTestPeer(t, logger)
+	connectHosts(t, senderHost, receiverHost)
+
+	content := make([]byte, 2*message.FileChunkSize+10)
+	_, err = rand.Read(content)
+	require.NoError(t, err)
+	source := filepath.Join(t.TempDir(), "verify.bin")
+	require.NoError(t, os.WriteFile(source, content, 0644))
+
+	chunk := func(i int) []byte {
+		end := (i + 1) * message.FileChunkSize
+		if end > len(content) {
+			end = len(content)
+		}
+		return content[i*message.FileChunkSize : end]
+	}
+
+	t.Run("bad chunk is retransmitted", func(t *testing.T) {
+		metadata, err := message.CreateFileMetadata(source)
+		require.NoError(t, err)
+		transfer := message.NewFileTransfer(metadata.ID, receiverHost.ID(), *metadata, true, logger)
+		transfer.LocalPath = source
+
+		stream, err := senderHost.NewStream(ctx, receiverHost.ID(), message.FileProtocolID)
+		require.NoError(t, err)
+		defer func() { _ = stream.Close() }()
+
+		require.NoError(t, transfer.SendFileRequest(stream))
+		require.Equal(t, "accept", readTestFileFrame(t, stream).Type)
+
+		require.NoError(t, transfer.SendFileChunk(stream, 0, chunk(0)))
+		writeTestFileFrame(t, stream, message.FileTransferRequest{
+			Type:      "chunk",
+			ChunkID:   1,
+			Data:      chunk(1),
+			ChunkHash: make([]byte, sha256.Size),
+		})
+		require.NoError(t, transfer.SendFileChunk(stream, 2, chunk(2)))
+		require.NoError(t, transfer.SendFileComplete(stream))
+
+		retransmit := readTestFileFrame(t, stream)
+		require.Equal(t, "retransmit", retransmit.Type)
+		assert.Equal(t, []message.ChunkRange{{Start: 1, End: 2}}, retransmit.Missing)
+
+		require.NoError(t, transfer.SendFileChunk(stream, 1, chunk(1)))
+		require.NoError(t, transfer.SendFileComplete(stream))
+
+		ack := readTestFileFrame(t, stream)
+		require.Equal(t, "ack", ack.Type)
+		payload := append(append([]byte("xelvra-file-ack-v1"), metadata.ID...), 0)
+		valid, err := receiverHost.Peerstore().PubKey(receiverHost.ID()).Verify(append(payload, metadata.Hash...), ack.Signature)
+		require.NoError(t, err)
+		assert.True(t, valid)
+
+		received, err := os.ReadFile(filepath.Join(downloadDir, "verify.bin"))
+		require.NoError(t, err)
+		assert.Equal(t, content, received)
+	})
+
+	t.Run("hash mismatch fails the transfer", func(t *testing.T) {
+		metadata, err := message.CreateFileMetadata(source)
+		require.NoError(t, err)
+		metadata.Name = "tampered.bin"
+		metadata.Hash = strings.Repeat("0", 64)
+		transfer := message.NewFileTransfer(metadata.ID, receiverHost.ID(), *metadata, true, logger)
+		transfer.LocalPath = source
+
+		stream, err := senderHost.NewStream(ctx, receiverHost.ID(), message.FileProtocolID)
+		require.NoError(t, err)
+		defer func() { _ = stream.Close() }()
+
+		require.NoError(t, transfer.SendFileRequest(stream))
+		require.Equal(t, "accept", readTestFileFrame(t, stream).Type)
+		for i := 0; i < metadata.ChunkCount; i++ {
+			require.NoError(t, transfer.SendFileChunk(stream, i, chunk(i)))
+		}
+		require.NoError(t, transfer.SendFileComplete(stream))
+
+		reject := readTestFileFrame(t, stream)
+		assert.Equal(t, "reject", reject.Type)
+		assert.Contains(t, reject.Error, "hash mismatch")
+
+		_, err = os.Stat(filepath.Join(downloadDir, "tampered.bin"))
+		assert.True(t, os.IsNotExist(err))
+
+		history, err := receiverDB.LoadFileTransfers(senderHost.ID().String(), 10)
+		require.NoError(t, err)
+		statuses := make(map[string]int64)
+		for _, entry := range history {
+			statuses[entry["transfer_id"].(string)] = entry["status"].(int64)
+		}
+		assert.Equal(t, int64(message.FileTransferFailed), statuses[metadata.ID])
+	})
+
+	t.Run("sender verifies the signed ack", func(t *testing.T) {
+		require.NoError(t, senderManager.Start())
+		defer func() {
+			assert.NoError(t, senderManager.Stop())
+		}()
+
+		signed := filepath.Join(t.TempDir(), "signed.bin")
+		require.NoError(t, os.WriteFile(signed, content, 0644))
+		require.NoError(t, senderManager.SendFile(receiverHost.ID(), signed))
+
+		transfers := senderManager.FileTransfers().ListTransfers()
+		require.Len(t, transfers, 1)
+		status, progress := transfers[0].State()
+		assert.Equal(t, message.FileTransferCompleted, status)
+		assert.Equal(t, 1.0, progress)
+	})
+}
+
+func TestFileTransferResume(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.ErrorLevel)
+	ctx := context.Background()
+
+	downloadDir := t.TempDir()
+	receiverDB, err := db.NewSQLiteDB(t.TempDir(), "test-password", logger)
+	require.NoError(t, err)
+	defer func() {
+		assert.NoError(t, receiverDB.Close())
+	}()
+
+	receiverHost, receiverIdentity, receiverManager := newMailboxTestPeer(t, logger)
+	receiverManager.SetDownloadDir(downloadDir)
+	receiverManager.SetFileTransferStore(receiverDB)
+	receiverManager.SetFileAcceptPolicy(autoAcceptPolicy())
+	require.NoError(t, receiverManager.Start())
+
+	senderHost, _, senderManager := newMailboxTestPeer(t, logger)
+	connectHosts(t, senderHost, receiverHost)
+
+	content := make([]byte, 32*message.FileChunkSize+100)
+	_, err = rand.Read(content)
+	require.NoError(t, err)
+	source := filepath.Join(t.TempDir(), "resume.bin")
+	require.NoError(t, os.WriteFile(source, content, 0644))
+
+	metadata, err := message.CreateFileMetadata(source)
+	require.NoError(t, err)
+	require.Equal(t, 33, metadata.ChunkCount)
+
+	// The first attempt delivers ten chunks before the connection drops
+	transfer := message.NewFileTransfer(metadata.ID, receiverHost.ID(), *metadata, true, logger)
+	transfer.LocalPath = source
+	stream, err := senderHost.NewStream(ctx, receiverHost.ID(), message.FileProtocolID)
+	require.NoError(t, err)
+	require.NoError(t, transfer.SendFileRequest(stream))
+	accept := readTestFileFrame(t, stream)
+	require.Equal(t, "accept", accept.Type)
+	assert.Equal(t, []message.ChunkRange{{Start: 0, End: 33}}, accept.Missing)
+
+	for i := 0; i < 10; i++ {
+		chunk := content[i*message.FileChunkSize : (i+1)*message.FileChunkSize]
+		require.NoError(t, transfer.SendFileChunk(stream, i, chunk))
+	}
+	require.NoError(t, stream.CloseWrite())
+	_, _ = io.ReadAll(stream) // Returns once the receiver saved its state
+	require.NoError(t, stream.Close())
+
+	// The receiver restarts and reports what it still needs, without asking
+	// the user again about a file that was already accepted
+	require.NoError(t, receiverManager.Stop())
+	receiverManager = message.NewMessageManager(receiverHost, receiverIdentity, nil, logger)
+	receiverManager.SetDownloadDir(downloadDir)
+	receiverManager.SetFileTransferStore(receiverDB)
+	require.NoError(t, receiverManager.Start())
+	defer func() {
+		assert.NoError(t, receiverManager.Stop())
+	}()
+
+	stream, err = senderHost.NewStream(ctx, receiverHost.ID(), message.FileProtocolID)
+	require.NoError(t, err)
+	require.NoError(t, transfer.SendFileRequest(stream))
+	accept = readTestFileFrame(t, stream)
+	require.Equal(t, "accept", accept.Type)
+	assert.Equal(t, []message.ChunkRange{{Start: 10, End: 33}}, accept.Missing)
+	require.NoError(t, stream.Reset())
+
+	// The sender picks the persisted transfer up on start and finishes it
+	senderStore := message.NewMemoryFileTransferStore()
+	transfer.Status = message.FileTransferActive
+	require.NoError(t, senderStore.SaveFileTransfer(transfer))
+	senderManager.SetFileTransferStore(senderStore)
+	require.NoError(t, senderManager.Start())
+	defer func() {
+		assert.NoError(t, senderManager.Stop())
+	}()
+
+	require.Eventually(t, func() bool {
+		resumed, exists := senderManager.FileTransfers().GetTransfer(metadata.ID)
+		if !exists {
+			return false
+		}
+		status, _ := resumed.State()
+		return status == message.FileTransferCompleted
+	}, 15*time.Second, 50*time.Millisecond)
+
+	received, err := os.ReadFile(filepath.Join(downloadDir, "resume.bin"))
+	require.NoError(t, err)
+	assert.Equal(t, content, received)
+
+	pending, err := receiverDB.LoadResumableTransfers()
+	require.NoError(t, err)
+	assert.Empty(t, pending)
+}
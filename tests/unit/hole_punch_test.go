@@ -0,0 +1,178 @@
+package unit
+
+import (
+	"context"
+	"errors"
+	"net"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Xelvra/peerchat/internal/p2p"
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	relayv2 "github.com/libp2p/go-libp2p/p2p/protocol/circuitv2/relay"
+	"github.com/libp2p/go-libp2p/p2p/protocol/holepunch"
+	"github.com/libp2p/go-libp2p/p2p/transport/quicreuse"
+	"github.com/marcopolo/simnet"
+	multiaddr "github.com/multiformats/go-multiaddr"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHolePuncherTrace(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.ErrorLevel)
+	hp := p2p.NewHolePuncher(logger)
+
+	remote := peer.ID("remote")
+	start := time.Now()
+	trace := func(offset time.Duration, evt interface{}) {
+		hp.Trace(&holepunch.Event{Timestamp: start.Add(offset).UnixNano(), Remote: remote, Evt: evt})
+	}
+	trace(100*time.Millisecond, &holepunch.DirectDialEvt{Success: false, EllapsedTime: 100 * time.Millisecond, Error: "timeout"})
+	trace(200*time.Millisecond, &holepunch.StartHolePunchEvt{RTT: 40 * time.Millisecond})
+	trace(300*time.Millisecond, &holepunch.HolePunchAttemptEvt{Attempt: 2})
+	trace(400*time.Millisecond, &holepunch.EndHolePunchEvt{Success: true, EllapsedTime: 200 * time.Millisecond})
+
+	history := hp.History()
+	require.Len(t, history, 2)
+
+	assert.Equal(t, p2p.StrategyDirect, history[0].Strategy)
+	assert.False(t, history[0].Success)
+	assert.EqualError(t, history[0].LastError, "timeout")
+
+	dcutr := history[1]
+	assert.Equal(t, p2p.StrategySimultaneousOpen, dcutr.Strategy)
+	assert.Equal(t, remote, dcutr.PeerID)
+	assert.True(t, dcutr.Success)
+	assert.NoError(t, dcutr.LastError)
+	assert.Equal(t, 2, dcutr.Attempts)
+	assert.Equal(t, 40*time.Millisecond, dcutr.RTT)
+	assert.Equal(t, 200*time.Millisecond, dcutr.EndTime.Sub(dcutr.StartTime))
+}
+
+// TestHolePunchingThroughEmulatedNAT connects two peers behind emulated NATs
+// through a relay and checks DCUtR upgrades the connection to a direct one
+func TestHolePunchingThroughEmulatedNAT(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.ErrorLevel)
+
+	router := &simnet.SimpleFirewallRouter{}
+	relay := newSimHost(t, router, true, "/ip4/1.2.0.1/udp/8000/quic-v1", libp2p.DisableRelay())
+	_, err := relayv2.New(relay)
+	require.NoError(t, err)
+
+	hp := p2p.NewHolePuncher(logger)
+	dialer := newSimHost(t, router, false, "/ip4/2.2.0.1/udp/8000/quic-v1",
+		libp2p.EnableHolePunching(holepunch.WithTracer(hp), holepunch.DirectDialTimeout(100*time.Millisecond)),
+		libp2p.ForceReachabilityPrivate(),
+	)
+	target := newSimHost(t, router, false, "/ip4/2.2.0.2/udp/8001/quic-v1",
+		libp2p.EnableRelay(),
+		libp2p.EnableAutoRelayWithStaticRelays([]peer.AddrInfo{{ID: relay.ID(), Addrs: relay.Addrs()}}),
+		libp2p.EnableHolePunching(holepunch.DirectDialTimeout(100*time.Millisecond)),
+		libp2p.ForceReachabilityPrivate(),
+	)
+
+	// The target can only be reached through its relay reservation
+	var circuits []string
+	require.Eventually(t, func() bool {
+		circuits = circuits[:0]
+		for _, addr := range target.Addrs() {
+			if _, err := addr.ValueForProtocol(multiaddr.P_CIRCUIT); err == nil {
+				circuits = append(circuits, addr.String())
+			}
+		}
+		return len(circuits) > 0
+	}, 10*time.Second, 50*time.Millisecond)
+
+	// DCUtR only starts on hosts that have found a public address
+	for _, h := range []host.Host{dialer, target} {
+		require.Eventually(t, func() bool {
+			return slices.Contains(h.Mux().Protocols(), holepunch.Protocol)
+		}, 10*time.Second, 50*time.Millisecond)
+	}
+
+	nat := p2p.NewAdvancedNATTraversal(dialer, logger)
+	nat.SetHolePuncher(hp)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	require.NoError(t, nat.AttemptConnection(ctx, target.ID(), circuits))
+
+	var direct bool
+	for _, conn := range dialer.Network().ConnsToPeer(target.ID()) {
+		if _, err := conn.RemoteMultiaddr().ValueForProtocol(multiaddr.P_CIRCUIT); err != nil {
+			direct = true
+		}
+	}
+	assert.True(t, direct, "the relayed connection is upgraded")
+
+	// Our direct dial has nothing to dial; DCUtR, traced and driven by us, succeeds
+	history := nat.HolePunchHistory()
+	require.NotEmpty(t, history)
+	last := history[len(history)-1]
+	assert.Equal(t, p2p.StrategySimultaneousOpen, last.Strategy)
+	assert.True(t, last.Success)
+	assert.Equal(t, p2p.StrategyDirect, history[0].Strategy)
+	assert.False(t, history[0].Success)
+
+	var traced bool
+	for _, attempt := range history {
+		traced = traced || (attempt.Strategy == p2p.StrategySimultaneousOpen && attempt.RTT > 0 && attempt.Success)
+	}
+	assert.True(t, traced, "the DCUtR exchange is in the history")
+	assert.Greater(t, nat.GetStatus().TraversalRate, 0.0)
+}
+
+// newSimHost creates a QUIC host on an in-memory network. Hosts that are not
+// publicly reachable sit behind a NAT that only lets in packets from
+// addresses they have sent to.
+func newSimHost(t *testing.T, router *simnet.SimpleFirewallRouter, public bool, listen string, opts ...libp2p.Option) host.Host {
+	t.Helper()
+
+	var sourceIP atomic.Pointer[net.IP]
+	opts = append(opts,
+		libp2p.ListenAddrStrings(listen),
+		libp2p.ResourceManager(&network.NullResourceManager{}),
+		libp2p.QUICReuse(
+			quicreuse.NewConnManager,
+			quicreuse.OverrideSourceIPSelector(func() (quicreuse.SourceIPSelector, error) {
+				return sourceIPSelector{&sourceIP}, nil
+			}),
+			quicreuse.OverrideListenUDP(func(_ string, addr *net.UDPAddr) (net.PacketConn, error) {
+				sourceIP.Store(&addr.IP)
+				conn := simnet.NewSimConn(addr)
+				conn.SetUpPacketReceiver(router)
+				if public {
+					router.SetAddrPubliclyReachable(addr)
+				}
+				router.AddNode(addr, conn)
+				return conn, nil
+			}),
+		),
+	)
+
+	h, err := libp2p.New(opts...)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = h.Close() })
+	return h
+}
+
+// sourceIPSelector makes QUIC dial from the simulated listen address
+type sourceIPSelector struct {
+	ip *atomic.Pointer[net.IP]
+}
+
+func (s sourceIPSelector) PreferredSourceIPForDestination(*net.UDPAddr) (net.IP, error) {
+	ip := s.ip.Load()
+	if ip == nil {
+		return nil, errors.New("not listening yet")
+	}
+	return *ip, nil
+}
@@ -0,0 +1,122 @@
+package unit
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Xelvra/peerchat/internal/p2p"
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/p2p/transport/tcp"
+	multiaddr "github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLinkLocalAddrs(t *testing.T) {
+	source := &net.UDPAddr{IP: net.ParseIP("fe80::1"), Port: p2p.IPv6DiscoveryPort, Zone: "eth0"}
+	announced := []multiaddr.Multiaddr{
+		multiaddr.StringCast("/ip6/fe80::1/tcp/4001"),
+		multiaddr.StringCast("/ip6/fd00::2/tcp/4001"),
+		multiaddr.StringCast("/ip6/fd00::2/udp/4001/quic-v1"),
+		multiaddr.StringCast("/ip4/192.168.1.20/tcp/4003"),
+		multiaddr.StringCast("/ip6zone/eth1/ip6/fe80::9/tcp/4002/ws"),
+	}
+
+	addrs := p2p.LinkLocalAddrs(source, announced)
+	require.Len(t, addrs, 1, "only plain TCP addresses are dialed")
+	assert.Equal(t, "/ip6zone/eth0/ip6/fe80::1/tcp/4001", addrs[0].String())
+
+	addrs = p2p.LinkLocalAddrs(source, []multiaddr.Multiaddr{multiaddr.StringCast("/ip6zone/eth1/ip6/fe80::9/tcp/4002")})
+	require.Len(t, addrs, 1)
+	assert.Equal(t, "/ip6zone/eth0/ip6/fe80::1/tcp/4002", addrs[0].String(), "the zone is where the beacon arrived")
+
+	for _, other := range []*net.UDPAddr{
+		{IP: net.ParseIP("fd00::2"), Zone: "eth0"},
+		{IP: net.ParseIP("fe80::1")},
+		{IP: net.ParseIP("192.168.1.20")},
+	} {
+		assert.Empty(t, p2p.LinkLocalAddrs(other, announced), other.String())
+	}
+}
+
+func TestConnectLinkLocal(t *testing.T) {
+	iface, linkLocal := linkLocalInterface(t)
+
+	target, err := libp2p.New(libp2p.ListenAddrStrings("/ip6/::/tcp/0"))
+	require.NoError(t, err)
+	defer func() { _ = target.Close() }()
+	dialer, err := libp2p.New(libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"),
+		libp2p.Transport(tcp.NewTCPTransport), p2p.LinkLocalTransport())
+	require.NoError(t, err)
+	defer func() { _ = dialer.Close() }()
+
+	var port string
+	for _, listen := range target.Network().ListenAddresses() {
+		if value, err := listen.ValueForProtocol(multiaddr.P_TCP); err == nil {
+			port = value
+		}
+	}
+	require.NotEmpty(t, port)
+	addr := multiaddr.StringCast("/ip6zone/" + iface + "/ip6/" + linkLocal.String() + "/tcp/" + port)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// libp2p itself refuses link-local addresses
+	assert.Error(t, dialer.Connect(ctx, peer.AddrInfo{ID: target.ID(), Addrs: []multiaddr.Multiaddr{addr}}))
+
+	require.NoError(t, p2p.ConnectLinkLocal(ctx, dialer, target.ID(), []multiaddr.Multiaddr{addr}))
+	assert.Equal(t, network.Connected, dialer.Network().Connectedness(target.ID()))
+
+	stream, err := dialer.NewStream(ctx, target.ID(), "/ipfs/id/1.0.0")
+	require.NoError(t, err)
+	_ = stream.Close()
+	conns := dialer.Network().ConnsToPeer(target.ID())
+	require.Len(t, conns, 1)
+	assert.Equal(t, addr.String(), conns[0].RemoteMultiaddr().String(), "the connection reports the link-local address")
+	for _, known := range dialer.Peerstore().Addrs(target.ID()) {
+		_, err := known.ValueForProtocol(multiaddr.P_MEMORY)
+		assert.Error(t, err, "in-process addresses are not kept: %s", known)
+	}
+
+	t.Run("hosts without the link-local transport fail", func(t *testing.T) {
+		plain, err := libp2p.New(libp2p.NoListenAddrs)
+		require.NoError(t, err)
+		defer func() { _ = plain.Close() }()
+		assert.ErrorIs(t, p2p.ConnectLinkLocal(ctx, plain, target.ID(), []multiaddr.Multiaddr{addr}), p2p.ErrNoLinkLocalAddrs)
+	})
+
+	t.Run("a different peer behind the address is rejected", func(t *testing.T) {
+		impostor, err := libp2p.New(libp2p.NoListenAddrs)
+		require.NoError(t, err)
+		defer func() { _ = impostor.Close() }()
+		assert.Error(t, p2p.ConnectLinkLocal(ctx, dialer, impostor.ID(), []multiaddr.Multiaddr{addr}))
+	})
+}
+
+// linkLocalInterface returns an interface with an IPv6 link-local address,
+// skipping the test if there is none
+func linkLocalInterface(t *testing.T) (string, net.IP) {
+	interfaces, err := net.Interfaces()
+	require.NoError(t, err)
+	for _, iface := range interfaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.To4() == nil && ipnet.IP.IsLinkLocalUnicast() {
+				return iface.Name, ipnet.IP
+			}
+		}
+	}
+	t.Skip("no interface with an IPv6 link-local address")
+	return "", nil
+}
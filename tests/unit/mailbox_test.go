@@ -0,0 +1,388 @@
+package unit
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Xelvra/peerchat/internal/db"
+	"github.com/Xelvra/peerchat/internal/message"
+	"github.com/Xelvra/peerchat/internal/user"
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMailboxStores(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.ErrorLevel)
+
+	sqliteStore, err := db.NewSQLiteDB(t.TempDir(), "test-password", logger)
+	require.NoError(t, err)
+	defer func() {
+		assert.NoError(t, sqliteStore.Close())
+	}()
+
+	stores := map[string]message.MailboxStore{
+		"memory": message.NewMemoryMailboxStore(),
+		"sqlite": sqliteStore,
+	}
+
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			now := time.Now()
+			envelope := func(id, owner string, created time.Time, ttl time.Duration) *message.Envelope {
+				return &message.Envelope{
+					ID:         id,
+					Owner:      owner,
+					Sender:     "did:xelvra:sender",
+					SenderPeer: "peer-s",
+					Payload:    []byte("payload-" + id),
+					CreatedAt:  created,
+					ExpiresAt:  created.Add(ttl),
+				}
+			}
+
+			require.NoError(t, store.StoreEnvelope(envelope("e2", "owner-a", now.Add(time.Millisecond), time.Hour)))
+			require.NoError(t, store.StoreEnvelope(envelope("e1", "owner-a", now, time.Hour)))
+			require.NoError(t, store.StoreEnvelope(envelope("e3", "owner-b", now, time.Hour)))
+			require.NoError(t, store.StoreEnvelope(envelope("e4", "owner-a", now.Add(-time.Hour), time.Minute)))
+
+			// IDs are chosen by senders, so a reused ID never replaces a stored envelope and is only unique per owner
+			forged := envelope("e1", "owner-a", now, time.Hour)
+			forged.Payload = []byte("forged")
+			assert.ErrorIs(t, store.StoreEnvelope(forged), message.ErrEnvelopeExists)
+			require.NoError(t, store.StoreEnvelope(envelope("e1", "owner-c", now, time.Hour)))
+
+			count, size, err := store.MailboxUsage("owner-a")
+			require.NoError(t, err)
+			assert.Equal(t, 3, count)
+			assert.Equal(t, int64(3*len("payload-e1")), size)
+
+			// Expired envelopes are never handed over, oldest first otherwise
+			envelopes, err := store.LoadEnvelopes("owner-a", 0)
+			require.NoError(t, err)
+			require.Len(t, envelopes, 2)
+			assert.Equal(t, "e1", envelopes[0].ID)
+			assert.Equal(t, []byte("payload-e1"), envelopes[0].Payload)
+			assert.Equal(t, "peer-s", envelopes[0].SenderPeer)
+			assert.Equal(t, "e2", envelopes[1].ID)
+
+			envelopes, err = store.LoadEnvelopes("owner-a", 1)
+			require.NoError(t, err)
+			require.Len(t, envelopes, 1)
+
+			removed, err := store.PurgeExpiredEnvelopes(now)
+			require.NoError(t, err)
+			assert.Equal(t, 1, removed)
+
+			// Deletion is scoped to the owner
+			require.NoError(t, store.DeleteEnvelopes("owner-b", []string{"e1"}))
+			require.NoError(t, store.DeleteEnvelopes("owner-a", []string{"e1", "e2"}))
+			count, _, err = store.MailboxUsage("owner-a")
+			require.NoError(t, err)
+			assert.Equal(t, 0, count)
+			count, _, err = store.MailboxUsage("owner-b")
+			require.NoError(t, err)
+			assert.Equal(t, 1, count)
+
+			announcement := &message.MailboxAnnouncement{Owner: "owner-a", Mailboxes: []string{"/ip4/127.0.0.1/tcp/4001/p2p/mailbox"}}
+			require.NoError(t, store.SaveMailboxAnnouncement("peer-a", announcement))
+			announcement.Mailboxes = []string{"/ip4/127.0.0.1/tcp/4002/p2p/mailbox"}
+			require.NoError(t, store.SaveMailboxAnnouncement("peer-a", announcement))
+			announcements, err := store.LoadMailboxAnnouncements()
+			require.NoError(t, err)
+			require.Len(t, announcements, 1)
+			assert.Equal(t, announcement.Mailboxes, announcements["peer-a"].Mailboxes)
+		})
+	}
+}
+
+func TestVerifyMailboxAuth(t *testing.T) {
+	identity, err := user.GenerateMessengerIDWithDifficulty(1)
+	require.NoError(t, err)
+	other, err := user.GenerateMessengerIDWithDifficulty(1)
+	require.NoError(t, err)
+
+	mailbox := peer.ID("mailbox")
+	challenge := []byte("0123456789abcdef0123456789abcdef")
+
+	sign := func(mid *user.MessengerID, mailbox peer.ID, owner string) *message.MailboxAuth {
+		signature, err := mid.Sign(append(append(append([]byte("xelvra-mailbox-auth-v1"), mailbox...), owner...), challenge...))
+		require.NoError(t, err)
+		return &message.MailboxAuth{
+			PublicKey:   mid.PublicKey,
+			ProofOfWork: mid.ProofOfWork,
+			Signature:   signature,
+		}
+	}
+
+	assert.True(t, message.VerifyMailboxAuth(mailbox, identity.DID, challenge, sign(identity, mailbox, identity.DID)))
+
+	// Another key cannot claim the DID
+	assert.False(t, message.VerifyMailboxAuth(mailbox, identity.DID, challenge, sign(other, mailbox, identity.DID)))
+
+	// A signature for one mailbox cannot be replayed against another
+	assert.False(t, message.VerifyMailboxAuth(peer.ID("other"), identity.DID, challenge, sign(identity, mailbox, identity.DID)))
+
+	assert.False(t, message.VerifyMailboxAuth(mailbox, identity.DID, challenge, nil))
+}
+
+func TestMessengerIDPersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), user.IdentityFileName)
+
+	created, err := user.LoadOrCreateMessengerID(path)
+	require.NoError(t, err)
+
+	loaded, err := user.LoadOrCreateMessengerID(path)
+	require.NoError(t, err)
+
+	assert.Equal(t, created.DID, loaded.DID)
+	assert.Equal(t, created.PeerID, loaded.PeerID)
+	assert.True(t, user.VerifyDIDOwnership(loaded.DID, loaded.PublicKey, loaded.ProofOfWork))
+}
+
+// recordingHandler collects delivered messages
+type recordingHandler struct {
+	messages []*message.Message
+	mu       sync.Mutex
+}
+
+func (h *recordingHandler) HandleMessage(ctx context.Context, msg *message.Message) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.messages = append(h.messages, msg)
+	return nil
+}
+
+func (h *recordingHandler) received() []*message.Message {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]*message.Message(nil), h.messages...)
+}
+
+// newMailboxTestPeer creates a loopback host and message manager sharing one identity
+func newMailboxTestPeer(t testing.TB, logger *logrus.Logger) (host.Host, *user.MessengerID, *message.MessageManager) {
+	identity, err := user.GenerateMessengerIDWithDifficulty(1)
+	require.NoError(t, err)
+
+	privKey, err := crypto.UnmarshalEd25519PrivateKey(identity.PrivateKey)
+	require.NoError(t, err)
+
+	h, err := libp2p.New(libp2p.Identity(privKey), libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = h.Close() })
+
+	return h, identity, message.NewMessageManager(h, identity, nil, logger)
+}
+
+func TestMailboxStoreAndForward(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.ErrorLevel)
+
+	mailboxHost, _, mailboxManager := newMailboxTestPeer(t, logger)
+	ownerHost, ownerIdentity, ownerManager := newMailboxTestPeer(t, logger)
+	senderHost, senderIdentity, senderManager := newMailboxTestPeer(t, logger)
+	forgerHost, _, forgerManager := newMailboxTestPeer(t, logger)
+
+	mailboxStore := message.NewMemoryMailboxStore()
+	mailboxConfig := message.DefaultMailboxConfig()
+	mailboxConfig.ServeOwners = []string{ownerIdentity.DID}
+	mailboxManager.EnableMailbox(mailboxConfig, mailboxStore)
+
+	ownerConfig := message.DefaultMailboxConfig()
+	ownerConfig.Mailboxes = []peer.AddrInfo{{ID: mailboxHost.ID(), Addrs: mailboxHost.Addrs()}}
+	ownerManager.EnableMailbox(ownerConfig, nil)
+
+	senderManager.EnableMailbox(message.DefaultMailboxConfig(), nil)
+	forgerManager.EnableMailbox(message.DefaultMailboxConfig(), nil)
+
+	handler := &recordingHandler{}
+	ownerManager.RegisterHandler(message.MessageTypeText, handler)
+
+	for _, mm := range []*message.MessageManager{mailboxManager, ownerManager, senderManager, forgerManager} {
+		require.NoError(t, mm.Start())
+	}
+	defer func() {
+		for _, mm := range []*message.MessageManager{forgerManager, senderManager, ownerManager, mailboxManager} {
+			assert.NoError(t, mm.Stop())
+		}
+	}()
+
+	// The owner tells the sender where to leave messages, then goes offline
+	ctx := context.Background()
+	for _, h := range []host.Host{senderHost, forgerHost} {
+		require.NoError(t, h.Connect(ctx, peer.AddrInfo{ID: ownerHost.ID(), Addrs: ownerHost.Addrs()}))
+	}
+	require.Eventually(t, func() bool {
+		return senderManager.Mailbox().HasMailbox(ownerHost.ID()) && forgerManager.Mailbox().HasMailbox(ownerHost.ID())
+	}, 5*time.Second, 20*time.Millisecond)
+
+	for _, h := range []host.Host{mailboxHost, senderHost, forgerHost} {
+		require.NoError(t, ownerHost.Network().ClosePeer(h.ID()))
+		require.NoError(t, h.Network().ClosePeer(ownerHost.ID()))
+	}
+
+	// A message claiming to come from the sender is deposited first and never delivered
+	forged := &message.Message{
+		ID:          "forged",
+		Type:        message.MessageTypeText,
+		From:        senderIdentity.DID,
+		To:          ownerHost.ID().String(),
+		Content:     []byte("forged"),
+		Timestamp:   time.Now(),
+		Signature:   make([]byte, 64),
+		SenderKey:   senderIdentity.PublicKey,
+		SenderProof: senderIdentity.ProofOfWork,
+	}
+	require.NoError(t, forgerManager.Mailbox().Deposit(ownerHost.ID(), forged))
+
+	require.NoError(t, senderManager.SendMessage(ownerHost.ID().String(), []byte("left in mailbox"), message.MessageTypeText))
+
+	// The mailbox only holds sealed envelopes
+	require.Eventually(t, func() bool {
+		envelopes, err := mailboxStore.LoadEnvelopes(ownerIdentity.DID, 0)
+		return err == nil && len(envelopes) == 2
+	}, 5*time.Second, 20*time.Millisecond)
+	envelopes, err := mailboxStore.LoadEnvelopes(ownerIdentity.DID, 0)
+	require.NoError(t, err)
+	for _, envelope := range envelopes {
+		assert.NotContains(t, string(envelope.Payload), "left in mailbox")
+		assert.NotContains(t, string(envelope.Payload), senderIdentity.DID)
+	}
+
+	// The owner comes back online and fetches from its mailbox
+	require.Eventually(t, func() bool {
+		if err := ownerHost.Connect(ctx, peer.AddrInfo{ID: mailboxHost.ID(), Addrs: mailboxHost.Addrs()}); err != nil {
+			return false
+		}
+		return len(handler.received()) > 0
+	}, 10*time.Second, 100*time.Millisecond)
+
+	received := handler.received()
+	require.Len(t, received, 1)
+	assert.Equal(t, []byte("left in mailbox"), received[0].Content)
+	assert.Equal(t, senderHost.ID(), received[0].RemotePeer())
+}
+
+func TestMailboxFetchBatchesFitFrames(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.ErrorLevel)
+
+	mailboxHost, _, mailboxManager := newMailboxTestPeer(t, logger)
+	ownerHost, ownerIdentity, ownerManager := newMailboxTestPeer(t, logger)
+
+	mailboxStore := message.NewMemoryMailboxStore()
+	mailboxConfig := message.DefaultMailboxConfig()
+	mailboxConfig.ServeOwners = []string{ownerIdentity.DID}
+	mailboxManager.EnableMailbox(mailboxConfig, mailboxStore)
+	ownerManager.EnableMailbox(message.DefaultMailboxConfig(), nil)
+
+	for _, mm := range []*message.MessageManager{mailboxManager, ownerManager} {
+		require.NoError(t, mm.Start())
+	}
+	defer func() {
+		for _, mm := range []*message.MessageManager{ownerManager, mailboxManager} {
+			assert.NoError(t, mm.Stop())
+		}
+	}()
+
+	// Twenty envelopes of 48 KiB need several frames even though they make a single batch
+	now := time.Now()
+	for i := 0; i < 20; i++ {
+		require.NoError(t, mailboxStore.StoreEnvelope(&message.Envelope{
+			ID:        fmt.Sprintf("e%02d", i),
+			Owner:     ownerIdentity.DID,
+			Payload:   make([]byte, 48*1024),
+			CreatedAt: now.Add(time.Duration(i) * time.Millisecond),
+			ExpiresAt: now.Add(time.Hour),
+		}))
+	}
+
+	ctx := context.Background()
+	require.NoError(t, ownerHost.Connect(ctx, peer.AddrInfo{ID: mailboxHost.ID(), Addrs: mailboxHost.Addrs()}))
+
+	fetched, err := ownerManager.Mailbox().Fetch(mailboxHost.ID())
+	require.NoError(t, err)
+	assert.Equal(t, 20, fetched)
+	count, _, err := mailboxStore.MailboxUsage(ownerIdentity.DID)
+	require.NoError(t, err)
+	assert.Equal(t, 0, count)
+
+	// A deposit that only just fits its own frame could never be handed over
+	envelope := &message.Envelope{ID: "too-large", Owner: ownerIdentity.DID, SenderPeer: ownerHost.ID().String()}
+	empty, err := json.Marshal(&message.MailboxFrame{Type: "deposit", Envelope: envelope})
+	require.NoError(t, err)
+	envelope.Payload = make([]byte, (message.MailboxMaxFrameSize-len(empty))/4*3) // Base64 in JSON
+	deposit, err := json.Marshal(&message.MailboxFrame{Type: "deposit", Envelope: envelope})
+	require.NoError(t, err)
+	require.LessOrEqual(t, len(deposit), message.MailboxMaxFrameSize)
+	require.Greater(t, len(deposit), message.MailboxMaxFrameSize-8)
+
+	stream, err := ownerHost.NewStream(ctx, mailboxHost.ID(), message.MailboxProtocolID)
+	require.NoError(t, err)
+	defer func() { _ = stream.Close() }()
+
+	require.NoError(t, binary.Write(stream, binary.BigEndian, uint32(len(deposit))))
+	_, err = stream.Write(deposit)
+	require.NoError(t, err)
+
+	var length uint32
+	require.NoError(t, binary.Read(stream, binary.BigEndian, &length))
+	data := make([]byte, length)
+	_, err = io.ReadFull(stream, data)
+	require.NoError(t, err)
+
+	var response message.MailboxFrame
+	require.NoError(t, json.Unmarshal(data, &response))
+	assert.Equal(t, "error", response.Type)
+	assert.Equal(t, "envelope too large", response.Error)
+}
+
+func TestMailboxDirectorySurvivesRestart(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.ErrorLevel)
+
+	database, err := db.NewSQLiteDB(t.TempDir(), "test-password", logger)
+	require.NoError(t, err)
+	defer func() {
+		assert.NoError(t, database.Close())
+	}()
+
+	mailboxHost, _, _ := newMailboxTestPeer(t, logger)
+	ownerHost, _, ownerManager := newMailboxTestPeer(t, logger)
+	senderHost, senderIdentity, senderManager := newMailboxTestPeer(t, logger)
+
+	ownerConfig := message.DefaultMailboxConfig()
+	ownerConfig.Mailboxes = []peer.AddrInfo{{ID: mailboxHost.ID(), Addrs: mailboxHost.Addrs()}}
+	ownerManager.EnableMailbox(ownerConfig, nil)
+	senderManager.EnableMailbox(message.DefaultMailboxConfig(), database)
+
+	for _, mm := range []*message.MessageManager{ownerManager, senderManager} {
+		require.NoError(t, mm.Start())
+	}
+
+	require.NoError(t, senderHost.Connect(context.Background(), peer.AddrInfo{ID: ownerHost.ID(), Addrs: ownerHost.Addrs()}))
+	require.Eventually(t, func() bool {
+		return senderManager.Mailbox().HasMailbox(ownerHost.ID())
+	}, 5*time.Second, 20*time.Millisecond)
+
+	assert.NoError(t, senderManager.Stop())
+	assert.NoError(t, ownerManager.Stop())
+
+	// The sender restarts while the owner is offline and still knows its mailbox
+	restarted := message.NewMessageManager(senderHost, senderIdentity, nil, logger)
+	restarted.EnableMailbox(message.DefaultMailboxConfig(), database)
+	assert.True(t, restarted.Mailbox().HasMailbox(ownerHost.ID()))
+	assert.False(t, restarted.Mailbox().HasMailbox(mailboxHost.ID()))
+}
@@ -0,0 +1,198 @@
+package unit
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Xelvra/peerchat/internal/message"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMultiFileTransfer(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.ErrorLevel)
+
+	// A folder with a nested file and an executable script
+	sourceDir := t.TempDir()
+	album := filepath.Join(sourceDir, "album")
+	require.NoError(t, os.MkdirAll(filepath.Join(album, "raw"), 0755))
+	writeRandomFile(t, album, "cover.jpg", 3000)
+	writeRandomFile(t, filepath.Join(album, "raw"), "photo.dng", 200*1024)
+	script := writeRandomFile(t, album, "open.sh", 100)
+	require.NoError(t, os.Chmod(script, 0755))
+
+	newPeers := func(t *testing.T, policy *message.FileAcceptPolicy) (host.Host, *message.MessageManager, host.Host, *message.MessageManager, string) {
+		downloadDir := t.TempDir()
+		receiverHost, _, receiverManager := newMailboxTestPeer(t, logger)
+		receiverManager.SetDownloadDir(downloadDir)
+		receiverManager.SetFileAcceptPolicy(policy)
+		require.NoError(t, receiverManager.Start())
+		t.Cleanup(func() {
+			assert.NoError(t, receiverManager.Stop())
+		})
+
+		senderHost, _, senderManager := newMailboxTestPeer(t, logger)
+		connectHosts(t, senderHost, receiverHost)
+		require.NoError(t, senderManager.Start())
+		t.Cleanup(func() {
+			assert.NoError(t, senderManager.Stop())
+		})
+		return senderHost, senderManager, receiverHost, receiverManager, downloadDir
+	}
+
+	t.Run("manifest describes a directory", func(t *testing.T) {
+		manifest, sources, err := message.CreateFileManifest([]string{album})
+		require.NoError(t, err)
+		assert.Equal(t, "album", manifest.Name)
+		require.Len(t, manifest.Files, 3)
+		require.Len(t, sources, 3)
+		assert.Equal(t, int64(3000+200*1024+100), manifest.TotalSize())
+
+		paths := make(map[string]message.FileMetadata)
+		for _, file := range manifest.Files {
+			assert.Equal(t, manifest.ID, file.ManifestID)
+			assert.NotEmpty(t, file.Hash)
+			paths[file.Path] = file
+		}
+		assert.Contains(t, paths, "album/raw/photo.dng")
+		assert.Equal(t, uint32(0755), paths["album/open.sh"].Mode)
+	})
+
+	t.Run("directory arrives with structure and permissions", func(t *testing.T) {
+		_, senderManager, receiverHost, _, downloadDir := newPeers(t, autoAcceptPolicy())
+
+		manifest, err := senderManager.SendFiles(receiverHost.ID(), []string{album})
+		require.NoError(t, err)
+
+		for _, path := range []string{"album/cover.jpg", "album/raw/photo.dng", "album/open.sh"} {
+			received, err := os.ReadFile(filepath.Join(downloadDir, filepath.FromSlash(path)))
+			require.NoError(t, err, path)
+			original, err := os.ReadFile(filepath.Join(sourceDir, filepath.FromSlash(path)))
+			require.NoError(t, err)
+			assert.Equal(t, original, received, path)
+		}
+
+		info, err := os.Stat(filepath.Join(downloadDir, "album", "open.sh"))
+		require.NoError(t, err)
+		assert.Equal(t, os.FileMode(0755), info.Mode().Perm())
+
+		// Per-file progress on the sender
+		transfers := senderManager.FileTransfers().ManifestTransfers(manifest.ID)
+		require.Len(t, transfers, 3)
+		assert.Equal(t, "album/cover.jpg", transfers[0].Metadata.Path)
+		for _, transfer := range transfers {
+			status, _ := transfer.State()
+			assert.Equal(t, message.FileTransferCompleted, status)
+		}
+	})
+
+	t.Run("receiver accepts a subset", func(t *testing.T) {
+		_, senderManager, receiverHost, receiverManager, downloadDir := newPeers(t, message.DefaultFileAcceptPolicy())
+
+		result := make(chan error, 1)
+		go func() {
+			_, err := senderManager.SendFiles(receiverHost.ID(), []string{album})
+			result <- err
+		}()
+
+		var offers []message.FileOffer
+		require.Eventually(t, func() bool {
+			offers = receiverManager.FileTransfers().PendingOffers()
+			return len(offers) == 1
+		}, 5*time.Second, 20*time.Millisecond)
+		assert.Equal(t, "album", offers[0].Metadata.Name)
+		assert.Len(t, offers[0].Files, 3)
+
+		assert.Error(t, receiverManager.FileTransfers().AcceptOffer("", offers[0].ID, "album/missing.txt"))
+		require.NoError(t, receiverManager.FileTransfers().AcceptOffer("", offers[0].ID, "album/cover.jpg"))
+		require.NoError(t, <-result)
+
+		_, err := os.Stat(filepath.Join(downloadDir, "album", "cover.jpg"))
+		assert.NoError(t, err)
+		_, err = os.Stat(filepath.Join(downloadDir, "album", "raw"))
+		assert.True(t, os.IsNotExist(err))
+	})
+
+	t.Run("unsigned or hostile manifests are rejected", func(t *testing.T) {
+		senderHost, _, receiverHost, _, downloadDir := newPeers(t, autoAcceptPolicy())
+
+		manifest, _, err := message.CreateFileManifest([]string{album})
+		require.NoError(t, err)
+
+		hostile := *manifest
+		hostile.Files = append([]message.FileMetadata(nil), manifest.Files...)
+		hostile.Files[0].Path = "../escape.jpg"
+
+		for _, offered := range []*message.FileManifest{manifest, &hostile} {
+			stream, err := senderHost.NewStream(context.Background(), receiverHost.ID(), message.FileProtocolID)
+			require.NoError(t, err)
+			writeTestFileFrame(t, stream, message.FileTransferRequest{Type: "manifest", Manifest: offered})
+
+			reply := readTestFileFrame(t, stream)
+			assert.Equal(t, "reject", reply.Type)
+			_ = stream.Close()
+		}
+
+		_, err = os.Stat(filepath.Join(filepath.Dir(downloadDir), "escape.jpg"))
+		assert.True(t, os.IsNotExist(err))
+		_, err = os.Stat(filepath.Join(downloadDir, "album"))
+		assert.True(t, os.IsNotExist(err))
+	})
+}
+
+func TestManifestAtFileLimit(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.ErrorLevel)
+
+	// Far more files than one frame can describe
+	folder := filepath.Join(t.TempDir(), "archive")
+	require.NoError(t, os.MkdirAll(folder, 0755))
+	for i := 0; i < message.MaxManifestFiles; i++ {
+		require.NoError(t, os.WriteFile(filepath.Join(folder, fmt.Sprintf("entry-with-a-fairly-long-name-%05d.txt", i)), []byte(fmt.Sprint(i)), 0644))
+	}
+
+	downloadDir := t.TempDir()
+	receiverHost, _, receiverManager := newMailboxTestPeer(t, logger)
+	receiverManager.SetDownloadDir(downloadDir)
+	receiverManager.SetFileAcceptPolicy(message.DefaultFileAcceptPolicy())
+	require.NoError(t, receiverManager.Start())
+	defer func() {
+		assert.NoError(t, receiverManager.Stop())
+	}()
+
+	senderHost, _, senderManager := newMailboxTestPeer(t, logger)
+	connectHosts(t, senderHost, receiverHost)
+	require.NoError(t, senderManager.Start())
+	defer func() {
+		assert.NoError(t, senderManager.Stop())
+	}()
+
+	result := make(chan error, 1)
+	go func() {
+		_, err := senderManager.SendFiles(receiverHost.ID(), []string{folder})
+		result <- err
+	}()
+
+	var offers []message.FileOffer
+	require.Eventually(t, func() bool {
+		offers = receiverManager.FileTransfers().PendingOffers()
+		return len(offers) == 1
+	}, 30*time.Second, 20*time.Millisecond)
+	require.Len(t, offers[0].Files, message.MaxManifestFiles)
+
+	// The last file travels in the last manifest frame
+	last := fmt.Sprintf("archive/entry-with-a-fairly-long-name-%05d.txt", message.MaxManifestFiles-1)
+	require.NoError(t, receiverManager.FileTransfers().AcceptOffer("", offers[0].ID, last))
+	require.NoError(t, <-result)
+
+	received, err := os.ReadFile(filepath.Join(downloadDir, filepath.FromSlash(last)))
+	require.NoError(t, err)
+	assert.Equal(t, fmt.Sprint(message.MaxManifestFiles-1), string(received))
+}
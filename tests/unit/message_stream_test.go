@@ -0,0 +1,167 @@
+package unit
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Xelvra/peerchat/internal/message"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// countStreams returns the number of open streams to a peer using a protocol
+func countStreams(n network.Network, p peer.ID, proto string) int {
+	count := 0
+	for _, conn := range n.ConnsToPeer(p) {
+		for _, stream := range conn.GetStreams() {
+			if string(stream.Protocol()) == proto {
+				count++
+			}
+		}
+	}
+	return count
+}
+
+func TestMessageStreamPipelining(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.ErrorLevel)
+
+	senderHost, _, senderManager := newMailboxTestPeer(t, logger)
+	receiverHost, _, receiverManager := newMailboxTestPeer(t, logger)
+
+	handler := &recordingHandler{}
+	receiverManager.RegisterHandler(message.MessageTypeText, handler)
+
+	require.NoError(t, senderManager.Start())
+	require.NoError(t, receiverManager.Start())
+	defer func() {
+		assert.NoError(t, senderManager.Stop())
+		assert.NoError(t, receiverManager.Stop())
+	}()
+
+	connectHosts(t, senderHost, receiverHost)
+
+	// Include a message close to the size limit to exercise partial reads
+	const count = 50
+	large := strings.Repeat("x", 40*1024)
+	for i := 0; i < count; i++ {
+		content := fmt.Sprintf("message %d", i)
+		if i == count/2 {
+			content = large
+		}
+		require.NoError(t, senderManager.SendMessage(receiverHost.ID().String(), []byte(content), message.MessageTypeText))
+	}
+
+	require.Eventually(t, func() bool {
+		return len(handler.received()) == count
+	}, 10*time.Second, 20*time.Millisecond)
+
+	received := handler.received()
+	for i, msg := range received {
+		if i == count/2 {
+			assert.Equal(t, large, string(msg.Content))
+			continue
+		}
+		assert.Equal(t, fmt.Sprintf("message %d", i), string(msg.Content))
+	}
+
+	// All messages share one long-lived stream
+	assert.Equal(t, 1, countStreams(senderHost.Network(), receiverHost.ID(), string(message.CompressedMessageProtocolID)))
+}
+
+func TestMessageStreamLegacyFallback(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.ErrorLevel)
+
+	senderHost, _, senderManager := newMailboxTestPeer(t, logger)
+	receiverHost, _, _ := newMailboxTestPeer(t, logger)
+
+	// Emulate an older peer that only speaks the one-message-per-stream protocol
+	receiverHost.RemoveStreamHandler(message.CompressedMessageProtocolID)
+	receiverHost.RemoveStreamHandler(message.MessageStreamProtocolID)
+	received := make(chan *message.Message, 1)
+	receiverHost.SetStreamHandler(message.MessageProtocolID, func(stream network.Stream) {
+		defer func() { _ = stream.Close() }()
+
+		var length uint32
+		if err := binary.Read(stream, binary.BigEndian, &length); err != nil {
+			return
+		}
+		data := make([]byte, length)
+		if _, err := io.ReadFull(stream, data); err != nil {
+			return
+		}
+
+		var msg message.Message
+		if err := json.Unmarshal(data, &msg); err == nil {
+			received <- &msg
+		}
+	})
+
+	require.NoError(t, senderManager.Start())
+	defer func() {
+		assert.NoError(t, senderManager.Stop())
+	}()
+
+	connectHosts(t, senderHost, receiverHost)
+	require.NoError(t, senderManager.SendMessage(receiverHost.ID().String(), []byte("old protocol"), message.MessageTypeText))
+
+	select {
+	case msg := <-received:
+		assert.Equal(t, []byte("old protocol"), msg.Content)
+	case <-time.After(10 * time.Second):
+		t.Fatal("legacy peer did not receive the message")
+	}
+}
+
+func BenchmarkMessageStreamDelivery(b *testing.B) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.ErrorLevel)
+
+	senderHost, _, senderManager := newMailboxTestPeer(b, logger)
+	receiverHost, _, receiverManager := newMailboxTestPeer(b, logger)
+
+	delivered := make(chan struct{}, 1)
+	receiverManager.RegisterHandler(message.MessageTypeText, signalHandler(delivered))
+
+	if err := senderManager.Start(); err != nil {
+		b.Fatal(err)
+	}
+	if err := receiverManager.Start(); err != nil {
+		b.Fatal(err)
+	}
+	defer func() {
+		_ = senderManager.Stop()
+		_ = receiverManager.Stop()
+	}()
+
+	if err := senderHost.Connect(context.Background(), peer.AddrInfo{ID: receiverHost.ID(), Addrs: receiverHost.Addrs()}); err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := senderManager.SendMessage(receiverHost.ID().String(), []byte("ping"), message.MessageTypeText); err != nil {
+			b.Fatal(err)
+		}
+		<-delivered
+	}
+}
+
+// signalHandler signals a channel for every delivered message
+type signalHandler chan struct{}
+
+func (h signalHandler) HandleMessage(ctx context.Context, msg *message.Message) error {
+	h <- struct{}{}
+	return nil
+}
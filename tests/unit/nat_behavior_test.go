@@ -0,0 +1,81 @@
+package unit
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Xelvra/peerchat/internal/p2p"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNATBehaviorDiscovery(t *testing.T) {
+	// Unanswered filtering requests wait this long
+	const timeout = 300 * time.Millisecond
+
+	for _, tc := range []struct {
+		emulate   p2p.NATType
+		mapping   p2p.MappingBehavior
+		filtering p2p.FilterBehavior
+	}{
+		{p2p.NATTypeOpen, p2p.MappingEndpointIndependent, p2p.FilterEndpointIndependent},
+		{p2p.NATTypeFullCone, p2p.MappingEndpointIndependent, p2p.FilterEndpointIndependent},
+		{p2p.NATTypeRestrictedCone, p2p.MappingEndpointIndependent, p2p.FilterAddressDependent},
+		{p2p.NATTypePortRestricted, p2p.MappingEndpointIndependent, p2p.FilterAddressPortDependent},
+		{p2p.NATTypeSymmetric, p2p.MappingAddressPortDependent, p2p.FilterAddressPortDependent},
+	} {
+		t.Run(tc.emulate.String(), func(t *testing.T) {
+			server := newTestSTUNServer(t, tc.emulate)
+
+			behavior, err := p2p.DiscoverNATBehavior(context.Background(), server.Addr().String(), timeout)
+			require.NoError(t, err)
+			assert.Equal(t, tc.emulate, behavior.Type)
+			assert.Equal(t, tc.mapping, behavior.Mapping)
+			require.NotNil(t, behavior.MappedAddr)
+			if tc.emulate == p2p.NATTypeOpen {
+				assert.True(t, behavior.MappedAddr.IP.IsLoopback())
+				return
+			}
+			assert.Equal(t, tc.filtering, behavior.Filtering)
+			assert.Equal(t, "203.0.113.7", behavior.MappedAddr.IP.String())
+		})
+	}
+
+	t.Run("unreachable servers fail", func(t *testing.T) {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		require.NoError(t, err)
+		defer func() { _ = conn.Close() }()
+
+		_, err = p2p.DiscoverNATBehavior(context.Background(), conn.LocalAddr().String(), timeout)
+		assert.Error(t, err)
+	})
+}
+
+func TestLegacySTUNClientNATType(t *testing.T) {
+	server := newTestSTUNServer(t, p2p.NATTypeFullCone)
+
+	logger := logrus.New()
+	logger.SetLevel(logrus.ErrorLevel)
+	client := p2p.NewLegacySTUNClient(logger)
+	client.SetServers([]string{"not a server", server.Addr().String()})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	info, err := client.DiscoverNAT(ctx, 4001)
+	require.NoError(t, err)
+	assert.Equal(t, "full_cone", info.Type)
+	assert.Equal(t, "203.0.113.7", info.PublicIP)
+}
+
+// newTestSTUNServer starts a STUN server on two loopback IPs emulating a NAT type
+func newTestSTUNServer(t *testing.T, emulate p2p.NATType) *p2p.STUNServer {
+	server, err := p2p.NewSTUNServer(net.IPv4(127, 0, 0, 1), net.IPv4(127, 0, 0, 2), emulate)
+	if err != nil {
+		t.Skipf("cannot listen on two loopback addresses: %v", err)
+	}
+	t.Cleanup(func() { _ = server.Close() })
+	return server
+}
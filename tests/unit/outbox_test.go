@@ -0,0 +1,217 @@
+package unit
+
+import (
+	"cmp"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/Xelvra/peerchat/internal/db"
+	"github.com/Xelvra/peerchat/internal/message"
+	"github.com/Xelvra/peerchat/internal/user"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOutboxBackoffGrowsWithJitter(t *testing.T) {
+	assert.Equal(t, time.Duration(0), message.OutboxBackoff(0))
+
+	for attempts := 1; attempts <= 20; attempts++ {
+		full := message.OutboxBaseBackoff << (attempts - 1)
+		if full > message.OutboxMaxBackoff || full <= 0 {
+			full = message.OutboxMaxBackoff
+		}
+
+		for i := 0; i < 10; i++ {
+			backoff := message.OutboxBackoff(attempts)
+			assert.GreaterOrEqual(t, backoff, full/2, "attempt %d", attempts)
+			assert.LessOrEqual(t, backoff, full, "attempt %d", attempts)
+		}
+	}
+}
+
+func TestOutboxEntryRecordFailure(t *testing.T) {
+	entry := message.NewOutboxEntry(&message.Message{ID: "msg-1"}, "peer-1")
+	now := time.Now()
+
+	entry.State = message.OutboxSending
+	entry.RecordFailure(errors.New("stream reset"), now)
+
+	assert.Equal(t, 1, entry.Attempts)
+	assert.Equal(t, message.OutboxPending, entry.State)
+	assert.Equal(t, "stream reset", entry.LastError)
+	assert.True(t, entry.NextAttempt.After(now))
+	assert.False(t, entry.IsExpired(now))
+	assert.True(t, entry.IsExpired(now.Add(message.OutboxMessageTTL+time.Minute)))
+}
+
+func TestOutboxStores(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.ErrorLevel)
+
+	sqliteStore, err := db.NewSQLiteDB(t.TempDir(), "test-password", logger)
+	require.NoError(t, err)
+	defer func() {
+		assert.NoError(t, sqliteStore.Close())
+	}()
+
+	stores := map[string]message.OutboxStore{
+		"memory": message.NewMemoryOutboxStore(),
+		"sqlite": sqliteStore,
+	}
+
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			first := message.NewOutboxEntry(&message.Message{ID: "m1", Content: []byte("one"), Lamport: 1}, "peer-a")
+			second := message.NewOutboxEntry(&message.Message{ID: "m2", Content: []byte("two"), Lamport: 2}, "peer-a")
+			second.CreatedAt = first.CreatedAt.Add(time.Millisecond)
+			other := message.NewOutboxEntry(&message.Message{ID: "m3"}, "peer-b")
+			expired := message.NewOutboxEntry(&message.Message{ID: "m4"}, "peer-b")
+			expired.ExpiresAt = time.Now().Add(-time.Minute)
+
+			for _, entry := range []*message.OutboxEntry{second, first, other, expired} {
+				require.NoError(t, store.SaveOutboxEntry(entry))
+			}
+
+			// Per-peer loading returns the oldest message first
+			entries, err := store.LoadOutbox("peer-a")
+			require.NoError(t, err)
+			require.Len(t, entries, 2)
+			assert.Equal(t, "m1", entries[0].Message.ID)
+			assert.Equal(t, []byte("one"), entries[0].Message.Content)
+			assert.Equal(t, uint64(1), entries[0].Message.Lamport)
+			assert.Equal(t, "m2", entries[1].Message.ID)
+
+			// Updates keep the entry and change its delivery state
+			first.State = message.OutboxSending
+			require.NoError(t, store.SaveOutboxEntry(first))
+			require.NoError(t, store.ResetSendingOutbox())
+			entries, err = store.LoadOutbox("peer-a")
+			require.NoError(t, err)
+			require.Len(t, entries, 2)
+			assert.Equal(t, message.OutboxPending, entries[0].State)
+
+			// Purge removes expired and delivered entries only
+			second.State = message.OutboxDelivered
+			require.NoError(t, store.SaveOutboxEntry(second))
+			removed, err := store.PurgeOutbox(time.Now())
+			require.NoError(t, err)
+			assert.Equal(t, 2, removed)
+
+			entries, err = store.LoadOutbox("")
+			require.NoError(t, err)
+			require.Len(t, entries, 2)
+
+			require.NoError(t, store.DeleteOutboxEntry("m1"))
+			entries, err = store.LoadOutbox("")
+			require.NoError(t, err)
+			require.Len(t, entries, 1)
+			assert.Equal(t, "m3", entries[0].Message.ID)
+		})
+	}
+}
+
+func TestOutboxNeedsTheIdentityKey(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.ErrorLevel)
+
+	identity, err := user.GenerateMessengerID()
+	require.NoError(t, err)
+	other, err := user.GenerateMessengerID()
+	require.NoError(t, err)
+	password := func(mid *user.MessengerID) string {
+		return hex.EncodeToString(mid.DeriveSecret("xelvra database key"))
+	}
+	assert.Equal(t, password(identity), password(identity))
+
+	dir := t.TempDir()
+	loadOutbox := func(password string) []*message.OutboxEntry {
+		store, err := db.NewSQLiteDB(dir, password, logger)
+		require.NoError(t, err)
+		defer func() {
+			assert.NoError(t, store.Close())
+		}()
+		entries, err := store.LoadOutbox("")
+		require.NoError(t, err)
+		return entries
+	}
+
+	store, err := db.NewSQLiteDB(dir, password(identity), logger)
+	require.NoError(t, err)
+	require.NoError(t, store.SaveOutboxEntry(message.NewOutboxEntry(&message.Message{ID: "m1", Content: []byte("secret")}, "peer-a")))
+	require.NoError(t, store.Close())
+
+	// Entries cannot be read without the key of the identity that wrote them
+	assert.Empty(t, loadOutbox(""))
+	assert.Empty(t, loadOutbox(password(other)))
+	entries := loadOutbox(password(identity))
+	require.Len(t, entries, 1)
+	assert.Equal(t, []byte("secret"), entries[0].Message.Content)
+}
+
+func TestLegacyOfflineMessagesAreSigned(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.ErrorLevel)
+
+	receiverHost, _, receiverManager := newMailboxTestPeer(t, logger)
+	handler := &recordingHandler{}
+	receiverManager.RegisterHandler(message.MessageTypeText, handler)
+	require.NoError(t, receiverManager.Start())
+	defer func() {
+		assert.NoError(t, receiverManager.Stop())
+	}()
+
+	// The legacy file holds unsigned messages without Lamport times, newest first
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	now := time.Now()
+	legacy := map[string][]*message.OfflineMessage{receiverHost.ID().String(): {}}
+	for i, content := range []string{"second", "first"} {
+		legacy[receiverHost.ID().String()] = append(legacy[receiverHost.ID().String()], &message.OfflineMessage{
+			Message: &message.Message{
+				ID:        content,
+				Type:      message.MessageTypeText,
+				To:        receiverHost.ID().String(),
+				Content:   []byte(content),
+				Timestamp: now.Add(-time.Duration(i) * time.Minute),
+			},
+			CreatedAt: now.Add(-time.Duration(i) * time.Minute),
+			ExpiresAt: now.Add(time.Hour),
+		})
+	}
+	data, err := json.Marshal(legacy)
+	require.NoError(t, err)
+	offlineDir := filepath.Join(home, ".xelvra", "offline_messages")
+	require.NoError(t, os.MkdirAll(offlineDir, 0700))
+	require.NoError(t, os.WriteFile(filepath.Join(offlineDir, "messages.json"), data, 0600))
+
+	senderHost, senderIdentity, senderManager := newMailboxTestPeer(t, logger)
+	connectHosts(t, senderHost, receiverHost)
+	require.NoError(t, senderManager.Start())
+	defer func() {
+		assert.NoError(t, senderManager.Stop())
+	}()
+
+	// Both pass signature checks on the receiver, in the order they were queued
+	require.Eventually(t, func() bool {
+		return len(handler.received()) == 2
+	}, 10*time.Second, 20*time.Millisecond)
+	received := handler.received()
+	slices.SortFunc(received, func(a, b *message.Message) int {
+		return cmp.Compare(a.Lamport, b.Lamport)
+	})
+	for i, content := range []string{"first", "second"} {
+		assert.Equal(t, content, string(received[i].Content))
+		assert.Equal(t, uint64(i+1), received[i].Lamport)
+		assert.Equal(t, senderIdentity.DID, received[i].From)
+	}
+
+	_, err = os.Stat(filepath.Join(offlineDir, "messages.json.migrated"))
+	assert.NoError(t, err)
+}
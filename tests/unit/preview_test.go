@@ -0,0 +1,225 @@
+package unit
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Xelvra/peerchat/internal/db"
+	"github.com/Xelvra/peerchat/internal/message"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testImage returns a gradient image of the given size
+func testImage(width, height int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.Set(x, y, color.RGBA{R: uint8(x), G: uint8(y), B: 128, A: 255})
+		}
+	}
+	return img
+}
+
+// mp4Box encodes an MP4 box around its contents
+func mp4Box(kind string, contents ...[]byte) []byte {
+	body := bytes.Join(contents, nil)
+	box := binary.BigEndian.AppendUint32(nil, uint32(8+len(body)))
+	return append(append(box, kind...), body...)
+}
+
+// testMP4 returns a minimal MP4 with a movie header and one video track header
+func testMP4(width, height int, timescale, duration uint32) []byte {
+	mvhd := make([]byte, 100)
+	binary.BigEndian.PutUint32(mvhd[12:], timescale)
+	binary.BigEndian.PutUint32(mvhd[16:], duration)
+
+	tkhd := make([]byte, 84)
+	binary.BigEndian.PutUint32(tkhd[76:], uint32(width)<<16)
+	binary.BigEndian.PutUint32(tkhd[80:], uint32(height)<<16)
+
+	return append(mp4Box("ftyp", []byte("isom")),
+		mp4Box("moov", mp4Box("mvhd", mvhd), mp4Box("trak", mp4Box("tkhd", tkhd)))...)
+}
+
+// testWAV returns a 16-bit mono WAV file with the given number of samples
+func testWAV(sampleRate, samples int) []byte {
+	format := binary.LittleEndian.AppendUint16(nil, 1) // PCM
+	format = binary.LittleEndian.AppendUint16(format, 1)
+	format = binary.LittleEndian.AppendUint32(format, uint32(sampleRate))
+	format = binary.LittleEndian.AppendUint32(format, uint32(sampleRate*2))
+	format = binary.LittleEndian.AppendUint16(format, 2)
+	format = binary.LittleEndian.AppendUint16(format, 16)
+
+	chunk := func(kind string, data []byte) []byte {
+		return append(binary.LittleEndian.AppendUint32([]byte(kind), uint32(len(data))), data...)
+	}
+	body := append([]byte("WAVE"), chunk("LIST", []byte("info"))...)
+	body = append(body, chunk("fmt ", format)...)
+	body = append(body, chunk("data", make([]byte, samples*2))...)
+	return append(binary.LittleEndian.AppendUint32([]byte("RIFF"), uint32(len(body))), body...)
+}
+
+func TestCreateFilePreview(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string, data []byte) string {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.WriteFile(path, data, 0644))
+		return path
+	}
+
+	encode := func(encoder func(*bytes.Buffer) error) []byte {
+		var buf bytes.Buffer
+		require.NoError(t, encoder(&buf))
+		return buf.Bytes()
+	}
+	img := testImage(400, 200)
+	images := map[string][]byte{
+		"photo.png": encode(func(buf *bytes.Buffer) error { return png.Encode(buf, img) }),
+		"photo.jpg": encode(func(buf *bytes.Buffer) error { return jpeg.Encode(buf, img, nil) }),
+		"photo.gif": encode(func(buf *bytes.Buffer) error { return gif.Encode(buf, img, nil) }),
+	}
+
+	for name, data := range images {
+		t.Run(name, func(t *testing.T) {
+			metadata, err := message.CreateFileMetadata(write(name, data))
+			require.NoError(t, err)
+			preview := metadata.Preview
+			require.NotNil(t, preview)
+			assert.Equal(t, message.MessageTypeImage, preview.Kind)
+			assert.Equal(t, 400, preview.Width)
+			assert.Equal(t, 200, preview.Height)
+			assert.LessOrEqual(t, len(preview.Thumbnail), message.MaxThumbnailBytes)
+
+			thumbnail, err := preview.DecodeThumbnail()
+			require.NoError(t, err)
+			assert.Equal(t, message.ThumbnailMaxSize, thumbnail.Bounds().Dx())
+			assert.Equal(t, message.ThumbnailMaxSize/2, thumbnail.Bounds().Dy())
+			assert.Equal(t, "image 400x200", preview.String())
+		})
+	}
+
+	t.Run("mp4 video", func(t *testing.T) {
+		metadata, err := message.CreateFileMetadata(write("clip.mp4", testMP4(1280, 720, 1000, 65500)))
+		require.NoError(t, err)
+		require.NotNil(t, metadata.Preview)
+		assert.Equal(t, message.MessageTypeVideo, metadata.Preview.Kind)
+		assert.Equal(t, 1280, metadata.Preview.Width)
+		assert.Equal(t, 720, metadata.Preview.Height)
+		assert.Equal(t, 65500*time.Millisecond, metadata.Preview.Duration)
+		assert.Empty(t, metadata.Preview.Thumbnail)
+	})
+
+	t.Run("wav audio", func(t *testing.T) {
+		metadata, err := message.CreateFileMetadata(write("voice.wav", testWAV(8000, 20000)))
+		require.NoError(t, err)
+		require.NotNil(t, metadata.Preview)
+		assert.Equal(t, message.MessageTypeAudio, metadata.Preview.Kind)
+		assert.Equal(t, 2500*time.Millisecond, metadata.Preview.Duration)
+		assert.Equal(t, "audio 3s", metadata.Preview.String())
+	})
+
+	t.Run("unparseable media and other files have no preview", func(t *testing.T) {
+		for _, name := range []string{"broken.png", "broken.mp4", "notes.txt"} {
+			metadata, err := message.CreateFileMetadata(write(name, []byte("not really media")))
+			require.NoError(t, err)
+			assert.Nil(t, metadata.Preview, name)
+		}
+	})
+}
+
+func TestFileOfferPreview(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.ErrorLevel)
+
+	var pngData bytes.Buffer
+	require.NoError(t, png.Encode(&pngData, testImage(300, 300)))
+	source := filepath.Join(t.TempDir(), "picture.png")
+	require.NoError(t, os.WriteFile(source, pngData.Bytes(), 0644))
+
+	t.Run("receiver sees the preview before accepting and stores it", func(t *testing.T) {
+		database, err := db.NewSQLiteDB(t.TempDir(), "test-password", logger)
+		require.NoError(t, err)
+		defer func() {
+			assert.NoError(t, database.Close())
+		}()
+
+		receiverHost, _, receiverManager := newMailboxTestPeer(t, logger)
+		receiverManager.SetDownloadDir(t.TempDir())
+		receiverManager.SetFileTransferStore(database)
+		receiverManager.SetFileAcceptPolicy(message.DefaultFileAcceptPolicy())
+		require.NoError(t, receiverManager.Start())
+		defer func() {
+			assert.NoError(t, receiverManager.Stop())
+		}()
+
+		senderHost, _, senderManager := newMailboxTestPeer(t, logger)
+		connectHosts(t, senderHost, receiverHost)
+		require.NoError(t, senderManager.Start())
+		defer func() {
+			assert.NoError(t, senderManager.Stop())
+		}()
+
+		result := make(chan error, 1)
+		go func() { result <- senderManager.SendFile(receiverHost.ID(), source) }()
+
+		var offers []message.FileOffer
+		require.Eventually(t, func() bool {
+			offers = receiverManager.FileTransfers().PendingOffers()
+			return len(offers) == 1
+		}, 5*time.Second, 20*time.Millisecond)
+		preview := offers[0].Metadata.Preview
+		require.NotNil(t, preview)
+		assert.Equal(t, "image 300x300", preview.String())
+		_, err = preview.DecodeThumbnail()
+		require.NoError(t, err)
+
+		require.NoError(t, receiverManager.FileTransfers().AcceptOffer("", offers[0].ID))
+		require.NoError(t, <-result)
+
+		stored, err := database.LoadFilePreview(offers[0].Metadata.ID)
+		require.NoError(t, err)
+		require.NotNil(t, stored)
+		assert.Equal(t, preview.Kind, stored.Kind)
+		assert.Equal(t, 300, stored.Width)
+		assert.Equal(t, preview.Thumbnail, stored.Thumbnail)
+	})
+
+	t.Run("offer with an oversized thumbnail is rejected", func(t *testing.T) {
+		receiverHost, _, receiverManager := newMailboxTestPeer(t, logger)
+		receiverManager.SetDownloadDir(t.TempDir())
+		receiverManager.SetFileAcceptPolicy(autoAcceptPolicy())
+		require.NoError(t, receiverManager.Start())
+		defer func() {
+			assert.NoError(t, receiverManager.Stop())
+		}()
+
+		senderHost, _, _ := newMailboxTestPeer(t, logger)
+		connectHosts(t, senderHost, receiverHost)
+
+		metadata, err := message.CreateFileMetadata(source)
+		require.NoError(t, err)
+		var large bytes.Buffer
+		require.NoError(t, jpeg.Encode(&large, testImage(300, 300), nil))
+		metadata.Preview.Thumbnail = large.Bytes()
+
+		stream, err := senderHost.NewStream(context.Background(), receiverHost.ID(), message.FileProtocolID)
+		require.NoError(t, err)
+		defer func() { _ = stream.Close() }()
+
+		writeTestFileFrame(t, stream, message.FileTransferRequest{Type: "request", Metadata: *metadata})
+		reply := readTestFileFrame(t, stream)
+		assert.Equal(t, "reject", reply.Type)
+	})
+}
@@ -0,0 +1,140 @@
+package unit
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Xelvra/peerchat/internal/p2p"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/pnet"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNetworkKey(t *testing.T) {
+	dataDir := t.TempDir()
+
+	psk, err := p2p.LoadNetworkKey(dataDir)
+	require.NoError(t, err)
+	assert.Nil(t, psk, "no key means the public network")
+
+	psk, err = p2p.GenerateNetworkKey()
+	require.NoError(t, err)
+	require.NoError(t, p2p.SaveNetworkKey(dataDir, psk, false))
+
+	loaded, err := p2p.LoadNetworkKey(dataDir)
+	require.NoError(t, err)
+	assert.Equal(t, psk, loaded)
+
+	// The file uses the swarm.key format other libp2p tools read
+	file, err := os.Open(filepath.Join(dataDir, p2p.NetworkKeyFile))
+	require.NoError(t, err)
+	defer func() { _ = file.Close() }()
+	decoded, err := pnet.DecodeV1PSK(file)
+	require.NoError(t, err)
+	assert.Equal(t, psk, decoded)
+
+	// The shared hex string parses back to the same key
+	parsed, err := p2p.ParseNetworkKey(p2p.EncodeNetworkKey(psk))
+	require.NoError(t, err)
+	assert.Equal(t, psk, parsed)
+	for _, invalid := range []string{"", "zz", p2p.EncodeNetworkKey(psk)[:62], p2p.EncodeNetworkKey(psk) + "00"} {
+		_, err := p2p.ParseNetworkKey(invalid)
+		assert.Error(t, err, invalid)
+	}
+
+	// An existing key is only replaced on purpose
+	other, err := p2p.GenerateNetworkKey()
+	require.NoError(t, err)
+	assert.ErrorIs(t, p2p.SaveNetworkKey(dataDir, other, false), p2p.ErrNetworkKeyExists)
+	require.NoError(t, p2p.SaveNetworkKey(dataDir, other, true))
+
+	require.NoError(t, p2p.RemoveNetworkKey(dataDir))
+	loaded, err = p2p.LoadNetworkKey(dataDir)
+	require.NoError(t, err)
+	assert.Nil(t, loaded)
+}
+
+func TestBootstrapList(t *testing.T) {
+	dataDir := t.TempDir()
+	const (
+		first  = "/ip4/10.0.0.5/tcp/4001/p2p/12D3KooWEyoppNCUx8Yx66oV9fJnriXwCcXwDDUA2kj6vnc6iDEp"
+		second = "/ip4/10.0.0.5/udp/4001/quic-v1/p2p/12D3KooWEyoppNCUx8Yx66oV9fJnriXwCcXwDDUA2kj6vnc6iDEp"
+		third  = "/ip4/10.0.0.6/tcp/4001/p2p/12D3KooWHHzSeKaY8xuZVzkLbKFfvNgPPeKhFBGrMbNzbm5akpqu"
+	)
+
+	require.NoError(t, os.WriteFile(filepath.Join(dataDir, p2p.BootstrapFile), []byte("# company mesh\n\n"+first+"\n"), 0600))
+	require.NoError(t, p2p.AddBootstrapPeers(dataDir, []string{first, second, third}))
+
+	peers, err := p2p.LoadBootstrapPeers(dataDir)
+	require.NoError(t, err)
+	require.Len(t, peers, 2)
+	assert.Len(t, peers[0].Addrs, 2, "addresses of one peer are merged")
+	assert.Len(t, peers[1].Addrs, 1)
+
+	_, err = p2p.ParseBootstrapPeers([]string{"/ip4/10.0.0.5/tcp/4001"})
+	assert.Error(t, err, "bootstrap addresses need a peer ID")
+	assert.Error(t, p2p.AddBootstrapPeers(dataDir, []string{"not an address"}))
+}
+
+func TestPrivateNetwork(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.ErrorLevel)
+
+	psk, err := p2p.GenerateNetworkKey()
+	require.NoError(t, err)
+	otherKey, err := p2p.GenerateNetworkKey()
+	require.NoError(t, err)
+
+	// newNode starts a DHT-less node whose data directory holds the given key
+	newNode := func(t *testing.T, key pnet.PSK, bootstrap ...peer.AddrInfo) *p2p.PeerChatNode {
+		dataDir := t.TempDir()
+		if key != nil {
+			require.NoError(t, p2p.SaveNetworkKey(dataDir, key, false))
+		}
+		config := p2p.DefaultNodeConfig()
+		config.ListenAddrs = []string{"/ip4/127.0.0.1/tcp/0", "/ip4/127.0.0.1/udp/0/quic-v1"}
+		config.DataDir = dataDir
+		config.DisableDHT = true
+		config.BootstrapPeers = bootstrap
+		config.Logger = logger
+
+		node, err := p2p.NewPeerChatNode(context.Background(), config)
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = node.Stop() })
+		return node
+	}
+	addrInfo := func(node *p2p.PeerChatNode) peer.AddrInfo {
+		return peer.AddrInfo{ID: node.GetPeerID(), Addrs: node.GetHost().Addrs()}
+	}
+
+	member := newNode(t, psk)
+	for _, addr := range member.GetHost().Addrs() {
+		assert.NotContains(t, addr.String(), "quic", "QUIC cannot carry a private network")
+	}
+
+	t.Run("members connect", func(t *testing.T) {
+		joiner := newNode(t, psk)
+		require.NoError(t, joiner.GetHost().Connect(context.Background(), addrInfo(member)))
+	})
+
+	t.Run("outsiders cannot connect", func(t *testing.T) {
+		for name, key := range map[string]pnet.PSK{"public": nil, "other network": otherKey} {
+			outsider := newNode(t, key)
+			assert.Error(t, outsider.GetHost().Connect(context.Background(), addrInfo(member)), name)
+		}
+	})
+
+	t.Run("bootstrap peers are connected on start", func(t *testing.T) {
+		t.Setenv("HOME", t.TempDir()) // Keep the status file out of the real home directory
+		joiner := newNode(t, psk, addrInfo(member))
+		require.NoError(t, joiner.Start())
+		assert.Eventually(t, func() bool {
+			return len(joiner.GetHost().Network().ConnsToPeer(member.GetPeerID())) > 0
+		}, 10*time.Second, 50*time.Millisecond)
+	})
+}
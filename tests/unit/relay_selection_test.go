@@ -0,0 +1,178 @@
+package unit
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Xelvra/peerchat/internal/p2p"
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/metrics"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/p2p/host/autorelay"
+	relayv2 "github.com/libp2p/go-libp2p/p2p/protocol/circuitv2/relay"
+	"github.com/libp2p/go-libp2p/p2p/protocol/ping"
+	"github.com/marcopolo/simnet"
+	multiaddr "github.com/multiformats/go-multiaddr"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRelaySelectionPolicy(t *testing.T) {
+	for _, policy := range []p2p.RelaySelectionPolicy{p2p.PolicyLowestLatency, p2p.PolicyHighestReliability, p2p.PolicyRandom, p2p.PolicyRoundRobin} {
+		parsed, err := p2p.ParseRelaySelectionPolicy(policy.String())
+		require.NoError(t, err)
+		assert.Equal(t, policy, parsed)
+	}
+
+	_, err := p2p.ParseRelaySelectionPolicy("cheapest")
+	assert.Error(t, err)
+}
+
+func TestRelayManagerFailover(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.ErrorLevel)
+
+	// Relays have public IPs, the only ones AutoRelay advertises circuits for
+	router := &simnet.SimpleFirewallRouter{}
+	newRelay := func(ip string, opts ...relayv2.Option) host.Host {
+		h := newSimHost(t, router, true, "/ip4/"+ip+"/udp/8000/quic-v1", libp2p.DisableRelay())
+		_, err := relayv2.New(h, opts...)
+		require.NoError(t, err)
+		return h
+	}
+	relays := []host.Host{newRelay("1.2.0.1"), newRelay("1.2.0.2")}
+	refusing := newRelay("1.2.0.3", relayv2.WithACL(p2p.NewRelayAllowlist(false)))
+	spare := newRelay("1.2.0.4")
+
+	var mu sync.Mutex
+	candidates := []peer.AddrInfo{{ID: refusing.ID(), Addrs: refusing.Addrs()}}
+	for _, relay := range relays {
+		candidates = append(candidates, peer.AddrInfo{ID: relay.ID(), Addrs: relay.Addrs()})
+	}
+
+	// AutoRelay reserves slots on the relays the manager prefers
+	var nat atomic.Pointer[p2p.AdvancedNATTraversal]
+	preferred := func(_ context.Context, num int) <-chan peer.AddrInfo {
+		out := make(chan peer.AddrInfo, num)
+		if n := nat.Load(); n != nil {
+			for _, info := range n.PreferredRelays(num) {
+				out <- info
+			}
+		}
+		close(out)
+		return out
+	}
+	bandwidth := metrics.NewBandwidthCounter()
+	client := newSimHost(t, router, false, "/ip4/2.2.0.1/udp/8000/quic-v1",
+		libp2p.EnableRelay(),
+		libp2p.BandwidthReporter(bandwidth),
+		libp2p.EnableAutoRelayWithPeerSource(preferred,
+			autorelay.WithNumRelays(3),
+			autorelay.WithBootDelay(0),
+			autorelay.WithMinInterval(100*time.Millisecond),
+		),
+		libp2p.ForceReachabilityPrivate(),
+	)
+
+	manager := p2p.NewAdvancedNATTraversal(client, logger)
+	manager.SetSTUNServers([]string{newTestSTUNServer(t, p2p.NATTypeFullCone).Addr().String()})
+	manager.SetRelaySelection(p2p.PolicyHighestReliability, 3)
+	manager.SetBandwidthReporter(bandwidth)
+	manager.SetRelaySource(func(context.Context, int) []peer.AddrInfo {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]peer.AddrInfo(nil), candidates...)
+	})
+	nat.Store(manager)
+	require.NoError(t, manager.Start())
+	defer func() { _ = manager.Stop() }()
+
+	active := func() map[peer.ID]bool {
+		ids := make(map[peer.ID]bool)
+		for _, relay := range manager.RelayHealth() {
+			if relay.Active {
+				ids[relay.PeerID] = true
+			}
+		}
+		return ids
+	}
+
+	// Three reservations are wanted, but the refusing relay grants none
+	require.Eventually(t, func() bool {
+		return len(active()) == 2
+	}, 10*time.Second, 50*time.Millisecond)
+	for _, relay := range relays {
+		assert.True(t, active()[relay.ID()])
+	}
+	assert.Equal(t, 2, manager.GetStatus().ActiveRelays)
+
+	// Active relays are the ones AutoRelay advertises circuits through
+	var circuits int
+	for _, addr := range client.Addrs() {
+		if _, err := addr.ValueForProtocol(multiaddr.P_CIRCUIT); err == nil {
+			circuits++
+		}
+	}
+	assert.Equal(t, 2, circuits)
+
+	health := manager.RelayHealth()
+	require.Len(t, health, 3)
+	for _, relay := range health {
+		assert.True(t, relay.Reachable)
+		assert.Greater(t, relay.Latency, time.Duration(0))
+		assert.Positive(t, relay.Probes)
+		assert.Equal(t, 1.0, relay.Reliability, "every probe was answered")
+		assert.Equal(t, relay.PeerID != refusing.ID(), relay.Active)
+		if relay.Active {
+			assert.Equal(t, 1, relay.Reservations)
+		} else {
+			assert.Zero(t, relay.Reservations)
+		}
+	}
+
+	// Traffic through the remaining relay shows up as throughput when a
+	// relay going away has it probed again
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	pings := ping.Ping(ctx, client, relays[1].ID())
+	go func() {
+		for range pings {
+		}
+	}()
+	require.Eventually(t, func() bool {
+		return bandwidth.GetBandwidthForPeer(relays[1].ID()).RateOut > 0
+	}, 10*time.Second, 50*time.Millisecond)
+
+	// A relay going away is replaced by a new candidate
+	mu.Lock()
+	candidates = append(candidates, peer.AddrInfo{ID: spare.ID(), Addrs: spare.Addrs()})
+	mu.Unlock()
+	require.NoError(t, relays[0].Close())
+
+	require.Eventually(t, func() bool {
+		ids := active()
+		return len(ids) == 2 && ids[relays[1].ID()] && ids[spare.ID()]
+	}, 10*time.Second, 50*time.Millisecond)
+	assert.False(t, active()[refusing.ID()])
+
+	// The closed relay is remembered for the reservation it lost
+	require.Eventually(t, func() bool {
+		for _, relay := range manager.RelayHealth() {
+			if relay.PeerID == relays[0].ID() {
+				return relay.Lost == 1 && !relay.Reachable
+			}
+		}
+		return false
+	}, 10*time.Second, 50*time.Millisecond)
+	for _, relay := range manager.RelayHealth() {
+		if relay.PeerID == relays[1].ID() {
+			assert.Positive(t, relay.Throughput)
+			assert.Zero(t, relay.Lost)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package unit
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/Xelvra/peerchat/internal/p2p"
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/p2p/protocol/circuitv2/client"
+	"github.com/libp2p/go-libp2p/p2p/protocol/circuitv2/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// relayContacts is a contact list keyed by peer, true meaning blocked
+type relayContacts map[peer.ID]bool
+
+func (c relayContacts) ContactStatus(_ string, peerID peer.ID) (bool, bool, error) {
+	blocked, ok := c[peerID]
+	return ok, blocked, nil
+}
+
+func TestRelayAllowlist(t *testing.T) {
+	contact, blocked, stranger := peer.ID("contact"), peer.ID("blocked"), peer.ID("stranger")
+
+	allowlist := p2p.NewRelayAllowlist(false)
+	assert.False(t, allowlist.AllowReserve(contact, nil), "nobody is allowed before the contacts are known")
+
+	allowlist.SetContacts(relayContacts{contact: false, blocked: true}, "did:key:owner")
+	assert.True(t, allowlist.AllowReserve(contact, nil))
+	assert.False(t, allowlist.AllowReserve(blocked, nil))
+	assert.False(t, allowlist.AllowReserve(stranger, nil))
+
+	// Both ends of a relayed connection must be allowed
+	assert.True(t, allowlist.AllowConnect(contact, nil, contact))
+	assert.False(t, allowlist.AllowConnect(contact, nil, stranger))
+	assert.False(t, allowlist.AllowConnect(stranger, nil, contact))
+
+	private := p2p.NewRelayAllowlist(true)
+	assert.True(t, private.AllowReserve(stranger, nil))
+	assert.True(t, private.AllowConnect(stranger, nil, blocked))
+}
+
+func TestRelayServiceReservations(t *testing.T) {
+	newHost := func(opts ...libp2p.Option) host.Host {
+		h, err := libp2p.New(append(opts, libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))...)
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = h.Close() })
+		return h
+	}
+
+	contact := newHost()
+	stranger := newHost()
+
+	limits := p2p.RelayServiceConfig{MaxReservations: 1, Duration: time.Minute}
+	allowlist := p2p.NewRelayAllowlist(false)
+	allowlist.SetContacts(relayContacts{contact.ID(): false}, "did:key:owner")
+	relay := newHost(limits.Option(allowlist), libp2p.ForceReachabilityPublic())
+
+	// The service starts once the host knows it is publicly reachable
+	require.Eventually(t, func() bool {
+		return slices.Contains(relay.Mux().Protocols(), proto.ProtoIDv2Hop)
+	}, 10*time.Second, 50*time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	relayInfo := peer.AddrInfo{ID: relay.ID(), Addrs: relay.Addrs()}
+
+	require.NoError(t, contact.Connect(ctx, relayInfo))
+	reservation, err := client.Reserve(ctx, contact, relayInfo)
+	require.NoError(t, err)
+	assert.Equal(t, time.Minute, reservation.LimitDuration)
+
+	require.NoError(t, stranger.Connect(ctx, relayInfo))
+	_, err = client.Reserve(ctx, stranger, relayInfo)
+	assert.Error(t, err, "peers that are not contacts are refused")
+}
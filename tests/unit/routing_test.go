@@ -0,0 +1,177 @@
+package unit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Xelvra/peerchat/internal/crypto"
+	"github.com/Xelvra/peerchat/internal/message"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSealAnonymousRoundTrip(t *testing.T) {
+	recipient, err := crypto.GenerateKeyPair()
+	require.NoError(t, err)
+	other, err := crypto.GenerateKeyPair()
+	require.NoError(t, err)
+
+	sealed, err := crypto.SealAnonymous(recipient.PublicKey, []byte("next hop"), []byte("info"))
+	require.NoError(t, err)
+	assert.Len(t, sealed, len("next hop")+crypto.SealedOverhead)
+
+	opened, err := crypto.OpenAnonymous(recipient, sealed, []byte("info"))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("next hop"), opened)
+
+	_, err = crypto.OpenAnonymous(other, sealed, []byte("info"))
+	assert.Error(t, err)
+	_, err = crypto.OpenAnonymous(recipient, sealed, []byte("other info"))
+	assert.Error(t, err)
+}
+
+// connectHosts connects a to b
+func connectHosts(t testing.TB, a, b host.Host) {
+	require.NoError(t, a.Connect(context.Background(), peer.AddrInfo{ID: b.ID(), Addrs: b.Addrs()}))
+}
+
+func TestMultiHopRouting(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.ErrorLevel)
+
+	senderHost, _, senderManager := newMailboxTestPeer(t, logger)
+	relayHost, _, relayManager := newMailboxTestPeer(t, logger)
+	targetHost, _, targetManager := newMailboxTestPeer(t, logger)
+
+	// The sender lists the relay as a friend, the others have it as a contact
+	senderConfig := message.DefaultRoutingConfig()
+	senderConfig.Friends = []peer.ID{relayHost.ID()}
+	require.NoError(t, senderManager.EnableRouting(senderConfig))
+	relayManager.SetContactStore(relayContacts{senderHost.ID(): false, targetHost.ID(): false})
+	require.NoError(t, relayManager.EnableRouting(nil))
+	require.NoError(t, targetManager.EnableRouting(nil))
+	targetManager.SetContactStore(relayContacts{relayHost.ID(): false})
+
+	managers := []*message.MessageManager{senderManager, relayManager, targetManager}
+
+	handler := &recordingHandler{}
+	targetManager.RegisterHandler(message.MessageTypeText, handler)
+
+	for _, mm := range managers {
+		require.NoError(t, mm.Start())
+	}
+	defer func() {
+		for _, mm := range managers {
+			assert.NoError(t, mm.Stop())
+		}
+	}()
+
+	// sender <-> relay <-> target, with no direct link between sender and target
+	connectHosts(t, senderHost, relayHost)
+	connectHosts(t, relayHost, targetHost)
+
+	require.Eventually(t, func() bool {
+		return senderManager.Router().HasRoute(targetHost.ID())
+	}, 10*time.Second, 50*time.Millisecond)
+
+	route := senderManager.Router().FindRoute(targetHost.ID())
+	assert.Equal(t, []peer.ID{relayHost.ID(), targetHost.ID()}, route)
+
+	require.NoError(t, senderManager.SendMessage(targetHost.ID().String(), []byte("via a friend"), message.MessageTypeText))
+
+	require.Eventually(t, func() bool {
+		return len(handler.received()) > 0
+	}, 10*time.Second, 50*time.Millisecond)
+
+	received := handler.received()
+	require.Len(t, received, 1)
+	assert.Equal(t, []byte("via a friend"), received[0].Content)
+	assert.Equal(t, senderHost.ID(), received[0].RemotePeer())
+}
+
+func TestMultiHopRoutingRespectsRelayOptOut(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.ErrorLevel)
+
+	senderHost, _, senderManager := newMailboxTestPeer(t, logger)
+	relayHost, _, relayManager := newMailboxTestPeer(t, logger)
+	targetHost, _, targetManager := newMailboxTestPeer(t, logger)
+
+	noRelay := message.DefaultRoutingConfig()
+	noRelay.Relay = false
+
+	for _, mm := range []*message.MessageManager{senderManager, relayManager, targetManager} {
+		mm.SetContactStore(relayContacts{senderHost.ID(): false, relayHost.ID(): false, targetHost.ID(): false})
+	}
+	require.NoError(t, senderManager.EnableRouting(nil))
+	require.NoError(t, relayManager.EnableRouting(noRelay))
+	require.NoError(t, targetManager.EnableRouting(nil))
+
+	managers := []*message.MessageManager{senderManager, relayManager, targetManager}
+	for _, mm := range managers {
+		require.NoError(t, mm.Start())
+	}
+	defer func() {
+		for _, mm := range managers {
+			assert.NoError(t, mm.Stop())
+		}
+	}()
+
+	connectHosts(t, senderHost, relayHost)
+	connectHosts(t, relayHost, targetHost)
+
+	// The target's advert still reaches the sender, but the relay refuses to forward
+	require.Eventually(t, func() bool {
+		return senderManager.Router().FindRoute(relayHost.ID()) != nil
+	}, 10*time.Second, 50*time.Millisecond)
+	time.Sleep(200 * time.Millisecond)
+
+	assert.False(t, senderManager.Router().HasRoute(targetHost.ID()))
+	assert.ErrorIs(t, senderManager.Router().Route(targetHost.ID(), &message.Message{ID: "m"}), message.ErrNoRoute)
+}
+
+func TestMultiHopRoutingOnlyThroughContacts(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.ErrorLevel)
+
+	senderHost, _, senderManager := newMailboxTestPeer(t, logger)
+	relayHost, _, relayManager := newMailboxTestPeer(t, logger)
+	targetHost, _, targetManager := newMailboxTestPeer(t, logger)
+	strangerHost, _, strangerManager := newMailboxTestPeer(t, logger)
+
+	// The relay would forward for anyone it knows, but the sender blocked it
+	// and does not know the stranger
+	senderManager.SetContactStore(relayContacts{relayHost.ID(): true, targetHost.ID(): false})
+	relayManager.SetContactStore(relayContacts{senderHost.ID(): false, targetHost.ID(): false})
+	strangerManager.SetContactStore(relayContacts{senderHost.ID(): false, targetHost.ID(): false})
+	targetManager.SetContactStore(relayContacts{relayHost.ID(): false, strangerHost.ID(): false})
+
+	managers := []*message.MessageManager{senderManager, relayManager, targetManager, strangerManager}
+	for _, mm := range managers {
+		require.NoError(t, mm.EnableRouting(nil))
+		require.NoError(t, mm.Start())
+	}
+	defer func() {
+		for _, mm := range managers {
+			assert.NoError(t, mm.Stop())
+		}
+	}()
+
+	connectHosts(t, senderHost, relayHost)
+	connectHosts(t, senderHost, strangerHost)
+	connectHosts(t, relayHost, targetHost)
+	connectHosts(t, strangerHost, targetHost)
+
+	// The target learns both hops, the sender neither
+	require.Eventually(t, func() bool {
+		return targetManager.Router().HasRoute(relayHost.ID()) && targetManager.Router().HasRoute(strangerHost.ID())
+	}, 10*time.Second, 50*time.Millisecond)
+	time.Sleep(200 * time.Millisecond)
+
+	assert.False(t, senderManager.Router().HasRoute(targetHost.ID()))
+	assert.ErrorIs(t, senderManager.Router().Route(targetHost.ID(), &message.Message{ID: "m"}), message.ErrNoRoute)
+}
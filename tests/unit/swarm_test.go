@@ -0,0 +1,163 @@
+package unit
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Xelvra/peerchat/internal/message"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMerkleProofs(t *testing.T) {
+	for _, count := range []int{1, 2, 3, 5, 33} {
+		t.Run(fmt.Sprintf("%d leaves", count), func(t *testing.T) {
+			leaves := make([][]byte, count)
+			for i := range leaves {
+				leaves[i] = message.MerkleLeafHash([]byte(fmt.Sprintf("chunk-%d", i)))
+			}
+			tree := message.NewMerkleTree(leaves)
+			root := tree.Root()
+			assert.Equal(t, count, tree.Leaves())
+
+			for i := range leaves {
+				proof, err := tree.Proof(i)
+				require.NoError(t, err)
+				assert.True(t, message.VerifyMerkleProof(root, i, count, leaves[i], proof))
+
+				// A different leaf, index or proof must not verify
+				assert.False(t, message.VerifyMerkleProof(root, i, count, message.MerkleLeafHash([]byte("forged")), proof))
+				if count > 1 {
+					assert.False(t, message.VerifyMerkleProof(root, (i+1)%count, count, leaves[i], proof))
+					tampered := append([][]byte(nil), proof...)
+					tampered[0] = message.MerkleLeafHash([]byte("forged"))
+					assert.False(t, message.VerifyMerkleProof(root, i, count, leaves[i], tampered))
+				}
+			}
+
+			_, err := tree.Proof(count)
+			assert.Error(t, err)
+		})
+	}
+
+	t.Run("file tree matches metadata", func(t *testing.T) {
+		content := make([]byte, 3*message.FileChunkSize+1)
+		_, err := rand.Read(content)
+		require.NoError(t, err)
+		path := filepath.Join(t.TempDir(), "tree.bin")
+		require.NoError(t, os.WriteFile(path, content, 0644))
+
+		metadata, err := message.CreateFileMetadata(path)
+		require.NoError(t, err)
+		tree, err := message.BuildFileMerkleTree(bytes.NewReader(content), message.FileChunkSize)
+		require.NoError(t, err)
+		assert.Equal(t, 4, tree.Leaves())
+		assert.Equal(t, hex.EncodeToString(tree.Root()), metadata.MerkleRoot)
+
+		contentID, err := message.FileContentID(metadata.MerkleRoot)
+		require.NoError(t, err)
+		assert.True(t, contentID.Defined())
+	})
+}
+
+func TestSwarmDownload(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.ErrorLevel)
+
+	content := make([]byte, 3*message.FileSwarmBatchChunks*message.FileChunkSize+123)
+	_, err := rand.Read(content)
+	require.NoError(t, err)
+
+	newProvider := func(t *testing.T) (host.Host, string, *message.MessageManager) {
+		providerHost, _, providerManager := newMailboxTestPeer(t, logger)
+		providerManager.EnableFileSwarm(nil)
+		require.NoError(t, providerManager.Start())
+		t.Cleanup(func() {
+			assert.NoError(t, providerManager.Stop())
+		})
+
+		path := filepath.Join(t.TempDir(), "swarm.bin")
+		require.NoError(t, os.WriteFile(path, content, 0644))
+		return providerHost, path, providerManager
+	}
+
+	t.Run("downloads from several providers", func(t *testing.T) {
+		firstHost, firstPath, firstManager := newProvider(t)
+		secondHost, secondPath, secondManager := newProvider(t)
+
+		metadata, err := firstManager.FileTransfers().ShareFile(firstPath)
+		require.NoError(t, err)
+		_, err = secondManager.FileTransfers().ShareFile(secondPath)
+		require.NoError(t, err)
+
+		downloadDir := t.TempDir()
+		downloaderHost, _, downloaderManager := newMailboxTestPeer(t, logger)
+		downloaderManager.SetDownloadDir(downloadDir)
+		connectHosts(t, downloaderHost, firstHost)
+		connectHosts(t, downloaderHost, secondHost)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		transfer, err := downloaderManager.FileTransfers().Download(ctx, *metadata, []peer.ID{firstHost.ID(), secondHost.ID()})
+		require.NoError(t, err)
+
+		status, progress := transfer.State()
+		assert.Equal(t, message.FileTransferCompleted, status)
+		assert.Equal(t, 1.0, progress)
+
+		received, err := os.ReadFile(filepath.Join(downloadDir, "swarm.bin"))
+		require.NoError(t, err)
+		assert.Equal(t, content, received)
+	})
+
+	t.Run("drops a provider with a corrupted file", func(t *testing.T) {
+		goodHost, goodPath, goodManager := newProvider(t)
+		badHost, badPath, badManager := newProvider(t)
+
+		metadata, err := goodManager.FileTransfers().ShareFile(goodPath)
+		require.NoError(t, err)
+		_, err = badManager.FileTransfers().ShareFile(badPath)
+		require.NoError(t, err)
+
+		corrupted := append([]byte(nil), content...)
+		corrupted[message.FileChunkSize+1] ^= 0xff
+		require.NoError(t, os.WriteFile(badPath, corrupted, 0644))
+
+		downloadDir := t.TempDir()
+		downloaderHost, _, downloaderManager := newMailboxTestPeer(t, logger)
+		downloaderManager.SetDownloadDir(downloadDir)
+		connectHosts(t, downloaderHost, goodHost)
+		connectHosts(t, downloaderHost, badHost)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		_, err = downloaderManager.FileTransfers().Download(ctx, *metadata, []peer.ID{badHost.ID(), goodHost.ID()})
+		require.NoError(t, err)
+
+		received, err := os.ReadFile(filepath.Join(downloadDir, "swarm.bin"))
+		require.NoError(t, err)
+		assert.Equal(t, content, received)
+	})
+
+	t.Run("fails without providers", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "lonely.bin")
+		require.NoError(t, os.WriteFile(path, []byte("nobody has this"), 0644))
+		metadata, err := message.CreateFileMetadata(path)
+		require.NoError(t, err)
+
+		_, _, downloaderManager := newMailboxTestPeer(t, logger)
+		downloaderManager.SetDownloadDir(t.TempDir())
+		_, err = downloaderManager.FileTransfers().Download(context.Background(), *metadata, nil)
+		assert.ErrorIs(t, err, message.ErrNoProviders)
+	})
+}
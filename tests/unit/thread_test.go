@@ -0,0 +1,147 @@
+package unit
+
+import (
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"github.com/Xelvra/peerchat/internal/db"
+	"github.com/Xelvra/peerchat/internal/message"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLamportClockTickAndObserve(t *testing.T) {
+	clock := message.NewLamportClock()
+	conv := message.ConversationKey("", peer.ID("peer-a"))
+
+	assert.Equal(t, uint64(1), clock.Tick(conv))
+	assert.Equal(t, uint64(2), clock.Tick(conv))
+
+	// Observing a timestamp ahead of us jumps past it
+	assert.Equal(t, uint64(11), clock.Observe(conv, 10))
+
+	// Observing an older timestamp still advances the clock
+	assert.Equal(t, uint64(12), clock.Observe(conv, 3))
+	assert.Equal(t, uint64(12), clock.Current(conv))
+
+	// Conversations are independent
+	other := message.ConversationKey("group-1", peer.ID("peer-a"))
+	assert.NotEqual(t, conv, other)
+	assert.Equal(t, uint64(1), clock.Tick(other))
+}
+
+func TestLamportClockContinuesFromStoredMessages(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.ErrorLevel)
+
+	store, err := db.NewSQLiteDB(t.TempDir(), "test-password", logger)
+	require.NoError(t, err)
+	defer func() {
+		assert.NoError(t, store.Close())
+	}()
+
+	_, pub, err := crypto.GenerateEd25519Key(rand.Reader)
+	require.NoError(t, err)
+	remote, err := peer.IDFromPublicKey(pub)
+	require.NoError(t, err)
+
+	root := &message.Message{ID: "root", From: "did:key:me", To: remote.String(), Content: []byte("hello"), Timestamp: time.Now(), Lamport: 6}
+	reply := &message.Message{ID: "reply", From: "did:key:me", To: remote.String(), Content: []byte("again"), Timestamp: time.Now(), Lamport: 7, ReplyTo: "root", ThreadID: "root"}
+	for _, msg := range []*message.Message{root, reply, root} {
+		require.NoError(t, store.SaveMessage(msg))
+	}
+
+	conv := message.ConversationKey("", remote)
+	assert.Equal(t, conv, reply.Conversation())
+	lamport, err := store.MaxLamport(conv)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(7), lamport)
+
+	thread, err := store.LoadThread("root")
+	require.NoError(t, err)
+	require.Len(t, thread, 2)
+	assert.Equal(t, "reply", thread[1].ID)
+	assert.Equal(t, []byte("again"), thread[1].Content)
+
+	// A restarted clock continues after the stored messages
+	clock := message.NewLamportClock()
+	clock.SetSeed(func(conversation string) uint64 {
+		lamport, err := store.MaxLamport(conversation)
+		require.NoError(t, err)
+		return lamport
+	})
+	assert.Equal(t, uint64(8), clock.Tick(conv))
+	assert.Equal(t, uint64(1), clock.Tick(message.ConversationKey("group-1", remote)))
+}
+
+func TestSortCausallyIgnoresClockSkew(t *testing.T) {
+	now := time.Now()
+
+	// The reply has an earlier wall-clock time due to skew but a later Lamport time
+	first := &message.Message{ID: "a", Lamport: 1, Timestamp: now}
+	reply := &message.Message{ID: "b", Lamport: 2, Timestamp: now.Add(-time.Minute), ReplyTo: "a", ThreadID: "a"}
+	concurrent1 := &message.Message{ID: "d", Lamport: 3, Timestamp: now}
+	concurrent2 := &message.Message{ID: "c", Lamport: 3, Timestamp: now}
+
+	messages := []*message.Message{concurrent1, reply, concurrent2, first}
+	message.SortCausally(messages)
+
+	require.Len(t, messages, 4)
+	assert.Equal(t, "a", messages[0].ID)
+	assert.Equal(t, "b", messages[1].ID)
+	// Equal Lamport and wall-clock time fall back to ID for a deterministic order
+	assert.Equal(t, "c", messages[2].ID)
+	assert.Equal(t, "d", messages[3].ID)
+}
+
+func TestMessageHistoryThreads(t *testing.T) {
+	history := message.NewMessageHistory(10)
+
+	root := &message.Message{ID: "root", Lamport: 1, Content: []byte("hello")}
+	reply := &message.Message{ID: "reply", Lamport: 2, ReplyTo: "root", ThreadID: "root"}
+	nested := &message.Message{ID: "nested", Lamport: 3, ReplyTo: "reply", ThreadID: "root"}
+	unrelated := &message.Message{ID: "other", Lamport: 1}
+
+	assert.Equal(t, 1, history.Add(root))
+	assert.Equal(t, 2, history.Add(reply))
+	assert.Equal(t, 3, history.Add(nested))
+	assert.Equal(t, 4, history.Add(unrelated))
+
+	// Adding a known message again keeps its number
+	assert.Equal(t, 2, history.Add(reply))
+
+	msg, exists := history.Get(2)
+	require.True(t, exists)
+	assert.Equal(t, "reply", msg.ID)
+
+	entry, exists := history.Lookup("nested")
+	require.True(t, exists)
+	assert.Equal(t, 2, entry.Depth)
+	assert.True(t, entry.Message.IsReply())
+	assert.Equal(t, "root", entry.Message.RootID())
+
+	thread := history.Thread("root")
+	require.Len(t, thread, 3)
+	assert.Equal(t, "root", thread[0].ID)
+	assert.Equal(t, "nested", thread[2].ID)
+}
+
+func TestMessageHistoryEviction(t *testing.T) {
+	history := message.NewMessageHistory(2)
+
+	history.Add(&message.Message{ID: "1"})
+	history.Add(&message.Message{ID: "2"})
+	history.Add(&message.Message{ID: "3"})
+
+	_, exists := history.Get(1)
+	assert.False(t, exists)
+
+	entries := history.Entries(0)
+	require.Len(t, entries, 2)
+	assert.Equal(t, 2, entries[0].Number)
+	assert.Equal(t, 3, entries[1].Number)
+}
@@ -0,0 +1,158 @@
+package unit
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Xelvra/peerchat/internal/p2p"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	multiaddr "github.com/multiformats/go-multiaddr"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWebTransports(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.ErrorLevel)
+
+	newNode := func(t *testing.T, configure func(config *p2p.NodeConfig)) (*p2p.PeerChatNode, error) {
+		config := p2p.DefaultNodeConfig()
+		config.ListenAddrs = []string{"/ip4/127.0.0.1/tcp/0"}
+		config.EnableQUIC = false
+		config.DataDir = t.TempDir()
+		config.DisableDHT = true
+		config.Logger = logger
+		configure(config)
+
+		node, err := p2p.NewPeerChatNode(context.Background(), config)
+		if err == nil {
+			t.Cleanup(func() { _ = node.Stop() })
+		}
+		return node, err
+	}
+	hasAddr := func(node *p2p.PeerChatNode, suffix string) bool {
+		for _, addr := range node.GetHost().Addrs() {
+			if strings.Contains(addr.String(), suffix) {
+				return true
+			}
+		}
+		return false
+	}
+
+	t.Run("WebSocket is dialed first once TCP keeps failing", func(t *testing.T) {
+		webSocket := func(config *p2p.NodeConfig) {
+			config.EnableWebSocket = true
+			config.WebSocketListenAddrs = []string{"/ip4/127.0.0.1/tcp/0/ws"}
+		}
+		dialer, err := newNode(t, webSocket)
+		require.NoError(t, err)
+		target, err := newNode(t, webSocket)
+		require.NoError(t, err)
+		require.True(t, hasAddr(target, "/ws"))
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		h := dialer.GetHost()
+		targetInfo := peer.AddrInfo{ID: target.GetPeerID(), Addrs: target.GetHost().Addrs()}
+		// Dials to a closed port fail like dials through a firewall letting only HTTPS out
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		closed, err := multiaddr.NewMultiaddr("/ip4/127.0.0.1/tcp/" + strings.TrimPrefix(listener.Addr().String(), "127.0.0.1:"))
+		require.NoError(t, err)
+		require.NoError(t, listener.Close())
+		for i := 0; i < 5; i++ {
+			_, pub, err := crypto.GenerateEd25519Key(rand.Reader)
+			require.NoError(t, err)
+			id, err := peer.IDFromPublicKey(pub)
+			require.NoError(t, err)
+			assert.Error(t, h.Connect(ctx, peer.AddrInfo{ID: id, Addrs: []multiaddr.Multiaddr{closed}}))
+		}
+
+		// TCP and WebSocket are otherwise dialed together, so one win could be luck
+		for i := 0; i < 3; i++ {
+			require.NoError(t, h.Connect(ctx, targetInfo))
+			conns := h.Network().ConnsToPeer(target.GetPeerID())
+			require.NotEmpty(t, conns)
+			assert.Contains(t, conns[0].RemoteMultiaddr().String(), "/ws")
+			require.NoError(t, h.Network().ClosePeer(target.GetPeerID()))
+		}
+	})
+
+	t.Run("secure WebSocket listeners need a certificate", func(t *testing.T) {
+		certFile, keyFile := writeTestCertificate(t)
+		node, err := newNode(t, func(config *p2p.NodeConfig) {
+			config.EnableWebSocket = true
+			config.WebSocketListenAddrs = []string{"/ip4/127.0.0.1/tcp/0/tls/ws"}
+			config.WebSocketCertFile = certFile
+			config.WebSocketKeyFile = keyFile
+		})
+		require.NoError(t, err)
+		assert.True(t, hasAddr(node, "/tls/ws"))
+
+		_, err = newNode(t, func(config *p2p.NodeConfig) {
+			config.EnableWebSocket = true
+			config.WebSocketCertFile = certFile
+			config.WebSocketKeyFile = filepath.Join(t.TempDir(), "missing.pem")
+		})
+		assert.Error(t, err)
+	})
+
+	t.Run("WebTransport is left out of private networks", func(t *testing.T) {
+		webTransport := func(config *p2p.NodeConfig) {
+			config.EnableWebTransport = true
+			config.WebTransportListenAddrs = []string{"/ip4/127.0.0.1/udp/0/quic-v1/webtransport"}
+		}
+		node, err := newNode(t, webTransport)
+		require.NoError(t, err)
+		assert.True(t, hasAddr(node, "/webtransport/certhash/"))
+
+		key, err := p2p.GenerateNetworkKey()
+		require.NoError(t, err)
+		private, err := newNode(t, func(config *p2p.NodeConfig) {
+			webTransport(config)
+			config.NetworkKey = key
+		})
+		require.NoError(t, err)
+		assert.False(t, hasAddr(private, "/webtransport"))
+	})
+}
+
+// writeTestCertificate writes a self-signed certificate for 127.0.0.1 and
+// its key, returning their paths
+func writeTestCertificate(t *testing.T) (string, string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "peerchat test"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+	return certFile, keyFile
+}